@@ -1,14 +1,170 @@
 package sseuda
 
+import (
+	"errors"
+	"strconv"
+)
+
+var (
+	// ErrNotFound is returned by Get when a key has no live value.
+	ErrNotFound = errors.New("sseuda: not found")
+
+	// ErrMergeUnsupported is returned by Apply for a batch holding merges when the engine
+	// has no way to combine merge operands.
+	ErrMergeUnsupported = errors.New("sseuda: merge is not supported")
+)
+
+// MergeOperator combines the merge operands recorded by Batch.Merge with the value they apply
+// to, so that a read-modify-write such as incrementing a counter needs no read at write time.
+// The engine stores operands as they come and resolves them lazily, when the key is read or
+// when its versions are compacted together.
+//
+// An operator must be deterministic, and must not change between openings of the same database.
+type MergeOperator interface {
+	// FullMerge returns the value of `key` obtained by applying `operands`, oldest first, to
+	// `existing`, the value they were written over. `existing` is nil if the key had no value,
+	// and non-nil, although possibly empty, otherwise. An error fails the read or compaction
+	// that needed the value.
+	FullMerge(key, existing []byte, operands [][]byte) ([]byte, error)
+
+	// PartialMerge combines two consecutive operands of `key`, `older` then `newer`, into a
+	// single operand with the same effect, without knowing the value they apply to. It reports
+	// false if the operands cannot be combined, in which case both are kept.
+	PartialMerge(key, older, newer []byte) ([]byte, bool)
+}
+
+// PrefixExtractor maps keys to prefixes, such as the table and index identifiers that start
+// the keys of an SQL index, so that engines can index the prefixes present in a set of keys and
+// rule out sets without a prefix before scanning them.
+//
+// An extractor must be consistent with the iteration prefixes it is to serve: when `prefix` is
+// in its domain, so is every key that begins with `prefix`, and Transform maps all of them to
+// Transform(prefix). A fixed-length extractor, for instance, maps every key of at least n bytes
+// to its first n bytes.
+type PrefixExtractor interface {
+	// Name identifies the extractor. Engines only use the prefixes indexed by an extractor
+	// of the same name, so the name must change whenever the mapping does.
+	Name() string
+
+	// InDomain reports whether `key` has a prefix.
+	InDomain(key []byte) bool
+
+	// Transform returns the prefix of `key`, which must be in the domain. The prefix is a
+	// subslice of `key`, or a slice the extractor does not modify afterwards.
+	Transform(key []byte) []byte
+}
+
+// FixedPrefix returns a PrefixExtractor that maps every key of at least `n` bytes to its first
+// `n` bytes.
+func FixedPrefix(n int) PrefixExtractor {
+	return fixedPrefix(n)
+}
+
+type fixedPrefix int
+
+func (g fixedPrefix) Name() string {
+	return "sseuda.fixed." + strconv.Itoa(int(g))
+}
+
+func (g fixedPrefix) InDomain(key []byte) bool {
+	return len(key) >= int(g)
+}
+
+func (g fixedPrefix) Transform(key []byte) []byte {
+	return key[:g]
+}
+
+// StorageEngine is an ordered key-value store that the SQL layer is built on.
+// Keys are ordered by the engine's comparator. Values handed to and returned by
+// the engine are copied, so callers may reuse their buffers after a call returns.
 type StorageEngine interface {
+	// Get returns a copy of the value stored for key, or ErrNotFound.
+	Get(key []byte) ([]byte, error)
+	// Put sets the value for key, overwriting any previous value.
+	Put(key, value []byte) error
+	// Delete removes key. Deleting a missing key is not an error.
+	Delete(key []byte) error
+	// DeleteRange removes every key in [start, end).
+	DeleteRange(start, end []byte) error
+
+	// NewIterator returns an iterator over the live keys of the engine, confined by opts.
+	// A nil opts iterates over every key. The iterator must be closed once it is no longer needed.
+	NewIterator(opts *IterOptions) (Iterator, error)
+
+	// NewBatch returns an empty batch that can later be applied with Apply.
+	NewBatch() Batch
+	// Apply applies every operation recorded in batch, in order.
+	Apply(batch Batch) error
+
+	// NewSnapshot returns a read-only, point-in-time view of the engine.
+	// The snapshot must be closed once it is no longer needed.
+	NewSnapshot() (Snapshot, error)
+
+	// Flush persists all buffered writes.
+	Flush() error
+	// Close releases all resources held by the engine.
+	Close() error
+}
+
+// Batch records a sequence of writes to be applied together by StorageEngine.Apply.
+// Either every write of a batch becomes visible or none does.
+// A batch is created by, and may only be applied to, the engine that created it.
+type Batch interface {
+	Put(key, value []byte)
+	Delete(key []byte)
+	DeleteRange(start, end []byte)
+	// Merge records `value` as an operand to combine with the value of key.
+	Merge(key, value []byte)
+
+	// Count returns the number of operations recorded in the batch.
+	Count() int
+	// Len returns the size in bytes of the batch's representation.
+	Len() int
+	// Reset empties the batch so that it can be reused.
+	Reset()
+}
+
+// Snapshot is a read-only view of a StorageEngine as of the moment it was taken.
+type Snapshot interface {
+	Get(key []byte) ([]byte, error)
+	NewIterator(opts *IterOptions) (Iterator, error)
+
+	Close() error
+}
+
+// IterOptions confines an iterator to a range of keys. Keys outside the range are never
+// surfaced, and seeks outside of it are clamped to it, so that bounded scans stop as soon
+// as they leave the range instead of being filtered by the caller.
+type IterOptions struct {
+	// LowerBound is the smallest key the iterator may surface. Nil leaves it unbounded.
+	LowerBound []byte
+	// UpperBound is the exclusive upper limit of the iterator's keys. Nil leaves it unbounded.
+	UpperBound []byte
+
+	// Prefix, when set, confines the iterator to keys that begin with it, in addition to the
+	// bounds. Prefix mode assumes that the keys sharing a prefix sort contiguously, starting
+	// at the prefix itself, as they do under bytewise ordering.
+	Prefix []byte
 }
 
+// Iterator walks the live keys of an engine or snapshot in key order, in either direction.
+// Positioning methods return whether the iterator is valid afterwards; deleted keys are never
+// surfaced.
 type Iterator interface {
+	// First positions the iterator at the smallest key.
 	First() bool
+	// Last positions the iterator at the largest key.
+	Last() bool
+	// Seek positions the iterator at the smallest key >= key.
 	Seek(key []byte) bool
+	// SeekLT positions the iterator at the largest key < key.
+	SeekLT(key []byte) bool
+	// SeekLE positions the iterator at the largest key <= key.
+	SeekLE(key []byte) bool
 
 	Valid() bool
 	Next() bool
+	Prev() bool
 
 	Key() []byte
 	Value() []byte
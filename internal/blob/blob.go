@@ -0,0 +1,168 @@
+// Package blob implements blob files: append-only files that hold large values apart from the
+// tables, so that compactions move small handles around instead of rewriting the values.
+//
+// A blob file is laid out as:
+//
+//	[magic (8 bytes)]
+//	[value 0][CRC32C of value 0 (4 bytes)]
+//	...
+//	[value N-1][CRC32C of value N-1 (4 bytes)]
+//
+// A Handle locates one value by the number of its file, its offset in the file and its length.
+// The file holds neither keys nor an index: a value is only ever reached through the handle a
+// table stores in its place.
+package blob
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+var (
+	ErrCorrupt = errors.New("blob: corrupt blob file")
+)
+
+const (
+	// BLOB_MAGIC starts every blob file.
+	BLOB_MAGIC = 0x626f6c62_61647565
+
+	// BLOB_HEADER_SIZE is the size of the magic number that starts every blob file.
+	BLOB_HEADER_SIZE = 8
+
+	// BLOB_TRAILER_SIZE is the size of the checksum that follows every value.
+	BLOB_TRAILER_SIZE = 4
+
+	// BLOB_MAX_HANDLE_SIZE is the largest encoding of a Handle: three 64-bit uvarints.
+	BLOB_MAX_HANDLE_SIZE = 3 * binary.MaxVarintLen64
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Handle locates a value, excluding its trailer, within a blob file.
+type Handle struct {
+	FileNum uint64
+	Offset  uint64
+	Length  uint64
+}
+
+// Encode appends the encoding of the handle to `dst`.
+func (g Handle) Encode(dst []byte) []byte {
+	dst = binary.AppendUvarint(dst, g.FileNum)
+	dst = binary.AppendUvarint(dst, g.Offset)
+	return binary.AppendUvarint(dst, g.Length)
+}
+
+// DecodeHandle parses a handle produced by Handle.Encode.
+func DecodeHandle(src []byte) (Handle, error) {
+	var h Handle
+	for _, field := range []*uint64{&h.FileNum, &h.Offset, &h.Length} {
+		v, n := binary.Uvarint(src)
+		if n <= 0 {
+			return Handle{}, ErrCorrupt
+		}
+		*field, src = v, src[n:]
+	}
+	if len(src) != 0 {
+		return Handle{}, ErrCorrupt
+	}
+	return h, nil
+}
+
+// Writer appends values to blob file `fileNum`.
+// The file is complete once every value has been added and `w` has been flushed.
+type Writer struct {
+	w          io.Writer
+	fileNum    uint64
+	offset     uint64 // Bytes written to `w` so far.
+	valueBytes uint64 // Total length of the values added so far.
+	err        error  // Sticky error: once set, every later call returns it.
+}
+
+// NewWriter returns a Writer that writes blob file `fileNum` to `w`.
+func NewWriter(w io.Writer, fileNum uint64) *Writer {
+	return &Writer{w: w, fileNum: fileNum}
+}
+
+func (g *Writer) write(b []byte) {
+	if g.err != nil {
+		return
+	}
+	n, err := g.w.Write(b)
+	g.offset += uint64(n)
+	g.err = err
+}
+
+// Add appends `value` to the file and returns its handle.
+func (g *Writer) Add(value []byte) (Handle, error) {
+	if g.offset == 0 {
+		g.write(binary.LittleEndian.AppendUint64(nil, BLOB_MAGIC))
+	}
+	h := Handle{FileNum: g.fileNum, Offset: g.offset, Length: uint64(len(value))}
+	g.write(value)
+	g.write(binary.LittleEndian.AppendUint32(nil, crc32.Checksum(value, crcTable)))
+	if g.err != nil {
+		return Handle{}, g.err
+	}
+	g.valueBytes += h.Length
+	return h, nil
+}
+
+// Size returns the number of bytes written so far.
+func (g *Writer) Size() uint64 {
+	return g.offset
+}
+
+// ValueBytes returns the total length of the values added so far.
+func (g *Writer) ValueBytes() uint64 {
+	return g.valueBytes
+}
+
+// Reader reads the values of a blob file.
+// A Reader is safe for concurrent use.
+type Reader struct {
+	r       io.ReaderAt
+	size    int64
+	fileNum uint64
+}
+
+// NewReader opens blob file `fileNum` of `size` bytes stored in `r`.
+// If `r` implements io.Closer, Reader.Close closes it.
+func NewReader(r io.ReaderAt, size int64, fileNum uint64) (*Reader, error) {
+	if size < BLOB_HEADER_SIZE {
+		return nil, ErrCorrupt
+	}
+	buf := make([]byte, BLOB_HEADER_SIZE)
+	if _, err := r.ReadAt(buf, 0); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint64(buf) != BLOB_MAGIC {
+		return nil, ErrCorrupt
+	}
+	return &Reader{r: r, size: size, fileNum: fileNum}, nil
+}
+
+// Read returns a copy of the value `h` locates, after checking it against its checksum.
+func (g *Reader) Read(h Handle) ([]byte, error) {
+	if h.FileNum != g.fileNum || h.Offset < BLOB_HEADER_SIZE || h.Offset > uint64(g.size) ||
+		h.Length > uint64(g.size)-h.Offset || uint64(g.size)-h.Offset-h.Length < BLOB_TRAILER_SIZE {
+		return nil, ErrCorrupt
+	}
+	buf := make([]byte, h.Length+BLOB_TRAILER_SIZE)
+	if _, err := g.r.ReadAt(buf, int64(h.Offset)); err != nil {
+		return nil, err
+	}
+	value := buf[:h.Length:h.Length]
+	if crc32.Checksum(value, crcTable) != binary.LittleEndian.Uint32(buf[h.Length:]) {
+		return nil, ErrCorrupt
+	}
+	return value, nil
+}
+
+func (g *Reader) Close() error {
+	if closer, ok := g.r.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
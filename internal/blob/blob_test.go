@@ -0,0 +1,96 @@
+package blob_test
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"gosuda.org/sseuda/internal/blob"
+)
+
+// TestBlobRoundTrip verifies that every value, including an empty one, is read back through
+// its handle, and that handles survive encoding.
+func TestBlobRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	w := blob.NewWriter(&buf, 7)
+	values := []string{"first", "", strings.Repeat("x", 100000), "last"}
+	var handles []blob.Handle
+	var valueBytes uint64
+	for _, v := range values {
+		h, err := w.Add([]byte(v))
+		if err != nil {
+			t.Fatal(err)
+		}
+		handles = append(handles, h)
+		valueBytes += uint64(len(v))
+	}
+	if w.Size() != uint64(buf.Len()) || w.ValueBytes() != valueBytes {
+		t.Fatalf("Size() = %d, ValueBytes() = %d; want %d and %d", w.Size(), w.ValueBytes(), buf.Len(), valueBytes)
+	}
+
+	r, err := blob.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()), 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, h := range handles {
+		decoded, err := blob.DecodeHandle(h.Encode(nil))
+		if err != nil || decoded != h {
+			t.Fatalf("DecodeHandle(Encode(%v)) = %v, %v", h, decoded, err)
+		}
+		got, err := r.Read(decoded)
+		if err != nil {
+			t.Fatalf("value %d: %v", i, err)
+		}
+		if string(got) != values[i] {
+			t.Fatalf("value %d mismatch", i)
+		}
+	}
+}
+
+// TestBlobCorruption verifies that a flipped bit, a handle out of bounds or into another file,
+// and a malformed handle are all reported as corruption.
+func TestBlobCorruption(t *testing.T) {
+	var buf bytes.Buffer
+	w := blob.NewWriter(&buf, 1)
+	h, err := w.Add([]byte("hello, blob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	r, err := blob.NewReader(bytes.NewReader(data), int64(len(data)), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range []blob.Handle{
+		{FileNum: 2, Offset: h.Offset, Length: h.Length},
+		{FileNum: 1, Offset: 0, Length: h.Length},
+		{FileNum: 1, Offset: h.Offset, Length: h.Length + 1},
+		{FileNum: 1, Offset: uint64(len(data)), Length: 0},
+	} {
+		if _, err := r.Read(bad); !errors.Is(err, blob.ErrCorrupt) {
+			t.Errorf("Read(%v) = %v, want ErrCorrupt", bad, err)
+		}
+	}
+
+	corrupt := bytes.Clone(data)
+	corrupt[h.Offset] ^= 1
+	r, err = blob.NewReader(bytes.NewReader(corrupt), int64(len(corrupt)), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Read(h); !errors.Is(err, blob.ErrCorrupt) {
+		t.Errorf("Read of a flipped value = %v, want ErrCorrupt", err)
+	}
+
+	if _, err := blob.NewReader(bytes.NewReader(data[1:]), int64(len(data)-1), 1); !errors.Is(err, blob.ErrCorrupt) {
+		t.Errorf("NewReader without the magic = %v, want ErrCorrupt", err)
+	}
+	encoded := h.Encode(nil)
+	for _, src := range [][]byte{encoded[:len(encoded)-1], append(encoded, 0)} {
+		if _, err := blob.DecodeHandle(src); !errors.Is(err, blob.ErrCorrupt) {
+			t.Errorf("DecodeHandle(%x) = %v, want ErrCorrupt", src, err)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+// Package bloom implements the Bloom filters of the tables: compact sets of keys that answer
+// "definitely absent" or "maybe present", so that a lookup can skip a table without reading it.
+//
+// A key is hashed once with wyhash, and the two halves of the hash drive double hashing: probe
+// i sets or tests bit (h1 + i*h2) mod m of the m-bit filter. The encoded filter is the bit
+// array followed by one byte holding the number of probes.
+package bloom
+
+import (
+	"math"
+
+	"gosuda.org/sseuda/internal/oldsepia/wyhash"
+)
+
+const (
+	// BLOOM_DEFAULT_BITS_PER_KEY gives a false positive rate of about 1%.
+	BLOOM_DEFAULT_BITS_PER_KEY = 10
+
+	// BLOOM_MAX_PROBES is the largest number of probes a filter may use. Filters declaring more
+	// are treated as matching every key, so that other encodings can be introduced later.
+	BLOOM_MAX_PROBES = 30
+
+	// BLOOM_MIN_BITS is the size of the bit array of a filter of very few keys.
+	BLOOM_MIN_BITS = 64
+)
+
+// Hash returns the hash of `key` the filters are built from and probed with.
+func Hash(key []byte) uint64 {
+	return wyhash.WyHash(key, 0)
+}
+
+// Builder collects the hashes of the keys of a filter.
+type Builder struct {
+	hashes []uint64
+}
+
+// Add adds `key` to the filter.
+func (g *Builder) Add(key []byte) {
+	g.hashes = append(g.hashes, Hash(key))
+}
+
+// Len returns the number of keys added since the last Finish.
+func (g *Builder) Len() int {
+	return len(g.hashes)
+}
+
+// Finish appends to `dst` a filter of every key added since the last Finish, with
+// `bitsPerKey` bits per key, and resets the builder.
+func (g *Builder) Finish(dst []byte, bitsPerKey int) []byte {
+	bitsPerKey = max(bitsPerKey, 1)
+	probes := min(max(int(float64(bitsPerKey)*math.Ln2), 1), BLOOM_MAX_PROBES)
+	nbits := max(len(g.hashes)*bitsPerKey, BLOOM_MIN_BITS)
+	nbytes := (nbits + 7) / 8
+	nbits = nbytes * 8
+
+	start := len(dst)
+	dst = append(dst, make([]byte, nbytes)...)
+	bits := dst[start:]
+	for _, h := range g.hashes {
+		h1, h2 := uint32(h), uint32(h>>32)
+		for i := 0; i < probes; i++ {
+			bit := (h1 + uint32(i)*h2) % uint32(nbits)
+			bits[bit/8] |= 1 << (bit % 8)
+		}
+	}
+	g.hashes = g.hashes[:0]
+	return append(dst, byte(probes))
+}
+
+// Filter is an encoded filter.
+type Filter []byte
+
+// MayContain reports whether the key of hash `h` may have been added to the filter. It only
+// returns false for keys that were not.
+func (g Filter) MayContain(h uint64) bool {
+	if len(g) < 2 {
+		return true
+	}
+	probes := int(g[len(g)-1])
+	if probes > BLOOM_MAX_PROBES {
+		return true
+	}
+	bits := g[:len(g)-1]
+	nbits := uint32(len(bits) * 8)
+	h1, h2 := uint32(h), uint32(h>>32)
+	for i := 0; i < probes; i++ {
+		bit := (h1 + uint32(i)*h2) % nbits
+		if bits[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,57 @@
+package bloom_test
+
+import (
+	"fmt"
+	"testing"
+
+	"gosuda.org/sseuda/internal/bloom"
+)
+
+// TestBloomFalsePositives verifies that a filter matches every key it holds, and that its false
+// positive rate tracks the number of bits per key.
+func TestBloomFalsePositives(t *testing.T) {
+	const n = 10000
+	for _, tc := range []struct {
+		bitsPerKey int
+		maxRate    float64
+	}{{5, 0.15}, {bloom.BLOOM_DEFAULT_BITS_PER_KEY, 0.02}, {20, 0.001}} {
+		var b bloom.Builder
+		for i := 0; i < n; i++ {
+			b.Add([]byte(fmt.Sprintf("key%d", i)))
+		}
+		filter := bloom.Filter(b.Finish(nil, tc.bitsPerKey))
+		if b.Len() != 0 {
+			t.Fatalf("Len() = %d after Finish, want 0", b.Len())
+		}
+
+		falsePositives := 0
+		for i := 0; i < n; i++ {
+			if !filter.MayContain(bloom.Hash([]byte(fmt.Sprintf("key%d", i)))) {
+				t.Fatalf("%d bits per key: filter rules out key%d", tc.bitsPerKey, i)
+			}
+			if filter.MayContain(bloom.Hash([]byte(fmt.Sprintf("absent%d", i)))) {
+				falsePositives++
+			}
+		}
+		if rate := float64(falsePositives) / n; rate > tc.maxRate {
+			t.Errorf("%d bits per key: false positive rate %.4f, want at most %.4f", tc.bitsPerKey, rate, tc.maxRate)
+		}
+	}
+}
+
+// TestBloomDegenerate verifies that empty, truncated and unknown filters match every key.
+func TestBloomDegenerate(t *testing.T) {
+	var b bloom.Builder
+	empty := bloom.Filter(b.Finish(nil, 10))
+	if len(empty) != bloom.BLOOM_MIN_BITS/8+1 {
+		t.Errorf("empty filter of %d bytes, want %d", len(empty), bloom.BLOOM_MIN_BITS/8+1)
+	}
+	if empty.MayContain(bloom.Hash([]byte("key"))) {
+		t.Error("an empty filter matched a key")
+	}
+	for _, filter := range []bloom.Filter{nil, {6}, append(make(bloom.Filter, 8), bloom.BLOOM_MAX_PROBES+1)} {
+		if !filter.MayContain(bloom.Hash([]byte("key"))) {
+			t.Errorf("filter %x ruled out a key", filter)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+// Package bounds confines iterators to the key range described by sseuda.IterOptions.
+package bounds
+
+import (
+	"bytes"
+
+	"gosuda.org/sseuda"
+)
+
+// Bounds is the effective key range of an iterator: the explicit bounds narrowed by the
+// prefix, if any. The zero Bounds is unbounded.
+type Bounds struct {
+	compare func(key1, key2 []byte) int
+	Lower   []byte // Inclusive lower bound, or nil.
+	Upper   []byte // Exclusive upper bound, or nil.
+	Prefix  []byte // Required key prefix, or nil.
+}
+
+// New returns the bounds described by `opts` under `compare`. A nil `opts` is unbounded.
+func New(compare func(key1, key2 []byte) int, opts *sseuda.IterOptions) Bounds {
+	g := Bounds{compare: compare}
+	if opts == nil {
+		return g
+	}
+	g.Lower, g.Upper, g.Prefix = opts.LowerBound, opts.UpperBound, opts.Prefix
+	if g.Prefix != nil {
+		if g.Lower == nil || compare(g.Lower, g.Prefix) < 0 {
+			g.Lower = g.Prefix
+		}
+		if succ := Successor(g.Prefix); succ != nil && (g.Upper == nil || compare(succ, g.Upper) < 0) {
+			g.Upper = succ
+		}
+	}
+	return g
+}
+
+// Successor returns the smallest key, under bytewise ordering, that is greater than every key
+// beginning with `prefix`, or nil if there is none because `prefix` is all 0xff bytes.
+func Successor(prefix []byte) []byte {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] != 0xff {
+			succ := append([]byte{}, prefix[:i+1]...)
+			succ[i]++
+			return succ
+		}
+	}
+	return nil
+}
+
+// Unbounded reports whether the bounds admit every key.
+func (g *Bounds) Unbounded() bool {
+	return g.Lower == nil && g.Upper == nil && g.Prefix == nil
+}
+
+// SeekGE clamps the target of a forward seek to the lower bound.
+func (g *Bounds) SeekGE(key []byte) []byte {
+	if g.Lower != nil && g.compare(key, g.Lower) < 0 {
+		return g.Lower
+	}
+	return key
+}
+
+// SeekLT clamps the target of a SeekLT to the upper bound.
+func (g *Bounds) SeekLT(key []byte) []byte {
+	if g.Upper != nil && g.compare(key, g.Upper) > 0 {
+		return g.Upper
+	}
+	return key
+}
+
+// SeekLE returns the target of a SeekLE clamped to the upper bound, and whether the seek must
+// become a SeekLT because `key` is not below the exclusive upper bound.
+func (g *Bounds) SeekLE(key []byte) ([]byte, bool) {
+	if g.Upper != nil && g.compare(key, g.Upper) >= 0 {
+		return g.Upper, true
+	}
+	return key, false
+}
+
+// Forward reports whether `key`, reached while moving forward, is still within the bounds.
+// Forward movement starts at or above the lower bound, so only the upper bound is checked.
+func (g *Bounds) Forward(key []byte) bool {
+	return (g.Upper == nil || g.compare(key, g.Upper) < 0) && g.hasPrefix(key)
+}
+
+// Backward reports whether `key`, reached while moving backward, is still within the bounds.
+func (g *Bounds) Backward(key []byte) bool {
+	return (g.Lower == nil || g.compare(key, g.Lower) >= 0) && g.hasPrefix(key)
+}
+
+// Contains reports whether `key` is within the bounds.
+func (g *Bounds) Contains(key []byte) bool {
+	return g.Forward(key) && g.Backward(key)
+}
+
+func (g *Bounds) hasPrefix(key []byte) bool {
+	return g.Prefix == nil || bytes.HasPrefix(key, g.Prefix)
+}
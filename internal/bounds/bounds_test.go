@@ -0,0 +1,53 @@
+package bounds_test
+
+import (
+	"bytes"
+	"testing"
+
+	"gosuda.org/sseuda"
+	"gosuda.org/sseuda/internal/bounds"
+)
+
+// TestBoundsPrefix verifies that a prefix narrows the explicit bounds and is checked on keys.
+func TestBoundsPrefix(t *testing.T) {
+	b := bounds.New(bytes.Compare, &sseuda.IterOptions{LowerBound: []byte("a"), Prefix: []byte("ab")})
+	if string(b.Lower) != "ab" || string(b.Upper) != "ac" {
+		t.Fatalf("bounds = [%q, %q), want [ab, ac)", b.Lower, b.Upper)
+	}
+	for key, want := range map[string]bool{"a": false, "ab": true, "abz": true, "ac": false} {
+		if got := b.Contains([]byte(key)); got != want {
+			t.Errorf("Contains(%s) = %v, want %v", key, got, want)
+		}
+	}
+
+	b = bounds.New(bytes.Compare, &sseuda.IterOptions{UpperBound: []byte("abc"), Prefix: []byte("ab")})
+	if string(b.Upper) != "abc" {
+		t.Fatalf("upper bound = %q, want the tighter abc", b.Upper)
+	}
+	if key, lt := b.SeekLE([]byte("abd")); !lt || string(key) != "abc" {
+		t.Fatalf("SeekLE(abd) = %q, %v; want abc, true", key, lt)
+	}
+	if key := b.SeekGE([]byte("a")); string(key) != "ab" {
+		t.Fatalf("SeekGE(a) = %q, want ab", key)
+	}
+}
+
+// TestSuccessor verifies the smallest key past every key with a given prefix.
+func TestSuccessor(t *testing.T) {
+	cases := []struct{ prefix, want []byte }{
+		{[]byte("ab"), []byte("ac")},
+		{[]byte{'a', 0xff}, []byte("b")},
+		{[]byte{0xff, 0xff}, nil},
+		{nil, nil},
+	}
+	for _, c := range cases {
+		if got := bounds.Successor(c.prefix); !bytes.Equal(got, c.want) {
+			t.Errorf("Successor(%q) = %q, want %q", c.prefix, got, c.want)
+		}
+	}
+
+	var b bounds.Bounds
+	if !b.Unbounded() || !b.Contains([]byte("anything")) {
+		t.Fatal("the zero Bounds should admit every key")
+	}
+}
@@ -0,0 +1,244 @@
+// Package cache implements the block cache: a sharded LRU cache of table blocks, bounded by
+// the total size of the blocks, that table readers share so that hot blocks are read from the
+// filesystem once.
+//
+// Blocks are keyed by the number of their table and their offset in it, within a namespace
+// that each user of a shared cache obtains from NewID, since the file numbers of two databases
+// collide. A key is hashed with wyhash to pick its shard, and every shard has a lock and an LRU
+// list of its own, so that readers on different shards never contend.
+//
+// A block handed out by Get or Set stays pinned until its Handle is released: it cannot be
+// evicted meanwhile, so the readers of a block never see it change. Pinned blocks count against
+// the capacity; the cache only evicts unpinned blocks, and may stay above its capacity while
+// the pinned ones alone exceed it.
+package cache
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"sync"
+	"sync/atomic"
+
+	"gosuda.org/sseuda/internal/oldsepia/wyhash"
+)
+
+const (
+	// CACHE_DEFAULT_SHARDS is the number of shards when Options.Shards is zero.
+	CACHE_DEFAULT_SHARDS = 16
+)
+
+// Options configures a Cache.
+type Options struct {
+	// Capacity is the total size, in bytes, of the blocks the cache keeps. Each shard keeps an
+	// equal share of it, and does not cache a block larger than its share.
+	Capacity int64
+
+	// Shards is the number of shards, rounded up to a power of two.
+	Shards int
+}
+
+// Key identifies a block: the offset of the block in table `FileNum` of the user `ID`.
+type Key struct {
+	ID      uint64
+	FileNum uint64
+	Offset  uint64
+}
+
+// Metrics describes the contents and the effectiveness of a cache.
+type Metrics struct {
+	Hits   int64 // Number of Get calls that found their block.
+	Misses int64 // Number of Get calls that did not.
+	Size   int64 // Total size of the cached blocks.
+	Count  int64 // Number of cached blocks.
+	Pinned int64 // Total size of the cached blocks that are pinned.
+}
+
+// entry is a cached block. While it is unpinned, it sits in the LRU list of its shard.
+type entry struct {
+	key        Key
+	value      []byte
+	shard      *shard
+	refs       int    // Number of unreleased handles; guarded by the shard's lock.
+	cached     bool   // Whether the entry is in the shard's map; guarded by the shard's lock.
+	prev, next *entry // Neighbors in the LRU list; nil while the entry is pinned.
+}
+
+// Handle pins a block until it is released.
+type Handle struct {
+	e *entry
+}
+
+// Value returns the block. It must not be modified, nor used after Release.
+func (g *Handle) Value() []byte {
+	return g.e.value
+}
+
+// Release unpins the block. The handle must not be used afterwards.
+func (g *Handle) Release() {
+	if g.e != nil {
+		g.e.shard.release(g.e)
+		g.e = nil
+	}
+}
+
+// shard is an LRU cache of a share of the keys.
+type shard struct {
+	mu       sync.Mutex
+	capacity int64
+	size     int64 // Total size of the entries in `entries`.
+	pinned   int64 // Total size of the entries in `entries` that are pinned.
+	entries  map[Key]*entry
+	lru      entry // Sentinel of the LRU list: lru.next is the most recently used entry.
+}
+
+// Cache is a sharded LRU cache of blocks. A Cache is safe for concurrent use.
+type Cache struct {
+	shards []*shard
+	mask   uint64 // len(shards) - 1.
+	ids    atomic.Uint64
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+// New creates a Cache. A nil `opts` gives a cache of no capacity, which caches nothing.
+func New(opts *Options) *Cache {
+	var o Options
+	if opts != nil {
+		o = *opts
+	}
+	if o.Shards <= 0 {
+		o.Shards = CACHE_DEFAULT_SHARDS
+	}
+	n := 1 << bits.Len(uint(o.Shards-1))
+	g := &Cache{shards: make([]*shard, n), mask: uint64(n - 1)}
+	for i := range g.shards {
+		s := &shard{capacity: max(o.Capacity, 0) / int64(n), entries: make(map[Key]*entry)}
+		s.lru.prev, s.lru.next = &s.lru, &s.lru
+		g.shards[i] = s
+	}
+	return g
+}
+
+// NewID returns a namespace for the keys of a new user of the cache.
+func (g *Cache) NewID() uint64 {
+	return g.ids.Add(1)
+}
+
+// shard returns the shard of `key`.
+func (g *Cache) shard(key Key) *shard {
+	var buf [24]byte
+	binary.LittleEndian.PutUint64(buf[0:], key.ID)
+	binary.LittleEndian.PutUint64(buf[8:], key.FileNum)
+	binary.LittleEndian.PutUint64(buf[16:], key.Offset)
+	return g.shards[wyhash.WyHash(buf[:], 0)&g.mask]
+}
+
+// Get returns the block of `key`, pinned, or nil if it is not cached.
+func (g *Cache) Get(key Key) *Handle {
+	s := g.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[key]
+	if !ok {
+		g.misses.Add(1)
+		return nil
+	}
+	g.hits.Add(1)
+	s.pin(e)
+	return &Handle{e: e}
+}
+
+// Set caches `value` as the block of `key`, in place of any block cached for it, and returns
+// it pinned. A block too large for its shard is handed back without being cached.
+// The cache takes ownership of `value`.
+func (g *Cache) Set(key Key, value []byte) *Handle {
+	s := g.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old, ok := s.entries[key]; ok {
+		s.remove(old)
+	}
+	e := &entry{key: key, value: value, shard: s, refs: 1}
+	if int64(len(value)) > s.capacity {
+		return &Handle{e: e}
+	}
+	e.cached = true
+	s.entries[key] = e
+	s.size += int64(len(value))
+	s.pinned += int64(len(value))
+	s.evict()
+	return &Handle{e: e}
+}
+
+// Evict drops the blocks of table `fileNum` of the user `id`, such as once the table is
+// deleted. Pinned blocks stay valid for their holders, but leave the cache.
+func (g *Cache) Evict(id, fileNum uint64) {
+	for _, s := range g.shards {
+		s.mu.Lock()
+		for key, e := range s.entries {
+			if key.ID == id && key.FileNum == fileNum {
+				s.remove(e)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// Metrics returns the current metrics of the cache.
+func (g *Cache) Metrics() Metrics {
+	m := Metrics{Hits: g.hits.Load(), Misses: g.misses.Load()}
+	for _, s := range g.shards {
+		s.mu.Lock()
+		m.Size += s.size
+		m.Count += int64(len(s.entries))
+		m.Pinned += s.pinned
+		s.mu.Unlock()
+	}
+	return m
+}
+
+// pin takes a reference to the cached entry `e`, taking it out of the LRU list if it was
+// unpinned. The caller must hold the lock.
+func (g *shard) pin(e *entry) {
+	if e.refs == 0 {
+		e.prev.next, e.next.prev = e.next, e.prev
+		e.prev, e.next = nil, nil
+		g.pinned += int64(len(e.value))
+	}
+	e.refs++
+}
+
+// release drops a reference to `e`. Once unpinned, a cached entry becomes the most recently
+// used one, and the shard evicts what its pin kept over capacity.
+func (g *shard) release(e *entry) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if e.refs--; e.refs > 0 || !e.cached {
+		return
+	}
+	g.pinned -= int64(len(e.value))
+	e.prev, e.next = &g.lru, g.lru.next
+	e.prev.next, e.next.prev = e, e
+	g.evict()
+}
+
+// remove takes the cached entry `e` out of the shard. The caller must hold the lock.
+func (g *shard) remove(e *entry) {
+	if e.refs == 0 {
+		e.prev.next, e.next.prev = e.next, e.prev
+		e.prev, e.next = nil, nil
+	} else {
+		g.pinned -= int64(len(e.value))
+	}
+	e.cached = false
+	delete(g.entries, e.key)
+	g.size -= int64(len(e.value))
+}
+
+// evict removes the least recently used unpinned entries while the shard is over capacity.
+// The caller must hold the lock.
+func (g *shard) evict() {
+	for g.size > g.capacity && g.lru.prev != &g.lru {
+		g.remove(g.lru.prev)
+	}
+}
@@ -0,0 +1,134 @@
+package cache_test
+
+import (
+	"sync"
+	"testing"
+
+	"gosuda.org/sseuda/internal/cache"
+)
+
+func key(offset uint64) cache.Key { return cache.Key{ID: 1, FileNum: 1, Offset: offset} }
+
+// TestCacheLRU verifies that a full cache evicts its least recently used block, that a hit
+// refreshes a block, and that the counters record hits and misses.
+func TestCacheLRU(t *testing.T) {
+	c := cache.New(&cache.Options{Capacity: 30, Shards: 1})
+	for i := uint64(0); i < 3; i++ {
+		c.Set(key(i), make([]byte, 10)).Release()
+	}
+	h := c.Get(key(0)) // Block 1 becomes the least recently used.
+	if h == nil {
+		t.Fatal("block 0 missing")
+	}
+	h.Release()
+	c.Set(key(3), make([]byte, 10)).Release()
+
+	for i, want := range []bool{true, false, true, true} {
+		h := c.Get(key(uint64(i)))
+		if (h != nil) != want {
+			t.Fatalf("Get(%d) cached = %t, want %t", i, h != nil, want)
+		}
+		if h != nil {
+			h.Release()
+		}
+	}
+	if m := c.Metrics(); m.Hits != 4 || m.Misses != 1 || m.Size != 30 || m.Count != 3 || m.Pinned != 0 {
+		t.Fatalf("Metrics() = %+v", m)
+	}
+}
+
+// TestCachePinning verifies that pinned blocks survive eviction and hold their contents, that
+// the cache shrinks back once they are released, and that oversized blocks are not cached.
+func TestCachePinning(t *testing.T) {
+	c := cache.New(&cache.Options{Capacity: 20, Shards: 1})
+	h0 := c.Set(key(0), []byte("0123456789"))
+	h1 := c.Set(key(1), []byte("abcdefghij"))
+	h2 := c.Set(key(2), []byte("ABCDEFGHIJ"))
+	if m := c.Metrics(); m.Size != 30 || m.Pinned != 30 {
+		t.Fatalf("Metrics() with every block pinned = %+v", m)
+	}
+	again := c.Get(key(0))
+	h0.Release()
+	if string(again.Value()) != "0123456789" {
+		t.Fatalf("block 0 = %q while pinned twice", again.Value())
+	}
+	again.Release()
+	if c.Get(key(0)) != nil {
+		t.Fatal("block 0 still cached over capacity once released")
+	}
+	h1.Release()
+	h2.Release()
+	h2.Release() // A second release is ignored.
+	if m := c.Metrics(); m.Size != 20 || m.Count != 2 || m.Pinned != 0 {
+		t.Fatalf("Metrics() once released = %+v", m)
+	}
+
+	big := c.Set(key(9), make([]byte, 21))
+	if len(big.Value()) != 21 || c.Get(key(9)) != nil {
+		t.Fatal("oversized block was cached")
+	}
+	big.Release()
+}
+
+// TestCacheEvict verifies that Evict drops the blocks of one table of one user only, and that
+// a block it drops while pinned stays valid for its holder.
+func TestCacheEvict(t *testing.T) {
+	c := cache.New(&cache.Options{Capacity: 1 << 20})
+	id1, id2 := c.NewID(), c.NewID()
+	if id1 == id2 {
+		t.Fatal("NewID returned the same namespace twice")
+	}
+	for fileNum := uint64(1); fileNum <= 2; fileNum++ {
+		for offset := uint64(0); offset < 100; offset++ {
+			c.Set(cache.Key{ID: id1, FileNum: fileNum, Offset: offset}, []byte{byte(offset)}).Release()
+			c.Set(cache.Key{ID: id2, FileNum: fileNum, Offset: offset}, []byte{byte(offset)}).Release()
+		}
+	}
+	pinned := c.Get(cache.Key{ID: id1, FileNum: 1, Offset: 7})
+	c.Evict(id1, 1)
+	if m := c.Metrics(); m.Count != 300 || m.Pinned != 0 {
+		t.Fatalf("Metrics() after Evict = %+v", m)
+	}
+	if pinned.Value()[0] != 7 {
+		t.Fatalf("evicted pinned block = %v", pinned.Value())
+	}
+	pinned.Release()
+	if c.Get(cache.Key{ID: id1, FileNum: 1, Offset: 7}) != nil {
+		t.Fatal("evicted block cached again on release")
+	}
+	if h := c.Get(cache.Key{ID: id2, FileNum: 1, Offset: 7}); h == nil {
+		t.Fatal("Evict dropped the block of another user")
+	} else {
+		h.Release()
+	}
+}
+
+// TestCacheConcurrent exercises every shard from several goroutines; run it with -race.
+func TestCacheConcurrent(t *testing.T) {
+	c := cache.New(&cache.Options{Capacity: 4 << 10})
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 5000; i++ {
+				k := key(uint64((i * (w + 1)) % 512))
+				h := c.Get(k)
+				if h == nil {
+					h = c.Set(k, []byte{byte(k.Offset), byte(k.Offset >> 8)})
+				}
+				if v := h.Value(); v[0] != byte(k.Offset) || v[1] != byte(k.Offset>>8) {
+					t.Errorf("block %d = %v", k.Offset, v)
+				}
+				h.Release()
+				if i%1000 == 0 {
+					c.Evict(1, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if m := c.Metrics(); m.Pinned != 0 || m.Size > 4<<10 || m.Hits+m.Misses != 8*5000 {
+		t.Fatalf("Metrics() = %+v", m)
+	}
+}
@@ -0,0 +1,160 @@
+package engine
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"gosuda.org/sseuda"
+	"gosuda.org/sseuda/internal/ikey"
+)
+
+var (
+	ErrCorruptRecord = errors.New("engine: corrupt write-ahead log record")
+)
+
+// batchHeaderSize is the size of the sequence number and count preceding a batch's entries.
+const batchHeaderSize = 12
+
+// batch is a sequence of writes kept in its serialized form, which is also the single
+// write-ahead log record the batch is logged as:
+//
+//	+-------------------+-----------------+-----------+-----------+-----+
+//	| Seq (8 bytes, LE) | Count (4, LE)   | Entry 1   | Entry 2   | ... |
+//	+-------------------+-----------------+-----------+-----------+-----+
+//
+// Each entry is a kind byte followed by the uvarint-prefixed key and, for every kind but
+// ikey.KindDelete, the uvarint-prefixed value. A range deletion stores the start of the range
+// as its key and the end as its value. The entries of a batch are applied with consecutive
+// sequence numbers starting at Seq.
+type batch struct {
+	data []byte
+}
+
+var _ sseuda.Batch = (*batch)(nil)
+
+func (g *batch) add(kind ikey.Kind, key, value []byte) {
+	if len(g.data) == 0 {
+		g.data = make([]byte, batchHeaderSize, batchHeaderSize+1+2*binary.MaxVarintLen32+len(key)+len(value))
+	}
+	g.data = append(g.data, byte(kind))
+	g.data = binary.AppendUvarint(g.data, uint64(len(key)))
+	g.data = append(g.data, key...)
+	if kind != ikey.KindDelete {
+		g.data = binary.AppendUvarint(g.data, uint64(len(value)))
+		g.data = append(g.data, value...)
+	}
+	binary.LittleEndian.PutUint32(g.data[8:], uint32(g.Count()+1))
+}
+
+func (g *batch) Put(key, value []byte) {
+	g.add(ikey.KindSet, key, value)
+}
+
+func (g *batch) Delete(key []byte) {
+	g.add(ikey.KindDelete, key, nil)
+}
+
+func (g *batch) DeleteRange(start, end []byte) {
+	g.add(ikey.KindRangeDelete, start, end)
+}
+
+func (g *batch) Merge(key, value []byte) {
+	g.add(ikey.KindMerge, key, value)
+}
+
+func (g *batch) Count() int {
+	if len(g.data) < batchHeaderSize {
+		return 0
+	}
+	return int(binary.LittleEndian.Uint32(g.data[8:]))
+}
+
+func (g *batch) Len() int {
+	return max(len(g.data), batchHeaderSize)
+}
+
+func (g *batch) Reset() {
+	g.data = g.data[:0]
+}
+
+// seq returns the sequence number of the first entry.
+func (g *batch) seq() uint64 {
+	return binary.LittleEndian.Uint64(g.data)
+}
+
+func (g *batch) setSeq(seq uint64) {
+	binary.LittleEndian.PutUint64(g.data, seq)
+}
+
+// footprints appends to `dst` the chain bytes needed to apply each entry of the batch to a
+// memtable, in order.
+func (g *batch) footprints(dst []int64) []int64 {
+	for r := g.reader(); ; {
+		_, key, value, ok := r.next()
+		if !ok {
+			return dst
+		}
+		dst = append(dst, entryFootprint(key, value))
+	}
+}
+
+// reader returns a reader over the entries of the batch.
+func (g *batch) reader() batchReader {
+	if len(g.data) < batchHeaderSize {
+		return nil
+	}
+	return batchReader(g.data[batchHeaderSize:])
+}
+
+// batchReader reads the entries of a serialized batch.
+type batchReader []byte
+
+// next returns the next entry. The returned slices alias the batch. It reports false at the
+// end of the batch, or at a malformed entry, which leaves the reader non-empty.
+func (g *batchReader) next() (kind ikey.Kind, key, value []byte, ok bool) {
+	if len(*g) == 0 {
+		return 0, nil, nil, false
+	}
+	r := *g
+	kind = ikey.Kind(r[0])
+	r = r[1:]
+	if kind > ikey.KindRangeDelete { // Blob handles are only written by flushes and compactions.
+		return 0, nil, nil, false
+	}
+	if key, ok = r.bytes(); !ok {
+		return 0, nil, nil, false
+	}
+	if kind != ikey.KindDelete {
+		if value, ok = r.bytes(); !ok {
+			return 0, nil, nil, false
+		}
+	}
+	*g = r
+	return kind, key, value, true
+}
+
+func (g *batchReader) bytes() ([]byte, bool) {
+	n, m := binary.Uvarint(*g)
+	if m <= 0 || n > uint64(len(*g)-m) {
+		return nil, false
+	}
+	b := (*g)[m : m+int(n)]
+	*g = (*g)[m+int(n):]
+	return b, true
+}
+
+// decodeBatch validates a batch read from the write-ahead log. The batch aliases `rec`.
+func decodeBatch(rec []byte) (*batch, error) {
+	if len(rec) < batchHeaderSize {
+		return nil, ErrCorruptRecord
+	}
+	b := &batch{data: rec}
+	r, n := b.reader(), 0
+	for _, _, _, ok := r.next(); ok; _, _, _, ok = r.next() {
+		n++
+	}
+	if len(r) != 0 || n != b.Count() {
+		return nil, ErrCorruptRecord
+	}
+	return b, nil
+}
@@ -0,0 +1,57 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"gosuda.org/sseuda/internal/ikey"
+)
+
+// TestBatchRepr verifies that a batch round-trips through its serialized form, and that
+// damaged representations are rejected.
+func TestBatchRepr(t *testing.T) {
+	var b batch
+	if b.Count() != 0 || b.Len() != batchHeaderSize {
+		t.Fatalf("empty batch: Count = %d, Len = %d", b.Count(), b.Len())
+	}
+	b.Put([]byte("a"), []byte("1"))
+	b.Delete([]byte("b"))
+	b.DeleteRange([]byte("c"), []byte("d"))
+	b.Merge([]byte("e"), []byte{})
+	b.setSeq(42)
+
+	decoded, err := decodeBatch(b.data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.seq() != 42 || decoded.Count() != 4 {
+		t.Fatalf("seq = %d, Count = %d; want 42, 4", decoded.seq(), decoded.Count())
+	}
+	var got []string
+	for r := decoded.reader(); ; {
+		kind, key, value, ok := r.next()
+		if !ok {
+			break
+		}
+		got = append(got, fmt.Sprintf("%s:%s:%s", kind, key, value))
+	}
+	if want := "[SET:a:1 DEL:b: RANGEDEL:c:d MERGE:e:]"; fmt.Sprint(got) != want {
+		t.Fatalf("entries = %v, want %s", got, want)
+	}
+
+	for n := 0; n < len(b.data); n++ {
+		if _, err := decodeBatch(b.data[:n]); !errors.Is(err, ErrCorruptRecord) {
+			t.Fatalf("decodeBatch(truncated to %d) = %v, want ErrCorruptRecord", n, err)
+		}
+	}
+
+	b.Reset()
+	if b.Count() != 0 || b.Len() != batchHeaderSize {
+		t.Fatalf("reset batch: Count = %d, Len = %d", b.Count(), b.Len())
+	}
+	b.add(ikey.KindSet, []byte("k"), nil)
+	if b.Count() != 1 {
+		t.Fatalf("Count = %d after reuse, want 1", b.Count())
+	}
+}
@@ -0,0 +1,137 @@
+package engine
+
+import (
+	"bufio"
+	"os"
+	"sync"
+
+	"gosuda.org/sseuda/internal/blob"
+	"gosuda.org/sseuda/internal/manifest"
+)
+
+// blobCache keeps the blob files of the database open. Like the tables, each blob file is
+// opened on first use and stays open until it is evicted, once no version contains it.
+type blobCache struct {
+	dirname string
+
+	mu    sync.Mutex
+	files map[uint64]*blob.Reader
+}
+
+// newBlobCache returns an empty cache of the blob files in `dirname`.
+func newBlobCache(dirname string) *blobCache {
+	return &blobCache{dirname: dirname, files: make(map[uint64]*blob.Reader)}
+}
+
+// get returns blob file `num`, opening it if necessary.
+func (g *blobCache) get(num uint64) (*blob.Reader, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if r, ok := g.files[num]; ok {
+		return r, nil
+	}
+
+	file, err := os.Open(blobFilename(g.dirname, num))
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	r, err := blob.NewReader(file, info.Size(), num)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	g.files[num] = r
+	return r, nil
+}
+
+// read returns a copy of the value that the encoded handle `handle` locates.
+func (g *blobCache) read(handle []byte) ([]byte, error) {
+	h, err := blob.DecodeHandle(handle)
+	if err != nil {
+		return nil, err
+	}
+	r, err := g.get(h.FileNum)
+	if err != nil {
+		return nil, err
+	}
+	return r.Read(h)
+}
+
+// evict closes blob file `num` if it is open.
+func (g *blobCache) evict(num uint64) {
+	g.mu.Lock()
+	r, ok := g.files[num]
+	delete(g.files, num)
+	g.mu.Unlock()
+	if ok {
+		r.Close()
+	}
+}
+
+// close closes every open blob file.
+func (g *blobCache) close() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for num, r := range g.files {
+		r.Close()
+		delete(g.files, num)
+	}
+}
+
+// blobBuilder writes a new blob file under a temporary name, like tableBuilder does tables.
+type blobBuilder struct {
+	dirname string
+	num     uint64
+	file    *os.File
+	bw      *bufio.Writer
+	w       *blob.Writer
+}
+
+// newBlobBuilder starts blob file `num` in `dirname`.
+func newBlobBuilder(dirname string, num uint64) (*blobBuilder, error) {
+	file, err := os.Create(blobFilename(dirname, num) + tempExt)
+	if err != nil {
+		return nil, err
+	}
+	bw := bufio.NewWriterSize(file, 256<<10)
+	return &blobBuilder{dirname: dirname, num: num, file: file, bw: bw, w: blob.NewWriter(bw, num)}, nil
+}
+
+func (g *blobBuilder) add(value []byte) (blob.Handle, error) {
+	return g.w.Add(value)
+}
+
+// finish syncs the blob file, renames it into place and returns its metadata. The builder is
+// abandoned on error. The caller syncs the directory.
+func (g *blobBuilder) finish() (*manifest.BlobFileMetadata, error) {
+	err := g.bw.Flush()
+	if err == nil {
+		err = g.file.Sync()
+	}
+	if err != nil {
+		g.abandon()
+		return nil, err
+	}
+
+	filename := blobFilename(g.dirname, g.num)
+	if err := g.file.Close(); err != nil {
+		os.Remove(filename + tempExt)
+		return nil, err
+	}
+	if err := os.Rename(filename+tempExt, filename); err != nil {
+		os.Remove(filename + tempExt)
+		return nil, err
+	}
+	return &manifest.BlobFileMetadata{FileNum: g.num, Size: g.w.Size(), ValueBytes: g.w.ValueBytes()}, nil
+}
+
+// abandon discards the partially written blob file.
+func (g *blobBuilder) abandon() {
+	g.file.Close()
+	os.Remove(blobFilename(g.dirname, g.num) + tempExt)
+}
@@ -0,0 +1,622 @@
+package engine
+
+import (
+	"os"
+	"slices"
+
+	"gosuda.org/sseuda"
+	"gosuda.org/sseuda/internal/blob"
+	"gosuda.org/sseuda/internal/ikey"
+	"gosuda.org/sseuda/internal/manifest"
+	"gosuda.org/sseuda/internal/merging"
+	"gosuda.org/sseuda/internal/rangedel"
+)
+
+// compaction merges the tables of `inputs[0]`, from `level`, with the overlapping tables of
+// `inputs[1]`, from the level below, and replaces them with new tables in the level below.
+//
+// A rewrite compaction instead replaces the single table of `inputs[0]` with new tables in its
+// own level, to move its values off blob files that are mostly garbage.
+type compaction struct {
+	level     int
+	inputs    [2][]*manifest.FileMetadata
+	version   *manifest.Version // Version the inputs were picked from; pinned for the job.
+	snapshots []uint64          // Sequence numbers of the snapshots open when the job started.
+	rewrite   bool
+	blobGC    map[uint64]bool // Blob files whose values the outputs take over into blob files of their own.
+}
+
+// outputLevel returns the level the compaction writes to.
+func (g *compaction) outputLevel() int {
+	if g.rewrite {
+		return g.level
+	}
+	return g.level + 1
+}
+
+// bounds returns the smallest and largest user keys of every input, where `compare` orders
+// user keys.
+func (g *compaction) bounds(compare func(key1, key2 []byte) int) (smallest, largest []byte) {
+	for _, files := range g.inputs {
+		for _, f := range files {
+			if s := ikey.UserKey(f.Smallest); smallest == nil || compare(s, smallest) < 0 {
+				smallest = s
+			}
+			if l := ikey.UserKey(f.Largest); largest == nil || compare(l, largest) > 0 {
+				largest = l
+			}
+		}
+	}
+	return smallest, largest
+}
+
+// isTrivialMove reports whether the compaction can move its single input down a level
+// without rewriting it.
+func (g *compaction) isTrivialMove() bool {
+	return !g.rewrite && g.level > 0 && len(g.inputs[0]) == 1 && len(g.inputs[1]) == 0
+}
+
+// maxBytesForLevel returns the size target of `level`, which must be at least 1.
+func (g *DB) maxBytesForLevel(level int) float64 {
+	size := float64(g.opts.LBaseMaxBytes)
+	for ; level > 1; level-- {
+		size *= float64(g.opts.LevelMultiplier)
+	}
+	return size
+}
+
+// levelScore returns how urgently `level` of `v` needs compacting; 1 or more means it does.
+// Level 0 is scored by table count, since every lookup probes each of its tables, and
+// deeper levels by total size relative to their target.
+func (g *DB) levelScore(v *manifest.Version, level int) float64 {
+	if level == 0 {
+		return float64(len(v.Levels[0])) / float64(g.opts.L0CompactionThreshold)
+	}
+	var size uint64
+	for _, f := range v.Levels[level] {
+		size += f.Size
+	}
+	return float64(size) / g.maxBytesForLevel(level)
+}
+
+// pickCompaction returns the compaction of the level with the highest score of at least 1
+// whose inputs are not already being compacted, or nil. The caller must hold the write lock.
+func (g *DB) pickCompaction() *compaction {
+	v := g.vs.Current()
+	type candidate struct {
+		level int
+		score float64
+	}
+	var candidates []candidate
+	for level := 0; level < manifest.MANIFEST_NUM_LEVELS-1; level++ {
+		if score := g.levelScore(v, level); score >= 1 {
+			candidates = append(candidates, candidate{level: level, score: score})
+		}
+	}
+	slices.SortStableFunc(candidates, func(a, b candidate) int {
+		switch {
+		case a.score > b.score:
+			return -1
+		case a.score < b.score:
+			return 1
+		}
+		return 0
+	})
+
+	for _, cand := range candidates {
+		if c := g.setupCompaction(v, cand.level); c != nil {
+			return c
+		}
+	}
+	if c := g.pickBlobRewrite(v); c != nil {
+		return c
+	}
+	v.DecRef()
+	return nil
+}
+
+// garbageBlobFiles returns the blob files of `v` whose share of values still referred to by a
+// table has fallen below Options.BlobGCRatio.
+func (g *DB) garbageBlobFiles(v *manifest.Version) map[uint64]bool {
+	garbage := make(map[uint64]bool)
+	live := v.BlobLiveBytes()
+	for num, b := range v.BlobFiles {
+		if float64(live[num]) < g.opts.BlobGCRatio*float64(b.ValueBytes) {
+			garbage[num] = true
+		}
+	}
+	return garbage
+}
+
+// pickBlobRewrite returns a rewrite compaction of the table below level 0 that refers to the
+// most value bytes in garbage blob files, or nil if none does. Level 0 is left alone: its
+// tables are ordered by age, which a rewrite would not preserve; they reach level 1 soon enough.
+//
+// Rewriting a table moves its values out of the garbage blob files, so a blob file is deleted
+// once every table referring to it has been rewritten or compacted.
+func (g *DB) pickBlobRewrite(v *manifest.Version) *compaction {
+	garbage := g.garbageBlobFiles(v)
+	if len(garbage) == 0 {
+		return nil
+	}
+	c := &compaction{version: v, rewrite: true}
+	var most uint64
+	for level := 1; level < manifest.MANIFEST_NUM_LEVELS; level++ {
+		for _, f := range v.Levels[level] {
+			if g.compacting[f.FileNum] {
+				continue
+			}
+			var bytes uint64
+			for _, ref := range f.BlobRefs {
+				if garbage[ref.FileNum] {
+					bytes += ref.Bytes
+				}
+			}
+			if bytes > most {
+				most = bytes
+				c.level, c.inputs[0] = level, []*manifest.FileMetadata{f}
+			}
+		}
+	}
+	if most == 0 {
+		return nil
+	}
+	return c
+}
+
+// setupCompaction chooses the inputs of a compaction of `level`, or returns nil when they
+// conflict with a running compaction.
+//
+// Tables in level 0 overlap and newer ones shadow older ones, so level 0 is always compacted
+// as a whole. In deeper levels a single table is picked, round-robin over the key space so
+// that every part of the level is eventually compacted.
+func (g *DB) setupCompaction(v *manifest.Version, level int) *compaction {
+	c := &compaction{level: level, version: v}
+	if level == 0 {
+		c.inputs[0] = v.Levels[0]
+	} else {
+		files := v.Levels[level]
+		start, _ := slices.BinarySearchFunc(files, g.compactPointers[level], func(f *manifest.FileMetadata, key []byte) int {
+			return g.icompare(f.Smallest, key)
+		})
+		if g.compactPointers[level] != nil && start < len(files) && g.icompare(files[start].Smallest, g.compactPointers[level]) == 0 {
+			start++
+		}
+		for i := range files {
+			f := files[(start+i)%len(files)]
+			if !g.compacting[f.FileNum] {
+				c.inputs[0] = []*manifest.FileMetadata{f}
+				break
+			}
+		}
+	}
+	if len(c.inputs[0]) == 0 || slices.ContainsFunc(c.inputs[0], g.isCompacting) {
+		return nil
+	}
+
+	smallest, largest := c.bounds(g.opts.Compare)
+	c.inputs[1] = v.Overlaps(c.outputLevel(), g.opts.Compare, smallest, largest)
+	if slices.ContainsFunc(c.inputs[1], g.isCompacting) {
+		return nil
+	}
+	return c
+}
+
+func (g *DB) isCompacting(f *manifest.FileMetadata) bool {
+	return g.compacting[f.FileNum]
+}
+
+// maybeScheduleCompaction starts compactions in the background until the concurrency limit
+// is reached or no level needs one. The caller must hold the write lock.
+func (g *DB) maybeScheduleCompaction() {
+	for !g.closed && g.bgErr == nil && g.compactions < g.opts.MaxConcurrentCompactions {
+		c := g.pickCompaction()
+		if c == nil {
+			return
+		}
+		for _, files := range c.inputs {
+			for _, f := range files {
+				g.compacting[f.FileNum] = true
+			}
+		}
+		if c.level > 0 && !c.rewrite {
+			g.compactPointers[c.level] = c.inputs[0][0].Smallest
+		}
+		// Snapshots taken later see a sequence number above every input, so they only need
+		// the newest versions, which are always kept.
+		c.snapshots = slices.Clone(g.snapshots)
+		c.blobGC = g.garbageBlobFiles(c.version)
+		g.compactions++
+		go g.compact(c)
+	}
+}
+
+// compact runs `c`, installs its result, and schedules any compaction that became necessary.
+func (g *DB) compact(c *compaction) {
+	var edit *manifest.VersionEdit
+	var err error
+	if c.isTrivialMove() {
+		f := c.inputs[0][0]
+		edit = &manifest.VersionEdit{
+			DeletedFiles: []manifest.DeletedFile{{Level: c.level, FileNum: f.FileNum}},
+			NewFiles:     []manifest.NewFile{{Level: c.outputLevel(), Meta: f}},
+		}
+	} else {
+		edit, err = g.runCompaction(c)
+	}
+
+	g.mu.Lock()
+	if err == nil {
+		err = g.vs.LogAndApply(edit)
+	}
+	c.version.DecRef() // Lets the inputs become obsolete.
+	g.mu.Unlock()
+
+	// The files are deleted without the lock, so that reads and writes go on meanwhile. The
+	// compaction still counts as running, so that Close waits for the deletions.
+	if err == nil {
+		err = g.deleteObsoleteTables()
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	defer g.cond.Broadcast()
+	if err != nil && g.bgErr == nil {
+		g.bgErr = err
+	}
+	for _, files := range c.inputs {
+		for _, f := range files {
+			delete(g.compacting, f.FileNum)
+		}
+	}
+	g.compactions--
+	g.maybeScheduleCompaction()
+}
+
+// runCompaction merges the inputs of `c` into new tables of the output level, split at
+// Options.TargetFileSize, and returns the edit that swaps them for the inputs.
+//
+// The open snapshots split the versions of a user key into stripes: the versions between two
+// consecutive snapshot sequence numbers are seen by the same snapshots, so only the newest of
+// them is kept and the others are dropped as shadowed. Without snapshots, only the newest
+// version of each user key survives. A deletion in the oldest stripe is dropped too once no
+// deeper level can hold an older version it would have to keep hiding.
+//
+// Range deletions follow the same rules: a version is dropped when a range deletion of the
+// same stripe covers it, and a range deletion is dropped when a newer one of its stripe covers
+// the same span, or when it lies in the oldest stripe and no deeper level overlaps its span.
+//
+// Merge operands that start a stripe are resolved by mergeStripe.
+//
+// The values of the surviving blob entries stay where they are, unless their blob file is in
+// `c.blobGC`: those are read back and separated anew into the blob files of the outputs.
+func (g *DB) runCompaction(c *compaction) (*manifest.VersionEdit, error) {
+	edit := &manifest.VersionEdit{}
+	rangeDels, err := g.compactionRangeDels(c)
+	if err != nil {
+		return nil, err
+	}
+	iters := make([]sseuda.Iterator, 0, len(c.inputs[0])+1)
+	for _, f := range c.inputs[0] {
+		iter, err := g.tableCache.newIter(f.FileNum, nil)
+		if err != nil {
+			for _, iter := range iters {
+				iter.Close()
+			}
+			return nil, err
+		}
+		iters = append(iters, iter)
+	}
+	iters = append(iters, newLevelIter(g.icompare, g.tableCache, c.inputs[1], nil))
+	iter := merging.NewIterator(&merging.Options{Compare: g.icompare}, iters...)
+
+	err = g.writeCompactionOutputs(c, iter, rangeDels, edit)
+	if cerr := iter.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		for _, n := range edit.NewFiles {
+			os.Remove(tableFilename(g.dirname, n.Meta.FileNum))
+		}
+		for _, b := range edit.NewBlobFiles {
+			os.Remove(blobFilename(g.dirname, b.FileNum))
+		}
+		return nil, err
+	}
+
+	for i, files := range c.inputs {
+		for _, f := range files {
+			edit.DeletedFiles = append(edit.DeletedFiles, manifest.DeletedFile{Level: c.level + i, FileNum: f.FileNum})
+		}
+	}
+	return edit, nil
+}
+
+// compactionRangeDels returns the range deletions of every input of `c`, fragmented together.
+func (g *DB) compactionRangeDels(c *compaction) (*rangedel.List, error) {
+	var tombstones []rangedel.Tombstone
+	for _, files := range c.inputs {
+		for _, f := range files {
+			t, err := g.tableCache.get(f.FileNum)
+			if err != nil {
+				return nil, err
+			}
+			tombstones = t.rangeDels.AppendTombstones(tombstones, ikey.IKEY_MAX_SEQ)
+		}
+	}
+	return rangedel.New(g.opts.Compare, tombstones), nil
+}
+
+// writeCompactionOutputs writes the entries of `iter` and the range deletions of `rangeDels`
+// that survive the compaction to tables of its output level, and records each finished table
+// in `edit`. Tables are only split between user keys, so that no user key spans two tables of
+// a level; each table receives the part of the range deletions between its first user key
+// and the first user key of the next table.
+func (g *DB) writeCompactionOutputs(c *compaction, iter sseuda.Iterator, rangeDels *rangedel.List, edit *manifest.VersionEdit) error {
+	kept := g.keptRangeDels(c, rangeDels)
+	var b *tableBuilder
+	var lower []byte // First user key of the table being written; nil for the first table.
+	finish := func(upper []byte) error {
+		if err := addRangeDelsWithin(b, kept, lower, upper, g.opts.Compare); err != nil {
+			b.abandon()
+			b = nil
+			return err
+		}
+		err := b.finish(edit, c.outputLevel())
+		b = nil
+		return err
+	}
+
+	add := func(key, value []byte, newUserKey bool) error {
+		if newUserKey && b != nil && b.size() >= g.opts.TargetFileSize {
+			userKey := ikey.UserKey(key)
+			if err := finish(userKey); err != nil {
+				return err
+			}
+			lower = slices.Clone(userKey)
+		}
+		if b == nil {
+			var err error
+			if b, err = g.newTableBuilder(); err != nil {
+				return err
+			}
+		}
+		if err := b.add(key, value); err != nil {
+			b.abandon()
+			return err
+		}
+		return nil
+	}
+
+	var lastUserKey []byte
+	hasLastUserKey := false
+	lastStripe := 0
+	for valid := iter.First(); valid; {
+		userKey, seq, kind := ikey.Decode(iter.Key())
+		stripe, _ := slices.BinarySearch(c.snapshots, seq)
+		newUserKey := !hasLastUserKey || g.opts.Compare(userKey, lastUserKey) != 0
+		if !newUserKey && stripe == lastStripe {
+			valid = iter.Next()
+			continue // Shadowed by the newer version of the stripe just written or dropped.
+		}
+		lastUserKey = append(lastUserKey[:0], userKey...)
+		hasLastUserKey = true
+		lastStripe = stripe
+		if (kind == ikey.KindDelete && stripe == 0 && g.isBaseLevelForKey(c, userKey)) ||
+			rangeDeletedInStripe(c, rangeDels, userKey, seq, stripe) {
+			valid = iter.Next()
+			continue
+		}
+
+		if kind == ikey.KindMerge {
+			entries, next, err := g.mergeStripe(c, iter, rangeDels, lastUserKey, stripe)
+			if err != nil {
+				return err
+			}
+			for i, e := range entries {
+				if err := add(e.key, e.value, newUserKey && i == 0); err != nil {
+					return err
+				}
+			}
+			valid = next
+			continue
+		}
+		key, value, err := g.collectBlob(c, iter.Key(), iter.Value())
+		if err != nil {
+			return err
+		}
+		if err := add(key, value, newUserKey); err != nil {
+			return err
+		}
+		valid = iter.Next()
+	}
+	if b == nil && len(kept) > 0 {
+		var err error
+		if b, err = g.newTableBuilder(); err != nil {
+			return err
+		}
+	}
+	if b != nil {
+		return finish(nil)
+	}
+	return nil
+}
+
+// collectBlob returns the entry to write for the entry `key` of `c` with `value`: unchanged,
+// unless it is a blob entry whose blob file `c` collects, in which case it turns back into a
+// set of the value the handle locates.
+func (g *DB) collectBlob(c *compaction, key, value []byte) ([]byte, []byte, error) {
+	userKey, seq, kind := ikey.Decode(key)
+	if kind != ikey.KindBlob || len(c.blobGC) == 0 {
+		return key, value, nil
+	}
+	h, err := blob.DecodeHandle(value)
+	if err != nil || !c.blobGC[h.FileNum] {
+		return key, value, err
+	}
+	if value, err = g.blobCache.read(value); err != nil {
+		return nil, nil, err
+	}
+	return ikey.Make(userKey, seq, ikey.KindSet), value, nil
+}
+
+// mergedEntry is an entry written by a compaction in place of merge operands.
+type mergedEntry struct {
+	key, value []byte
+}
+
+// mergeStripe resolves the merge operands of `userKey` that start the stripe of `c` that `iter`
+// rests on, and returns the entries to write in their place, in order. It leaves `iter` on the
+// first version the operands do not consume, and reports whether `iter` is still valid.
+//
+// When the operands sit on a set, a deletion or a version covered by a range deletion of the
+// stripe, they are fully merged into a set that replaces all of them, and the version under
+// them is left to be dropped as shadowed. So are they when the stripe is the oldest and no
+// deeper level can hold the key. Otherwise, an older stripe or level may hold the value they
+// apply to, so they are only combined, oldest first, as far as the merge operator allows.
+func (g *DB) mergeStripe(c *compaction, iter sseuda.Iterator, rangeDels *rangedel.List, userKey []byte, stripe int) ([]mergedEntry, bool, error) {
+	if g.opts.MergeOperator == nil {
+		return nil, false, sseuda.ErrMergeUnsupported
+	}
+	var operands []mergedEntry // Newest first.
+	var base []byte
+	decided := false
+	valid := true
+	for !decided {
+		operands = append(operands, mergedEntry{key: slices.Clone(iter.Key()), value: slices.Clone(iter.Value())})
+		if valid = iter.Next(); !valid {
+			break
+		}
+		key, seq, kind := ikey.Decode(iter.Key())
+		if s, _ := slices.BinarySearch(c.snapshots, seq); s != stripe || g.opts.Compare(key, userKey) != 0 {
+			break
+		}
+		switch {
+		case kind == ikey.KindDelete || rangeDeletedInStripe(c, rangeDels, key, seq, stripe):
+			decided = true
+		case kind == ikey.KindSet:
+			base = slices.Clone(iter.Value())
+			decided = true
+		case kind == ikey.KindBlob:
+			var err error
+			if base, err = g.blobCache.read(iter.Value()); err != nil {
+				return nil, false, err
+			}
+			decided = true
+		}
+	}
+
+	if decided || (stripe == 0 && g.isBaseLevelForKey(c, userKey)) {
+		values := make([][]byte, len(operands))
+		for i, operand := range operands {
+			values[i] = operand.value
+		}
+		value, err := fullMerge(g.opts.MergeOperator, userKey, base, values)
+		if err != nil {
+			return nil, false, err
+		}
+		_, seq, _ := ikey.Decode(operands[0].key)
+		return []mergedEntry{{key: ikey.Make(userKey, seq, ikey.KindSet), value: value}}, valid, nil
+	}
+
+	combined := []mergedEntry{operands[len(operands)-1]} // Oldest first.
+	for _, operand := range slices.Backward(operands[:len(operands)-1]) {
+		last := &combined[len(combined)-1]
+		if value, ok := g.opts.MergeOperator.PartialMerge(userKey, last.value, operand.value); ok {
+			*last = mergedEntry{key: operand.key, value: value}
+		} else {
+			combined = append(combined, operand)
+		}
+	}
+	slices.Reverse(combined)
+	return combined, valid, nil
+}
+
+// keptRangeDels returns the fragments of `rangeDels` with the sequence numbers that survive
+// the compaction `c`: the newest of each stripe, except in the oldest stripe when no deeper
+// level overlaps the fragment.
+func (g *DB) keptRangeDels(c *compaction, rangeDels *rangedel.List) []rangedel.Fragment {
+	var kept []rangedel.Fragment
+	for _, f := range rangeDels.Fragments() {
+		var seqs []uint64
+		lastStripe := -1
+		for _, seq := range f.Seqs {
+			stripe, _ := slices.BinarySearch(c.snapshots, seq)
+			if stripe == lastStripe {
+				continue // Shadowed by the newer range deletion of the stripe.
+			}
+			lastStripe = stripe
+			seqs = append(seqs, seq)
+		}
+		if lastStripe == 0 && g.isBaseLevelForRange(c, f.Start, f.End) {
+			seqs = seqs[:len(seqs)-1]
+		}
+		if len(seqs) > 0 {
+			kept = append(kept, rangedel.Fragment{Start: f.Start, End: f.End, Seqs: seqs})
+		}
+	}
+	return kept
+}
+
+// rangeDeletedInStripe reports whether a range deletion of `rangeDels` in the same stripe of
+// `c` as the version of `userKey` at `seq` covers it, so that no snapshot can see the version.
+// The oldest range deletion newer than the version is the only candidate.
+func rangeDeletedInStripe(c *compaction, rangeDels *rangedel.List, userKey []byte, seq uint64, stripe int) bool {
+	seqs := rangeDels.Covering(userKey)
+	for i := len(seqs) - 1; i >= 0; i-- {
+		if seqs[i] > seq {
+			rangeStripe, _ := slices.BinarySearch(c.snapshots, seqs[i])
+			return rangeStripe == stripe
+		}
+	}
+	return false
+}
+
+// addRangeDelsWithin adds to `b` the part of every fragment of `fragments` that lies within
+// [lower, upper), where nil bounds are open and `compare` orders user keys.
+func addRangeDelsWithin(b *tableBuilder, fragments []rangedel.Fragment, lower, upper []byte, compare func(key1, key2 []byte) int) error {
+	for _, f := range fragments {
+		start, end := f.Start, f.End
+		if lower != nil && compare(start, lower) < 0 {
+			start = lower
+		}
+		if upper != nil && compare(end, upper) > 0 {
+			end = upper
+		}
+		if compare(start, end) >= 0 {
+			continue
+		}
+		for _, seq := range f.Seqs {
+			if err := b.addRangeDel(start, end, seq); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// isBaseLevelForKey reports whether no level below the output of `c` may hold the user key
+// `key`, in which case a deletion of `key` has nothing left to hide.
+func (g *DB) isBaseLevelForKey(c *compaction, key []byte) bool {
+	for level := c.outputLevel() + 1; level < manifest.MANIFEST_NUM_LEVELS; level++ {
+		for _, f := range c.version.Levels[level] {
+			if g.opts.Compare(key, ikey.UserKey(f.Smallest)) >= 0 && g.opts.Compare(key, ikey.UserKey(f.Largest)) <= 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// isBaseLevelForRange reports whether no level below the output of `c` may hold a user key in
+// [start, end), in which case a range deletion of it has nothing left to hide.
+func (g *DB) isBaseLevelForRange(c *compaction, start, end []byte) bool {
+	for level := c.outputLevel() + 1; level < manifest.MANIFEST_NUM_LEVELS; level++ {
+		for _, f := range c.version.Levels[level] {
+			if g.opts.Compare(ikey.UserKey(f.Smallest), end) < 0 && g.opts.Compare(ikey.UserKey(f.Largest), start) >= 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
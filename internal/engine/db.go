@@ -0,0 +1,512 @@
+// Package engine implements sseuda.StorageEngine on disk.
+//
+// Every write is first appended to a segmented write-ahead log (see package wal) and then
+// applied to a memtable: an mskip.WideSkipList in a marena.Chain that grows up to a size bound.
+// When the memtable fills up it becomes immutable, stays readable, and is written to an SSTable
+// by a background goroutine, after which the log segments it covered are deleted.
+//
+// Tables are arranged in the levels of an LSM tree: flushed tables land in level 0, and every
+// deeper level is a sorted run of non-overlapping tables. The tables of each level are tracked
+// by a manifest.VersionSet, whose MANIFEST records every change. Background compactions merge
+// a level that outgrows its size target into the level below, dropping shadowed entries,
+// entries covered by range deletions, and deletions that have nothing left to hide.
+//
+// Range deletions are kept apart from the entries: in a second skip list of each memtable,
+// and in the range deletion block of each table, whose bounds extend to cover them.
+//
+// Values of at least Options.BlobThreshold bytes are separated from their keys when memtables
+// are flushed: they are appended to a blob file (see package blob), and the table stores a blob
+// entry holding a handle to the value instead. Compactions then move handles rather than values.
+// The manifest tracks how many value bytes the tables refer to in each blob file; once that
+// share falls below Options.BlobGCRatio, compactions copy the values still referred to into new
+// blob files, and the old one is deleted when no table refers to it any more.
+//
+// Merge operands are stored like values and resolved by Options.MergeOperator: reads apply
+// them to the version of their key under them, and compactions fold them into it, or into
+// each other when that version lies out of reach.
+//
+// Opening a database recovers the levels from the manifest and replays the log segments that
+// were not flushed yet, so acknowledged writes survive a crash.
+package engine
+
+import (
+	"errors"
+	"os"
+	"slices"
+	"sync"
+
+	"gosuda.org/sseuda"
+	"gosuda.org/sseuda/internal/cache"
+	"gosuda.org/sseuda/internal/ikey"
+	"gosuda.org/sseuda/internal/manifest"
+	"gosuda.org/sseuda/internal/oldsepia/marena"
+	"gosuda.org/sseuda/internal/record"
+	"gosuda.org/sseuda/internal/wal"
+)
+
+var (
+	ErrClosed       = errors.New("engine: database is closed")
+	ErrForeignBatch = errors.New("engine: batch was not created by this database")
+)
+
+// DB is an on-disk sseuda.StorageEngine.
+type DB struct {
+	dirname    string
+	opts       Options
+	icompare   func(key1, key2 []byte) int // Orders internal keys by Options.Compare.
+	vs         *manifest.VersionSet        // Levels of tables; also allocates file numbers.
+	tableCache *tableCache
+	blobCache  *blobCache
+
+	flushCh   chan struct{} // Wakes the flush goroutine; closed by Close.
+	flushDone chan struct{} // Closed when the flush goroutine exits.
+
+	mu        sync.RWMutex // Guards the fields below. Writers hold it exclusively, readers share it.
+	cond      *sync.Cond   // Signaled, with `mu`, whenever a flush or compaction finishes.
+	mem       *memTable    // Mutable memtable receiving writes.
+	imm       []*memTable  // Immutable memtables awaiting flush, oldest first.
+	obsolete  []*memTable  // Flushed memtables still referenced by iterators.
+	writers   []*writer    // Commit queue; the head alone writes the log and rotates the memtable.
+	log       *wal.Log     // Written by the head of the commit queue, which may do so without the lock.
+	lastSeq   uint64       // Sequence number of the last applied write; reads see every write up to it.
+	snapshots []uint64     // Sequence numbers of the open snapshots, ascending.
+	bgErr     error        // First error of a log write, flush or compaction; fails every later write.
+	closed    bool
+
+	compactions     int                                  // Number of running compactions.
+	compacting      map[uint64]bool                      // Tables that are inputs of a running compaction.
+	compactPointers [manifest.MANIFEST_NUM_LEVELS][]byte // Smallest key of each level's last compaction.
+}
+
+var _ sseuda.StorageEngine = (*DB)(nil)
+
+// Open opens the database in `dirname`, creating it if it does not exist, and replays
+// its write-ahead log into fresh memtables. A nil `opts` uses the defaults.
+func Open(dirname string, opts *Options) (*DB, error) {
+	g := &DB{
+		dirname:    dirname,
+		opts:       opts.withDefaults(),
+		flushCh:    make(chan struct{}, 1),
+		flushDone:  make(chan struct{}),
+		compacting: make(map[uint64]bool),
+	}
+	g.cond = sync.NewCond(&g.mu)
+	g.icompare = ikey.Comparer(g.opts.Compare)
+	if err := os.MkdirAll(dirname, 0o755); err != nil {
+		return nil, err
+	}
+	if err := removeTempFiles(dirname); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if g.vs, err = manifest.Open(dirname, g.opts.Compare); err != nil {
+		return nil, err
+	}
+	blockCache := g.opts.BlockCache
+	if blockCache == nil {
+		blockCache = cache.New(&cache.Options{Capacity: ENGINE_DEFAULT_BLOCK_CACHE_SIZE})
+	}
+	g.tableCache = newTableCache(dirname, g.opts.Compare, blockCache)
+	g.blobCache = newBlobCache(dirname)
+	g.lastSeq = g.vs.LastSequence()
+	if err := g.removeUnusedTables(); err != nil {
+		g.vs.Close()
+		return nil, err
+	}
+
+	// Segments older than the manifest's log number were flushed before the last shutdown.
+	if err := g.removeObsoleteLogs(g.vs.LogNumber()); err != nil {
+		g.vs.Close()
+		return nil, err
+	}
+	segments, err := wal.ListSegments(dirname)
+	if err != nil {
+		g.vs.Close()
+		return nil, err
+	}
+	if err := g.replayLog(segments); err != nil {
+		g.releaseMemTables()
+		g.vs.Close()
+		return nil, err
+	}
+
+	g.log, err = wal.Create(dirname, g.vs.NewFileNum(), wal.Options{
+		SegmentSize: g.opts.WALSegmentSize,
+		NewFileNum:  g.vs.NewFileNum,
+	})
+	if err != nil {
+		g.releaseMemTables()
+		g.vs.Close()
+		return nil, err
+	}
+	if len(segments) == 0 {
+		g.mem.logNum = g.log.Num()
+	}
+
+	go g.flushLoop()
+	g.mu.Lock()
+	if len(g.imm) > 0 {
+		g.scheduleFlush()
+	}
+	g.maybeScheduleCompaction()
+	g.mu.Unlock()
+	return g, nil
+}
+
+// removeUnusedTables deletes the table and blob files that the current version does not
+// contain: files written by a flush or compaction whose version edit never reached the manifest.
+func (g *DB) removeUnusedTables() error {
+	tables, err := listFiles(g.dirname, tableExt)
+	if err != nil {
+		return err
+	}
+	blobs, err := listFiles(g.dirname, blobExt)
+	if err != nil {
+		return err
+	}
+	v := g.vs.Current()
+	defer v.DecRef()
+	live := make(map[uint64]bool)
+	for _, files := range v.Levels {
+		for _, f := range files {
+			live[f.FileNum] = true
+		}
+	}
+	for _, num := range tables {
+		if !live[num] {
+			if err := os.Remove(tableFilename(g.dirname, num)); err != nil {
+				return err
+			}
+		}
+	}
+	for _, num := range blobs {
+		if _, ok := v.BlobFiles[num]; !ok {
+			if err := os.Remove(blobFilename(g.dirname, num)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// replayLog replays `segments` into memtables. Memtables that fill up are queued for flushing.
+// Every replayed memtable keeps the first segment as its log number, so no segment is deleted
+// before the last of them has been flushed.
+func (g *DB) replayLog(segments []uint64) error {
+	var logNum uint64
+	if len(segments) > 0 {
+		logNum = segments[0]
+	}
+	var err error
+	if g.mem, err = g.newMemTable(logNum); err != nil {
+		return err
+	}
+
+	return wal.Replay(g.dirname, segments, func(rec []byte) error {
+		b, err := decodeBatch(rec)
+		if err != nil {
+			return err
+		}
+		if !g.mem.fits(b) {
+			mem, err := g.newMemTable(logNum)
+			if err != nil {
+				return err
+			}
+			g.imm = append(g.imm, g.mem)
+			g.mem = mem
+		}
+		if !g.mem.applyBatch(b) {
+			return marena.ErrAllocationFailed
+		}
+		g.lastSeq = max(g.lastSeq, b.seq()+uint64(b.Count())-1)
+		return nil
+	})
+}
+
+// releaseMemTables drops the DB's references to its memtables and hands the chains of the
+// memtables nothing else references back to the pool.
+func (g *DB) releaseMemTables() {
+	mems := slices.Clone(g.imm)
+	if g.mem != nil {
+		mems = append(mems, g.mem)
+	}
+	for _, mem := range mems {
+		mem.unref()
+	}
+	g.obsolete = append(g.obsolete, mems...)
+	g.recycleChains()
+}
+
+// readState returns the sources a read consults, with the current version pinned.
+// The caller must hold the lock and unref the state once done.
+func (g *DB) readState() readState {
+	mems := make([]*memTable, 0, 1+len(g.imm))
+	mems = append(mems, g.mem)
+	for _, mem := range slices.Backward(g.imm) {
+		mems = append(mems, mem)
+	}
+	return readState{
+		compare: g.opts.Compare,
+		merge:   g.opts.MergeOperator,
+		seq:     g.lastSeq,
+		mems:    mems,
+		version: g.vs.Current(),
+		cache:   g.tableCache,
+		blobs:   g.blobCache,
+		prefix:  g.opts.PrefixExtractor,
+	}
+}
+
+// Get returns a copy of the value stored for `key`, or sseuda.ErrNotFound.
+func (g *DB) Get(key []byte) ([]byte, error) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	if g.closed {
+		return nil, ErrClosed
+	}
+	state := g.readState()
+	defer state.unref()
+	return state.get(key)
+}
+
+// Put sets the value for `key`.
+func (g *DB) Put(key, value []byte) error {
+	var b batch
+	b.Put(key, value)
+	return g.write(&b)
+}
+
+// Merge records `value` as a merge operand of `key`, to be combined with the value of `key` by
+// Options.MergeOperator when it is read. It fails with sseuda.ErrMergeUnsupported if the
+// database has no merge operator.
+func (g *DB) Merge(key, value []byte) error {
+	var b batch
+	b.Merge(key, value)
+	return g.write(&b)
+}
+
+// Delete removes `key`.
+func (g *DB) Delete(key []byte) error {
+	var b batch
+	b.Delete(key)
+	return g.write(&b)
+}
+
+// DeleteRange removes every key in [start, end) with a single range tombstone, however many
+// keys the range holds. Reads skip the keys it covers, and compactions drop them.
+func (g *DB) DeleteRange(start, end []byte) error {
+	var b batch
+	b.DeleteRange(start, end)
+	return g.write(&b)
+}
+
+// NewBatch returns an empty batch for this database.
+func (g *DB) NewBatch() sseuda.Batch {
+	return &batch{}
+}
+
+// Apply writes every operation of `b` atomically: the batch is logged as a single record and
+// applied with consecutive sequence numbers, so readers observe either none or all of it, and
+// recovery after a crash replays either none or all of it.
+func (g *DB) Apply(b sseuda.Batch) error {
+	bt, ok := b.(*batch)
+	if !ok {
+		return ErrForeignBatch
+	}
+	return g.write(bt)
+}
+
+// maxGroupSize bounds the bytes of batches a group commit logs, past which the head of the
+// commit queue leaves the writers behind it to the next group.
+const maxGroupSize = 1 << 20
+
+// writer is a write waiting in the commit queue. Flush and Close queue as writers without a
+// batch, so that they touch the log and the memtable only between group commits.
+type writer struct {
+	b    *batch
+	cond sync.Cond // Signaled, with the write lock, once the writer is done or heads the queue.
+	done bool      // Set once a group commit led by another writer has completed the write.
+	err  error
+}
+
+// enqueue appends `w` to the commit queue and waits until it heads the queue, or until a
+// group commit led by another writer has completed it. The caller must hold the write lock.
+func (g *DB) enqueue(w *writer) {
+	w.cond.L = &g.mu
+	g.writers = append(g.writers, w)
+	for !w.done && g.writers[0] != w {
+		w.cond.Wait()
+	}
+}
+
+// dequeue removes the first `n` writers from the commit queue, completing those that another
+// writer led with `err`, and wakes the new head. The caller must hold the write lock.
+func (g *DB) dequeue(n int, err error) {
+	for _, w := range g.writers[1:n] {
+		w.done, w.err = true, err
+		w.cond.Signal()
+	}
+	g.writers = slices.Delete(g.writers, 0, n)
+	if len(g.writers) > 0 {
+		g.writers[0].cond.Signal()
+	}
+}
+
+// group returns the writers whose batches the head of the commit queue logs together with its
+// own: those queued right behind it whose batches still fit in the memtable and in maxGroupSize.
+// The caller must hold the write lock and have made room for the batch of the head.
+func (g *DB) group() []*writer {
+	batches := []*batch{g.writers[0].b}
+	size := len(batches[0].data)
+	for _, w := range g.writers[1:] {
+		if w.b == nil || size+len(w.b.data) > maxGroupSize || !g.mem.fits(append(batches, w.b)...) {
+			break
+		}
+		batches = append(batches, w.b)
+		size += len(w.b.data)
+	}
+	return slices.Clone(g.writers[:len(batches)])
+}
+
+// write logs `b` and then applies it to the memtable. Writes queue up while the head of the
+// queue commits: it logs its batch together with those of the writers behind it and syncs
+// the log once for all of them, without holding the lock, and then applies the batches and
+// completes the writes under the lock. A write fails before logging anything if the memtable
+// cannot hold its whole batch.
+func (g *DB) write(b *batch) error {
+	if b.Count() > 0 && len(b.data) > record.RECORD_MAX_SIZE {
+		return record.ErrTooLarge
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		return ErrClosed
+	}
+	if b.Count() == 0 {
+		return nil
+	}
+
+	for r := b.reader(); g.opts.MergeOperator == nil; {
+		kind, _, _, ok := r.next()
+		if !ok {
+			break
+		}
+		if kind == ikey.KindMerge {
+			return sseuda.ErrMergeUnsupported
+		}
+	}
+	w := &writer{b: b}
+	g.enqueue(w)
+	if w.done {
+		return w.err
+	}
+	if err := g.makeRoomForWrite(b); err != nil {
+		g.dequeue(1, nil)
+		return err
+	}
+
+	group := g.group()
+	seq := g.lastSeq + 1
+	for _, w := range group {
+		w.b.setSeq(seq)
+		seq += uint64(w.b.Count())
+	}
+	// Only the head of the queue writes the log or replaces the memtable, so both stay put
+	// while the lock is released for the I/O.
+	g.mu.Unlock()
+	err := g.logGroup(group)
+	g.mu.Lock()
+
+	if err == nil {
+		for _, w := range group {
+			if !g.mem.applyBatch(w.b) {
+				err = marena.ErrAllocationFailed // Unreachable: the memtable made room for the group.
+				break
+			}
+			g.lastSeq += uint64(w.b.Count())
+		}
+	}
+	// A failed append may leave a torn record in the log, which replay takes for its end, and a
+	// failed sync leaves unknown which earlier records are durable. Either error fails every
+	// later write, since the log can no longer acknowledge them.
+	if err != nil && g.bgErr == nil {
+		g.bgErr = err
+	}
+	g.dequeue(len(group), err)
+	return err
+}
+
+// logGroup appends the batches of `group` to the log and syncs it once for all of them. It
+// is called by the head of the commit queue, without the lock.
+func (g *DB) logGroup(group []*writer) error {
+	for _, w := range group {
+		if err := g.log.Append(w.b.data); err != nil {
+			return err
+		}
+	}
+	if g.opts.NoSync {
+		return nil
+	}
+	return g.log.Sync()
+}
+
+// NewIterator returns an iterator over the live keys of the database within `opts`, as of the
+// last write applied before the call. Later writes are invisible to it, even mid-scan.
+func (g *DB) NewIterator(opts *sseuda.IterOptions) (sseuda.Iterator, error) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	if g.closed {
+		return nil, ErrClosed
+	}
+	state := g.readState()
+	return state.newDBIter(&g.mu, func() { g.recycleReleased(state.mems) }, opts)
+}
+
+// NewSnapshot returns a consistent, read-only view of the database as of the last write
+// applied before the call.
+func (g *DB) NewSnapshot() (sseuda.Snapshot, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		return nil, ErrClosed
+	}
+	return g.newSnapshot(g.readState()), nil
+}
+
+// Close stops the background flush, waits for running compactions, syncs and closes the
+// write-ahead log, and closes every table. Memtables that were not flushed yet are recovered
+// from the log by the next Open.
+// The chains of the memtables go back to the arena pool, except for those that open iterators
+// or snapshots still reference: they follow once the last of those is closed. Such iterators
+// and snapshots must not be used to read tables after Close.
+func (g *DB) Close() error {
+	g.mu.Lock()
+	if g.closed {
+		g.mu.Unlock()
+		return ErrClosed
+	}
+	g.closed = true
+	close(g.flushCh)
+	g.cond.Broadcast()
+	g.mu.Unlock()
+	<-g.flushDone
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for g.compactions > 0 {
+		g.cond.Wait()
+	}
+	// Wait for the group commit in progress; the writers queued behind it find the DB closed.
+	w := &writer{}
+	g.enqueue(w)
+	defer g.dequeue(1, nil)
+	g.releaseMemTables()
+	g.tableCache.close()
+	g.blobCache.close()
+	err := g.log.Close()
+	if vsErr := g.vs.Close(); err == nil {
+		err = vsErr
+	}
+	return err
+}
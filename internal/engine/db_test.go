@@ -0,0 +1,2168 @@
+package engine
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"maps"
+	"math/rand/v2"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gosuda.org/sseuda"
+	"gosuda.org/sseuda/internal/bounds"
+	"gosuda.org/sseuda/internal/cache"
+	"gosuda.org/sseuda/internal/ikey"
+	"gosuda.org/sseuda/internal/manifest"
+	"gosuda.org/sseuda/internal/oldsepia/marena"
+	"gosuda.org/sseuda/internal/wal"
+)
+
+func openDB(t *testing.T, dir string, opts *Options) *DB {
+	t.Helper()
+	db, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// scan returns every key-value pair visible through `iter`, in order,
+// or the error that prevented creating it.
+func scan(iter sseuda.Iterator, err error) string {
+	if err != nil {
+		return "error: " + err.Error()
+	}
+	defer iter.Close()
+	var out []string
+	for valid := iter.First(); valid; valid = iter.Next() {
+		out = append(out, string(iter.Key())+"="+string(iter.Value()))
+	}
+	return fmt.Sprint(out)
+}
+
+func mustGet(t *testing.T, r interface{ Get([]byte) ([]byte, error) }, key, want string) {
+	t.Helper()
+	got, err := r.Get([]byte(key))
+	if want == "" {
+		if !errors.Is(err, sseuda.ErrNotFound) {
+			t.Fatalf("Get(%s) = %q, %v; want ErrNotFound", key, got, err)
+		}
+		return
+	}
+	if err != nil || string(got) != want {
+		t.Fatalf("Get(%s) = %q, %v; want %s", key, got, err, want)
+	}
+}
+
+// TestDBReadWrite verifies point operations, range deletions and iteration on an open database.
+func TestDBReadWrite(t *testing.T) {
+	db := openDB(t, t.TempDir(), &Options{NoSync: true})
+	defer db.Close()
+
+	for i := 0; i < 10; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("k%d", i)), []byte(fmt.Sprintf("v%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete([]byte("k1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteRange([]byte("k4"), []byte("k8")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("k5"), []byte("again")); err != nil {
+		t.Fatal(err)
+	}
+
+	mustGet(t, db, "k0", "v0")
+	mustGet(t, db, "k1", "")
+	mustGet(t, db, "k4", "")
+	mustGet(t, db, "k5", "again")
+	mustGet(t, db, "k8", "v8")
+
+	got := scan(db.NewIterator(nil))
+	if want := "[k0=v0 k2=v2 k3=v3 k5=again k8=v8 k9=v9]"; got != want {
+		t.Fatalf("scan = %s, want %s", got, want)
+	}
+}
+
+// TestDBRecovery verifies that every acknowledged write is replayed from the log on reopen.
+func TestDBRecovery(t *testing.T) {
+	dir := t.TempDir()
+	opts := &Options{WALSegmentSize: 512}
+
+	db := openDB(t, dir, opts)
+	for i := 0; i < 100; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("value%03d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 100; i += 2 {
+		if err := db.Delete([]byte(fmt.Sprintf("key%03d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for reopen := 0; reopen < 2; reopen++ {
+		db = openDB(t, dir, opts)
+		for i := 0; i < 100; i++ {
+			want := ""
+			if i%2 == 1 {
+				want = fmt.Sprintf("value%03d", i)
+			}
+			mustGet(t, db, fmt.Sprintf("key%03d", i), want)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestDBTornWrite verifies that a write torn by a crash is dropped on recovery
+// while every earlier write survives.
+func TestDBTornWrite(t *testing.T) {
+	dir := t.TempDir()
+	db := openDB(t, dir, nil)
+	if err := db.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("b"), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	segments, err := wal.ListSegments(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := wal.SegmentFilename(dir, segments[len(segments)-1])
+	info, err := os.Stat(last)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(last, info.Size()-1); err != nil {
+		t.Fatal(err)
+	}
+
+	db = openDB(t, dir, nil)
+	defer db.Close()
+	mustGet(t, db, "a", "1")
+	mustGet(t, db, "b", "")
+}
+
+// TestDBFailedAppend verifies that a write the log fails to append fails every later write,
+// even once the log works again, rather than acknowledging writes that recovery would drop
+// after the torn record a failed append may leave, and that reopening recovers every
+// acknowledged write.
+func TestDBFailedAppend(t *testing.T) {
+	dir := t.TempDir()
+	db := openDB(t, dir, nil)
+	defer func() { db.Close() }()
+	if err := db.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Close the segment under the log, so that the next append fails.
+	db.mu.Lock()
+	err := db.log.Close()
+	db.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Put([]byte("b"), []byte("2"))
+	if !errors.Is(err, os.ErrClosed) {
+		t.Fatalf("Put with a failing log: %v, want os.ErrClosed", err)
+	}
+
+	// Move to a working log, as a rotation would.
+	db.mu.Lock()
+	db.log, err = wal.Create(dir, db.vs.NewFileNum(), wal.Options{NewFileNum: db.vs.NewFileNum})
+	db.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("c"), []byte("3")); !errors.Is(err, os.ErrClosed) {
+		t.Fatalf("Put after a failed append: %v, want the append's error", err)
+	}
+	mustGet(t, db, "a", "1")
+	mustGet(t, db, "b", "")
+	db.Close()
+
+	db = openDB(t, dir, nil)
+	mustGet(t, db, "a", "1")
+	mustGet(t, db, "b", "")
+	if err := db.Put([]byte("d"), []byte("4")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db = openDB(t, dir, nil)
+	if got, want := scan(db.NewIterator(nil)), "[a=1 d=4]"; got != want {
+		t.Fatalf("scan after recovery = %s, want %s", got, want)
+	}
+}
+
+// TestDBFailedRotate verifies that a log that fails to move to a new segment fails every later
+// write, and that reopening recovers the writes logged before.
+func TestDBFailedRotate(t *testing.T) {
+	dir := t.TempDir()
+	db := openDB(t, dir, nil)
+	defer func() { db.Close() }()
+	if err := db.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Take the file name of the next segment, so that creating it fails.
+	db.mu.Lock()
+	taken := wal.SegmentFilename(dir, db.vs.NewFileNum()+1)
+	db.mu.Unlock()
+	if err := os.WriteFile(taken, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	err := db.Flush()
+	if !errors.Is(err, os.ErrExist) {
+		t.Fatalf("Flush with a taken segment name: %v, want os.ErrExist", err)
+	}
+	if err := os.Remove(taken); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("b"), []byte("2")); !errors.Is(err, os.ErrExist) {
+		t.Fatalf("Put after a failed rotation: %v, want the rotation's error", err)
+	}
+	db.Close()
+
+	db = openDB(t, dir, nil)
+	if got, want := scan(db.NewIterator(nil)), "[a=1]"; got != want {
+		t.Fatalf("scan after recovery = %s, want %s", got, want)
+	}
+}
+
+// TestDBGroupCommit verifies that concurrent writes, committed in groups that share a log
+// sync, are each applied once with distinct sequence numbers and survive reopening, across
+// memtable rotations and a concurrent Flush.
+func TestDBGroupCommit(t *testing.T) {
+	dir := t.TempDir()
+	db := openDB(t, dir, &Options{MemTableSize: 64 << 10, L0CompactionThreshold: 100})
+	const writers, n = 8, 200
+	var wg sync.WaitGroup
+	errs := make(chan error, writers+1)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				if err := db.Put([]byte(fmt.Sprintf("w%d-key%04d", w, i)), []byte(fmt.Sprintf("value%04d", i))); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := db.Flush(); err != nil {
+			errs <- err
+		}
+	}()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	db.mu.RLock()
+	lastSeq := db.lastSeq
+	db.mu.RUnlock()
+	if lastSeq != writers*n {
+		t.Fatalf("lastSeq = %d, want %d", lastSeq, writers*n)
+	}
+
+	check := func() {
+		t.Helper()
+		for w := 0; w < writers; w++ {
+			for i := 0; i < n; i += 17 {
+				mustGet(t, db, fmt.Sprintf("w%d-key%04d", w, i), fmt.Sprintf("value%04d", i))
+			}
+		}
+	}
+	check()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db = openDB(t, dir, nil)
+	defer db.Close()
+	check()
+}
+
+// TestDBTornBatch verifies that a batch torn by a crash is dropped as a whole on recovery,
+// and that a batch takes consecutive sequence numbers.
+func TestDBTornBatch(t *testing.T) {
+	dir := t.TempDir()
+	db := openDB(t, dir, nil)
+	if err := db.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	b := db.NewBatch()
+	for i := 0; i < 10; i++ {
+		b.Put([]byte(fmt.Sprintf("b%d", i)), []byte("2"))
+	}
+	b.Delete([]byte("a"))
+	if err := db.Apply(b); err != nil {
+		t.Fatal(err)
+	}
+	if db.lastSeq != 12 {
+		t.Fatalf("lastSeq = %d, want 12", db.lastSeq)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	segments, err := wal.ListSegments(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := wal.SegmentFilename(dir, segments[len(segments)-1])
+	info, err := os.Stat(last)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(last, info.Size()-1); err != nil {
+		t.Fatal(err)
+	}
+
+	db = openDB(t, dir, nil)
+	defer db.Close()
+	got := scan(db.NewIterator(nil))
+	if want := "[a=1]"; got != want {
+		t.Fatalf("scan = %s, want %s", got, want)
+	}
+}
+
+// TestDBMemTableFull verifies that a write which cannot fit is rejected without being logged.
+func TestDBMemTableFull(t *testing.T) {
+	dir := t.TempDir()
+	db := openDB(t, dir, &Options{MemTableSize: 1 << 16})
+	if err := db.Put([]byte("big"), make([]byte, 1<<16)); err == nil {
+		t.Fatal("expected oversized write to fail")
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db = openDB(t, dir, &Options{MemTableSize: 1 << 16})
+	defer db.Close()
+	mustGet(t, db, "big", "")
+}
+
+// TestDBSnapshot verifies that a snapshot is unaffected by later writes.
+func TestDBSnapshot(t *testing.T) {
+	db := openDB(t, t.TempDir(), &Options{NoSync: true})
+	defer db.Close()
+	if err := db.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	snap, err := db.NewSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Close()
+
+	if err := db.Put([]byte("a"), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("b"), []byte("3")); err != nil {
+		t.Fatal(err)
+	}
+
+	mustGet(t, snap, "a", "1")
+	mustGet(t, snap, "b", "")
+	if got, want := scan(snap.NewIterator(nil)), "[a=1]"; got != want {
+		t.Fatalf("snapshot scan = %s, want %s", got, want)
+	}
+}
+
+// TestDBFlush verifies that full memtables are rotated and flushed to tables, that the
+// flushed log segments are deleted, and that deletions in newer sources shadow older tables.
+func TestDBFlush(t *testing.T) {
+	dir := t.TempDir()
+	opts := &Options{MemTableSize: 64 << 10, L0CompactionThreshold: 100, NoSync: true}
+	db := openDB(t, dir, opts)
+
+	const n = 3000
+	for i := 0; i < n; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("key%05d", i)), []byte(fmt.Sprintf("value%05d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < n; i += 3 {
+		if err := db.Delete([]byte(fmt.Sprintf("key%05d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	db.mu.RLock()
+	v := db.vs.Current()
+	numTables, numImm := len(v.Levels[0]), len(db.imm)
+	v.DecRef()
+	db.mu.RUnlock()
+	if numTables < 2 || numImm != 0 {
+		t.Fatalf("after Flush: %d tables and %d immutable memtables", numTables, numImm)
+	}
+	segments, err := wal.ListSegments(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 1 {
+		t.Fatalf("expected only the current log segment to remain, found %v", segments)
+	}
+
+	check := func(db *DB) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			want := fmt.Sprintf("value%05d", i)
+			if i%3 == 0 {
+				want = ""
+			}
+			mustGet(t, db, fmt.Sprintf("key%05d", i), want)
+		}
+
+		iter, err := db.NewIterator(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer iter.Close()
+		i := 1000
+		for valid := iter.Seek([]byte("key01000")); valid; valid = iter.Next() {
+			if i%3 == 0 {
+				i++
+			}
+			if want := fmt.Sprintf("key%05d", i); string(iter.Key()) != want {
+				t.Fatalf("iteration: got %s, want %s", iter.Key(), want)
+			}
+			i++
+		}
+		if i != n {
+			t.Fatalf("iteration stopped before key%05d", i)
+		}
+	}
+	check(db)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db = openDB(t, dir, opts)
+	defer db.Close()
+	check(db)
+}
+
+// TestDBMemTableRelease verifies that a flushed memtable is released only after the
+// iterators reading it have been closed, and that its chain is then reused.
+func TestDBMemTableRelease(t *testing.T) {
+	pool := marena.NewArenaPool(&marena.ArenaPoolOptions{})
+	defer pool.Close()
+	db := openDB(t, t.TempDir(), &Options{ArenaPool: pool, NoSync: true})
+	defer db.Close()
+
+	if err := db.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	iter, err := db.NewIterator(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.mu.RLock()
+	mem := db.mem
+	db.mu.RUnlock()
+
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	recycleChains(db)
+	if mem.released() {
+		t.Fatal("memtable released while an iterator still references it")
+	}
+	if !iter.First() || string(iter.Value()) != "1" {
+		t.Fatal("iterator lost access to the flushed memtable")
+	}
+
+	iter.Close()
+	if !mem.released() {
+		t.Fatalf("memtable not released after its last iterator closed: refcount %d", mem.skl.RefCount())
+	}
+	waitFor(t, func() bool { return db.opts.ArenaPool.Free() == 1 })
+	chain, err := db.opts.ArenaPool.Get(db.opts.MemTableSize, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chain != mem.chain || chain.Chunks() != 1 || chain.Used() != marena.ARENA_MIN_ADDRESS {
+		t.Fatal("released chain was not reset and kept for reuse")
+	}
+	db.opts.ArenaPool.Put(chain)
+}
+
+// TestDBCloseReleasedChains verifies that the chain of a memtable that an iterator and a
+// snapshot still reference when the database closes goes back to the pool once both are closed.
+func TestDBCloseReleasedChains(t *testing.T) {
+	pool := marena.NewArenaPool(&marena.ArenaPoolOptions{})
+	defer pool.Close()
+	db := openDB(t, t.TempDir(), &Options{ArenaPool: pool, NoSync: true})
+	if err := db.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	iter, err := db.NewIterator(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap, err := db.NewSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem := db.mem
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	iter.Close()
+	if mem.released() || pool.Free() != 0 {
+		t.Fatal("chain returned while a snapshot still references its memtable")
+	}
+	snap.Close()
+	waitFor(t, func() bool { return pool.Free() == 1 })
+	if pool.Allocated() != pool.ChunkSize() {
+		t.Errorf("Allocated() = %d, want only the reset chain", pool.Allocated())
+	}
+}
+
+// recycleChains hands the chains of the released memtables of `db` back to its pool.
+func recycleChains(db *DB) {
+	db.mu.Lock()
+	db.recycleChains()
+	db.mu.Unlock()
+}
+
+// waitFor polls `cond` until it holds, failing the test if it does not within a few seconds.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+	}
+}
+
+// TestDBMemTableMmap verifies that memtables in mapped chains serve reads across rotations,
+// that a chain stays mapped while an iterator references its memtable, and that the chains
+// of released memtables are recycled or released, not left for the garbage collector.
+func TestDBMemTableMmap(t *testing.T) {
+	pool := marena.NewArenaPool(&marena.ArenaPoolOptions{})
+	defer pool.Close()
+	db, err := Open(t.TempDir(), &Options{ArenaPool: pool, MemTableMmap: true, MemTableSize: 32 << 10, L0CompactionThreshold: 100, NoSync: true})
+	if errors.Is(err, marena.ErrMmapUnsupported) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Put([]byte("key00000"), []byte("value00000")); err != nil {
+		t.Fatal(err)
+	}
+	iter, err := db.NewIterator(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.mu.RLock()
+	first := db.mem
+	db.mu.RUnlock()
+
+	const n = 2000
+	for i := 1; i < n; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("key%05d", i)), []byte(fmt.Sprintf("value%05d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	recycleChains(db)
+	if first.chain.Chunks() == 0 {
+		t.Fatal("chain released while an iterator still references its memtable")
+	}
+	if !iter.First() || string(iter.Value()) != "value00000" || iter.Next() {
+		t.Fatal("iterator lost access to the flushed memtable")
+	}
+	iter.Close()
+
+	recycleChains(db)
+	if allocated := db.opts.ArenaPool.Allocated(); allocated > max(db.opts.MemTableSize, db.opts.ArenaPool.ChunkSize())+db.opts.ArenaPool.ChunkSize() {
+		t.Errorf("%d bytes of chains allocated, want at most the memtable's and a spare", allocated)
+	}
+	for i := 0; i < n; i += 97 {
+		mustGet(t, db, fmt.Sprintf("key%05d", i), fmt.Sprintf("value%05d", i))
+	}
+	if got := scan(db.NewIterator(&sseuda.IterOptions{LowerBound: []byte("key01998")})); got != "[key01998=value01998 key01999=value01999]" {
+		t.Errorf("scan = %s", got)
+	}
+
+	mem := db.mem
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	pool.Close()
+	waitFor(t, func() bool { return pool.Allocated() == 0 })
+	if mem.chain.Chunks() != 0 {
+		t.Error("closing the pool did not release the chain of the memtable")
+	}
+}
+
+// TestDBArenaPoolBudget verifies that databases sharing an arena pool stall, rather than fail,
+// while their memtables have spent its budget, and never allocate beyond it.
+func TestDBArenaPoolBudget(t *testing.T) {
+	const memTableSize = 2 * marena.ARENA_PAGESIZE
+	const budget = 3 * memTableSize
+	pool := marena.NewArenaPool(&marena.ArenaPoolOptions{ChunkSize: marena.ARENA_PAGESIZE, Budget: budget})
+	defer pool.Close()
+
+	const n = 2000
+	dbs := make([]*DB, 2)
+	for i := range dbs {
+		dbs[i] = openDB(t, t.TempDir(), &Options{ArenaPool: pool, MemTableSize: memTableSize, L0CompactionThreshold: 100, NoSync: true})
+	}
+	errs := make(chan error, len(dbs))
+	for _, db := range dbs {
+		go func() {
+			for i := 0; i < n; i++ {
+				if err := db.Put([]byte(fmt.Sprintf("key%05d", i)), []byte(fmt.Sprintf("value%05d", i))); err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}()
+	}
+	for range dbs {
+		for done := false; !done; {
+			select {
+			case err := <-errs:
+				if err != nil {
+					t.Fatal(err)
+				}
+				done = true
+			default:
+				if allocated := pool.Allocated(); allocated > budget {
+					t.Fatalf("%d bytes of chains allocated, beyond the budget", allocated)
+				}
+			}
+		}
+	}
+
+	for _, db := range dbs {
+		for i := 0; i < n; i += 97 {
+			mustGet(t, db, fmt.Sprintf("key%05d", i), fmt.Sprintf("value%05d", i))
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, func() bool { return pool.Allocated() == int64(pool.Free())*pool.ChunkSize() })
+}
+
+// TestDBMemTableChain verifies that a memtable grows its chain past the first chunk, both for
+// a value larger than that chunk and for a batch larger than any one chunk, and that the
+// writes stay readable across reopening, which replays them, and after a flush.
+func TestDBMemTableChain(t *testing.T) {
+	dir := t.TempDir()
+	opts := &Options{MemTableSize: 8 << 20, NoSync: true}
+	db := openDB(t, dir, opts)
+	large := bytes.Repeat([]byte{'b'}, int(db.opts.ArenaPool.ChunkSize())+1)
+	if err := db.Put([]byte("large"), large); err != nil {
+		t.Fatal(err)
+	}
+	const n = 3000
+	value := func(i int) string { return fmt.Sprintf("value%05d%s", i, bytes.Repeat([]byte{'v'}, 1000)) }
+	b := db.NewBatch()
+	for i := 0; i < n; i++ {
+		b.Put([]byte(fmt.Sprintf("key%05d", i)), []byte(value(i)))
+	}
+	if err := db.Apply(b); err != nil {
+		t.Fatal(err)
+	}
+
+	db.mu.RLock()
+	mem, imm := db.mem, len(db.imm)
+	db.mu.RUnlock()
+	if imm != 0 {
+		t.Fatalf("%d memtables rotated, want the writes to fit in the first one", imm)
+	}
+	if chunks := mem.chain.Chunks(); chunks < 3 {
+		t.Fatalf("Chunks() = %d, want the memtable to span several chunks", chunks)
+	}
+	if used := mem.used(); used > opts.MemTableSize {
+		t.Fatalf("used() = %d, beyond MemTableSize", used)
+	}
+	check := func() {
+		t.Helper()
+		mustGet(t, db, "large", string(large))
+		iter, err := db.NewIterator(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer iter.Close()
+		i := 0
+		for valid := iter.First(); valid && i < n; valid = iter.Next() {
+			if key := fmt.Sprintf("key%05d", i); string(iter.Key()) != key || string(iter.Value()) != value(i) {
+				t.Fatalf("entry %d = %s, want %s", i, iter.Key(), key)
+			}
+			i++
+		}
+		if i != n || !iter.Valid() || string(iter.Key()) != "large" {
+			t.Fatalf("iterated %d keys before large, want %d", i, n)
+		}
+	}
+	check()
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db = openDB(t, dir, opts)
+	defer db.Close()
+	check()
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	check()
+}
+
+// TestDBVersionPinning verifies that a table dropped from the current version is deleted only
+// once the iterators reading it are closed, and that Open removes tables the manifest never
+// recorded.
+func TestDBVersionPinning(t *testing.T) {
+	dir := t.TempDir()
+	db := openDB(t, dir, &Options{NoSync: true})
+	defer db.Close()
+
+	if err := db.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	iter, err := db.NewIterator(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.mu.Lock()
+	v := db.vs.Current()
+	f := v.Levels[0][0]
+	v.DecRef()
+	err = db.vs.LogAndApply(&manifest.VersionEdit{DeletedFiles: []manifest.DeletedFile{{Level: 0, FileNum: f.FileNum}}})
+	db.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.deleteObsoleteTables(); err != nil {
+		t.Fatal(err)
+	}
+	if got := scan(iter, nil); got != "[a=1]" {
+		t.Fatalf("pinned iterator: got %s", got)
+	}
+	if err := db.deleteObsoleteTables(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(tableFilename(dir, f.FileNum)); !os.IsNotExist(err) {
+		t.Fatalf("table %d not deleted after its last iterator closed: %v", f.FileNum, err)
+	}
+	mustGet(t, db, "a", "")
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	stray := tableFilename(dir, 1000)
+	if err := os.WriteFile(stray, []byte("unrecorded"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	db = openDB(t, dir, &Options{NoSync: true})
+	defer db.Close()
+	if _, err := os.Stat(stray); !os.IsNotExist(err) {
+		t.Fatalf("unrecorded table survived Open: %v", err)
+	}
+}
+
+// waitForCompactions blocks until no compaction is running or needed.
+func waitForCompactions(db *DB) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for db.compactions > 0 {
+		db.cond.Wait()
+	}
+}
+
+// TestDBCompaction verifies that compactions keep every level within its targets while
+// preserving the newest value of every key, across a reopen.
+func TestDBCompaction(t *testing.T) {
+	dir := t.TempDir()
+	opts := &Options{
+		MemTableSize:             32 << 10,
+		L0CompactionThreshold:    2,
+		LBaseMaxBytes:            32 << 10,
+		LevelMultiplier:          4,
+		TargetFileSize:           8 << 10,
+		MaxConcurrentCompactions: 3,
+		NoSync:                   true,
+	}
+	db := openDB(t, dir, opts)
+
+	const n = 3000
+	want := make(map[string]string)
+	for round := 0; round < 4; round++ {
+		for i := 0; i < n; i++ {
+			key := fmt.Sprintf("key%05d", (i*7919+round*13)%n)
+			switch {
+			case (i+round)%5 == 0:
+				if err := db.Delete([]byte(key)); err != nil {
+					t.Fatal(err)
+				}
+				delete(want, key)
+			default:
+				value := fmt.Sprintf("value%d-%05d", round, i)
+				if err := db.Put([]byte(key), []byte(value)); err != nil {
+					t.Fatal(err)
+				}
+				want[key] = value
+			}
+		}
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	waitForCompactions(db)
+
+	check := func(db *DB) {
+		t.Helper()
+		v := db.vs.Current()
+		defer v.DecRef()
+		if len(v.Levels[0]) >= opts.L0CompactionThreshold {
+			t.Fatalf("level 0 holds %d tables after compacting", len(v.Levels[0]))
+		}
+		deepest := 0
+		for level := 1; level < len(v.Levels); level++ {
+			if len(v.Levels[level]) > 0 {
+				deepest = level
+			}
+			if level < len(v.Levels)-1 && db.levelScore(v, level) >= 1 {
+				t.Fatalf("level %d over its size target after compacting", level)
+			}
+		}
+		if deepest < 2 {
+			t.Fatalf("expected data to reach level 2, deepest level is %d", deepest)
+		}
+
+		for i := 0; i < n; i++ {
+			key := fmt.Sprintf("key%05d", i)
+			mustGet(t, db, key, want[key])
+		}
+		iter, err := db.NewIterator(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		count := 0
+		for valid := iter.First(); valid; valid = iter.Next() {
+			if want[string(iter.Key())] != string(iter.Value()) {
+				t.Fatalf("iteration: %s=%s, want %s", iter.Key(), iter.Value(), want[string(iter.Key())])
+			}
+			count++
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if count != len(want) {
+			t.Fatalf("iteration: got %d keys, want %d", count, len(want))
+		}
+	}
+	check(db)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db = openDB(t, dir, opts)
+	defer db.Close()
+	check(db)
+	tables, err := listFiles(dir, tableExt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := db.vs.Current()
+	defer v.DecRef()
+	if len(tables) != v.NumFiles() {
+		t.Fatalf("%d table files on disk for %d live tables", len(tables), v.NumFiles())
+	}
+}
+
+// TestDBCompactionDropsTombstones verifies that deletions compacted into the bottom of the
+// tree are dropped along with the entries they hide.
+func TestDBCompactionDropsTombstones(t *testing.T) {
+	db := openDB(t, t.TempDir(), &Options{L0CompactionThreshold: 2, NoSync: true})
+	defer db.Close()
+
+	for _, kind := range []ikey.Kind{ikey.KindSet, ikey.KindDelete} {
+		for i := 0; i < 100; i++ {
+			key := []byte(fmt.Sprintf("key%03d", i))
+			var err error
+			if kind == ikey.KindSet {
+				err = db.Put(key, []byte("value"))
+			} else {
+				err = db.Delete(key)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForCompactions(db)
+
+	v := db.vs.Current()
+	defer v.DecRef()
+	if v.NumFiles() != 0 {
+		t.Fatalf("expected every entry to be compacted away, %d tables remain", v.NumFiles())
+	}
+	if got := scan(db.NewIterator(nil)); got != "[]" {
+		t.Fatalf("scan after compaction: %s", got)
+	}
+}
+
+// TestDBIteratorSequence verifies that an iterator reads at the sequence number it was
+// created at: writes made during the scan, including overwrites and deletions of keys it has
+// yet to reach, are invisible to it.
+func TestDBIteratorSequence(t *testing.T) {
+	dir := t.TempDir()
+	db := openDB(t, dir, &Options{NoSync: true})
+	defer db.Close()
+
+	for _, key := range []string{"a", "b", "c", "d"} {
+		if err := db.Put([]byte(key), []byte("old")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	iter, err := db.NewIterator(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer iter.Close()
+
+	var got []string
+	for valid := iter.First(); valid; valid = iter.Next() {
+		got = append(got, string(iter.Key())+"="+string(iter.Value()))
+		if len(got) == 1 {
+			db.Put([]byte("c"), []byte("new"))
+			db.Delete([]byte("d"))
+			db.Put([]byte("bb"), []byte("new"))
+			if err := db.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if want := "[a=old b=old c=old d=old]"; fmt.Sprint(got) != want {
+		t.Fatalf("scan during writes: got %s, want %s", got, want)
+	}
+	if got, want := scan(db.NewIterator(nil)), "[a=old b=old bb=new c=new]"; got != want {
+		t.Fatalf("scan after writes: got %s, want %s", got, want)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db = openDB(t, dir, &Options{NoSync: true})
+	defer db.Close()
+	if err := db.Put([]byte("e"), []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := scan(db.NewIterator(nil)), "[a=old b=old bb=new c=new e=new]"; got != want {
+		t.Fatalf("scan after reopen: got %s, want %s", got, want)
+	}
+}
+
+// TestDBSnapshotCompaction verifies that a snapshot keeps reading the values it was taken
+// with across flushes and compactions, and that compactions keep the versions it can see
+// in the tables they write.
+func TestDBSnapshotCompaction(t *testing.T) {
+	db := openDB(t, t.TempDir(), &Options{L0CompactionThreshold: 2, NoSync: true})
+	defer db.Close()
+
+	write := func(value string) {
+		t.Helper()
+		for i := 0; i < 100; i++ {
+			key := []byte(fmt.Sprintf("key%03d", i))
+			var err error
+			if value == "" && i%3 == 0 {
+				err = db.Delete(key)
+			} else {
+				err = db.Put(key, []byte(fmt.Sprintf("%s%03d", value, i)))
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		waitForCompactions(db)
+	}
+	write("old")
+	snap, err := db.NewSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapSeq := snap.(*snapshot).state.seq
+	oldTable := snap.(*snapshot).state.version.Levels[0][0].FileNum
+	write("")
+	write("new")
+
+	// Read at the snapshot's sequence number through the current version, where the values
+	// the snapshot sees only survive in tables written by compactions.
+	db.mu.RLock()
+	state := db.readState()
+	db.mu.RUnlock()
+	for _, files := range state.version.Levels {
+		for _, f := range files {
+			if f.FileNum == oldTable {
+				t.Fatalf("table %d was not compacted", oldTable)
+			}
+		}
+	}
+	state.seq = snapSeq
+	stale := &snapshot{db: db, state: state}
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%03d", i)
+		mustGet(t, snap, key, fmt.Sprintf("old%03d", i))
+		mustGet(t, stale, key, fmt.Sprintf("old%03d", i))
+		mustGet(t, db, key, fmt.Sprintf("new%03d", i))
+	}
+	state.unref()
+	if err := snap.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := snap.Get([]byte("key000")); err != ErrClosed {
+		t.Fatalf("Get on a closed snapshot: %v", err)
+	}
+
+	// Without the snapshot, the next compaction keeps only the newest versions.
+	write("newer")
+	write("newest")
+	db.mu.RLock()
+	state = db.readState()
+	db.mu.RUnlock()
+	defer state.unref()
+	state.seq = snapSeq
+	stale = &snapshot{db: db, state: state}
+	for i := 0; i < 100; i++ {
+		mustGet(t, stale, fmt.Sprintf("key%03d", i), "")
+	}
+}
+
+// TestDBIteratorReverse compares backward iteration and SeekLT/SeekLE against a model, over
+// versions spread across memtables and tables and as of an older snapshot.
+func TestDBIteratorReverse(t *testing.T) {
+	db := openDB(t, t.TempDir(), &Options{NoSync: true})
+	defer db.Close()
+
+	rng := rand.New(rand.NewPCG(1, 2))
+	model := make(map[string]string)
+	var snap sseuda.Snapshot
+	var snapModel []string
+	live := func() []string {
+		var pairs []string
+		for key, value := range model {
+			pairs = append(pairs, key+"="+value)
+		}
+		slices.Sort(pairs)
+		return pairs
+	}
+	for round := 0; round < 6; round++ {
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("k%03d", rng.IntN(150))
+			if rng.IntN(3) == 0 {
+				if err := db.Delete([]byte(key)); err != nil {
+					t.Fatal(err)
+				}
+				delete(model, key)
+				continue
+			}
+			value := fmt.Sprintf("v%d.%d", round, i)
+			if err := db.Put([]byte(key), []byte(value)); err != nil {
+				t.Fatal(err)
+			}
+			model[key] = value
+		}
+		if round == 2 {
+			var err error
+			if snap, err = db.NewSnapshot(); err != nil {
+				t.Fatal(err)
+			}
+			defer snap.Close()
+			snapModel = live()
+		}
+		if round < 5 {
+			if err := db.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	check := func(name string, newIter func(*sseuda.IterOptions) (sseuda.Iterator, error), want []string) {
+		iter, err := newIter(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer iter.Close()
+
+		var got []string
+		for valid := iter.Last(); valid; valid = iter.Prev() {
+			got = append(got, string(iter.Key())+"="+string(iter.Value()))
+		}
+		slices.Reverse(got)
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("%s: backward scan:\ngot  %v\nwant %v", name, got, want)
+		}
+
+		for i := 0; i < 100; i++ {
+			target := fmt.Sprintf("k%03d", rng.IntN(160))
+			n, found := slices.BinarySearchFunc(want, target, func(pair, key string) int {
+				return strings.Compare(strings.SplitN(pair, "=", 2)[0], key)
+			})
+			check := func(op string, valid bool, index int) {
+				t.Helper()
+				if index < 0 {
+					if valid {
+						t.Fatalf("%s: %s(%s) landed on %s, want invalid", name, op, target, iter.Key())
+					}
+					return
+				}
+				if !valid || string(iter.Key())+"="+string(iter.Value()) != want[index] {
+					t.Fatalf("%s: %s(%s) = %s (valid=%v), want %s", name, op, target, iter.Key(), valid, want[index])
+				}
+			}
+			check("SeekLT", iter.SeekLT([]byte(target)), n-1)
+			le := n - 1
+			if found {
+				le = n
+			}
+			check("SeekLE", iter.SeekLE([]byte(target)), le)
+			if le >= 0 && le+1 < len(want) {
+				check("Next after SeekLE", iter.Next(), le+1)
+				check("Prev after Next", iter.Prev(), le)
+			}
+		}
+	}
+	check("db", db.NewIterator, live())
+	check("snapshot", snap.NewIterator, snapModel)
+}
+
+// TestDBIteratorBounds verifies bounded and prefix iteration over memtables and tables, and
+// that tables outside the bounds are never opened.
+func TestDBIteratorBounds(t *testing.T) {
+	dir := t.TempDir()
+	opts := &Options{NoSync: true, L0CompactionThreshold: 100}
+	db := openDB(t, dir, opts)
+	for _, prefix := range []string{"a", "b", "c", "d"} {
+		for i := 0; i < 10; i++ {
+			if err := db.Put([]byte(fmt.Sprintf("%s%d", prefix, i)), []byte(prefix)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db = openDB(t, dir, opts)
+	defer db.Close()
+	if err := db.Put([]byte("b35"), []byte("mem")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete([]byte("b4")); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := func(iter sseuda.Iterator, err error) string {
+		if err != nil {
+			return "error: " + err.Error()
+		}
+		defer iter.Close()
+		var forward, backward []string
+		for valid := iter.First(); valid; valid = iter.Next() {
+			forward = append(forward, string(iter.Key()))
+		}
+		for valid := iter.Last(); valid; valid = iter.Prev() {
+			backward = append(backward, string(iter.Key()))
+		}
+		slices.Reverse(backward)
+		if fmt.Sprint(forward) != fmt.Sprint(backward) {
+			return fmt.Sprintf("forward %v != backward %v", forward, backward)
+		}
+		return fmt.Sprint(forward)
+	}
+
+	got := keys(db.NewIterator(&sseuda.IterOptions{LowerBound: []byte("b3"), UpperBound: []byte("b6")}))
+	if want := "[b3 b35 b5]"; got != want {
+		t.Fatalf("bounded scan: got %s, want %s", got, want)
+	}
+	if n := len(db.tableCache.tables); n != 1 {
+		t.Fatalf("bounded scan opened %d tables, want 1", n)
+	}
+	got = keys(db.NewIterator(&sseuda.IterOptions{Prefix: []byte("c")}))
+	if want := "[c0 c1 c2 c3 c4 c5 c6 c7 c8 c9]"; got != want {
+		t.Fatalf("prefix scan: got %s, want %s", got, want)
+	}
+	got = keys(db.NewIterator(&sseuda.IterOptions{Prefix: []byte("b3")}))
+	if want := "[b3 b35]"; got != want {
+		t.Fatalf("prefix scan: got %s, want %s", got, want)
+	}
+	got = keys(db.NewIterator(&sseuda.IterOptions{LowerBound: []byte("d9"), UpperBound: []byte("z")}))
+	if want := "[d9]"; got != want {
+		t.Fatalf("bounded scan at the end: got %s, want %s", got, want)
+	}
+}
+
+// TestDBGet verifies that Get returns the newest visible version across memtables and tables,
+// that a deletion in a newer source hides the versions in older ones, and that a key with no
+// visible version is not found even though a later key follows it.
+func TestDBGet(t *testing.T) {
+	db := openDB(t, t.TempDir(), &Options{NoSync: true, L0CompactionThreshold: 100})
+	defer db.Close()
+
+	steps := []func() error{
+		func() error { return db.Put([]byte("a"), []byte("1")) },
+		func() error { return db.Put([]byte("b"), []byte("1")) },
+		db.Flush,
+		func() error { return db.Delete([]byte("a")) },
+		func() error { return db.Put([]byte("b"), []byte("2")) },
+		db.Flush,
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mustGet(t, db, "a", "")
+	mustGet(t, db, "b", "2")
+	mustGet(t, db, "c", "")
+
+	if err := db.Put([]byte("a"), []byte("3")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete([]byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	mustGet(t, db, "a", "3")
+	mustGet(t, db, "b", "")
+
+	// A memtable lookup lands on the next user key when the key has no version visible to it.
+	if err := db.Put([]byte("ab"), []byte("4")); err != nil {
+		t.Fatal(err)
+	}
+	snap, err := db.NewSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Close()
+	if err := db.Put([]byte("aa"), []byte("5")); err != nil {
+		t.Fatal(err)
+	}
+	mustGet(t, snap, "aa", "")
+	mustGet(t, db, "aa", "5")
+}
+
+// checkModel verifies that `r` holds exactly the keys of `want`, through Get and through
+// iteration in both directions. Keys absent from `want` are looked up among `universe`.
+func checkModel(t *testing.T, r interface {
+	Get([]byte) ([]byte, error)
+	NewIterator(*sseuda.IterOptions) (sseuda.Iterator, error)
+}, universe []string, want map[string]string) {
+	t.Helper()
+	for _, key := range universe {
+		mustGet(t, r, key, want[key])
+	}
+	keys := make([]string, 0, len(want))
+	for key := range want {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	iter, err := r.NewIterator(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer iter.Close()
+	var forward, backward []string
+	for valid := iter.First(); valid; valid = iter.Next() {
+		if want[string(iter.Key())] != string(iter.Value()) {
+			t.Fatalf("iteration: %s=%s, want %q", iter.Key(), iter.Value(), want[string(iter.Key())])
+		}
+		forward = append(forward, string(iter.Key()))
+	}
+	for valid := iter.Last(); valid; valid = iter.Prev() {
+		if want[string(iter.Key())] != string(iter.Value()) {
+			t.Fatalf("reverse iteration: %s=%s, want %q", iter.Key(), iter.Value(), want[string(iter.Key())])
+		}
+		backward = append(backward, string(iter.Key()))
+	}
+	slices.Reverse(backward)
+	if !slices.Equal(forward, keys) || !slices.Equal(backward, keys) {
+		t.Fatalf("iteration: forward %v, backward %v, want %v", forward, backward, keys)
+	}
+}
+
+// tableCounts returns the number of entries and of range deletions in the tables of the
+// current version.
+func tableCounts(t *testing.T, db *DB) (entries, rangeDels uint64) {
+	t.Helper()
+	v := db.vs.Current()
+	defer v.DecRef()
+	for _, files := range v.Levels {
+		for _, f := range files {
+			tbl, err := db.tableCache.get(f.FileNum)
+			if err != nil {
+				t.Fatal(err)
+			}
+			props := tbl.reader.Properties()
+			entries += props.NumEntries
+			rangeDels += props.NumRangeDeletes
+		}
+	}
+	return entries, rangeDels
+}
+
+// TestDBDeleteRange verifies that a range deletion is a single tombstone that hides the keys
+// it covers from Get and iterators in the memtable, after a reopen and in tables, that a
+// snapshot older than it still sees them, and that compactions drop what it covers.
+func TestDBDeleteRange(t *testing.T) {
+	dir := t.TempDir()
+	opts := &Options{L0CompactionThreshold: 2, NoSync: true}
+	db := openDB(t, dir, opts)
+	defer func() { db.Close() }()
+
+	var universe []string
+	want := make(map[string]string)
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("key%03d", i)
+		universe = append(universe, key)
+		want[key] = "v1"
+		if err := db.Put([]byte(key), []byte("v1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	deleteRange := func(start, end int) {
+		t.Helper()
+		for i := start; i < end; i++ {
+			delete(want, fmt.Sprintf("key%03d", i))
+		}
+	}
+	if err := db.DeleteRange([]byte("key050"), []byte("key150")); err != nil {
+		t.Fatal(err)
+	}
+	deleteRange(50, 150)
+	if err := db.Put([]byte("key100"), []byte("v2")); err != nil {
+		t.Fatal(err)
+	}
+	want["key100"] = "v2"
+	b := db.NewBatch()
+	b.Put([]byte("key160"), []byte("v3"))
+	b.DeleteRange([]byte("key155"), []byte("key165"))
+	if err := db.Apply(b); err != nil {
+		t.Fatal(err)
+	}
+	deleteRange(155, 165)
+	if n := db.mem.entries; n != 4 {
+		t.Fatalf("memtable holds %d entries, want 4: each range deletion is one", n)
+	}
+	checkModel(t, db, universe, want)
+
+	// The range deletions are replayed from the log.
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db = openDB(t, dir, opts)
+	checkModel(t, db, universe, want)
+
+	snap, err := db.NewSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapWant := maps.Clone(want)
+	if err := db.DeleteRange([]byte("key000"), []byte("key010")); err != nil {
+		t.Fatal(err)
+	}
+	deleteRange(0, 10)
+	checkModel(t, db, universe, want)
+	checkModel(t, snap, universe, snapWant)
+
+	// The flush makes a second table in level 0, which is compacted into level 1. The snapshot
+	// keeps the keys of [key000, key010) alive, while the older range deletions drop theirs.
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	waitForCompactions(db)
+	checkModel(t, db, universe, want)
+	checkModel(t, snap, universe, snapWant)
+	if entries, rangeDels := tableCounts(t, db); entries != 91 || rangeDels != 1 {
+		t.Fatalf("tables hold %d entries and %d range deletions, want 91 and 1", entries, rangeDels)
+	}
+
+	// Without the snapshot, the next compaction drops the last range deletion too.
+	if err := snap.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"key005", "key006"} {
+		if err := db.Put([]byte(key), []byte("v4")); err != nil {
+			t.Fatal(err)
+		}
+		want[key] = "v4"
+		if err := db.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForCompactions(db)
+	checkModel(t, db, universe, want)
+	if entries, rangeDels := tableCounts(t, db); entries != 83 || rangeDels != 0 {
+		t.Fatalf("tables hold %d entries and %d range deletions, want 83 and 0", entries, rangeDels)
+	}
+}
+
+// TestDBDeleteRangeCompaction runs range deletions, deletions and writes against a model with
+// small tables, so that compactions split range deletions across their output tables.
+func TestDBDeleteRangeCompaction(t *testing.T) {
+	dir := t.TempDir()
+	opts := &Options{
+		MemTableSize:          32 << 10,
+		L0CompactionThreshold: 2,
+		LBaseMaxBytes:         16 << 10,
+		LevelMultiplier:       4,
+		TargetFileSize:        4 << 10,
+		NoSync:                true,
+	}
+	db := openDB(t, dir, opts)
+
+	const n = 2000
+	rng := rand.New(rand.NewPCG(1, 2))
+	var universe []string
+	for i := 0; i < n; i++ {
+		universe = append(universe, fmt.Sprintf("key%04d", i))
+	}
+	want := make(map[string]string)
+	for op := 0; op < 20000; op++ {
+		i := rng.IntN(n)
+		key := universe[i]
+		switch r := rng.IntN(100); {
+		case r < 1:
+			end := min(i+1+rng.IntN(200), n)
+			endKey := fmt.Sprintf("key%04d", end)
+			if err := db.DeleteRange([]byte(key), []byte(endKey)); err != nil {
+				t.Fatal(err)
+			}
+			for j := i; j < end; j++ {
+				delete(want, universe[j])
+			}
+		case r < 10:
+			if err := db.Delete([]byte(key)); err != nil {
+				t.Fatal(err)
+			}
+			delete(want, key)
+		default:
+			value := fmt.Sprintf("%s-value%d", strings.Repeat("v", 32), op)
+			if err := db.Put([]byte(key), []byte(value)); err != nil {
+				t.Fatal(err)
+			}
+			want[key] = value
+		}
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	waitForCompactions(db)
+	checkModel(t, db, universe, want)
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db = openDB(t, dir, opts)
+	defer db.Close()
+	checkModel(t, db, universe, want)
+}
+
+// TestDBDeleteRangeSplit verifies that a compaction splitting its output within a range
+// deletion gives each table the part of it up to the next table's first key, so that every
+// table ends at a range deletion sentinel, and that the deletion still applies across them.
+func TestDBDeleteRangeSplit(t *testing.T) {
+	dir := t.TempDir()
+	opts := &Options{L0CompactionThreshold: 2, TargetFileSize: 4 << 10, NoSync: true}
+	db := openDB(t, dir, opts)
+	defer func() { db.Close() }()
+
+	var universe []string
+	want := make(map[string]string)
+	for i := 0; i < 400; i++ {
+		key := fmt.Sprintf("key%04d", i)
+		value := strings.Repeat("v", 40)
+		universe = append(universe, key)
+		want[key] = value
+		if err := db.Put([]byte(key), []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The snapshot keeps the keys under the range deletion, so that the single compaction of
+	// the two level 0 tables writes several tables across it.
+	snap, err := db.NewSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Close()
+	snapWant := maps.Clone(want)
+	if err := db.DeleteRange([]byte("key0000"), []byte("key0400")); err != nil {
+		t.Fatal(err)
+	}
+	clear(want)
+	if err := db.Put([]byte("key0200"), []byte("v2")); err != nil {
+		t.Fatal(err)
+	}
+	want["key0200"] = "v2"
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	waitForCompactions(db)
+	checkModel(t, db, universe, want)
+	checkModel(t, snap, universe, snapWant)
+
+	v := db.vs.Current()
+	defer v.DecRef()
+	split := 0
+	for _, f := range v.Levels[1] {
+		if ikey.IsRangeDeleteSentinel(f.Largest) {
+			split++
+		}
+	}
+	if len(v.Levels[1]) < 2 || split != len(v.Levels[1]) {
+		t.Fatalf("%d of %d tables end at a range deletion sentinel, want every one of at least 2", split, len(v.Levels[1]))
+	}
+}
+
+var errMergeFailed = errors.New("merge failed")
+
+// appendOperator is a MergeOperator that appends operands to the value they apply to, so that
+// operands applied out of order show. A missing value starts as "#". Operands beginning with
+// '!' cannot be combined with older ones, and the operand "fail" fails the merge.
+type appendOperator struct {
+	partialMerges atomic.Int64
+}
+
+func (g *appendOperator) FullMerge(key, existing []byte, operands [][]byte) ([]byte, error) {
+	value := []byte("#")
+	if existing != nil {
+		value = slices.Clone(existing)
+	}
+	for _, operand := range operands {
+		if string(operand) == "fail" {
+			return nil, errMergeFailed
+		}
+		value = append(value, operand...)
+	}
+	return value, nil
+}
+
+func (g *appendOperator) PartialMerge(key, older, newer []byte) ([]byte, bool) {
+	if strings.HasPrefix(string(newer), "!") || string(older) == "fail" || string(newer) == "fail" {
+		return nil, false
+	}
+	g.partialMerges.Add(1)
+	return append(slices.Clone(older), newer...), true
+}
+
+// TestDBMerge verifies that merge operands are applied to the value under them, or to no value
+// under a deletion, a range deletion or nothing at all, by Get and iterators in the memtable
+// and in tables, that snapshots see the operands older than themselves, and that compactions
+// combine operands within each snapshot stripe.
+func TestDBMerge(t *testing.T) {
+	dir := t.TempDir()
+	db := openDB(t, dir, &Options{NoSync: true})
+	if err := db.Merge([]byte("a"), []byte("1")); !errors.Is(err, sseuda.ErrMergeUnsupported) {
+		t.Fatalf("Merge without an operator: %v, want ErrMergeUnsupported", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	merge := &appendOperator{}
+	opts := &Options{MergeOperator: merge, L0CompactionThreshold: 2, NoSync: true}
+	db = openDB(t, dir, opts)
+	defer func() { db.Close() }()
+
+	universe := []string{"a", "b", "c", "d", "e"}
+	b := db.NewBatch()
+	b.Put([]byte("a"), []byte("x"))
+	b.Merge([]byte("a"), []byte("1"))
+	b.Merge([]byte("a"), []byte("2"))
+	b.Put([]byte("b"), nil)
+	b.Merge([]byte("b"), []byte("1"))
+	b.Merge([]byte("c"), []byte("1"))
+	b.Put([]byte("d"), []byte("y"))
+	b.Delete([]byte("d"))
+	b.Merge([]byte("d"), []byte("1"))
+	b.Put([]byte("e"), []byte("y"))
+	b.DeleteRange([]byte("e"), []byte("f"))
+	b.Merge([]byte("e"), []byte("1"))
+	if err := db.Apply(b); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"a": "x12", "b": "1", "c": "#1", "d": "#1", "e": "#1"}
+	checkModel(t, db, universe, want)
+
+	snap, err := db.NewSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { snap.Close() }()
+	snapWant := maps.Clone(want)
+	mergeAll := func(key string, operands ...string) {
+		t.Helper()
+		for _, operand := range operands {
+			if err := db.Merge([]byte(key), []byte(operand)); err != nil {
+				t.Fatal(err)
+			}
+			want[key] += operand
+		}
+	}
+	mergeAll("a", "3")
+	mergeAll("c", "2", "!3")
+	checkModel(t, db, universe, want)
+	checkModel(t, snap, universe, snapWant)
+
+	// The flushes make two tables in level 0, which are compacted into level 1. The operands
+	// older than the snapshot are merged with the versions under them into sets, while the
+	// newer ones can only be combined with each other.
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	mergeAll("a", "4")
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	waitForCompactions(db)
+	checkModel(t, db, universe, want)
+	checkModel(t, snap, universe, snapWant)
+	if entries, rangeDels := tableCounts(t, db); entries != 8 || rangeDels != 0 {
+		t.Fatalf("tables hold %d entries and %d range deletions, want 8 and 0", entries, rangeDels)
+	}
+	if merge.partialMerges.Load() == 0 {
+		t.Fatalf("no operands were combined")
+	}
+
+	// Without the snapshot, every key is merged into a single set.
+	if err := snap.Close(); err != nil {
+		t.Fatal(err)
+	}
+	mergeAll("a", "5")
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	mergeAll("e", "2")
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	waitForCompactions(db)
+	checkModel(t, db, universe, want)
+	if entries, _ := tableCounts(t, db); entries != 5 {
+		t.Fatalf("tables hold %d entries, want 5", entries)
+	}
+
+	// A failing merge fails the reads that need it.
+	mergeAll("b", "fail")
+	if _, err := db.Get([]byte("b")); !errors.Is(err, errMergeFailed) {
+		t.Fatalf("Get(b) = %v, want errMergeFailed", err)
+	}
+	iter, err := db.NewIterator(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for valid := iter.First(); valid; valid = iter.Next() {
+		if string(iter.Key()) >= "b" {
+			t.Fatalf("iteration went on to %s past a failing merge", iter.Key())
+		}
+	}
+	if err := iter.Close(); !errors.Is(err, errMergeFailed) {
+		t.Fatalf("Close = %v, want errMergeFailed", err)
+	}
+	if err := db.Put([]byte("b"), []byte("z")); err != nil {
+		t.Fatal(err)
+	}
+	want["b"] = "z"
+
+	// The operands are replayed from the log.
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db = openDB(t, dir, opts)
+	checkModel(t, db, universe, want)
+}
+
+// TestDBMergeCompaction runs merges alongside writes, deletions and range deletions against a
+// model with small tables and open snapshots, so that compactions resolve operands in every
+// combination of stripes and levels.
+func TestDBMergeCompaction(t *testing.T) {
+	dir := t.TempDir()
+	opts := &Options{
+		MergeOperator:         &appendOperator{},
+		MemTableSize:          32 << 10,
+		L0CompactionThreshold: 2,
+		LBaseMaxBytes:         16 << 10,
+		LevelMultiplier:       4,
+		TargetFileSize:        4 << 10,
+		NoSync:                true,
+	}
+	db := openDB(t, dir, opts)
+
+	const n = 1000
+	rng := rand.New(rand.NewPCG(3, 4))
+	var universe []string
+	for i := 0; i < n; i++ {
+		universe = append(universe, fmt.Sprintf("key%04d", i))
+	}
+	want := make(map[string]string)
+	var snaps []sseuda.Snapshot
+	var snapWants []map[string]string
+	for op := 0; op < 20000; op++ {
+		if op%5000 == 2500 {
+			snap, err := db.NewSnapshot()
+			if err != nil {
+				t.Fatal(err)
+			}
+			snaps = append(snaps, snap)
+			snapWants = append(snapWants, maps.Clone(want))
+		}
+		i := rng.IntN(n)
+		key := universe[i]
+		switch r := rng.IntN(100); {
+		case r < 1:
+			end := min(i+1+rng.IntN(100), n)
+			if err := db.DeleteRange([]byte(key), []byte(universe[end-1]+"\x00")); err != nil {
+				t.Fatal(err)
+			}
+			for j := i; j < end; j++ {
+				delete(want, universe[j])
+			}
+		case r < 5:
+			if err := db.Delete([]byte(key)); err != nil {
+				t.Fatal(err)
+			}
+			delete(want, key)
+		case r < 50:
+			operand := fmt.Sprintf(".%d", op)
+			if rng.IntN(4) == 0 {
+				operand = "!" + operand
+			}
+			if err := db.Merge([]byte(key), []byte(operand)); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := want[key]; !ok {
+				want[key] = "#"
+			}
+			want[key] += operand
+		default:
+			value := fmt.Sprintf("%s-value%d", strings.Repeat("v", 32), op)
+			if err := db.Put([]byte(key), []byte(value)); err != nil {
+				t.Fatal(err)
+			}
+			want[key] = value
+		}
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	waitForCompactions(db)
+	checkModel(t, db, universe, want)
+	for i, snap := range snaps {
+		checkModel(t, snap, universe, snapWants[i])
+		if err := snap.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db = openDB(t, dir, opts)
+	defer db.Close()
+	checkModel(t, db, universe, want)
+}
+
+// TestDBBlobValues verifies that values from Options.BlobThreshold on are moved to blob files
+// by flushes and read back by Get, iterators and snapshots, merges included, across
+// compactions and a reopen, and that Open removes blob files the manifest never recorded.
+func TestDBBlobValues(t *testing.T) {
+	dir := t.TempDir()
+	opts := &Options{BlobThreshold: 64, MergeOperator: &appendOperator{}, L0CompactionThreshold: 2, NoSync: true}
+	db := openDB(t, dir, opts)
+	defer func() { db.Close() }()
+
+	universe := []string{"big1", "big2", "big3", "small", "merged"}
+	big := func(key string, round int) string {
+		return fmt.Sprintf("%s-%d-%s", key, round, strings.Repeat("v", 100))
+	}
+	want := map[string]string{"small": "s"}
+	for _, key := range []string{"big1", "big2", "big3", "merged"} {
+		want[key] = big(key, 0)
+	}
+	for key, value := range want {
+		if err := db.Put([]byte(key), []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	v := db.vs.Current()
+	if len(v.BlobFiles) != 1 || len(v.Levels[0]) != 1 || len(v.Levels[0][0].BlobRefs) != 1 {
+		t.Fatalf("%d blob files, %d tables after a flush; want a table referring to one blob file", len(v.BlobFiles), len(v.Levels[0]))
+	}
+	var valueBytes int
+	for key, value := range want {
+		if key != "small" {
+			valueBytes += len(value)
+		}
+	}
+	if ref := v.Levels[0][0].BlobRefs[0]; ref.Bytes != uint64(valueBytes) {
+		t.Fatalf("table refers to %d bytes, want the %d of the large values", ref.Bytes, valueBytes)
+	}
+	v.DecRef()
+	checkModel(t, db, universe, want)
+
+	snap, err := db.NewSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Close()
+	snapWant := maps.Clone(want)
+
+	if err := db.Merge([]byte("merged"), []byte("+1")); err != nil {
+		t.Fatal(err)
+	}
+	want["merged"] += "+1"
+	if err := db.Delete([]byte("big2")); err != nil {
+		t.Fatal(err)
+	}
+	delete(want, "big2")
+	if err := db.Put([]byte("big3"), []byte(big("big3", 1))); err != nil {
+		t.Fatal(err)
+	}
+	want["big3"] = big("big3", 1)
+	checkModel(t, db, universe, want)
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	waitForCompactions(db)
+	checkModel(t, db, universe, want)
+	checkModel(t, snap, universe, snapWant)
+	if err := snap.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	stray := blobFilename(dir, 1000)
+	if err := os.WriteFile(stray, []byte("unrecorded"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	db = openDB(t, dir, opts)
+	checkModel(t, db, universe, want)
+	if _, err := os.Stat(stray); !os.IsNotExist(err) {
+		t.Fatalf("unrecorded blob file survived Open: %v", err)
+	}
+}
+
+// TestDBBlobGC overwrites large values until their blob files are mostly garbage, and verifies
+// that compactions and table rewrites move the live values out of them so that they are deleted.
+func TestDBBlobGC(t *testing.T) {
+	dir := t.TempDir()
+	opts := &Options{
+		MemTableSize:          marena.ARENA_PAGESIZE,
+		BlobThreshold:         256,
+		L0CompactionThreshold: 2,
+		LBaseMaxBytes:         8 << 10,
+		LevelMultiplier:       4,
+		TargetFileSize:        1 << 10,
+		NoSync:                true,
+	}
+	db := openDB(t, dir, opts)
+	defer func() { db.Close() }()
+
+	const n, rounds, size = 100, 20, 1000
+	var universe []string
+	want := make(map[string]string)
+	for round := 0; round < rounds; round++ {
+		for i := 0; i < n; i++ {
+			key := fmt.Sprintf("key%03d", (i*37+round)%n)
+			value := fmt.Sprintf("%s-%d-", key, round)
+			value += strings.Repeat("v", size-len(value))
+			if err := db.Put([]byte(key), []byte(value)); err != nil {
+				t.Fatal(err)
+			}
+			want[key] = value
+		}
+	}
+	for key := range want {
+		universe = append(universe, key)
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	waitForCompactions(db)
+
+	check := func(db *DB) {
+		t.Helper()
+		checkModel(t, db, universe, want)
+		// Versions released by the reads above leave their files for the next cleanup.
+		if err := db.deleteObsoleteTables(); err != nil {
+			t.Fatal(err)
+		}
+		v := db.vs.Current()
+		defer v.DecRef()
+		inLevel0 := make(map[uint64]bool)
+		for _, f := range v.Levels[0] {
+			for _, ref := range f.BlobRefs {
+				inLevel0[ref.FileNum] = true
+			}
+		}
+		live := v.BlobLiveBytes()
+		var total uint64
+		for num, b := range v.BlobFiles {
+			if !inLevel0[num] && float64(live[num]) < db.opts.BlobGCRatio*float64(b.ValueBytes) {
+				t.Errorf("blob file %d keeps %d live bytes of %d", num, live[num], b.ValueBytes)
+			}
+			total += b.ValueBytes
+		}
+		if total > 3*n*size {
+			t.Errorf("blob files hold %d value bytes for %d live ones", total, n*size)
+		}
+		blobs, err := listFiles(dir, blobExt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(blobs) != len(v.BlobFiles) {
+			t.Errorf("%d blob files on disk for %d live ones", len(blobs), len(v.BlobFiles))
+		}
+	}
+	check(db)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db = openDB(t, dir, opts)
+	check(db)
+}
+
+// TestDBBloomFilter verifies that tables carry a filter of their user keys unless filters are
+// disabled, that Get still honors the range deletions of a table whose filter rules the key
+// out, and that the filters rule out most absent keys.
+func TestDBBloomFilter(t *testing.T) {
+	for _, bitsPerKey := range []int{0, -1} {
+		db := openDB(t, t.TempDir(), &Options{BloomBitsPerKey: bitsPerKey, L0CompactionThreshold: 100, NoSync: true})
+		for i := 0; i < 1000; i++ {
+			if err := db.Put([]byte(fmt.Sprintf("key%04d", 2*i)), []byte("v")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.DeleteRange([]byte("key0000"), []byte("key0010")); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put([]byte("other"), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		mustGet(t, db, "key0004", "")
+		mustGet(t, db, "key0010", "v")
+		mustGet(t, db, "key0011", "")
+
+		v := db.vs.Current()
+		if len(v.Levels[0]) != 2 {
+			t.Fatalf("%d tables in level 0, want 2", len(v.Levels[0]))
+		}
+		tbl, err := db.tableCache.get(v.Levels[0][1].FileNum)
+		v.DecRef()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hasFilter := tbl.reader.Properties().FilterSize > 0; hasFilter != (bitsPerKey >= 0) {
+			t.Fatalf("BloomBitsPerKey %d: table has a filter: %v", bitsPerKey, hasFilter)
+		}
+		if bitsPerKey >= 0 {
+			falsePositives := 0
+			for i := 0; i < 1000; i++ {
+				if !tbl.reader.MayContain([]byte(fmt.Sprintf("key%04d", 2*i))) {
+					t.Fatalf("filter rules out key%04d", 2*i)
+				}
+				if tbl.reader.MayContain([]byte(fmt.Sprintf("key%04d", 2*i+1))) {
+					falsePositives++
+				}
+			}
+			if falsePositives > 50 {
+				t.Errorf("%d false positives among 1000 absent keys", falsePositives)
+			}
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestDBPrefixFilter verifies that iterators confined to a prefix in the domain of
+// Options.PrefixExtractor leave out the tables whose prefix filter rules it out, and only those
+// built by the same extractor, while returning the same keys.
+func TestDBPrefixFilter(t *testing.T) {
+	dir := t.TempDir()
+	opts := &Options{PrefixExtractor: sseuda.FixedPrefix(4), L0CompactionThreshold: 100, NoSync: true}
+	db := openDB(t, dir, opts)
+	defer func() { db.Close() }()
+	for i := 0; i < 4; i++ {
+		// Every table spans the same key range, so that only its prefix filter can rule it out.
+		for _, key := range []string{"a", fmt.Sprintf("p%03d", i), fmt.Sprintf("p%03d1", i), fmt.Sprintf("p%03d2", i), "z"} {
+			if err := db.Put([]byte(key), []byte(strconv.Itoa(i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tablesWithin := func(db *DB, prefix string) int {
+		t.Helper()
+		db.mu.RLock()
+		state := db.readState()
+		db.mu.RUnlock()
+		defer state.unref()
+		b := bounds.New(db.opts.Compare, &sseuda.IterOptions{Prefix: []byte(prefix)})
+		files, err := state.tablesWithin(state.version.Levels[0], &b, state.filterPrefix(&b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(files)
+	}
+	for _, tc := range []struct {
+		prefix string
+		tables int
+		want   string
+	}{
+		{"p002", 1, "[p002=2 p0021=2 p0022=2]"},
+		{"p0021", 1, "[p0021=2]"},
+		{"p009", 0, "[]"},
+		{"p00", 4, "[p000=0 p0001=0 p0002=0 p001=1 p0011=1 p0012=1 p002=2 p0021=2 p0022=2 p003=3 p0031=3 p0032=3]"},
+	} {
+		if got := scan(db.NewIterator(&sseuda.IterOptions{Prefix: []byte(tc.prefix)})); got != tc.want {
+			t.Errorf("prefix %s: got %s, want %s", tc.prefix, got, tc.want)
+		}
+		if n := tablesWithin(db, tc.prefix); n != tc.tables {
+			t.Errorf("prefix %s: iterator reads %d tables, want %d", tc.prefix, n, tc.tables)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Filters built by another extractor rule nothing out.
+	db = openDB(t, dir, &Options{PrefixExtractor: sseuda.FixedPrefix(3), L0CompactionThreshold: 100, NoSync: true})
+	if n := tablesWithin(db, "p002"); n != 4 {
+		t.Errorf("prefix filters of another extractor: iterator reads %d tables, want 4", n)
+	}
+	if got, want := scan(db.NewIterator(&sseuda.IterOptions{Prefix: []byte("p002")})), "[p002=2 p0021=2 p0022=2]"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+// TestDBBlockCache verifies that two databases sharing a block cache, whose tables have the
+// same file numbers, read their own blocks, that repeated reads hit the cache, and that closing
+// a database drops its blocks and leaves none pinned.
+func TestDBBlockCache(t *testing.T) {
+	c := cache.New(&cache.Options{Capacity: 1 << 20})
+	var dbs [2]*DB
+	for d := range dbs {
+		dbs[d] = openDB(t, t.TempDir(), &Options{BlockCache: c, BlockSize: 256, L0CompactionThreshold: 100, NoSync: true})
+		for i := 0; i < 500; i++ {
+			if err := dbs[d].Put([]byte(fmt.Sprintf("key%04d", i)), []byte(fmt.Sprintf("db%d-%d", d, i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := dbs[d].Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	v0, v1 := dbs[0].vs.Current(), dbs[1].vs.Current()
+	if v0.Levels[0][0].FileNum != v1.Levels[0][0].FileNum {
+		t.Fatalf("tables %d and %d; want the same file number", v0.Levels[0][0].FileNum, v1.Levels[0][0].FileNum)
+	}
+	v0.DecRef()
+	v1.DecRef()
+
+	for pass := 0; pass < 2; pass++ {
+		for d, db := range dbs {
+			for i := 0; i < 500; i += 7 {
+				mustGet(t, db, fmt.Sprintf("key%04d", i), fmt.Sprintf("db%d-%d", d, i))
+			}
+		}
+		if m := c.Metrics(); pass == 1 && m.Hits < m.Misses {
+			t.Fatalf("Metrics() after reading twice = %+v, want mostly hits", m)
+		}
+	}
+	want := "[key0498=db1-498 key0499=db1-499]"
+	if got := scan(dbs[1].NewIterator(&sseuda.IterOptions{LowerBound: []byte("key0498")})); got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+	if m := c.Metrics(); m.Count == 0 || m.Pinned != 0 {
+		t.Fatalf("Metrics() = %+v, want cached blocks, none pinned", m)
+	}
+
+	if err := dbs[0].Close(); err != nil {
+		t.Fatal(err)
+	}
+	mustGet(t, dbs[1], "key0042", "db1-42")
+	if err := dbs[1].Close(); err != nil {
+		t.Fatal(err)
+	}
+	if m := c.Metrics(); m.Count != 0 || m.Size != 0 {
+		t.Fatalf("Metrics() once closed = %+v, want an empty cache", m)
+	}
+}
@@ -0,0 +1,78 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	tableExt = ".sst"
+	blobExt  = ".blob"
+	tempExt  = ".tmp"
+)
+
+// tableFilename returns the path of table `num`. Tables are written under a temporary
+// name and renamed once complete, so a table file on disk is never partial.
+func tableFilename(dirname string, num uint64) string {
+	return filepath.Join(dirname, fmt.Sprintf("%06d%s", num, tableExt))
+}
+
+// blobFilename returns the path of blob file `num`. Like tables, blob files are written under
+// a temporary name and renamed once complete.
+func blobFilename(dirname string, num uint64) string {
+	return filepath.Join(dirname, fmt.Sprintf("%06d%s", num, blobExt))
+}
+
+// listFiles returns the numbers of the files in `dirname` with extension `ext`, in ascending order.
+func listFiles(dirname string, ext string) ([]uint64, error) {
+	entries, err := os.ReadDir(dirname)
+	if err != nil {
+		return nil, err
+	}
+
+	var nums []uint64
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ext)
+		if !ok {
+			continue
+		}
+		if num, err := strconv.ParseUint(name, 10, 64); err == nil {
+			nums = append(nums, num)
+		}
+	}
+	slices.Sort(nums)
+	return nums, nil
+}
+
+// removeTempFiles deletes the leftovers of files that were being written during a crash.
+func removeTempFiles(dirname string) error {
+	entries, err := os.ReadDir(dirname)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), tempExt) {
+			if err := os.Remove(filepath.Join(dirname, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// syncDir makes file creations, renames and removals in `dirname` durable.
+func syncDir(dirname string) error {
+	dir, err := os.Open(dirname)
+	if err != nil {
+		return err
+	}
+	if err := dir.Sync(); err != nil {
+		dir.Close()
+		return err
+	}
+	return dir.Close()
+}
@@ -0,0 +1,242 @@
+package engine
+
+import (
+	"os"
+	"slices"
+
+	"gosuda.org/sseuda/internal/manifest"
+	"gosuda.org/sseuda/internal/oldsepia/marena"
+	"gosuda.org/sseuda/internal/wal"
+)
+
+// newMemTable returns an empty memtable whose writes start in log segment `logNum`, in a
+// chain from the pool. The caller must hold the write lock.
+func (g *DB) newMemTable(logNum uint64) (*memTable, error) {
+	chain, err := g.opts.ArenaPool.Get(g.opts.MemTableSize, g.opts.MemTableMmap)
+	if err != nil {
+		return nil, err
+	}
+	mem, err := newMemTable(chain, g.opts.Compare, logNum)
+	if err != nil {
+		g.opts.ArenaPool.Put(chain)
+		return nil, err
+	}
+	return mem, nil
+}
+
+// makeRoomForWrite ensures the memtable can take the entries of `b`. A memtable that is
+// full, or has crossed the flush threshold, is made immutable and handed to the background
+// flush, and a fresh one takes its place. Writes stall while too many memtables await flushing.
+// The caller must hold the write lock.
+func (g *DB) makeRoomForWrite(b *batch) error {
+	for {
+		switch {
+		case g.closed:
+			return ErrClosed
+		case g.bgErr != nil:
+			return g.bgErr
+		case g.mem.empty() || (g.mem.used() < g.opts.MemTableFlushThreshold && g.mem.fits(b)):
+			if !g.mem.fits(b) {
+				return marena.ErrAllocationFailed // Too large for even an empty memtable.
+			}
+			return nil
+		case len(g.imm) >= g.opts.MemTableStopWritesThreshold:
+			g.cond.Wait()
+		default:
+			switch err := g.rotate(); {
+			case err == marena.ErrArenaBudgetExceeded && len(g.imm) > 0:
+				g.cond.Wait() // A flush hands the chain of its memtable back to the pool.
+			case err == marena.ErrArenaBudgetExceeded:
+				// The budget is spent by other users of the pool; wait for one to hand a chain back.
+				g.mu.Unlock()
+				g.opts.ArenaPool.Wait(g.opts.MemTableSize, g.flushDone)
+				g.mu.Lock()
+			case err != nil:
+				return err
+			}
+		}
+	}
+}
+
+// rotate makes the memtable immutable, switches the log to a new segment for its successor,
+// and wakes the background flush. The caller must hold the write lock.
+func (g *DB) rotate() error {
+	// The chain comes first, so that a rotation stalled by the pool's budget leaves the log as is.
+	mem, err := g.newMemTable(0)
+	if err != nil {
+		return err
+	}
+	if mem.logNum, err = g.log.Rotate(); err != nil {
+		// The old segment may be closed already, and the log has no segment to write to.
+		g.opts.ArenaPool.Put(mem.chain)
+		if g.bgErr == nil {
+			g.bgErr = err
+		}
+		return err
+	}
+
+	g.imm = append(g.imm, g.mem)
+	g.mem = mem
+	g.scheduleFlush()
+	return nil
+}
+
+// scheduleFlush wakes the flush goroutine without blocking. The caller must hold the write lock.
+func (g *DB) scheduleFlush() {
+	select {
+	case g.flushCh <- struct{}{}:
+	default:
+	}
+}
+
+// flushLoop writes immutable memtables to tables, oldest first, until the DB is closed.
+func (g *DB) flushLoop() {
+	defer close(g.flushDone)
+	for range g.flushCh {
+		for g.flushOne() {
+		}
+	}
+}
+
+// flushOne flushes the oldest immutable memtable. It reports whether there may be more to do.
+func (g *DB) flushOne() bool {
+	g.mu.Lock()
+	if g.closed || g.bgErr != nil || len(g.imm) == 0 {
+		g.mu.Unlock()
+		return false
+	}
+	mem := g.imm[0]
+	g.mu.Unlock()
+
+	// An immutable memtable is never written again, so it is read without the lock.
+	edit := &manifest.VersionEdit{}
+	iter := mem.skl.Iterator()
+	err := g.writeTable(iter, mem.rangeDels(), edit)
+	iter.Close()
+	if !g.installFlush(mem, edit, err) {
+		return false
+	}
+
+	// The files are deleted without the lock, so that reads and writes go on meanwhile.
+	if err := g.deleteObsoleteTables(); err != nil {
+		g.mu.Lock()
+		g.bgErr = err
+		g.cond.Broadcast()
+		g.mu.Unlock()
+		return false
+	}
+	return true
+}
+
+// installFlush records the table written from `mem` by `edit`, or the error `err` that failed
+// it, and retires `mem`. It reports whether the flush succeeded.
+func (g *DB) installFlush(mem *memTable, edit *manifest.VersionEdit, err error) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	defer g.cond.Broadcast()
+	if err != nil {
+		g.bgErr = err
+		return false
+	}
+
+	// Once the table is in the manifest, the log segments before the next memtable's are
+	// no longer needed for recovery.
+	minLogNum := g.mem.logNum
+	if len(g.imm) > 1 {
+		minLogNum = g.imm[1].logNum
+	}
+	edit.LogNumber = minLogNum
+	edit.LastSequence = g.lastSeq
+	if err := g.vs.LogAndApply(edit); err != nil {
+		g.bgErr = err
+		return false
+	}
+
+	g.imm = g.imm[1:]
+	g.obsolete = append(g.obsolete, mem)
+	mem.unref()
+	g.recycleChains()
+
+	if err := g.removeObsoleteLogs(minLogNum); err != nil {
+		g.bgErr = err
+		return false
+	}
+	g.maybeScheduleCompaction()
+	return true
+}
+
+// removeObsoleteLogs deletes the log segments older than `minLogNum`, whose writes are all
+// in tables by now. Only segments the log has moved past can be obsolete.
+func (g *DB) removeObsoleteLogs(minLogNum uint64) error {
+	segments, err := wal.ListSegments(g.dirname)
+	if err != nil {
+		return err
+	}
+	for _, num := range segments {
+		if num >= minLogNum {
+			break
+		}
+		if err := os.Remove(wal.SegmentFilename(g.dirname, num)); err != nil {
+			return err
+		}
+	}
+	return syncDir(g.dirname)
+}
+
+// recycleChains hands the chains of the flushed memtables that no iterator references any more
+// back to the pool, which resets them off the write path. The caller must hold the write lock.
+// It runs when the DB drops its reference to a memtable, and when an iterator or a snapshot
+// drops the last other one, even after Close.
+func (g *DB) recycleChains() {
+	live := g.obsolete[:0]
+	for _, mem := range g.obsolete {
+		if mem.released() {
+			g.opts.ArenaPool.Put(mem.chain)
+		} else {
+			live = append(live, mem)
+		}
+	}
+	clear(g.obsolete[len(live):])
+	g.obsolete = live
+}
+
+// recycleReleased calls recycleChains if one of `mems`, the memtables an iterator referenced,
+// has been released.
+func (g *DB) recycleReleased(mems []*memTable) {
+	if !slices.ContainsFunc(mems, (*memTable).released) {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.recycleChains()
+}
+
+// Flush makes the memtable immutable and waits until every immutable memtable has been
+// written to a table, so that nothing remains buffered in memory.
+func (g *DB) Flush() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		return ErrClosed
+	}
+	w := &writer{}
+	g.enqueue(w)
+	var err error
+	switch {
+	case g.closed:
+		err = ErrClosed
+	case !g.mem.empty():
+		err = g.rotate()
+	}
+	g.dequeue(1, nil)
+	if err != nil {
+		return err
+	}
+	for len(g.imm) > 0 && g.bgErr == nil && !g.closed {
+		g.cond.Wait()
+	}
+	if g.closed {
+		return ErrClosed
+	}
+	return g.bgErr
+}
@@ -0,0 +1,344 @@
+package engine
+
+import (
+	"slices"
+	"sync"
+
+	"gosuda.org/sseuda"
+	"gosuda.org/sseuda/internal/bounds"
+	"gosuda.org/sseuda/internal/ikey"
+	"gosuda.org/sseuda/internal/manifest"
+	"gosuda.org/sseuda/internal/rangedel"
+)
+
+// dbIter exposes the user keys visible at sequence number `seq` of an iterator over
+// internal keys. For each user key it surfaces the newest version no newer than `seq`,
+// unless that version is a deletion, and skips every other version.
+// When `mu` is set, every step holds the DB's read lock so that it never races a writer.
+// The iterator pins `version` until it is closed, so that its tables are not deleted.
+//
+// Moving forward, `iter` rests on the visible version of the current key. Moving backward,
+// the versions of a user key are met oldest first, so the visible one is only known once
+// `iter` has stepped past all of them: `iter` then rests before the current key, and the
+// visible value is copied into `value`.
+//
+// A visible merge operand is resolved with `merge` against the older versions of its key, down
+// to the first one that is not an operand. Moving forward, `iter` then rests past the operands
+// and the merged value is held in `value` as well. An error of `merge` invalidates the
+// iterator and is returned by Close.
+//
+// The iterator is confined to `bounds` on user keys. `iter` is confined to the same range of
+// internal keys, so it stops at the bounds by itself; the prefix is checked on user keys.
+//
+// Range deletions do not appear in `iter`: the ones visible at `seq` are gathered up front in
+// `rangeDels`, and a version they cover is treated like a deletion.
+//
+// The value of a blob entry is only read from `blobs` once Value asks for it, and then held in
+// `value`. An error reading it invalidates the iterator and is returned by Close.
+type dbIter struct {
+	mu        *sync.RWMutex
+	release   func()                      // If set, called by Close once the iterator no longer references its memtables.
+	compare   func(key1, key2 []byte) int // Orders user keys.
+	iter      sseuda.Iterator
+	seq       uint64
+	version   *manifest.Version
+	bounds    bounds.Bounds
+	rangeDels *rangedel.List
+	merge     sseuda.MergeOperator
+	blobs     *blobCache
+	key       []byte   // User key of the current entry.
+	value     []byte   // Value of the current entry when `hasValue` is set.
+	hasValue  bool     // Whether the value is held in `value` rather than read from `iter`.
+	blob      bool     // Whether the value, wherever it is held, is a blob handle yet to be read.
+	operands  [][]byte // Merge operands of the key being resolved.
+	reverse   bool     // Whether `iter` rests before the current key rather than on it.
+	valid     bool
+	err       error
+}
+
+var _ sseuda.Iterator = (*dbIter)(nil)
+
+func (g *dbIter) lock() {
+	if g.mu != nil {
+		g.mu.RLock()
+	}
+}
+
+func (g *dbIter) unlock() {
+	if g.mu != nil {
+		g.mu.RUnlock()
+	}
+}
+
+// findNextEntry advances `iter` to the visible version of the next user key that is not
+// deleted, starting from the entry it rests on.
+func (g *dbIter) findNextEntry() bool {
+	g.valid, g.hasValue, g.blob = false, false, false
+	for g.iter.Valid() && g.err == nil {
+		userKey, seq, kind := ikey.Decode(g.iter.Key())
+		switch {
+		case seq > g.seq:
+			g.iter.Next()
+		case kind == ikey.KindMerge && !g.rangeDels.Covers(userKey, seq, g.seq):
+			g.key = append(g.key[:0], userKey...)
+			return g.mergeForward()
+		case g.live(userKey, seq, kind):
+			g.key = append(g.key[:0], userKey...)
+			g.valid, g.blob = true, kind == ikey.KindBlob
+			return true
+		default:
+			g.key = append(g.key[:0], userKey...)
+			g.skipUserKey()
+		}
+	}
+	return false
+}
+
+// mergeForward resolves the merge operand `iter` rests on, the visible version of `g.key`,
+// and leaves `iter` on the first version of the key the merge does not consume, or past them.
+// The versions below the operand are all visible, being older.
+func (g *dbIter) mergeForward() bool {
+	g.operands = append(g.operands[:0], append([]byte{}, g.iter.Value()...))
+	var base []byte
+	for g.iter.Next() {
+		userKey, seq, kind := ikey.Decode(g.iter.Key())
+		if g.compare(userKey, g.key) != 0 || kind == ikey.KindDelete || g.rangeDels.Covers(userKey, seq, g.seq) {
+			break
+		}
+		if kind == ikey.KindSet {
+			base = append([]byte{}, g.iter.Value()...)
+			break
+		}
+		if kind == ikey.KindBlob {
+			var err error
+			if base, err = g.blobs.read(g.iter.Value()); err != nil {
+				g.err = err
+				return false
+			}
+			break
+		}
+		g.operands = append(g.operands, append([]byte{}, g.iter.Value()...))
+	}
+	return g.resolve(base, g.operands)
+}
+
+// resolve sets the value of the current entry to `operands`, newest first, applied to `base`.
+func (g *dbIter) resolve(base []byte, operands [][]byte) bool {
+	value, err := fullMerge(g.merge, g.key, base, operands)
+	if err != nil {
+		g.err = err
+		g.valid = false
+		return false
+	}
+	g.value, g.hasValue, g.valid = value, true, true
+	return true
+}
+
+// live reports whether the version of `userKey` written at `seq` with `kind` holds a value,
+// inline or in a blob file, rather than a deletion or a value covered by a range deletion.
+func (g *dbIter) live(userKey []byte, seq uint64, kind ikey.Kind) bool {
+	return (kind == ikey.KindSet || kind == ikey.KindBlob) && !g.rangeDels.Covers(userKey, seq, g.seq)
+}
+
+// findPrevEntry moves `iter` backward to the previous user key that is not deleted at `seq`,
+// starting from the entry it rests on, and leaves `iter` on the entry before that key.
+//
+// The visible versions of a key are met oldest first. The merge operands met since the last
+// set or deletion are collected, newest last, and applied once every version has been seen.
+func (g *dbIter) findPrevEntry() bool {
+	g.valid, g.reverse, g.hasValue, g.blob = false, true, true, false
+	hasKey := false
+	live := false // Whether the newest visible version met so far for `g.key` is a set.
+	g.operands = g.operands[:0]
+	for g.iter.Valid() {
+		userKey, seq, kind := ikey.Decode(g.iter.Key())
+		if seq <= g.seq {
+			if hasKey && g.compare(userKey, g.key) < 0 {
+				if len(g.operands) > 0 || live {
+					break // Every version of `g.key` has been seen.
+				}
+			}
+			hasKey = true
+			if kind == ikey.KindMerge && !g.rangeDels.Covers(userKey, seq, g.seq) {
+				g.operands = append(g.operands, append([]byte{}, g.iter.Value()...))
+			} else {
+				g.operands = g.operands[:0]
+				live = g.live(userKey, seq, kind)
+				g.blob = live && kind == ikey.KindBlob
+				if live {
+					g.value = append(g.value[:0], g.iter.Value()...)
+				}
+			}
+			g.key = append(g.key[:0], userKey...)
+		}
+		g.iter.Prev()
+	}
+	if len(g.operands) == 0 {
+		g.valid = live
+		return live
+	}
+	var base []byte
+	if live {
+		if base = g.value; g.blob {
+			var err error
+			if base, err = g.blobs.read(g.value); err != nil {
+				g.err = err
+				return false
+			}
+			g.blob = false
+		}
+	}
+	slices.Reverse(g.operands)
+	return g.resolve(base, g.operands)
+}
+
+// checkForward invalidates the iterator if forward movement has left its bounds.
+func (g *dbIter) checkForward() bool {
+	if g.valid && !g.bounds.Forward(g.key) {
+		g.valid = false
+	}
+	return g.valid
+}
+
+// checkBackward invalidates the iterator if backward movement has left its bounds.
+func (g *dbIter) checkBackward() bool {
+	if g.valid && !g.bounds.Backward(g.key) {
+		g.valid = false
+	}
+	return g.valid
+}
+
+// skipUserKey advances `iter` past every version of the user key `g.key`, starting from the
+// entry it rests on.
+func (g *dbIter) skipUserKey() {
+	for g.iter.Valid() && g.compare(ikey.UserKey(g.iter.Key()), g.key) == 0 {
+		g.iter.Next()
+	}
+}
+
+func (g *dbIter) First() bool {
+	g.lock()
+	defer g.unlock()
+	g.reverse = false
+	g.iter.First()
+	g.findNextEntry()
+	return g.checkForward()
+}
+
+func (g *dbIter) Last() bool {
+	g.lock()
+	defer g.unlock()
+	g.iter.Last()
+	g.findPrevEntry()
+	return g.checkBackward()
+}
+
+func (g *dbIter) Seek(key []byte) bool {
+	g.lock()
+	defer g.unlock()
+	g.reverse = false
+	g.iter.Seek(ikey.Make(g.bounds.SeekGE(key), g.seq, ikey.KindMax))
+	g.findNextEntry()
+	return g.checkForward()
+}
+
+// SeekLT starts before the newest possible version of `key`, which precedes all of its versions.
+func (g *dbIter) SeekLT(key []byte) bool {
+	g.lock()
+	defer g.unlock()
+	g.iter.SeekLT(ikey.Make(g.bounds.SeekLT(key), ikey.IKEY_MAX_SEQ, ikey.KindMax))
+	g.findPrevEntry()
+	return g.checkBackward()
+}
+
+// SeekLE starts at the oldest possible version of `key`, which follows all of its versions.
+func (g *dbIter) SeekLE(key []byte) bool {
+	key, lt := g.bounds.SeekLE(key)
+	if lt {
+		return g.SeekLT(key)
+	}
+	g.lock()
+	defer g.unlock()
+	g.iter.SeekLE(ikey.Make(key, 0, ikey.KindDelete))
+	g.findPrevEntry()
+	return g.checkBackward()
+}
+
+func (g *dbIter) Valid() bool {
+	return g.valid
+}
+
+func (g *dbIter) Next() bool {
+	if !g.valid {
+		return false
+	}
+	g.lock()
+	defer g.unlock()
+	if g.reverse {
+		// Move `iter` back onto the visible version of the current key.
+		g.reverse = false
+		g.iter.Seek(ikey.Make(g.key, g.seq, ikey.KindMax))
+	}
+	g.skipUserKey()
+	g.findNextEntry()
+	return g.checkForward()
+}
+
+func (g *dbIter) Prev() bool {
+	if !g.valid {
+		return false
+	}
+	g.lock()
+	defer g.unlock()
+	if !g.reverse {
+		// Move `iter` before every version of the current key.
+		g.iter.SeekLT(ikey.Make(g.key, ikey.IKEY_MAX_SEQ, ikey.KindMax))
+	}
+	g.findPrevEntry()
+	return g.checkBackward()
+}
+
+func (g *dbIter) Key() []byte {
+	if !g.valid {
+		return nil
+	}
+	return g.key
+}
+
+func (g *dbIter) Value() []byte {
+	if !g.valid {
+		return nil
+	}
+	if g.hasValue && !g.blob {
+		return g.value
+	}
+	g.lock()
+	defer g.unlock()
+	if !g.blob {
+		return g.iter.Value()
+	}
+	handle := g.value
+	if !g.hasValue {
+		handle = g.iter.Value()
+	}
+	value, err := g.blobs.read(handle)
+	if err != nil {
+		g.err, g.valid = err, false
+		return nil
+	}
+	g.value, g.hasValue, g.blob = value, true, false
+	return value
+}
+
+func (g *dbIter) Close() error {
+	g.valid = false
+	err := g.iter.Close()
+	g.version.DecRef()
+	if g.release != nil {
+		g.release()
+	}
+	if g.err != nil {
+		return g.err
+	}
+	return err
+}
@@ -0,0 +1,178 @@
+package engine
+
+import (
+	"sort"
+
+	"gosuda.org/sseuda"
+	"gosuda.org/sseuda/internal/bounds"
+	"gosuda.org/sseuda/internal/manifest"
+	"gosuda.org/sseuda/internal/sstable"
+)
+
+// levelIter iterates over the sorted, non-overlapping tables of one level as if they were a
+// single table. Only the table under the iterator is open for iteration at any time.
+// Tables that lie entirely outside the iterator's bounds are never opened.
+type levelIter struct {
+	compare func(key1, key2 []byte) int
+	cache   *tableCache
+	files   []*manifest.FileMetadata
+	opts    *sseuda.IterOptions // Bounds on internal keys, passed on to every table.
+	bounds  bounds.Bounds
+	index   int               // Index in `files` of the table under `iter`.
+	iter    *sstable.Iterator // Nil when the iterator is exhausted or failed.
+	err     error
+}
+
+var _ sseuda.Iterator = (*levelIter)(nil)
+
+func newLevelIter(compare func(key1, key2 []byte) int, cache *tableCache, files []*manifest.FileMetadata, opts *sseuda.IterOptions) *levelIter {
+	return &levelIter{compare: compare, cache: cache, files: files, opts: opts, bounds: bounds.New(compare, opts)}
+}
+
+// load switches to the table at `index`, closing the previous one.
+func (g *levelIter) load(index int) bool {
+	if g.iter != nil {
+		if err := g.iter.Close(); err != nil && g.err == nil {
+			g.err = err
+		}
+		g.iter = nil
+	}
+	g.index = index
+	if g.err != nil || index < 0 || index >= len(g.files) {
+		return false
+	}
+	g.iter, g.err = g.cache.newIter(g.files[index].FileNum, g.opts)
+	return g.err == nil
+}
+
+// skipExhausted moves on to the following tables while the current one is exhausted,
+// up to the first table that starts at or past the upper bound.
+func (g *levelIter) skipExhausted() bool {
+	for g.iter != nil && !g.iter.Valid() {
+		if err := g.iter.Error(); err != nil {
+			g.err = err
+		}
+		next := g.index + 1
+		if next < len(g.files) && g.bounds.Upper != nil && g.compare(g.files[next].Smallest, g.bounds.Upper) >= 0 {
+			next = len(g.files)
+		}
+		if !g.load(next) {
+			return false
+		}
+		g.iter.First()
+	}
+	return g.iter != nil
+}
+
+// skipExhaustedBackward moves back to the preceding tables while the current one is
+// exhausted, down to the first table that ends below the lower bound.
+func (g *levelIter) skipExhaustedBackward() bool {
+	for g.iter != nil && !g.iter.Valid() {
+		if err := g.iter.Error(); err != nil {
+			g.err = err
+		}
+		prev := g.index - 1
+		if prev >= 0 && g.bounds.Lower != nil && g.compare(g.files[prev].Largest, g.bounds.Lower) < 0 {
+			prev = -1
+		}
+		if !g.load(prev) {
+			return false
+		}
+		g.iter.Last()
+	}
+	return g.iter != nil
+}
+
+func (g *levelIter) First() bool {
+	if g.bounds.Lower != nil {
+		return g.Seek(g.bounds.Lower)
+	}
+	if !g.load(0) {
+		return false
+	}
+	g.iter.First()
+	return g.skipExhausted()
+}
+
+func (g *levelIter) Last() bool {
+	if g.bounds.Upper != nil {
+		return g.SeekLT(g.bounds.Upper)
+	}
+	if !g.load(len(g.files) - 1) {
+		return false
+	}
+	g.iter.Last()
+	return g.skipExhaustedBackward()
+}
+
+// search returns the index of the first table whose largest key is >= `key`.
+func (g *levelIter) search(key []byte) int {
+	return sort.Search(len(g.files), func(i int) bool {
+		return g.compare(g.files[i].Largest, key) >= 0
+	})
+}
+
+func (g *levelIter) Seek(key []byte) bool {
+	key = g.bounds.SeekGE(key)
+	if !g.load(g.search(key)) {
+		return false
+	}
+	g.iter.Seek(key)
+	return g.skipExhausted()
+}
+
+// SeekLT searches the first table that may hold keys >= `key`, and falls back to the end of
+// the tables before it; past the last table, it starts from the last one.
+func (g *levelIter) SeekLT(key []byte) bool {
+	key = g.bounds.SeekLT(key)
+	if !g.load(min(g.search(key), len(g.files)-1)) {
+		return false
+	}
+	g.iter.SeekLT(key)
+	return g.skipExhaustedBackward()
+}
+
+func (g *levelIter) SeekLE(key []byte) bool {
+	key, lt := g.bounds.SeekLE(key)
+	if lt {
+		return g.SeekLT(key)
+	}
+	if !g.load(min(g.search(key), len(g.files)-1)) {
+		return false
+	}
+	g.iter.SeekLE(key)
+	return g.skipExhaustedBackward()
+}
+
+func (g *levelIter) Valid() bool {
+	return g.iter != nil && g.iter.Valid()
+}
+
+func (g *levelIter) Next() bool {
+	if g.iter == nil {
+		return false
+	}
+	g.iter.Next()
+	return g.skipExhausted()
+}
+
+func (g *levelIter) Prev() bool {
+	if g.iter == nil {
+		return false
+	}
+	g.iter.Prev()
+	return g.skipExhaustedBackward()
+}
+
+func (g *levelIter) Key() []byte {
+	return g.iter.Key()
+}
+
+func (g *levelIter) Value() []byte {
+	return g.iter.Value()
+}
+
+func (g *levelIter) Close() error {
+	g.load(len(g.files))
+	return g.err
+}
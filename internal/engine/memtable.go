@@ -0,0 +1,164 @@
+package engine
+
+import (
+	"math/rand/v2"
+	"slices"
+	"sync/atomic"
+
+	"gosuda.org/sseuda/internal/ikey"
+	"gosuda.org/sseuda/internal/oldsepia/marena"
+	"gosuda.org/sseuda/internal/oldsepia/mskip"
+	"gosuda.org/sseuda/internal/rangedel"
+)
+
+// nodeFootprint is an upper bound on the chain bytes taken by one skip list node, including
+// alignment padding. Memtables link their nodes with 64-bit offsets, so it is the size of a
+// wide node of the maximum height.
+const nodeFootprint = int64(mskip.MSKIP_WIDE_NODE_MAX_SIZE)
+
+// align rounds n up to the chain's 8-byte allocation granularity.
+func align(n int) int64 {
+	return int64((n + 7) &^ 7)
+}
+
+// entryFootprint bounds the chain bytes needed to insert one entry into a memtable. The skip
+// list reserves them in one piece.
+func entryFootprint(key, value []byte) int64 {
+	return nodeFootprint + align(len(key)+ikey.IKEY_TRAILER_SIZE) + align(len(value))
+}
+
+// memTable is a skip list keyed by internal keys, in a marena.Chain that grows as the memtable
+// fills, up to MemTableSize. Every write inserts a new internal key, so the versions of a user
+// key sit side by side, newest first, and a reader at an older sequence number is never
+// affected by later writes.
+//
+// Range deletions are kept apart, in a second skip list in the same chain keyed by the
+// internal key of their start, with their end as the value. Readers consult them through
+// rangeDels, which fragments them once and caches the result until the next range deletion.
+//
+// The DB owns one reference to the skip list, and every open iterator owns another.
+// Once a memtable has been flushed, the DB drops its reference; the memtable is
+// released only when the skip list's reference count reaches zero.
+type memTable struct {
+	chain       *marena.Chain
+	skl         *mskip.WideSkipList
+	rangeDelSkl *mskip.WideSkipList
+	fragments   atomic.Pointer[rangedel.List] // Cached result of rangeDels, or nil if stale.
+	compare     func(key1, key2 []byte) int   // Orders user keys.
+	logNum      uint64                        // First write-ahead log segment that may hold writes of this memtable.
+	entries     int                           // Number of writes applied.
+	buf         []byte                        // Scratch buffer for internal keys; writers are serialized by the DB.
+	sizes       []int64                       // Scratch buffer for the footprints of a batch's entries.
+}
+
+// newMemTable builds an empty memtable in `chain`, which must be empty or freshly reset.
+// `compare` orders user keys.
+func newMemTable(chain *marena.Chain, compare func(key1, key2 []byte) int, logNum uint64) (*memTable, error) {
+	skl, err := mskip.NewChainSkipList(chain, ikey.Comparer(compare), rand.Uint64())
+	if err != nil {
+		return nil, err
+	}
+	rangeDelSkl, err := mskip.NewChainSkipList(chain, ikey.Comparer(compare), rand.Uint64())
+	if err != nil {
+		return nil, err
+	}
+	return &memTable{chain: chain, skl: skl, rangeDelSkl: rangeDelSkl, compare: compare, logNum: logNum}, nil
+}
+
+func (g *memTable) empty() bool {
+	return g.entries == 0
+}
+
+// unref drops the DB's reference. It reports whether the memtable can be released immediately.
+func (g *memTable) unref() bool {
+	return g.skl.DecRef() == 0
+}
+
+// released reports whether every reference to the memtable, including iterators, is gone.
+func (g *memTable) released() bool {
+	return g.skl.RefCount() == 0
+}
+
+// used returns the chain bytes the memtable has consumed.
+func (g *memTable) used() int64 {
+	return g.chain.Used()
+}
+
+// fits reports whether the entries of `batches`, applied in order, are guaranteed to fit in the
+// chain, growing it ahead as needed. Each entry is reserved on its own and may start a new
+// chunk, so the chain makes room for every entry's footprint in turn rather than for their sum.
+func (g *memTable) fits(batches ...*batch) bool {
+	g.sizes = g.sizes[:0]
+	for _, b := range batches {
+		g.sizes = b.footprints(g.sizes)
+	}
+	return g.chain.Grow(g.sizes...)
+}
+
+// apply records a write of `kind` to `key` at sequence number `seq`. A range deletion of
+// [key, value) goes to the range deletion skip list.
+// It returns false if the chain is exhausted.
+func (g *memTable) apply(seq uint64, kind ikey.Kind, key, value []byte) bool {
+	g.buf = ikey.Append(g.buf[:0], key, seq, kind)
+	skl := g.skl
+	if kind == ikey.KindRangeDelete {
+		skl = g.rangeDelSkl
+		g.fragments.Store(nil)
+	}
+	if !skl.Insert(g.buf, value) {
+		return false
+	}
+	g.entries++
+	return true
+}
+
+// applyBatch applies the entries of `b` with consecutive sequence numbers starting at the
+// batch's. It returns false if the chain is exhausted, which fits rules out.
+func (g *memTable) applyBatch(b *batch) bool {
+	seq := b.seq()
+	for r := b.reader(); ; seq++ {
+		kind, key, value, ok := r.next()
+		if !ok {
+			return true
+		}
+		if !g.apply(seq, kind, key, value) {
+			return false
+		}
+	}
+}
+
+// get returns the newest version of `key` visible at sequence number `seq`, if any, with the
+// sequence number it was written at. The versions of a key are ordered newest first, so it is
+// the first entry at or after the internal key of `key` at `seq`, provided that entry is a
+// version of `key` rather than of a later user key. The skip list's Get would match the
+// internal key exactly, so the lookup seeks and compares user keys itself.
+func (g *memTable) get(key []byte, seq uint64) (keySeq uint64, kind ikey.Kind, value []byte, found bool) {
+	internalKey, value, _, ok := g.skl.SeekGE(ikey.Make(key, seq, ikey.KindMax))
+	if !ok {
+		return 0, 0, nil, false
+	}
+	userKey, keySeq, kind := ikey.Decode(internalKey)
+	if g.compare(userKey, key) != 0 {
+		return 0, 0, nil, false
+	}
+	return keySeq, kind, value, true
+}
+
+// rangeDels returns the range deletions of the memtable, fragmented. The fragments are copied
+// out of the chain, so they outlive the memtable. Writers are serialized with readers of the
+// mutable memtable by the DB's lock, so a cached result is never stale.
+func (g *memTable) rangeDels() *rangedel.List {
+	if list := g.fragments.Load(); list != nil {
+		return list
+	}
+	var tombstones []rangedel.Tombstone
+	iter := g.rangeDelSkl.Iterator()
+	for valid := iter.First(); valid; valid = iter.Next() {
+		start, seq, _ := ikey.Decode(iter.Key())
+		tombstones = append(tombstones, rangedel.Tombstone{Start: slices.Clone(start), End: slices.Clone(iter.Value()), Seq: seq})
+	}
+	iter.Close()
+	list := rangedel.New(g.compare, tombstones)
+	g.fragments.Store(list)
+	return list
+}
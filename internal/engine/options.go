@@ -0,0 +1,181 @@
+package engine
+
+import (
+	"bytes"
+
+	"gosuda.org/sseuda"
+	"gosuda.org/sseuda/internal/bloom"
+	"gosuda.org/sseuda/internal/cache"
+	"gosuda.org/sseuda/internal/oldsepia/marena"
+)
+
+const (
+	// ENGINE_DEFAULT_MEMTABLE_SIZE is the memtable size limit used when Options.MemTableSize is zero.
+	ENGINE_DEFAULT_MEMTABLE_SIZE = 64 << 20
+
+	// ENGINE_DEFAULT_MEMTABLE_STOP_WRITES is the number of immutable memtables at which writes
+	// stall when Options.MemTableStopWritesThreshold is zero.
+	ENGINE_DEFAULT_MEMTABLE_STOP_WRITES = 4
+
+	// ENGINE_DEFAULT_L0_COMPACTION_THRESHOLD is the number of level 0 tables that triggers a
+	// compaction when Options.L0CompactionThreshold is zero.
+	ENGINE_DEFAULT_L0_COMPACTION_THRESHOLD = 4
+
+	// ENGINE_DEFAULT_LBASE_MAX_BYTES is the size target of level 1 when Options.LBaseMaxBytes is zero.
+	ENGINE_DEFAULT_LBASE_MAX_BYTES = 64 << 20
+
+	// ENGINE_DEFAULT_LEVEL_MULTIPLIER is the growth factor between the size targets of
+	// consecutive levels when Options.LevelMultiplier is zero.
+	ENGINE_DEFAULT_LEVEL_MULTIPLIER = 10
+
+	// ENGINE_DEFAULT_TARGET_FILE_SIZE is the size at which compactions start a new output
+	// table when Options.TargetFileSize is zero.
+	ENGINE_DEFAULT_TARGET_FILE_SIZE = 4 << 20
+
+	// ENGINE_DEFAULT_BLOB_GC_RATIO is the share of live values below which a blob file is
+	// collected when Options.BlobGCRatio is zero.
+	ENGINE_DEFAULT_BLOB_GC_RATIO = 0.5
+
+	// ENGINE_DEFAULT_BLOCK_CACHE_SIZE is the capacity of the private block cache of a database
+	// opened without Options.BlockCache.
+	ENGINE_DEFAULT_BLOCK_CACHE_SIZE = 8 << 20
+)
+
+// Options configures a DB. The zero value is usable: every unset field takes its default.
+type Options struct {
+	// Compare orders user keys. Defaults to bytes.Compare.
+	// It must not change between openings of the same database.
+	Compare func(key1, key2 []byte) int
+
+	// MergeOperator resolves the operands written with Batch.Merge. Without one, writes
+	// holding merges fail with sseuda.ErrMergeUnsupported.
+	// It must not change between openings of the same database.
+	MergeOperator sseuda.MergeOperator
+
+	// MemTableSize is the most memory, in bytes, each memtable takes. A memtable's chain of
+	// arena chunks grows up to it as writes arrive. A single entry must fit in one chunk, so
+	// it is limited to about marena.ARENA_CHAIN_MAX_ALLOC_SIZE bytes.
+	MemTableSize int64
+
+	// MemTableMmap backs the chunks of memtable chains with anonymous memory mappings instead of
+	// the Go heap, so that large memtables neither count against the heap nor pace the garbage
+	// collector. Open fails with marena.ErrMmapUnsupported on platforms without memory mappings.
+	MemTableMmap bool
+
+	// ArenaPool supplies the memtable chains and takes them back once their memtables have been
+	// flushed and released. Databases sharing a pool share its memory budget, against which
+	// each memtable counts for MemTableSize: writes stall while the budget is spent, and Open
+	// fails if it cannot get the chains to replay the log into. The database never closes it.
+	// Defaults to marena.DefaultArenaPool, which has no budget.
+	ArenaPool *marena.ArenaPool
+
+	// MemTableFlushThreshold is the memtable usage, in bytes, past which the memtable is rotated
+	// and flushed even though the next write would still fit. Defaults to 7/8 of MemTableSize.
+	MemTableFlushThreshold int64
+
+	// MemTableStopWritesThreshold is the number of immutable memtables waiting to be flushed
+	// at which writes block until the background flush catches up.
+	MemTableStopWritesThreshold int
+
+	// BlockSize is the target size of SSTable data blocks. Defaults to the sstable package default.
+	BlockSize int
+
+	// BlockCache holds the data blocks read from the tables, so that hot blocks are read from
+	// disk once. Databases sharing a cache share its capacity, each in a namespace of its own.
+	// Defaults to a private cache of ENGINE_DEFAULT_BLOCK_CACHE_SIZE bytes.
+	BlockCache *cache.Cache
+
+	// BloomBitsPerKey is the number of bits per user key of the Bloom filter written into every
+	// table, which lets Get skip the tables that cannot hold a key without reading their blocks.
+	// Defaults to bloom.BLOOM_DEFAULT_BITS_PER_KEY; a negative value writes tables without filters.
+	BloomBitsPerKey int
+
+	// PrefixExtractor, when set, adds to every table a Bloom filter of the prefixes of its user
+	// keys, which lets iterators confined to a prefix in the extractor's domain skip the tables
+	// that hold no key with that prefix. It may change between openings of the same database:
+	// tables written with another extractor, or none, are never skipped.
+	PrefixExtractor sseuda.PrefixExtractor
+
+	// L0CompactionThreshold is the number of level 0 tables at which level 0 is compacted
+	// into level 1.
+	L0CompactionThreshold int
+
+	// LBaseMaxBytes is the size target of level 1. Every deeper level may grow
+	// LevelMultiplier times larger than the one above it before it is compacted downwards.
+	LBaseMaxBytes int64
+
+	// LevelMultiplier is the growth factor between the size targets of consecutive levels.
+	LevelMultiplier int
+
+	// TargetFileSize is the size at which a compaction finishes an output table and starts
+	// the next one.
+	TargetFileSize int64
+
+	// BlobThreshold is the value size, in bytes, from which flushes and compactions move values
+	// out of the tables into blob files, leaving a small handle in their place, so that later
+	// compactions rewrite the handle rather than the value. Reads follow handles transparently.
+	// Zero keeps every value in the tables. It may change between openings of the same database.
+	BlobThreshold int
+
+	// BlobGCRatio is the share of the values of a blob file that tables must still refer to for
+	// the blob file to be kept as is. Compactions move the values of a blob file below it into new
+	// blob files, and tables holding handles into one are rewritten when no level needs
+	// compacting, so that the blob file can be deleted. Defaults to ENGINE_DEFAULT_BLOB_GC_RATIO.
+	BlobGCRatio float64
+
+	// MaxConcurrentCompactions is the number of compactions that may run at the same time.
+	// Defaults to 1.
+	MaxConcurrentCompactions int
+
+	// WALSegmentSize is the size after which the write-ahead log moves to a new segment.
+	WALSegmentSize int64
+
+	// NoSync skips the fsync of the write-ahead log after each write. Writes that were
+	// acknowledged but not yet synced may be lost in a crash; Flush forces them to disk.
+	NoSync bool
+}
+
+// withDefaults returns a copy of `opts` with every unset field filled in.
+func (opts *Options) withDefaults() Options {
+	var o Options
+	if opts != nil {
+		o = *opts
+	}
+	if o.Compare == nil {
+		o.Compare = bytes.Compare
+	}
+	if o.MemTableSize <= 0 {
+		o.MemTableSize = ENGINE_DEFAULT_MEMTABLE_SIZE
+	}
+	if o.MemTableFlushThreshold <= 0 || o.MemTableFlushThreshold > o.MemTableSize {
+		o.MemTableFlushThreshold = o.MemTableSize / 8 * 7
+	}
+	if o.ArenaPool == nil {
+		o.ArenaPool = marena.DefaultArenaPool()
+	}
+	if o.MemTableStopWritesThreshold <= 0 {
+		o.MemTableStopWritesThreshold = ENGINE_DEFAULT_MEMTABLE_STOP_WRITES
+	}
+	if o.BloomBitsPerKey == 0 {
+		o.BloomBitsPerKey = bloom.BLOOM_DEFAULT_BITS_PER_KEY
+	}
+	if o.L0CompactionThreshold <= 0 {
+		o.L0CompactionThreshold = ENGINE_DEFAULT_L0_COMPACTION_THRESHOLD
+	}
+	if o.LBaseMaxBytes <= 0 {
+		o.LBaseMaxBytes = ENGINE_DEFAULT_LBASE_MAX_BYTES
+	}
+	if o.LevelMultiplier <= 1 {
+		o.LevelMultiplier = ENGINE_DEFAULT_LEVEL_MULTIPLIER
+	}
+	if o.TargetFileSize <= 0 {
+		o.TargetFileSize = ENGINE_DEFAULT_TARGET_FILE_SIZE
+	}
+	if o.BlobGCRatio <= 0 {
+		o.BlobGCRatio = ENGINE_DEFAULT_BLOB_GC_RATIO
+	}
+	if o.MaxConcurrentCompactions <= 0 {
+		o.MaxConcurrentCompactions = 1
+	}
+	return o
+}
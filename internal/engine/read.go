@@ -0,0 +1,304 @@
+package engine
+
+import (
+	"sort"
+	"sync"
+
+	"gosuda.org/sseuda"
+	"gosuda.org/sseuda/internal/bounds"
+	"gosuda.org/sseuda/internal/ikey"
+	"gosuda.org/sseuda/internal/manifest"
+	"gosuda.org/sseuda/internal/merging"
+	"gosuda.org/sseuda/internal/rangedel"
+)
+
+// readState is the set of sources a read at sequence number `seq` consults: the memtables,
+// newest first, and a pinned version of the table levels. Every version of a key in a newer
+// source is newer than the versions in older ones; the tables of level 0 are newer than every
+// deeper level.
+type readState struct {
+	compare func(key1, key2 []byte) int // Orders user keys.
+	merge   sseuda.MergeOperator
+	seq     uint64
+	mems    []*memTable
+	version *manifest.Version
+	cache   *tableCache
+	blobs   *blobCache
+	prefix  sseuda.PrefixExtractor // Extractor of the prefix filters of the tables, or nil.
+}
+
+// unref unpins the version of the state.
+func (g *readState) unref() {
+	g.version.DecRef()
+}
+
+// get returns a copy of the value of `key` visible at the state's sequence number, or
+// sseuda.ErrNotFound. Sources are consulted newest first: the memtables, the tables of level 0,
+// then at most one table per deeper level, unless its Bloom filter rules the key out. The first
+// visible version found decides, so a deletion ends the lookup without reading older sources.
+// A merge operand does not decide: the lookup goes on through the older versions, collecting
+// operands, until one that does.
+//
+// A range deletion covering `key` hides the versions older than itself. Every version in an
+// older source is older than it, so once a source holds one, the lookup ends there too.
+func (g *readState) get(key []byte) ([]byte, error) {
+	l := lookup{key: key, merge: g.merge, blobs: g.blobs}
+	for _, mem := range g.mems {
+		l.rangeSeq = max(l.rangeSeq, mem.rangeDels().MaxSeq(key, g.seq))
+		for seq := g.seq; ; {
+			keySeq, kind, value, found := mem.get(key, seq)
+			if !found || !l.visit(keySeq, kind, value) || keySeq == 0 {
+				break
+			}
+			seq = keySeq - 1
+		}
+		if l.done || l.rangeSeq > 0 {
+			return l.result()
+		}
+	}
+
+	lookupKey := ikey.Make(key, g.seq, ikey.KindMax)
+	icompare := ikey.Comparer(g.compare)
+	for level, files := range g.version.Levels {
+		if level > 0 {
+			// Deeper levels do not overlap, so at most one table can hold the key. The search
+			// compares internal keys, so that a table ending at the sentinel of `key` is passed.
+			i := sort.Search(len(files), func(i int) bool {
+				return icompare(files[i].Largest, lookupKey) >= 0
+			})
+			files = files[i:min(i+1, len(files))]
+		}
+		for _, f := range files {
+			if g.compare(key, ikey.UserKey(f.Smallest)) < 0 || icompare(lookupKey, f.Largest) > 0 {
+				continue
+			}
+			t, err := g.cache.get(f.FileNum)
+			if err != nil {
+				return nil, err
+			}
+			// The filter only covers the entries: the range deletions of the table apply regardless.
+			l.rangeSeq = max(l.rangeSeq, t.rangeDels.MaxSeq(key, g.seq))
+			if t.reader.MayContain(key) {
+				if err := g.getFromTable(t, &l); err != nil {
+					return nil, err
+				}
+			}
+			if l.done || l.rangeSeq > 0 {
+				return l.result()
+			}
+		}
+	}
+	return l.result()
+}
+
+// getFromTable hands the versions of the key of `l` in the table `t` that are visible at the
+// state's sequence number to `l`, newest first, for as long as it needs them.
+func (g *readState) getFromTable(t *table, l *lookup) error {
+	iter := t.reader.NewIter(nil)
+	for valid := iter.Seek(ikey.Make(l.key, g.seq, ikey.KindMax)); valid; valid = iter.Next() {
+		userKey, seq, kind := ikey.Decode(iter.Key())
+		if g.compare(userKey, l.key) != 0 || !l.visit(seq, kind, iter.Value()) {
+			break
+		}
+	}
+	return iter.Close()
+}
+
+// lookup gathers the versions of `key` met by a point lookup, newest first, until one of them
+// decides its value: a set, a deletion, or a version covered by a range deletion. The merge
+// operands above that version are copied aside, to be applied to it by `merge`. The value of a
+// deciding blob entry is read from `blobs`.
+type lookup struct {
+	key      []byte
+	merge    sseuda.MergeOperator
+	blobs    *blobCache
+	rangeSeq uint64   // Sequence number of the newest range deletion of `key` met so far.
+	operands [][]byte // Merge operands met so far, newest first.
+	done     bool     // Whether a version decided the value.
+	base     []byte   // Copy of the value of the deciding version, or nil if it has none.
+	err      error    // Error reading the value of a blob entry.
+}
+
+// visit hands the next older visible version of the key to `l`. It reports whether `l` needs
+// the versions older than this one.
+func (g *lookup) visit(seq uint64, kind ikey.Kind, value []byte) bool {
+	switch {
+	case seq < g.rangeSeq || kind == ikey.KindDelete:
+	case kind == ikey.KindMerge:
+		g.operands = append(g.operands, append([]byte{}, value...))
+		return true
+	case kind == ikey.KindBlob:
+		g.base, g.err = g.blobs.read(value)
+	default:
+		g.base = append([]byte{}, value...)
+	}
+	g.done = true
+	return false
+}
+
+// result returns the value of the key: the value of the deciding version, with the operands
+// above it applied, or sseuda.ErrNotFound if it holds none and no operand was met. When no
+// version decides, the operands apply to no value.
+func (g *lookup) result() ([]byte, error) {
+	if g.err != nil {
+		return nil, g.err
+	}
+	if len(g.operands) == 0 {
+		if g.base == nil {
+			return nil, sseuda.ErrNotFound
+		}
+		return g.base, nil
+	}
+	return fullMerge(g.merge, g.key, g.base, g.operands)
+}
+
+// fullMerge applies `operands`, newest first, to `base`, which is nil if the key has no value.
+func fullMerge(merge sseuda.MergeOperator, key, base []byte, operands [][]byte) ([]byte, error) {
+	if merge == nil {
+		return nil, sseuda.ErrMergeUnsupported
+	}
+	oldestFirst := make([][]byte, len(operands))
+	for i, operand := range operands {
+		oldestFirst[len(operands)-1-i] = operand
+	}
+	return merge.FullMerge(key, base, oldestFirst)
+}
+
+// internalBounds translates user key bounds into the internal key bounds of the same range:
+// the smallest internal key of a user key precedes all of its versions. It returns nil if
+// the bounds are unbounded.
+func internalBounds(b *bounds.Bounds) *sseuda.IterOptions {
+	if b.Lower == nil && b.Upper == nil {
+		return nil
+	}
+	opts := &sseuda.IterOptions{}
+	if b.Lower != nil {
+		opts.LowerBound = ikey.Make(b.Lower, ikey.IKEY_MAX_SEQ, ikey.KindMax)
+	}
+	if b.Upper != nil {
+		opts.UpperBound = ikey.Make(b.Upper, ikey.IKEY_MAX_SEQ, ikey.KindMax)
+	}
+	return opts
+}
+
+// outside reports whether the table `f` lies entirely outside of the bounds `b`.
+func (g *readState) outside(f *manifest.FileMetadata, b *bounds.Bounds) bool {
+	return (b.Upper != nil && g.compare(ikey.UserKey(f.Smallest), b.Upper) >= 0) ||
+		(b.Lower != nil && g.compare(ikey.UserKey(f.Largest), b.Lower) < 0)
+}
+
+// filterPrefix returns the prefix to probe the prefix filters of the tables with for an
+// iterator confined to the bounds `b`, or nil if the filters cannot rule out any table: the
+// bounds have no prefix, or one outside the domain of the extractor.
+func (g *readState) filterPrefix(b *bounds.Bounds) []byte {
+	if g.prefix == nil || b.Prefix == nil || !g.prefix.InDomain(b.Prefix) {
+		return nil
+	}
+	return g.prefix.Transform(b.Prefix)
+}
+
+// tablesWithin returns the tables of `files` that may hold keys within the bounds `b`: those
+// whose key range overlaps the bounds, less those whose prefix filter rules out `prefix`,
+// when it is set.
+func (g *readState) tablesWithin(files []*manifest.FileMetadata, b *bounds.Bounds, prefix []byte) ([]*manifest.FileMetadata, error) {
+	var within []*manifest.FileMetadata
+	for _, f := range files {
+		if g.outside(f, b) {
+			continue
+		}
+		if prefix != nil {
+			t, err := g.cache.get(f.FileNum)
+			if err != nil {
+				return nil, err
+			}
+			if !t.reader.MayContainPrefix(g.prefix.Name(), prefix) {
+				continue
+			}
+		}
+		within = append(within, f)
+	}
+	return within, nil
+}
+
+// newIter returns an iterator over the internal keys of every source, confined to the
+// bounds `b` on user keys. Level 0 tables outside of the bounds are left out entirely;
+// the deeper levels skip such tables as they go. When the prefix filters can rule out tables
+// for the prefix of the bounds, the tables they rule out are left out of every level.
+func (g *readState) newIter(b *bounds.Bounds) (sseuda.Iterator, error) {
+	opts := internalBounds(b)
+	prefix := g.filterPrefix(b)
+	level0, err := g.tablesWithin(g.version.Levels[0], b, prefix)
+	if err != nil {
+		return nil, err
+	}
+	iters := make([]sseuda.Iterator, 0, len(g.mems)+len(level0)+manifest.MANIFEST_NUM_LEVELS)
+	closeAll := func() {
+		for _, iter := range iters {
+			iter.Close()
+		}
+	}
+	for _, mem := range g.mems {
+		iters = append(iters, mem.skl.IteratorWithOptions(opts))
+	}
+	for _, f := range level0 {
+		iter, err := g.cache.newIter(f.FileNum, opts)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		iters = append(iters, iter)
+	}
+	icompare := ikey.Comparer(g.compare)
+	for _, files := range g.version.Levels[1:] {
+		if prefix != nil {
+			if files, err = g.tablesWithin(files, b, prefix); err != nil {
+				closeAll()
+				return nil, err
+			}
+		}
+		if len(files) > 0 {
+			iters = append(iters, newLevelIter(icompare, g.cache, files, opts))
+		}
+	}
+	return merging.NewIterator(&merging.Options{Compare: icompare, Bounds: opts}, iters...), nil
+}
+
+// rangeDels returns the range deletions visible to the state in every source that may hold
+// keys within the bounds `b`, fragmented together.
+func (g *readState) rangeDels(b *bounds.Bounds) (*rangedel.List, error) {
+	var tombstones []rangedel.Tombstone
+	for _, mem := range g.mems {
+		tombstones = mem.rangeDels().AppendTombstones(tombstones, g.seq)
+	}
+	for _, files := range g.version.Levels {
+		for _, f := range files {
+			if g.outside(f, b) {
+				continue
+			}
+			t, err := g.cache.get(f.FileNum)
+			if err != nil {
+				return nil, err
+			}
+			tombstones = t.rangeDels.AppendTombstones(tombstones, g.seq)
+		}
+	}
+	return rangedel.New(g.compare, tombstones), nil
+}
+
+// newDBIter returns an iterator over the user keys visible to the state, confined to `opts`.
+// The iterator takes over the state's version reference. When `mu` is set, the iterator
+// holds it to step, and `release`, if set, is called once the iterator is closed.
+func (g *readState) newDBIter(mu *sync.RWMutex, release func(), opts *sseuda.IterOptions) (*dbIter, error) {
+	b := bounds.New(g.compare, opts)
+	rangeDels, err := g.rangeDels(&b)
+	if err != nil {
+		g.unref()
+		return nil, err
+	}
+	iter, err := g.newIter(&b)
+	if err != nil {
+		g.unref()
+		return nil, err
+	}
+	return &dbIter{mu: mu, release: release, compare: g.compare, iter: iter, seq: g.seq, version: g.version, bounds: b, rangeDels: rangeDels, merge: g.merge, blobs: g.blobs}, nil
+}
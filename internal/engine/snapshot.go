@@ -0,0 +1,71 @@
+package engine
+
+import (
+	"slices"
+
+	"gosuda.org/sseuda"
+)
+
+// snapshot reads the database at the sequence number of the last write applied before it was
+// taken. It pins the memtables and the version that were current then, so later flushes and
+// compactions cannot take away the data it reads, and registers its sequence number with the
+// DB so that compactions keep every version it can see.
+type snapshot struct {
+	db     *DB
+	state  readState
+	closed bool
+}
+
+var _ sseuda.Snapshot = (*snapshot)(nil)
+
+// newSnapshot pins `state`, whose version reference it takes over, and registers it.
+// The caller must hold the write lock.
+func (g *DB) newSnapshot(state readState) *snapshot {
+	for _, mem := range state.mems {
+		mem.skl.IncRef()
+	}
+	g.snapshots = append(g.snapshots, state.seq) // Sequence numbers only grow, so this stays sorted.
+	return &snapshot{db: g, state: state}
+}
+
+// Get returns a copy of the value `key` had when the snapshot was taken.
+func (g *snapshot) Get(key []byte) ([]byte, error) {
+	g.db.mu.RLock()
+	defer g.db.mu.RUnlock()
+	if g.closed {
+		return nil, ErrClosed
+	}
+	return g.state.get(key)
+}
+
+// NewIterator returns an iterator over the live keys within `opts` at the time the snapshot
+// was taken. The iterator stays usable after the snapshot is closed.
+func (g *snapshot) NewIterator(opts *sseuda.IterOptions) (sseuda.Iterator, error) {
+	g.db.mu.RLock()
+	defer g.db.mu.RUnlock()
+	if g.closed {
+		return nil, ErrClosed
+	}
+	g.state.version.IncRef()
+	return g.state.newDBIter(&g.db.mu, func() { g.db.recycleReleased(g.state.mems) }, opts)
+}
+
+// Close unpins the snapshot's memtables and version and unregisters it. The chains of the
+// memtables it was the last to reference go back to the pool.
+func (g *snapshot) Close() error {
+	g.db.mu.Lock()
+	defer g.db.mu.Unlock()
+	if g.closed {
+		return ErrClosed
+	}
+	g.closed = true
+
+	i, _ := slices.BinarySearch(g.db.snapshots, g.state.seq)
+	g.db.snapshots = slices.Delete(g.db.snapshots, i, i+1)
+	for _, mem := range g.state.mems {
+		mem.skl.DecRef()
+	}
+	g.db.recycleChains()
+	g.state.unref()
+	return nil
+}
@@ -0,0 +1,402 @@
+package engine
+
+import (
+	"bufio"
+	"cmp"
+	"os"
+	"slices"
+	"sync"
+
+	"gosuda.org/sseuda"
+	"gosuda.org/sseuda/internal/blob"
+	"gosuda.org/sseuda/internal/cache"
+	"gosuda.org/sseuda/internal/ikey"
+	"gosuda.org/sseuda/internal/manifest"
+	"gosuda.org/sseuda/internal/rangedel"
+	"gosuda.org/sseuda/internal/sstable"
+)
+
+// table is an open SSTable of the database.
+type table struct {
+	num       uint64
+	reader    *sstable.Reader
+	rangeDels *rangedel.List // Fragmented range deletions of the table, loaded when it is opened.
+}
+
+func (g *table) close() error {
+	return g.reader.Close()
+}
+
+// tableCache keeps the tables of the database open. Each table is opened on first use and
+// stays open until it is evicted, which only happens once no version contains it. The tables
+// read their data blocks through the block cache, under the namespace `cacheID`, and eviction
+// drops the blocks of the table from it.
+type tableCache struct {
+	dirname  string
+	compare  func(key1, key2 []byte) int // Orders user keys.
+	icompare func(key1, key2 []byte) int // Orders internal keys, as the tables are.
+	blocks   *cache.Cache
+	cacheID  uint64
+
+	mu     sync.Mutex
+	tables map[uint64]*table
+}
+
+// newTableCache returns an empty cache of the tables in `dirname`, whose user keys are ordered
+// by `compare`, reading their blocks through `blocks`.
+func newTableCache(dirname string, compare func(key1, key2 []byte) int, blocks *cache.Cache) *tableCache {
+	return &tableCache{
+		dirname:  dirname,
+		compare:  compare,
+		icompare: ikey.Comparer(compare),
+		blocks:   blocks,
+		cacheID:  blocks.NewID(),
+		tables:   make(map[uint64]*table),
+	}
+}
+
+// get returns table `num`, opening it if necessary.
+func (g *tableCache) get(num uint64) (*table, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if t, ok := g.tables[num]; ok {
+		return t, nil
+	}
+
+	file, err := os.Open(tableFilename(g.dirname, num))
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	reader, err := sstable.NewReader(file, info.Size(), &sstable.ReaderOptions{
+		Compare: g.icompare,
+		Cache:   g.blocks,
+		CacheID: g.cacheID,
+		FileNum: num,
+	})
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	rangeDels, err := loadRangeDels(reader, g.compare)
+	if err != nil {
+		reader.Close()
+		return nil, err
+	}
+	t := &table{num: num, reader: reader, rangeDels: rangeDels}
+	g.tables[num] = t
+	return t, nil
+}
+
+// loadRangeDels reads the range deletion block of `reader`, where each entry maps the internal
+// key of a start to an end. `compare` orders user keys.
+func loadRangeDels(reader *sstable.Reader, compare func(key1, key2 []byte) int) (*rangedel.List, error) {
+	iter := reader.NewRangeDelIter()
+	if iter == nil {
+		return rangedel.New(compare, nil), nil
+	}
+	var tombstones []rangedel.Tombstone
+	for valid := iter.First(); valid; valid = iter.Next() {
+		start, seq, _ := ikey.Decode(iter.Key())
+		tombstones = append(tombstones, rangedel.Tombstone{Start: slices.Clone(start), End: slices.Clone(iter.Value()), Seq: seq})
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return rangedel.New(compare, tombstones), nil
+}
+
+// newIter returns an iterator over table `num`, confined to `opts`, whose bounds are internal keys.
+func (g *tableCache) newIter(num uint64, opts *sseuda.IterOptions) (*sstable.Iterator, error) {
+	t, err := g.get(num)
+	if err != nil {
+		return nil, err
+	}
+	return t.reader.NewIter(opts), nil
+}
+
+// evict closes table `num` if it is open, and drops its blocks from the block cache.
+func (g *tableCache) evict(num uint64) {
+	g.mu.Lock()
+	t, ok := g.tables[num]
+	delete(g.tables, num)
+	g.mu.Unlock()
+	if ok {
+		t.close()
+		g.blocks.Evict(g.cacheID, num)
+	}
+}
+
+// close closes every open table and drops their blocks from the block cache, which may outlive
+// the database when it is shared.
+func (g *tableCache) close() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for num, t := range g.tables {
+		t.close()
+		g.blocks.Evict(g.cacheID, num)
+		delete(g.tables, num)
+	}
+}
+
+// tableBuilder writes a new table under a temporary name. finish syncs the table and renames
+// it into place, so a table file on disk is never partial.
+//
+// The bounds of the table cover its range deletions as well as its entries. A range deletion
+// ends the table at the sentinel of its exclusive end, so the next table of a level may start
+// at that very user key.
+//
+// Values of at least `blobThreshold` bytes are separated: they go to a blob file of the table's
+// own, and the table stores their handles as blob entries in their place. The builder tracks
+// how many value bytes the table refers to in every blob file, its own included.
+type tableBuilder struct {
+	dirname       string
+	num           uint64
+	icompare      func(key1, key2 []byte) int
+	file          *os.File
+	bw            *bufio.Writer
+	w             *sstable.Writer
+	smallest      []byte            // Smallest start of the range deletions added so far, as an internal key.
+	largest       []byte            // Largest end of the range deletions added so far, as a sentinel.
+	blobThreshold int               // Zero keeps every value in the table.
+	newFileNum    func() uint64     // Allocates the number of the blob file.
+	blob          *blobBuilder      // Blob file of the table, started by its first separated value.
+	blobRefs      map[uint64]uint64 // Value bytes the table refers to, by blob file.
+	keyBuf        []byte
+	handleBuf     []byte
+}
+
+// newTableBuilder starts a table with a freshly allocated file number.
+func (g *DB) newTableBuilder() (*tableBuilder, error) {
+	num := g.vs.NewFileNum()
+	file, err := os.Create(tableFilename(g.dirname, num) + tempExt)
+	if err != nil {
+		return nil, err
+	}
+	bw := bufio.NewWriterSize(file, 256<<10)
+	w := sstable.NewWriter(bw, &sstable.WriterOptions{
+		Compare:          g.icompare,
+		BlockSize:        g.opts.BlockSize,
+		FilterBitsPerKey: max(g.opts.BloomBitsPerKey, 0),
+		FilterKey:        ikey.UserKey,
+		PrefixExtractor:  g.opts.PrefixExtractor,
+	})
+	return &tableBuilder{
+		dirname:       g.dirname,
+		num:           num,
+		icompare:      g.icompare,
+		file:          file,
+		bw:            bw,
+		w:             w,
+		blobThreshold: g.opts.BlobThreshold,
+		newFileNum:    g.vs.NewFileNum,
+		blobRefs:      make(map[uint64]uint64),
+	}, nil
+}
+
+// add appends an entry, separating its value if it is a set of at least `blobThreshold` bytes.
+func (g *tableBuilder) add(key, value []byte) error {
+	switch _, _, kind := ikey.Decode(key); {
+	case kind == ikey.KindSet && g.blobThreshold > 0 && len(value) >= g.blobThreshold:
+		return g.addBlob(key, value)
+	case kind == ikey.KindBlob:
+		h, err := blob.DecodeHandle(value)
+		if err != nil {
+			return err
+		}
+		g.blobRefs[h.FileNum] += h.Length
+	}
+	return g.w.Add(key, value)
+}
+
+// addBlob writes `value` to the blob file of the table and adds the handle that locates it
+// under `key`, turned into a blob entry.
+func (g *tableBuilder) addBlob(key, value []byte) error {
+	if g.blob == nil {
+		var err error
+		if g.blob, err = newBlobBuilder(g.dirname, g.newFileNum()); err != nil {
+			return err
+		}
+	}
+	h, err := g.blob.add(value)
+	if err != nil {
+		return err
+	}
+	g.blobRefs[h.FileNum] += h.Length
+	userKey, seq, _ := ikey.Decode(key)
+	g.keyBuf = ikey.Append(g.keyBuf[:0], userKey, seq, ikey.KindBlob)
+	g.handleBuf = h.Encode(g.handleBuf[:0])
+	return g.w.Add(g.keyBuf, g.handleBuf)
+}
+
+// addRangeDel records the deletion of [start, end) at sequence number `seq`. Deletions must be
+// added in the order of their internal keys: by start, then newest first.
+func (g *tableBuilder) addRangeDel(start, end []byte, seq uint64) error {
+	key := ikey.Make(start, seq, ikey.KindRangeDelete)
+	if err := g.w.AddRangeDel(key, end); err != nil {
+		return err
+	}
+	if g.smallest == nil || g.icompare(key, g.smallest) < 0 {
+		g.smallest = key
+	}
+	if sentinel := ikey.MakeRangeDeleteSentinel(end); g.largest == nil || g.icompare(sentinel, g.largest) > 0 {
+		g.largest = sentinel
+	}
+	return nil
+}
+
+// addRangeDels records every fragment of `list`.
+func (g *tableBuilder) addRangeDels(list *rangedel.List) error {
+	for _, f := range list.Fragments() {
+		for _, seq := range f.Seqs {
+			if err := g.addRangeDel(f.Start, f.End, seq); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// size returns the number of bytes written so far.
+func (g *tableBuilder) size() int64 {
+	return int64(g.w.Size())
+}
+
+// bounds returns the smallest and largest internal keys of the table, range deletions included.
+func (g *tableBuilder) bounds() (smallest, largest []byte) {
+	smallest, largest = g.w.Bounds()
+	if g.smallest != nil && (len(smallest) == 0 || g.icompare(g.smallest, smallest) < 0) {
+		smallest = g.smallest
+	}
+	if g.largest != nil && (len(largest) == 0 || g.icompare(g.largest, largest) > 0) {
+		largest = g.largest
+	}
+	return smallest, largest
+}
+
+// finish completes the table, and its blob file if it has one, and records them in `edit` as
+// new files of `level`. The builder is abandoned on error.
+func (g *tableBuilder) finish(edit *manifest.VersionEdit, level int) error {
+	smallest, largest := g.bounds()
+	meta := &manifest.FileMetadata{
+		FileNum:  g.num,
+		Smallest: slices.Clone(smallest),
+		Largest:  slices.Clone(largest),
+	}
+	for num, bytes := range g.blobRefs {
+		meta.BlobRefs = append(meta.BlobRefs, manifest.BlobRef{FileNum: num, Bytes: bytes})
+	}
+	slices.SortFunc(meta.BlobRefs, func(a, b manifest.BlobRef) int {
+		return cmp.Compare(a.FileNum, b.FileNum)
+	})
+
+	var blobMeta *manifest.BlobFileMetadata
+	if g.blob != nil {
+		var err error
+		blobMeta, err = g.blob.finish()
+		g.blob = nil
+		if err != nil {
+			g.abandon()
+			return err
+		}
+	}
+	err := g.w.Close()
+	if err == nil {
+		err = g.bw.Flush()
+	}
+	if err == nil {
+		err = g.file.Sync()
+	}
+	if err != nil {
+		g.abandon()
+		removeBlobFile(g.dirname, blobMeta)
+		return err
+	}
+	meta.Size = g.w.Size()
+
+	filename := tableFilename(g.dirname, g.num)
+	if err := g.file.Close(); err != nil {
+		os.Remove(filename + tempExt)
+		removeBlobFile(g.dirname, blobMeta)
+		return err
+	}
+	if err := os.Rename(filename+tempExt, filename); err != nil {
+		os.Remove(filename + tempExt)
+		removeBlobFile(g.dirname, blobMeta)
+		return err
+	}
+	if err := syncDir(g.dirname); err != nil {
+		return err
+	}
+	if blobMeta != nil {
+		edit.NewBlobFiles = append(edit.NewBlobFiles, blobMeta)
+	}
+	edit.NewFiles = append(edit.NewFiles, manifest.NewFile{Level: level, Meta: meta})
+	return nil
+}
+
+// abandon discards the partially written table and blob file.
+func (g *tableBuilder) abandon() {
+	g.file.Close()
+	os.Remove(tableFilename(g.dirname, g.num) + tempExt)
+	if g.blob != nil {
+		g.blob.abandon()
+		g.blob = nil
+	}
+}
+
+// removeBlobFile deletes the finished blob file `meta` of a table that failed to finish, if any.
+func removeBlobFile(dirname string, meta *manifest.BlobFileMetadata) {
+	if meta != nil {
+		os.Remove(blobFilename(dirname, meta.FileNum))
+	}
+}
+
+// writeTable writes every entry of `iter` and every range deletion of `rangeDels` to a new
+// table of level 0, and records it in `edit`.
+func (g *DB) writeTable(iter sseuda.Iterator, rangeDels *rangedel.List, edit *manifest.VersionEdit) error {
+	b, err := g.newTableBuilder()
+	if err != nil {
+		return err
+	}
+	for valid := iter.First(); valid; valid = iter.Next() {
+		if err := b.add(iter.Key(), iter.Value()); err != nil {
+			b.abandon()
+			return err
+		}
+	}
+	if err := b.addRangeDels(rangeDels); err != nil {
+		b.abandon()
+		return err
+	}
+	return b.finish(edit, 0)
+}
+
+// deleteObsoleteTables closes and deletes the tables and blob files that no live version
+// contains any more, and drops their blocks from the block cache. The version set hands each
+// obsolete file out once, so concurrent calls delete different files. The caller must not hold
+// the write lock, which would stall every read and write behind the deletions.
+func (g *DB) deleteObsoleteTables() error {
+	obsolete := g.vs.Obsolete()
+	for _, f := range obsolete {
+		g.tableCache.evict(f.FileNum)
+		if err := os.Remove(tableFilename(g.dirname, f.FileNum)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	obsoleteBlobs := g.vs.ObsoleteBlobFiles()
+	for _, b := range obsoleteBlobs {
+		g.blobCache.evict(b.FileNum)
+		if err := os.Remove(blobFilename(g.dirname, b.FileNum)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if len(obsolete) == 0 && len(obsoleteBlobs) == 0 {
+		return nil
+	}
+	return syncDir(g.dirname)
+}
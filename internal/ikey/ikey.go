@@ -0,0 +1,145 @@
+// Package ikey implements the internal keys that the engine stores in memtables and tables.
+//
+// An internal key is a user key followed by an 8-byte little-endian trailer packing a 56-bit
+// sequence number and a one-byte kind:
+//
+//	+-----------------+------------------------------------+
+//	| User key        | Trailer: seq << 8 | kind (8 bytes) |
+//	+-----------------+------------------------------------+
+//
+// Every write is assigned a distinct sequence number, so writes to the same user key become
+// distinct internal keys instead of overwriting each other. Internal keys are ordered by user
+// key ascending and then by trailer descending, so that the newest version of a user key comes
+// first and a reader at sequence number `seq` finds the version it sees with a single seek.
+package ikey
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	// IKEY_TRAILER_SIZE is the size of the trailer appended to every user key.
+	IKEY_TRAILER_SIZE = 8
+
+	// IKEY_MAX_SEQ is the largest sequence number that fits in a trailer.
+	IKEY_MAX_SEQ = 1<<56 - 1
+)
+
+// Kind is the kind of write an internal key records.
+type Kind uint8
+
+const (
+	KindDelete      Kind = 0 // The user key was deleted.
+	KindSet         Kind = 1 // The user key was set to the value.
+	KindMerge       Kind = 2 // The value is an operand to merge into the previous value.
+	KindRangeDelete Kind = 3 // Every user key in [user key, value) was deleted.
+	KindBlob        Kind = 4 // The user key was set to the value the blob handle in the value locates.
+
+	// KindMax is the largest kind. Seeking to a user key with KindMax at sequence number
+	// `seq` lands on the first version visible at `seq`.
+	KindMax = KindBlob
+
+	// KindInvalid is reported for keys too short to hold a trailer.
+	KindInvalid Kind = 255
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindDelete:
+		return "DEL"
+	case KindSet:
+		return "SET"
+	case KindMerge:
+		return "MERGE"
+	case KindRangeDelete:
+		return "RANGEDEL"
+	case KindBlob:
+		return "BLOB"
+	}
+	return fmt.Sprintf("INVALID(%d)", uint8(k))
+}
+
+// Append appends the internal key of `userKey` at `seq` with `kind` to `dst`.
+func Append(dst []byte, userKey []byte, seq uint64, kind Kind) []byte {
+	dst = append(dst, userKey...)
+	return binary.LittleEndian.AppendUint64(dst, seq<<8|uint64(kind))
+}
+
+// Make returns the internal key of `userKey` at `seq` with `kind`.
+func Make(userKey []byte, seq uint64, kind Kind) []byte {
+	return Append(make([]byte, 0, len(userKey)+IKEY_TRAILER_SIZE), userKey, seq, kind)
+}
+
+// MakeRangeDeleteSentinel returns the internal key that ends a table whose range deletions
+// extend up to, but exclude, `userKey`. It sorts before every real version of `userKey`, so
+// the next table of a level may start at `userKey` without overlapping the table it ends.
+func MakeRangeDeleteSentinel(userKey []byte) []byte {
+	return Make(userKey, IKEY_MAX_SEQ, KindRangeDelete)
+}
+
+// IsRangeDeleteSentinel reports whether `key` was made by MakeRangeDeleteSentinel. No write
+// is assigned IKEY_MAX_SEQ, so a real internal key never is.
+func IsRangeDeleteSentinel(key []byte) bool {
+	_, seq, kind := Decode(key)
+	return seq == IKEY_MAX_SEQ && kind == KindRangeDelete
+}
+
+// Decode splits an internal key into its parts. The user key aliases `key`.
+// A key too short to hold a trailer decodes as itself with KindInvalid.
+func Decode(key []byte) (userKey []byte, seq uint64, kind Kind) {
+	n := len(key) - IKEY_TRAILER_SIZE
+	if n < 0 {
+		return key, 0, KindInvalid
+	}
+	trailer := binary.LittleEndian.Uint64(key[n:])
+	kind = Kind(trailer)
+	if kind > KindMax {
+		kind = KindInvalid
+	}
+	return key[:n:n], trailer >> 8, kind
+}
+
+// UserKey returns the user key part of an internal key.
+func UserKey(key []byte) []byte {
+	userKey, _, _ := Decode(key)
+	return userKey
+}
+
+// Seq returns the sequence number of an internal key.
+func Seq(key []byte) uint64 {
+	_, seq, _ := Decode(key)
+	return seq
+}
+
+// trailer returns the trailer of an internal key, or 0 for a key too short to hold one.
+func trailer(key []byte) uint64 {
+	if len(key) < IKEY_TRAILER_SIZE {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(key[len(key)-IKEY_TRAILER_SIZE:])
+}
+
+// Comparer returns the ordering of internal keys built on the user key ordering `compare`:
+// user key ascending, then sequence number and kind descending.
+func Comparer(compare func(key1, key2 []byte) int) func(key1, key2 []byte) int {
+	return func(key1, key2 []byte) int {
+		if c := compare(UserKey(key1), UserKey(key2)); c != 0 {
+			return c
+		}
+		t1, t2 := trailer(key1), trailer(key2)
+		switch {
+		case t1 > t2:
+			return -1
+		case t1 < t2:
+			return 1
+		}
+		return 0
+	}
+}
+
+// Format renders an internal key for debugging, as "userkey#seq,KIND".
+func Format(key []byte) string {
+	userKey, seq, kind := Decode(key)
+	return fmt.Sprintf("%q#%d,%s", userKey, seq, kind)
+}
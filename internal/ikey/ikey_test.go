@@ -0,0 +1,66 @@
+package ikey_test
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+
+	"gosuda.org/sseuda/internal/ikey"
+)
+
+// TestDecode verifies that an internal key decodes into the parts it was made of.
+func TestDecode(t *testing.T) {
+	key := ikey.Make([]byte("user"), ikey.IKEY_MAX_SEQ, ikey.KindRangeDelete)
+	userKey, seq, kind := ikey.Decode(key)
+	if string(userKey) != "user" || seq != ikey.IKEY_MAX_SEQ || kind != ikey.KindRangeDelete {
+		t.Fatalf("Decode: got %q, %d, %s", userKey, seq, kind)
+	}
+	if _, _, kind := ikey.Decode([]byte("short")); kind != ikey.KindInvalid {
+		t.Fatalf("Decode of a short key: got kind %s", kind)
+	}
+}
+
+// TestComparer verifies that internal keys order by user key, then newest first.
+func TestComparer(t *testing.T) {
+	want := [][]byte{
+		ikey.Make([]byte("a"), 9, ikey.KindSet),
+		ikey.Make([]byte("a"), 5, ikey.KindMax),
+		ikey.Make([]byte("a"), 5, ikey.KindDelete),
+		ikey.Make([]byte("a"), 1, ikey.KindSet),
+		ikey.Make([]byte("ab"), 100, ikey.KindSet),
+		ikey.Make([]byte("b"), 0, ikey.KindSet),
+	}
+	got := slices.Clone(want)
+	slices.Reverse(got)
+	slices.SortFunc(got, ikey.Comparer(bytes.Compare))
+	for i := range want {
+		if !bytes.Equal(got[i], want[i]) {
+			t.Fatalf("position %d: got %s, want %s", i, ikey.Format(got[i]), ikey.Format(want[i]))
+		}
+	}
+}
+
+// TestRangeDeleteSentinel verifies that the sentinel of a user key sorts before all of its
+// versions and is told apart from them.
+func TestRangeDeleteSentinel(t *testing.T) {
+	sentinel := ikey.MakeRangeDeleteSentinel([]byte("b"))
+	if !ikey.IsRangeDeleteSentinel(sentinel) {
+		t.Fatalf("IsRangeDeleteSentinel(%s) = false", ikey.Format(sentinel))
+	}
+	compare := ikey.Comparer(bytes.Compare)
+	for _, key := range [][]byte{
+		ikey.Make([]byte("b"), ikey.IKEY_MAX_SEQ-1, ikey.KindMax),
+		ikey.Make([]byte("b"), 1, ikey.KindRangeDelete),
+		ikey.Make([]byte("b"), 0, ikey.KindDelete),
+	} {
+		if ikey.IsRangeDeleteSentinel(key) {
+			t.Errorf("IsRangeDeleteSentinel(%s) = true", ikey.Format(key))
+		}
+		if compare(sentinel, key) >= 0 {
+			t.Errorf("sentinel does not sort before %s", ikey.Format(key))
+		}
+	}
+	if compare(ikey.Make([]byte("a"), 0, ikey.KindDelete), sentinel) >= 0 {
+		t.Errorf("sentinel sorts before a smaller user key")
+	}
+}
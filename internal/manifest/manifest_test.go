@@ -0,0 +1,275 @@
+package manifest_test
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"gosuda.org/sseuda/internal/ikey"
+	"gosuda.org/sseuda/internal/manifest"
+)
+
+func meta(num uint64, smallest, largest string) *manifest.FileMetadata {
+	return &manifest.FileMetadata{
+		FileNum:  num,
+		Size:     100 * num,
+		Smallest: ikey.Make([]byte(smallest), num, ikey.KindSet),
+		Largest:  ikey.Make([]byte(largest), num, ikey.KindSet),
+	}
+}
+
+func openVS(t *testing.T, dir string) *manifest.VersionSet {
+	t.Helper()
+	vs, err := manifest.Open(dir, bytes.Compare)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return vs
+}
+
+func apply(t *testing.T, vs *manifest.VersionSet, edit *manifest.VersionEdit) {
+	t.Helper()
+	if err := vs.LogAndApply(edit); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// levels renders the file numbers of every non-empty level, e.g. "L0:[5 4] L1:[2 3]".
+func levels(v *manifest.Version) string {
+	var parts []string
+	for level, files := range v.Levels {
+		if len(files) == 0 {
+			continue
+		}
+		nums := make([]uint64, len(files))
+		for i, f := range files {
+			nums[i] = f.FileNum
+		}
+		parts = append(parts, fmt.Sprintf("L%d:%v", level, nums))
+	}
+	return strings.Join(parts, " ")
+}
+
+// TestVersionEditRoundTrip verifies that a decoded edit equals the encoded one.
+func TestVersionEditRoundTrip(t *testing.T) {
+	edit := manifest.VersionEdit{
+		LogNumber:      7,
+		NextFileNumber: 12,
+		LastSequence:   1000,
+		DeletedFiles:   []manifest.DeletedFile{{Level: 0, FileNum: 3}, {Level: 2, FileNum: 4}},
+		NewFiles: []manifest.NewFile{
+			{Level: 1, Meta: meta(9, "a", "m")},
+			{Level: 1, Meta: meta(10, "n", "z")},
+		},
+		NewBlobFiles: []*manifest.BlobFileMetadata{{FileNum: 8, Size: 4096, ValueBytes: 4000}},
+	}
+	edit.NewFiles[0].Meta.BlobRefs = []manifest.BlobRef{{FileNum: 8, Bytes: 3000}, {FileNum: 2, Bytes: 50}}
+
+	var decoded manifest.VersionEdit
+	if err := decoded.Decode(edit.Encode(nil)); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(edit, decoded) {
+		t.Fatalf("round trip: got %+v, want %+v", decoded, edit)
+	}
+
+	if err := decoded.Decode([]byte{99}); err == nil {
+		t.Fatal("expected an unknown tag to fail decoding")
+	}
+}
+
+// TestVersionSetRecovery verifies that the levels and log number survive a reopen, and that
+// level 0 is ordered newest first while deeper levels are ordered by key.
+func TestVersionSetRecovery(t *testing.T) {
+	dir := t.TempDir()
+	vs := openVS(t, dir)
+	apply(t, vs, &manifest.VersionEdit{LogNumber: 3, NewFiles: []manifest.NewFile{{Level: 0, Meta: meta(4, "a", "k")}}})
+	apply(t, vs, &manifest.VersionEdit{LogNumber: 5, LastSequence: 42, NewFiles: []manifest.NewFile{{Level: 0, Meta: meta(6, "c", "z")}}})
+	apply(t, vs, &manifest.VersionEdit{
+		DeletedFiles: []manifest.DeletedFile{{Level: 0, FileNum: 4}},
+		NewFiles: []manifest.NewFile{
+			{Level: 1, Meta: meta(8, "l", "p")},
+			{Level: 1, Meta: meta(7, "a", "f")},
+		},
+	})
+	const want = "L0:[6] L1:[7 8]"
+
+	v := vs.Current()
+	if got := levels(v); got != want {
+		t.Fatalf("levels: got %q, want %q", got, want)
+	}
+	v.DecRef()
+	next := vs.NewFileNum()
+	if err := vs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	vs = openVS(t, dir)
+	defer vs.Close()
+	v = vs.Current()
+	defer v.DecRef()
+	if got := levels(v); got != want {
+		t.Fatalf("levels after reopen: got %q, want %q", got, want)
+	}
+	if got := vs.LogNumber(); got != 5 {
+		t.Fatalf("log number after reopen: got %d, want 5", got)
+	}
+	if got := vs.LastSequence(); got != 42 {
+		t.Fatalf("last sequence after reopen: got %d, want 42", got)
+	}
+	if got := vs.NewFileNum(); got <= next {
+		t.Fatalf("file number %d reused after reopen (previously allocated %d)", got, next)
+	}
+	if f := v.Levels[1][1]; string(ikey.UserKey(f.Smallest)) != "l" || string(ikey.UserKey(f.Largest)) != "p" || f.Size != 800 {
+		t.Fatalf("table metadata after reopen: %+v", f)
+	}
+
+	manifests, _ := filepath.Glob(filepath.Join(dir, manifest.MANIFEST_FILENAME_PREFIX+"*"))
+	if len(manifests) != 1 {
+		t.Fatalf("expected a single manifest, found %v", manifests)
+	}
+}
+
+// TestVersionSetRejectsOverlap verifies that an edit overlapping tables in a deep level is
+// rejected and leaves the current version in place.
+func TestVersionSetRejectsOverlap(t *testing.T) {
+	vs := openVS(t, t.TempDir())
+	defer vs.Close()
+	apply(t, vs, &manifest.VersionEdit{NewFiles: []manifest.NewFile{{Level: 1, Meta: meta(2, "a", "m")}}})
+
+	err := vs.LogAndApply(&manifest.VersionEdit{NewFiles: []manifest.NewFile{{Level: 1, Meta: meta(3, "k", "z")}}})
+	if err == nil {
+		t.Fatal("expected overlapping tables in level 1 to be rejected")
+	}
+	v := vs.Current()
+	defer v.DecRef()
+	if got := levels(v); got != "L1:[2]" {
+		t.Fatalf("levels after rejected edit: %q", got)
+	}
+
+	// A table whose range deletions end at "t" does not overlap a table starting there.
+	sentinel := meta(4, "n", "r")
+	sentinel.Largest = ikey.MakeRangeDeleteSentinel([]byte("t"))
+	apply(t, vs, &manifest.VersionEdit{NewFiles: []manifest.NewFile{{Level: 1, Meta: sentinel}}})
+	apply(t, vs, &manifest.VersionEdit{NewFiles: []manifest.NewFile{{Level: 1, Meta: meta(5, "t", "u")}}})
+}
+
+// TestVersionPinning verifies that a table removed from the current version only becomes
+// obsolete once every version containing it has been unpinned.
+func TestVersionPinning(t *testing.T) {
+	vs := openVS(t, t.TempDir())
+	defer vs.Close()
+	apply(t, vs, &manifest.VersionEdit{NewFiles: []manifest.NewFile{{Level: 0, Meta: meta(2, "a", "m")}}})
+
+	pinned := vs.Current()
+	apply(t, vs, &manifest.VersionEdit{
+		DeletedFiles: []manifest.DeletedFile{{Level: 0, FileNum: 2}},
+		NewFiles:     []manifest.NewFile{{Level: 1, Meta: meta(3, "a", "m")}},
+	})
+	if obsolete := vs.Obsolete(); len(obsolete) != 0 {
+		t.Fatalf("table obsolete while a version still contains it: %v", obsolete)
+	}
+	if got := levels(pinned); got != "L0:[2]" {
+		t.Fatalf("pinned version changed: %q", got)
+	}
+
+	pinned.DecRef()
+	obsolete := vs.Obsolete()
+	if len(obsolete) != 1 || obsolete[0].FileNum != 2 {
+		t.Fatalf("expected table 2 to be obsolete, got %v", obsolete)
+	}
+}
+
+// TestVersionSetTornManifest verifies that a torn edit at the end of the manifest, which was
+// never acknowledged, is ignored on reopen.
+func TestVersionSetTornManifest(t *testing.T) {
+	dir := t.TempDir()
+	vs := openVS(t, dir)
+	apply(t, vs, &manifest.VersionEdit{NewFiles: []manifest.NewFile{{Level: 0, Meta: meta(2, "a", "m")}}})
+	vs.Close()
+
+	current, err := os.ReadFile(filepath.Join(dir, manifest.MANIFEST_CURRENT_FILENAME))
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.OpenFile(filepath.Join(dir, strings.TrimSpace(string(current))), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte{1, 2, 3, 4, 40, 0, 0, 0, 4, 1})
+	file.Close()
+
+	vs = openVS(t, dir)
+	defer vs.Close()
+	v := vs.Current()
+	defer v.DecRef()
+	if got := levels(v); got != "L0:[2]" {
+		t.Fatalf("levels after torn edit: %q", got)
+	}
+}
+
+// TestVersionSetBlobFiles verifies that a blob file belongs to the versions whose tables refer
+// to it, that it becomes obsolete with the last of them, and that it survives a reopen.
+func TestVersionSetBlobFiles(t *testing.T) {
+	dir := t.TempDir()
+	vs := openVS(t, dir)
+	withRefs := func(f *manifest.FileMetadata, refs ...manifest.BlobRef) *manifest.FileMetadata {
+		f.BlobRefs = refs
+		return f
+	}
+	apply(t, vs, &manifest.VersionEdit{
+		NewFiles:     []manifest.NewFile{{Level: 0, Meta: withRefs(meta(5, "a", "k"), manifest.BlobRef{FileNum: 4, Bytes: 600})}},
+		NewBlobFiles: []*manifest.BlobFileMetadata{{FileNum: 4, Size: 1100, ValueBytes: 1000}},
+	})
+	apply(t, vs, &manifest.VersionEdit{
+		NewFiles:     []manifest.NewFile{{Level: 1, Meta: withRefs(meta(7, "l", "z"), manifest.BlobRef{FileNum: 4, Bytes: 400}, manifest.BlobRef{FileNum: 6, Bytes: 10})}},
+		NewBlobFiles: []*manifest.BlobFileMetadata{{FileNum: 6, Size: 20, ValueBytes: 10}},
+	})
+	if err := vs.LogAndApply(&manifest.VersionEdit{
+		NewFiles: []manifest.NewFile{{Level: 0, Meta: withRefs(meta(8, "a", "b"), manifest.BlobRef{FileNum: 99, Bytes: 1})}},
+	}); err == nil {
+		t.Fatal("expected a reference to an unknown blob file to fail")
+	}
+
+	v := vs.Current()
+	if live := v.BlobLiveBytes(); len(v.BlobFiles) != 2 || live[4] != 1000 || live[6] != 10 {
+		t.Fatalf("blob files %v with live bytes %v, want 4 and 6 fully live", v.BlobFiles, live)
+	}
+	v.DecRef()
+
+	apply(t, vs, &manifest.VersionEdit{DeletedFiles: []manifest.DeletedFile{{Level: 0, FileNum: 5}}})
+	if obsolete := vs.ObsoleteBlobFiles(); len(obsolete) != 0 {
+		t.Fatalf("blob files %v obsolete while table 7 still refers to them", obsolete)
+	}
+	v = vs.Current()
+	if live := v.BlobLiveBytes(); live[4] != 400 {
+		t.Errorf("live bytes of blob file 4 = %d, want 400", live[4])
+	}
+	if err := vs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	vs = openVS(t, dir)
+	defer vs.Close()
+	v.DecRef()
+	v = vs.Current()
+	if b := v.BlobFiles[4]; b == nil || b.Size != 1100 || b.ValueBytes != 1000 || len(v.BlobFiles) != 2 {
+		t.Fatalf("blob files after reopen: %v", v.BlobFiles)
+	}
+	v.DecRef()
+
+	apply(t, vs, &manifest.VersionEdit{DeletedFiles: []manifest.DeletedFile{{Level: 1, FileNum: 7}}})
+	var nums []uint64
+	for _, b := range vs.ObsoleteBlobFiles() {
+		nums = append(nums, b.FileNum)
+	}
+	slices.Sort(nums)
+	if !slices.Equal(nums, []uint64{4, 6}) {
+		t.Fatalf("obsolete blob files = %v, want [4 6]", nums)
+	}
+}
@@ -0,0 +1,107 @@
+// Package manifest tracks which tables make up each level of the LSM tree.
+//
+// A Version is an immutable snapshot of the tree: level 0 holds tables flushed from memtables,
+// which may overlap and are ordered newest first; every deeper level is a sorted run of
+// non-overlapping tables. A VersionSet moves from one Version to the next by applying
+// VersionEdits, each of which is first appended to the MANIFEST log so that the tree can be
+// rebuilt on open.
+package manifest
+
+import (
+	"sync/atomic"
+
+	"gosuda.org/sseuda/internal/ikey"
+)
+
+const (
+	// MANIFEST_NUM_LEVELS is the number of levels of the LSM tree.
+	MANIFEST_NUM_LEVELS = 7
+)
+
+// FileMetadata describes a table of the tree.
+type FileMetadata struct {
+	FileNum  uint64 // File number of the table.
+	Size     uint64 // Size of the table in bytes.
+	Smallest []byte // Smallest internal key in the table.
+	Largest  []byte // Largest internal key in the table.
+	BlobRefs []BlobRef
+
+	refs atomic.Int32 // Number of versions that contain the table.
+}
+
+// BlobRef records that a table holds handles to `Bytes` bytes of values in blob file `FileNum`.
+type BlobRef struct {
+	FileNum uint64
+	Bytes   uint64
+}
+
+// BlobFileMetadata describes a blob file holding values of the tables of the tree.
+type BlobFileMetadata struct {
+	FileNum    uint64 // File number of the blob file.
+	Size       uint64 // Size of the blob file in bytes.
+	ValueBytes uint64 // Total length of the values in the blob file.
+
+	refs atomic.Int32 // Number of versions that contain the blob file.
+}
+
+// Version is an immutable set of tables, arranged by level.
+// A Version is reference counted: readers pin it with IncRef while they read its tables, and
+// a table stops being live once no Version referencing it remains.
+type Version struct {
+	Levels [MANIFEST_NUM_LEVELS][]*FileMetadata
+
+	// BlobFiles holds the blob files that the tables of the version hold handles into, by file
+	// number. A blob file leaves the tree once no table refers to it any more.
+	BlobFiles map[uint64]*BlobFileMetadata
+
+	refs atomic.Int32
+	vs   *VersionSet
+}
+
+// IncRef pins the version.
+func (g *Version) IncRef() {
+	g.refs.Add(1)
+}
+
+// DecRef unpins the version. When the last reference is dropped, every table that only this
+// version contained becomes obsolete.
+func (g *Version) DecRef() {
+	if g.refs.Add(-1) == 0 {
+		g.vs.release(g)
+	}
+}
+
+// Overlaps returns the tables of `level` holding user keys in [smallest, largest], where
+// `compare` orders user keys.
+func (g *Version) Overlaps(level int, compare func(key1, key2 []byte) int, smallest, largest []byte) []*FileMetadata {
+	var out []*FileMetadata
+	for _, f := range g.Levels[level] {
+		if compare(ikey.UserKey(f.Largest), smallest) >= 0 && compare(ikey.UserKey(f.Smallest), largest) <= 0 {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// BlobLiveBytes returns, for each blob file of the version, the total length of the values
+// the tables of the version hold handles to. The rest of the blob file is garbage.
+func (g *Version) BlobLiveBytes() map[uint64]uint64 {
+	live := make(map[uint64]uint64, len(g.BlobFiles))
+	for _, files := range g.Levels {
+		for _, f := range files {
+			for _, ref := range f.BlobRefs {
+				live[ref.FileNum] += ref.Bytes
+			}
+		}
+	}
+	return live
+}
+
+// NumFiles returns the total number of tables in the version.
+func (g *Version) NumFiles() int {
+	n := 0
+	for _, files := range g.Levels {
+		n += len(files)
+	}
+	return n
+}
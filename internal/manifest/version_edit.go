@@ -0,0 +1,275 @@
+package manifest
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+
+	"gosuda.org/sseuda/internal/ikey"
+)
+
+var (
+	ErrCorrupt = errors.New("manifest: corrupt version edit")
+)
+
+// Tags identifying the fields of an encoded VersionEdit.
+const (
+	tagLogNumber      = 1
+	tagNextFileNumber = 2
+	tagDeletedFile    = 3
+	tagNewFile        = 4
+	tagLastSequence   = 5
+	tagNewBlobFile    = 6
+	tagBlobRefs       = 7 // Blob references of the table of the preceding tagNewFile.
+)
+
+// DeletedFile identifies a table removed from a level.
+type DeletedFile struct {
+	Level   int
+	FileNum uint64
+}
+
+// NewFile is a table added to a level.
+type NewFile struct {
+	Level int
+	Meta  *FileMetadata
+}
+
+// VersionEdit is the difference between two consecutive versions.
+type VersionEdit struct {
+	// LogNumber, when non-zero, is the oldest write-ahead log segment still needed:
+	// every older segment has been flushed to tables.
+	LogNumber uint64
+
+	// NextFileNumber, when non-zero, is the next unused file number.
+	NextFileNumber uint64
+
+	// LastSequence, when non-zero, is the largest sequence number assigned to a write.
+	LastSequence uint64
+
+	DeletedFiles []DeletedFile
+	NewFiles     []NewFile
+
+	// NewBlobFiles are the blob files written for the new tables.
+	NewBlobFiles []*BlobFileMetadata
+}
+
+// Encode appends the encoding of the edit to `dst`. Each field is a uvarint tag followed
+// by its value; keys are uvarint length-prefixed.
+func (g *VersionEdit) Encode(dst []byte) []byte {
+	if g.LogNumber != 0 {
+		dst = binary.AppendUvarint(dst, tagLogNumber)
+		dst = binary.AppendUvarint(dst, g.LogNumber)
+	}
+	if g.NextFileNumber != 0 {
+		dst = binary.AppendUvarint(dst, tagNextFileNumber)
+		dst = binary.AppendUvarint(dst, g.NextFileNumber)
+	}
+	if g.LastSequence != 0 {
+		dst = binary.AppendUvarint(dst, tagLastSequence)
+		dst = binary.AppendUvarint(dst, g.LastSequence)
+	}
+	for _, d := range g.DeletedFiles {
+		dst = binary.AppendUvarint(dst, tagDeletedFile)
+		dst = binary.AppendUvarint(dst, uint64(d.Level))
+		dst = binary.AppendUvarint(dst, d.FileNum)
+	}
+	for _, b := range g.NewBlobFiles {
+		dst = binary.AppendUvarint(dst, tagNewBlobFile)
+		dst = binary.AppendUvarint(dst, b.FileNum)
+		dst = binary.AppendUvarint(dst, b.Size)
+		dst = binary.AppendUvarint(dst, b.ValueBytes)
+	}
+	for _, n := range g.NewFiles {
+		dst = binary.AppendUvarint(dst, tagNewFile)
+		dst = binary.AppendUvarint(dst, uint64(n.Level))
+		dst = binary.AppendUvarint(dst, n.Meta.FileNum)
+		dst = binary.AppendUvarint(dst, n.Meta.Size)
+		dst = appendBytes(dst, n.Meta.Smallest)
+		dst = appendBytes(dst, n.Meta.Largest)
+		if len(n.Meta.BlobRefs) > 0 {
+			dst = binary.AppendUvarint(dst, tagBlobRefs)
+			dst = binary.AppendUvarint(dst, uint64(len(n.Meta.BlobRefs)))
+			for _, ref := range n.Meta.BlobRefs {
+				dst = binary.AppendUvarint(dst, ref.FileNum)
+				dst = binary.AppendUvarint(dst, ref.Bytes)
+			}
+		}
+	}
+	return dst
+}
+
+func appendBytes(dst []byte, b []byte) []byte {
+	dst = binary.AppendUvarint(dst, uint64(len(b)))
+	return append(dst, b...)
+}
+
+// editDecoder reads the fields of an encoded VersionEdit, remembering the first error.
+type editDecoder struct {
+	src []byte
+	err error
+}
+
+func (g *editDecoder) uvarint() uint64 {
+	if g.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(g.src)
+	if n <= 0 {
+		g.err = ErrCorrupt
+		return 0
+	}
+	g.src = g.src[n:]
+	return v
+}
+
+func (g *editDecoder) level() int {
+	level := g.uvarint()
+	if g.err == nil && level >= MANIFEST_NUM_LEVELS {
+		g.err = fmt.Errorf("%w: level %d out of range", ErrCorrupt, level)
+	}
+	return int(level)
+}
+
+func (g *editDecoder) bytes() []byte {
+	n := g.uvarint()
+	if g.err != nil {
+		return nil
+	}
+	if n > uint64(len(g.src)) {
+		g.err = ErrCorrupt
+		return nil
+	}
+	b := slices.Clone(g.src[:n])
+	g.src = g.src[n:]
+	return b
+}
+
+// Decode parses an edit produced by Encode.
+func (g *VersionEdit) Decode(src []byte) error {
+	d := editDecoder{src: src}
+	for len(d.src) > 0 && d.err == nil {
+		switch tag := d.uvarint(); tag {
+		case tagLogNumber:
+			g.LogNumber = d.uvarint()
+		case tagNextFileNumber:
+			g.NextFileNumber = d.uvarint()
+		case tagLastSequence:
+			g.LastSequence = d.uvarint()
+		case tagDeletedFile:
+			g.DeletedFiles = append(g.DeletedFiles, DeletedFile{Level: d.level(), FileNum: d.uvarint()})
+		case tagNewFile:
+			level := d.level()
+			meta := &FileMetadata{FileNum: d.uvarint(), Size: d.uvarint()}
+			meta.Smallest = d.bytes()
+			meta.Largest = d.bytes()
+			g.NewFiles = append(g.NewFiles, NewFile{Level: level, Meta: meta})
+		case tagNewBlobFile:
+			g.NewBlobFiles = append(g.NewBlobFiles, &BlobFileMetadata{FileNum: d.uvarint(), Size: d.uvarint(), ValueBytes: d.uvarint()})
+		case tagBlobRefs:
+			n := d.uvarint()
+			if d.err == nil && (len(g.NewFiles) == 0 || n > uint64(len(d.src))) {
+				d.err = fmt.Errorf("%w: misplaced blob references", ErrCorrupt)
+			}
+			if d.err != nil {
+				break
+			}
+			meta := g.NewFiles[len(g.NewFiles)-1].Meta
+			for i := uint64(0); i < n; i++ {
+				meta.BlobRefs = append(meta.BlobRefs, BlobRef{FileNum: d.uvarint(), Bytes: d.uvarint()})
+			}
+		default:
+			if d.err == nil {
+				d.err = fmt.Errorf("%w: unknown tag %d", ErrCorrupt, tag)
+			}
+		}
+	}
+	return d.err
+}
+
+// apply returns the version that results from applying the edit to `base`, where `compare`
+// orders user keys. Level 0 is kept newest first; deeper levels are kept sorted, and no user
+// key may appear in two tables of the same deeper level. The blob files of the version are the
+// ones its tables refer to, each of which must be in `base` or added by the edit.
+func (g *VersionEdit) apply(base *Version, compare func(key1, key2 []byte) int) (*Version, error) {
+	v := &Version{}
+	deleted := make(map[DeletedFile]bool, len(g.DeletedFiles))
+	for _, d := range g.DeletedFiles {
+		deleted[d] = true
+	}
+
+	for level := range v.Levels {
+		for _, f := range base.Levels[level] {
+			if deleted[DeletedFile{Level: level, FileNum: f.FileNum}] {
+				delete(deleted, DeletedFile{Level: level, FileNum: f.FileNum})
+				continue
+			}
+			v.Levels[level] = append(v.Levels[level], f)
+		}
+	}
+	if len(deleted) > 0 {
+		return nil, fmt.Errorf("manifest: edit deletes %d table(s) missing from their level", len(deleted))
+	}
+	for _, n := range g.NewFiles {
+		v.Levels[n.Level] = append(v.Levels[n.Level], n.Meta)
+	}
+
+	if err := g.applyBlobFiles(base, v); err != nil {
+		return nil, err
+	}
+
+	slices.SortFunc(v.Levels[0], func(a, b *FileMetadata) int {
+		return -cmpUint64(a.FileNum, b.FileNum)
+	})
+	icompare := ikey.Comparer(compare)
+	for level := 1; level < MANIFEST_NUM_LEVELS; level++ {
+		files := v.Levels[level]
+		slices.SortFunc(files, func(a, b *FileMetadata) int {
+			return icompare(a.Smallest, b.Smallest)
+		})
+		for i := 1; i < len(files); i++ {
+			// A table whose range deletions end at a user key may be followed by a table
+			// starting at that same user key.
+			c := compare(ikey.UserKey(files[i-1].Largest), ikey.UserKey(files[i].Smallest))
+			if c > 0 || (c == 0 && !ikey.IsRangeDeleteSentinel(files[i-1].Largest)) {
+				return nil, fmt.Errorf("manifest: tables %d and %d overlap in level %d",
+					files[i-1].FileNum, files[i].FileNum, level)
+			}
+		}
+	}
+	return v, nil
+}
+
+// applyBlobFiles fills in the blob files of `v`, the result of the edit on `base`.
+func (g *VersionEdit) applyBlobFiles(base, v *Version) error {
+	v.BlobFiles = make(map[uint64]*BlobFileMetadata)
+	for _, files := range v.Levels {
+		for _, f := range files {
+			for _, ref := range f.BlobRefs {
+				if v.BlobFiles[ref.FileNum] != nil {
+					continue
+				}
+				b := base.BlobFiles[ref.FileNum]
+				if i := slices.IndexFunc(g.NewBlobFiles, func(b *BlobFileMetadata) bool { return b.FileNum == ref.FileNum }); i >= 0 {
+					b = g.NewBlobFiles[i]
+				}
+				if b == nil {
+					return fmt.Errorf("manifest: table %d refers to unknown blob file %d", f.FileNum, ref.FileNum)
+				}
+				v.BlobFiles[ref.FileNum] = b
+			}
+		}
+	}
+	return nil
+}
+
+func cmpUint64(a, b uint64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,384 @@
+package manifest
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"gosuda.org/sseuda/internal/record"
+)
+
+const (
+	// MANIFEST_CURRENT_FILENAME names the file holding the name of the live manifest.
+	MANIFEST_CURRENT_FILENAME = "CURRENT"
+
+	// MANIFEST_FILENAME_PREFIX prefixes the file number in manifest filenames.
+	MANIFEST_FILENAME_PREFIX = "MANIFEST-"
+
+	// MANIFEST_MAX_SIZE is the size after which the next edit starts a new manifest,
+	// written as a single snapshot of the current version.
+	MANIFEST_MAX_SIZE = 64 << 20
+)
+
+// ManifestFilename returns the path of manifest `num` in `dirname`.
+func ManifestFilename(dirname string, num uint64) string {
+	return filepath.Join(dirname, fmt.Sprintf("%s%06d", MANIFEST_FILENAME_PREFIX, num))
+}
+
+// VersionSet owns the current Version, the MANIFEST log that persists it, and the file
+// number counter shared by every file of the database directory.
+//
+// LogAndApply is not safe for concurrent use and must be serialized by the caller;
+// every other method may be called concurrently.
+type VersionSet struct {
+	dirname     string
+	compare     func(key1, key2 []byte) int // Orders user keys.
+	nextFileNum atomic.Uint64
+	logNum      uint64
+	lastSeq     uint64
+
+	manifestNum  uint64
+	manifestFile *os.File       // Nil after a failed write; the next edit starts a new manifest.
+	manifest     *record.Writer // Record framing over `manifestFile`.
+	buf          []byte         // Scratch buffer for encoding edits.
+
+	mu            sync.Mutex // Guards the fields below.
+	current       *Version
+	obsolete      []*FileMetadata     // Tables no live version contains any more.
+	obsoleteBlobs []*BlobFileMetadata // Blob files no live version contains any more.
+}
+
+// Open recovers the version set of `dirname`, whose tables are ordered by the user key
+// ordering `compare`, from its manifest, or starts an empty one if
+// the directory has none, and then writes the recovered state to a fresh manifest.
+// A torn tail of the old manifest is an edit that was never acknowledged and is ignored.
+func Open(dirname string, compare func(key1, key2 []byte) int) (*VersionSet, error) {
+	g := &VersionSet{dirname: dirname, compare: compare}
+	maxNum, err := maxFileNum(dirname)
+	if err != nil {
+		return nil, err
+	}
+	g.nextFileNum.Store(maxNum + 1)
+
+	v := &Version{vs: g, BlobFiles: map[uint64]*BlobFileMetadata{}}
+	current, err := os.ReadFile(filepath.Join(dirname, MANIFEST_CURRENT_FILENAME))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return nil, err
+	default:
+		name := strings.TrimSuffix(string(current), "\n")
+		if v, err = g.replay(filepath.Join(dirname, name)); err != nil {
+			return nil, err
+		}
+	}
+
+	oldManifest := g.manifestNum
+	if err := g.createManifest(v); err != nil {
+		return nil, err
+	}
+	if oldManifest != 0 {
+		if err := os.Remove(ManifestFilename(dirname, oldManifest)); err != nil {
+			g.Close()
+			return nil, err
+		}
+	}
+	g.install(v)
+	return g, nil
+}
+
+// replay rebuilds the version recorded in `filename` by applying its edits in order.
+func (g *VersionSet) replay(filename string) (*Version, error) {
+	num, ok := parseFileNum(filepath.Base(filename))
+	if !ok || !strings.HasPrefix(filepath.Base(filename), MANIFEST_FILENAME_PREFIX) {
+		return nil, fmt.Errorf("%w: CURRENT names %q", ErrCorrupt, filepath.Base(filename))
+	}
+	g.manifestNum = num
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	v := &Version{vs: g, BlobFiles: map[uint64]*BlobFileMetadata{}}
+	r := record.NewReader(file)
+	for {
+		rec, err := r.Next()
+		switch {
+		case err == io.EOF || err == io.ErrUnexpectedEOF:
+			return v, nil
+		case errors.Is(err, record.ErrCorrupt):
+			return nil, fmt.Errorf("%w: %s at offset %d: %v", ErrCorrupt, filename, r.Offset(), err)
+		case err != nil:
+			return nil, err
+		}
+
+		var edit VersionEdit
+		if err := edit.Decode(rec); err != nil {
+			return nil, err
+		}
+		if v, err = edit.apply(v, g.compare); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+		}
+		v.vs = g
+		if edit.LogNumber != 0 {
+			g.logNum = edit.LogNumber
+		}
+		g.lastSeq = max(g.lastSeq, edit.LastSequence)
+		if edit.NextFileNumber > g.nextFileNum.Load() {
+			g.nextFileNum.Store(edit.NextFileNumber)
+		}
+	}
+}
+
+// createManifest starts a new manifest holding a snapshot of `v`, and points CURRENT at it.
+func (g *VersionSet) createManifest(v *Version) error {
+	num := g.NewFileNum()
+	file, err := os.OpenFile(ManifestFilename(g.dirname, num), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	w := record.NewWriter(file)
+
+	snapshot := VersionEdit{LogNumber: g.logNum, NextFileNumber: g.nextFileNum.Load(), LastSequence: g.lastSeq}
+	for level, files := range v.Levels {
+		for _, f := range files {
+			snapshot.NewFiles = append(snapshot.NewFiles, NewFile{Level: level, Meta: f})
+		}
+	}
+	for _, b := range v.BlobFiles {
+		snapshot.NewBlobFiles = append(snapshot.NewBlobFiles, b)
+	}
+	slices.SortFunc(snapshot.NewBlobFiles, func(a, b *BlobFileMetadata) int {
+		return cmpUint64(a.FileNum, b.FileNum)
+	})
+	g.buf = snapshot.Encode(g.buf[:0])
+	if err := w.WriteRecord(g.buf); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := setCurrent(g.dirname, num); err != nil {
+		file.Close()
+		return err
+	}
+
+	if g.manifestFile != nil {
+		g.manifestFile.Close()
+	}
+	g.manifestNum = num
+	g.manifestFile = file
+	g.manifest = w
+	return nil
+}
+
+// setCurrent atomically points CURRENT at manifest `num`.
+func setCurrent(dirname string, num uint64) error {
+	filename := filepath.Join(dirname, MANIFEST_CURRENT_FILENAME)
+	content := fmt.Sprintf("%s%06d\n", MANIFEST_FILENAME_PREFIX, num)
+	file, err := os.Create(filename + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := file.WriteString(content); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(filename+".tmp", filename); err != nil {
+		return err
+	}
+	return syncDir(dirname)
+}
+
+// LogAndApply persists `edit` to the manifest and then installs the version it produces.
+// The new version becomes current only once the edit is durable; on error the current
+// version is unchanged. The edit's NextFileNumber is filled in by the version set.
+func (g *VersionSet) LogAndApply(edit *VersionEdit) error {
+	g.mu.Lock()
+	base := g.current
+	g.mu.Unlock()
+
+	v, err := edit.apply(base, g.compare)
+	if err != nil {
+		return err
+	}
+	v.vs = g
+	logNum, lastSeq := max(g.logNum, edit.LogNumber), max(g.lastSeq, edit.LastSequence)
+	edit.NextFileNumber = g.nextFileNum.Load()
+
+	if g.manifestFile == nil || g.manifest.Offset() >= MANIFEST_MAX_SIZE {
+		oldManifest, oldLogNum, oldLastSeq := g.manifestNum, g.logNum, g.lastSeq
+		g.logNum, g.lastSeq = logNum, lastSeq
+		if err := g.createManifest(v); err != nil {
+			g.logNum, g.lastSeq = oldLogNum, oldLastSeq
+			return err
+		}
+		os.Remove(ManifestFilename(g.dirname, oldManifest))
+	} else {
+		g.buf = edit.Encode(g.buf[:0])
+		err := g.manifest.WriteRecord(g.buf)
+		if err == nil {
+			err = g.manifestFile.Sync()
+		}
+		if err != nil {
+			// The manifest may now end in a partial record; never append after it.
+			g.manifestFile.Close()
+			g.manifestFile = nil
+			return err
+		}
+		g.logNum, g.lastSeq = logNum, lastSeq
+	}
+
+	g.install(v)
+	return nil
+}
+
+// install makes `v` the current version. The version set holds one reference on it.
+func (g *VersionSet) install(v *Version) {
+	for _, files := range v.Levels {
+		for _, f := range files {
+			f.refs.Add(1)
+		}
+	}
+	for _, b := range v.BlobFiles {
+		b.refs.Add(1)
+	}
+	v.refs.Store(1)
+
+	g.mu.Lock()
+	old := g.current
+	g.current = v
+	g.mu.Unlock()
+	if old != nil {
+		old.DecRef()
+	}
+}
+
+// release drops the references `v` holds on its tables and blob files.
+func (g *VersionSet) release(v *Version) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, files := range v.Levels {
+		for _, f := range files {
+			if f.refs.Add(-1) == 0 {
+				g.obsolete = append(g.obsolete, f)
+			}
+		}
+	}
+	for _, b := range v.BlobFiles {
+		if b.refs.Add(-1) == 0 {
+			g.obsoleteBlobs = append(g.obsoleteBlobs, b)
+		}
+	}
+}
+
+// Current returns the current version with a reference the caller must drop with DecRef.
+func (g *VersionSet) Current() *Version {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.current.IncRef()
+	return g.current
+}
+
+// Obsolete returns, and forgets, the tables that stopped being part of any live version
+// since the last call. Their files may be deleted.
+func (g *VersionSet) Obsolete() []*FileMetadata {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	obsolete := g.obsolete
+	g.obsolete = nil
+	return obsolete
+}
+
+// ObsoleteBlobFiles returns, and forgets, the blob files that stopped being part of any live
+// version since the last call. Their files may be deleted.
+func (g *VersionSet) ObsoleteBlobFiles() []*BlobFileMetadata {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	obsolete := g.obsoleteBlobs
+	g.obsoleteBlobs = nil
+	return obsolete
+}
+
+// LogNumber returns the oldest write-ahead log segment that has not been flushed yet.
+func (g *VersionSet) LogNumber() uint64 {
+	return g.logNum
+}
+
+// LastSequence returns the largest sequence number recorded by an edit.
+func (g *VersionSet) LastSequence() uint64 {
+	return g.lastSeq
+}
+
+// NewFileNum allocates a file number.
+func (g *VersionSet) NewFileNum() uint64 {
+	return g.nextFileNum.Add(1) - 1
+}
+
+// Close closes the manifest. The current version is left untouched so that its tables
+// are never mistaken for obsolete ones.
+func (g *VersionSet) Close() error {
+	if g.manifestFile == nil {
+		return nil
+	}
+	err := g.manifestFile.Close()
+	g.manifestFile = nil
+	return err
+}
+
+// parseFileNum extracts the file number from a filename such as "000042.sst" or
+// "MANIFEST-000042".
+func parseFileNum(name string) (uint64, bool) {
+	name = strings.TrimPrefix(name, MANIFEST_FILENAME_PREFIX)
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		name = name[:i]
+	}
+	num, err := strconv.ParseUint(name, 10, 64)
+	return num, err == nil
+}
+
+// maxFileNum returns the largest file number used by any file in `dirname`.
+func maxFileNum(dirname string) (uint64, error) {
+	entries, err := os.ReadDir(dirname)
+	if err != nil {
+		return 0, err
+	}
+	var maxNum uint64
+	for _, entry := range entries {
+		if num, ok := parseFileNum(entry.Name()); ok {
+			maxNum = max(maxNum, num)
+		}
+	}
+	return maxNum, nil
+}
+
+// syncDir makes file creations, renames and removals in `dirname` durable.
+func syncDir(dirname string) error {
+	dir, err := os.Open(dirname)
+	if err != nil {
+		return err
+	}
+	if err := dir.Sync(); err != nil {
+		dir.Close()
+		return err
+	}
+	return dir.Close()
+}
@@ -0,0 +1,80 @@
+package memengine
+
+import "gosuda.org/sseuda"
+
+type opKind uint8
+
+const (
+	opPut opKind = iota
+	opDelete
+	opDeleteRange // key holds the start and value the end of the range.
+	opMerge
+)
+
+type op struct {
+	kind  opKind
+	key   []byte
+	value []byte
+}
+
+// batch records operations by copying their arguments, and tracks an upper bound
+// on the arena bytes needed to apply them.
+type batch struct {
+	ops       []op
+	footprint int64
+	size      int // Bytes of keys and values recorded.
+}
+
+var _ sseuda.Batch = (*batch)(nil)
+
+// align rounds n up to the arena's 8-byte allocation granularity.
+func align(n int) int64 {
+	return int64((n + 7) &^ 7)
+}
+
+func (g *batch) Put(key, value []byte) {
+	g.ops = append(g.ops, op{kind: opPut, key: clone(key), value: clone(value)})
+	g.footprint += nodeFootprint + align(len(key)) + align(len(value))
+	g.size += len(key) + len(value)
+}
+
+func (g *batch) Delete(key []byte) {
+	g.ops = append(g.ops, op{kind: opDelete, key: clone(key)})
+	g.footprint += nodeFootprint + align(len(key))
+	g.size += len(key)
+}
+
+// DeleteRange only tombstones existing nodes, so it never adds to the footprint.
+func (g *batch) DeleteRange(start, end []byte) {
+	g.ops = append(g.ops, op{kind: opDeleteRange, key: clone(start), value: clone(end)})
+	g.size += len(start) + len(end)
+}
+
+// Merge is recorded, but Apply rejects the batch: the engine cannot combine operands.
+func (g *batch) Merge(key, value []byte) {
+	g.ops = append(g.ops, op{kind: opMerge, key: clone(key), value: clone(value)})
+	g.size += len(key) + len(value)
+}
+
+func (g *batch) Count() int {
+	return len(g.ops)
+}
+
+// Len returns the bytes of keys and values recorded; the batch has no serialized form.
+func (g *batch) Len() int {
+	return g.size
+}
+
+func (g *batch) Reset() {
+	clear(g.ops)
+	g.ops = g.ops[:0]
+	g.footprint = 0
+	g.size = 0
+}
+
+func clone(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
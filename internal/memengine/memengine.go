@@ -0,0 +1,342 @@
+// Package memengine implements sseuda.StorageEngine entirely in memory on top of mskip.SkipList.
+// It is the reference implementation of the storage contract: nothing is persisted, and every
+// write lands directly in a single arena-backed skip list.
+package memengine
+
+import (
+	"errors"
+	"math/rand/v2"
+	"sync"
+
+	"gosuda.org/sseuda"
+	"gosuda.org/sseuda/internal/oldsepia/marena"
+	"gosuda.org/sseuda/internal/oldsepia/mskip"
+)
+
+var (
+	ErrClosed       = errors.New("memengine: engine is closed")
+	ErrForeignBatch = errors.New("memengine: batch was not created by this engine")
+)
+
+// nodeFootprint is an upper bound on the arena bytes taken by one skip list node,
+// including alignment padding. It is used to reject batches that cannot fit before
+// any of their operations are applied.
+const nodeFootprint = 128
+
+// Engine is an in-memory sseuda.StorageEngine.
+// Writers are serialized by a mutex; readers share it, so that a read never observes a
+// batch or a range deletion half applied.
+type Engine struct {
+	mu      sync.RWMutex
+	arena   *marena.Arena
+	skl     *mskip.SkipList
+	compare func(key1, key2 []byte) int // Key ordering shared with the skip list.
+	closed  bool
+}
+
+var _ sseuda.StorageEngine = (*Engine)(nil)
+
+// New creates an empty engine whose data must fit in an arena of `size` bytes.
+// Writes fail with marena.ErrAllocationFailed once the arena is exhausted.
+// It fails with marena.ErrArenaTooLarge if `size` exceeds marena.ARENA_MAX_SIZE.
+func New(size int64, compare func(key1, key2 []byte) int) (*Engine, error) {
+	arena, err := marena.NewArena(size)
+	if err != nil {
+		return nil, err
+	}
+	skl, err := mskip.NewSkipList(arena, compare, rand.Uint64())
+	if err != nil {
+		return nil, err
+	}
+
+	return &Engine{
+		arena:   arena,
+		skl:     skl,
+		compare: compare,
+	}, nil
+}
+
+// Get returns a copy of the value stored for `key`, or sseuda.ErrNotFound.
+func (g *Engine) Get(key []byte) ([]byte, error) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	if g.closed {
+		return nil, ErrClosed
+	}
+	return get(g.skl, key)
+}
+
+// Put sets the value for `key`. A nil value is stored as an empty value.
+func (g *Engine) Put(key, value []byte) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		return ErrClosed
+	}
+	return g.put(key, value)
+}
+
+// Delete marks `key` as deleted.
+func (g *Engine) Delete(key []byte) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		return ErrClosed
+	}
+	return g.delete(key)
+}
+
+// DeleteRange marks every live key in [start, end) as deleted.
+func (g *Engine) DeleteRange(start, end []byte) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		return ErrClosed
+	}
+	g.deleteRange(start, end)
+	return nil
+}
+
+// put inserts a live value. The skip list stores a nil value as an empty one.
+func (g *Engine) put(key, value []byte) error {
+	if !g.skl.Insert(key, value) {
+		return marena.ErrAllocationFailed
+	}
+	return nil
+}
+
+func (g *Engine) delete(key []byte) error {
+	if !g.skl.Delete(key) {
+		return marena.ErrAllocationFailed
+	}
+	return nil
+}
+
+// deleteRange tombstones existing keys in place, which never allocates.
+func (g *Engine) deleteRange(start, end []byte) {
+	iter := g.skl.Iterator()
+	defer iter.Close()
+
+	for valid := iter.Seek(start); valid && g.compare(iter.Key(), end) < 0; valid = iter.Next() {
+		g.skl.Delete(iter.Key())
+	}
+}
+
+// NewIterator returns an iterator over the live keys of the engine within `opts`.
+// The iterator observes writes made after its creation; use NewSnapshot for a stable view.
+func (g *Engine) NewIterator(opts *sseuda.IterOptions) (sseuda.Iterator, error) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	if g.closed {
+		return nil, ErrClosed
+	}
+	return &iterator{mu: &g.mu, iter: g.skl.IteratorWithOptions(opts)}, nil
+}
+
+// NewBatch returns an empty batch for this engine.
+func (g *Engine) NewBatch() sseuda.Batch {
+	return &batch{}
+}
+
+// Apply applies every operation of `b` while holding the write lock, so that readers
+// observe either none or all of them. The batch is rejected up front if the arena
+// cannot possibly hold it, or if it holds a merge.
+func (g *Engine) Apply(b sseuda.Batch) error {
+	bt, ok := b.(*batch)
+	if !ok {
+		return ErrForeignBatch
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		return ErrClosed
+	}
+	if bt.footprint > g.arena.Remaining() {
+		return marena.ErrAllocationFailed
+	}
+	for _, op := range bt.ops {
+		if op.kind == opMerge {
+			return sseuda.ErrMergeUnsupported
+		}
+	}
+
+	for _, op := range bt.ops {
+		var err error
+		switch op.kind {
+		case opPut:
+			err = g.put(op.key, op.value)
+		case opDelete:
+			err = g.delete(op.key)
+		case opDeleteRange:
+			g.deleteRange(op.key, op.value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewSnapshot copies every live entry into a private skip list.
+// This costs O(n) time and memory, which is acceptable for a reference implementation.
+func (g *Engine) NewSnapshot() (sseuda.Snapshot, error) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	if g.closed {
+		return nil, ErrClosed
+	}
+
+	arena, err := marena.NewArena(g.arena.Used())
+	if err != nil {
+		return nil, err
+	}
+	skl, err := mskip.NewSkipList(arena, g.compare, rand.Uint64())
+	if err != nil {
+		return nil, err
+	}
+
+	iter := g.skl.Iterator()
+	defer iter.Close()
+	for valid := iter.First(); valid; valid = iter.Next() {
+		if !skl.Insert(iter.Key(), iter.Value()) {
+			skl.DecRef()
+			return nil, marena.ErrAllocationFailed
+		}
+	}
+
+	return &snapshot{skl: skl}, nil
+}
+
+// Flush is a no-op: the engine keeps nothing on disk.
+func (g *Engine) Flush() error {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	if g.closed {
+		return ErrClosed
+	}
+	return nil
+}
+
+// Close releases the engine's skip list. Open iterators keep it alive until they are closed.
+func (g *Engine) Close() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		return ErrClosed
+	}
+	g.closed = true
+	g.skl.DecRef()
+	return nil
+}
+
+// get looks `key` up in `skl`, treating tombstones as missing keys.
+func get(skl *mskip.SkipList, key []byte) ([]byte, error) {
+	value, found, deleted := skl.Get(key)
+	if !found || deleted {
+		return nil, sseuda.ErrNotFound
+	}
+	return append([]byte{}, value...), nil
+}
+
+// snapshot is an immutable copy of the engine's live entries.
+type snapshot struct {
+	skl *mskip.SkipList
+}
+
+var _ sseuda.Snapshot = (*snapshot)(nil)
+
+func (g *snapshot) Get(key []byte) ([]byte, error) {
+	return get(g.skl, key)
+}
+
+func (g *snapshot) NewIterator(opts *sseuda.IterOptions) (sseuda.Iterator, error) {
+	return &iterator{iter: g.skl.IteratorWithOptions(opts)}, nil
+}
+
+func (g *snapshot) Close() error {
+	g.skl.DecRef()
+	return nil
+}
+
+// iterator adapts SkipListIterator to the engine: when `mu` is set, every step holds
+// the engine's read lock so that it never races a writer.
+// Keys and values stay valid until the engine is closed, since the arena never reuses memory.
+type iterator struct {
+	mu   *sync.RWMutex
+	iter *mskip.SkipListIterator
+}
+
+var _ sseuda.Iterator = (*iterator)(nil)
+
+func (g *iterator) lock() {
+	if g.mu != nil {
+		g.mu.RLock()
+	}
+}
+
+func (g *iterator) unlock() {
+	if g.mu != nil {
+		g.mu.RUnlock()
+	}
+}
+
+func (g *iterator) First() bool {
+	g.lock()
+	defer g.unlock()
+	return g.iter.First()
+}
+
+func (g *iterator) Seek(key []byte) bool {
+	g.lock()
+	defer g.unlock()
+	return g.iter.Seek(key)
+}
+
+func (g *iterator) Last() bool {
+	g.lock()
+	defer g.unlock()
+	return g.iter.Last()
+}
+
+func (g *iterator) SeekLT(key []byte) bool {
+	g.lock()
+	defer g.unlock()
+	return g.iter.SeekLT(key)
+}
+
+func (g *iterator) SeekLE(key []byte) bool {
+	g.lock()
+	defer g.unlock()
+	return g.iter.SeekLE(key)
+}
+
+func (g *iterator) Valid() bool {
+	return g.iter.Valid()
+}
+
+func (g *iterator) Next() bool {
+	g.lock()
+	defer g.unlock()
+	return g.iter.Next()
+}
+
+func (g *iterator) Prev() bool {
+	g.lock()
+	defer g.unlock()
+	return g.iter.Prev()
+}
+
+func (g *iterator) Key() []byte {
+	return g.iter.Key()
+}
+
+func (g *iterator) Value() []byte {
+	g.lock()
+	defer g.unlock()
+	return g.iter.Value()
+}
+
+func (g *iterator) Close() error {
+	return g.iter.Close()
+}
@@ -0,0 +1,238 @@
+package memengine_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+
+	"gosuda.org/sseuda"
+	"gosuda.org/sseuda/internal/memengine"
+)
+
+func newEngine(t *testing.T) *memengine.Engine {
+	t.Helper()
+	e, err := memengine.New(1<<20, bytes.Compare)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { e.Close() })
+	return e
+}
+
+// collect returns every key-value pair visible through `iter`, in order.
+func collect(t *testing.T, iter sseuda.Iterator) []string {
+	t.Helper()
+	defer iter.Close()
+	var out []string
+	for valid := iter.First(); valid; valid = iter.Next() {
+		out = append(out, string(iter.Key())+"="+string(iter.Value()))
+	}
+	return out
+}
+
+// TestEngineGetPutDelete verifies point reads and writes, including empty values
+// which must remain distinguishable from deleted keys.
+func TestEngineGetPutDelete(t *testing.T) {
+	e := newEngine(t)
+
+	if _, err := e.Get([]byte("a")); !errors.Is(err, sseuda.ErrNotFound) {
+		t.Fatalf("Get on empty engine: expected ErrNotFound, got %v", err)
+	}
+
+	if err := e.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Put([]byte("empty"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := e.Get([]byte("a")); err != nil || string(v) != "1" {
+		t.Fatalf("Get(a) = %q, %v; want 1", v, err)
+	}
+	if v, err := e.Get([]byte("empty")); err != nil || len(v) != 0 {
+		t.Fatalf("Get(empty) = %q, %v; want empty value", v, err)
+	}
+
+	if err := e.Put([]byte("a"), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := e.Get([]byte("a")); string(v) != "2" {
+		t.Fatalf("Get(a) after overwrite = %q, want 2", v)
+	}
+
+	if err := e.Delete([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Get([]byte("a")); !errors.Is(err, sseuda.ErrNotFound) {
+		t.Fatalf("Get(a) after delete: expected ErrNotFound, got %v", err)
+	}
+}
+
+// TestEngineIterator verifies ordered iteration in both directions and that seeks skip tombstones.
+func TestEngineIterator(t *testing.T) {
+	e := newEngine(t)
+	for _, k := range []string{"d", "b", "a", "c"} {
+		if err := e.Put([]byte(k), []byte(k+k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := e.Delete([]byte("b")); err != nil {
+		t.Fatal(err)
+	}
+
+	iter, err := e.NewIterator(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := fmt.Sprint(collect(t, iter))
+	if want := "[a=aa c=cc d=dd]"; got != want {
+		t.Fatalf("iteration = %s, want %s", got, want)
+	}
+
+	iter, err = e.NewIterator(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer iter.Close()
+	if !iter.Seek([]byte("b")) || string(iter.Key()) != "c" {
+		t.Fatalf("Seek(b) landed on %q, want c", iter.Key())
+	}
+	if iter.Seek([]byte("e")) {
+		t.Fatalf("Seek(e) should be invalid, landed on %q", iter.Key())
+	}
+
+	var backward []string
+	for valid := iter.Last(); valid; valid = iter.Prev() {
+		backward = append(backward, string(iter.Key()))
+	}
+	if got, want := fmt.Sprint(backward), "[d c a]"; got != want {
+		t.Fatalf("backward iteration = %s, want %s", got, want)
+	}
+	if !iter.SeekLT([]byte("c")) || string(iter.Key()) != "a" {
+		t.Fatalf("SeekLT(c) landed on %q, want a", iter.Key())
+	}
+	if !iter.SeekLE([]byte("b")) || string(iter.Key()) != "a" {
+		t.Fatalf("SeekLE(b) landed on %q, want a", iter.Key())
+	}
+	if iter.SeekLT([]byte("a")) {
+		t.Fatalf("SeekLT(a) should be invalid, landed on %q", iter.Key())
+	}
+}
+
+// TestEngineDeleteRange verifies that only keys inside [start, end) are removed.
+func TestEngineDeleteRange(t *testing.T) {
+	e := newEngine(t)
+	for i := 0; i < 10; i++ {
+		if err := e.Put([]byte(fmt.Sprintf("k%d", i)), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := e.DeleteRange([]byte("k3"), []byte("k7")); err != nil {
+		t.Fatal(err)
+	}
+
+	iter, err := e.NewIterator(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := fmt.Sprint(collect(t, iter))
+	if want := "[k0=v k1=v k2=v k7=v k8=v k9=v]"; got != want {
+		t.Fatalf("iteration = %s, want %s", got, want)
+	}
+}
+
+// TestEngineBatch verifies that a batch applies all of its operations in order,
+// and that an oversized batch is rejected without applying any of them.
+func TestEngineBatch(t *testing.T) {
+	e := newEngine(t)
+	if err := e.Put([]byte("x"), []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+
+	b := e.NewBatch()
+	b.Put([]byte("a"), []byte("1"))
+	b.Put([]byte("b"), []byte("2"))
+	b.Delete([]byte("x"))
+	b.Put([]byte("a"), []byte("3"))
+	if b.Count() != 4 {
+		t.Fatalf("Count = %d, want 4", b.Count())
+	}
+	if err := e.Apply(b); err != nil {
+		t.Fatal(err)
+	}
+
+	iter, err := e.NewIterator(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := fmt.Sprint(collect(t, iter))
+	if want := "[a=3 b=2]"; got != want {
+		t.Fatalf("iteration = %s, want %s", got, want)
+	}
+
+	b.Reset()
+	b.Put([]byte("huge"), make([]byte, 2<<20))
+	b.Put([]byte("c"), []byte("3"))
+	if err := e.Apply(b); err == nil {
+		t.Fatal("expected oversized batch to fail")
+	}
+	if _, err := e.Get([]byte("c")); !errors.Is(err, sseuda.ErrNotFound) {
+		t.Fatalf("oversized batch was partially applied: Get(c) err = %v", err)
+	}
+}
+
+// TestEngineSnapshot verifies that a snapshot is unaffected by later writes.
+func TestEngineSnapshot(t *testing.T) {
+	e := newEngine(t)
+	if err := e.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Put([]byte("b"), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+
+	snap, err := e.NewSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Close()
+
+	if err := e.Put([]byte("a"), []byte("changed")); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Delete([]byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Put([]byte("c"), []byte("3")); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := snap.Get([]byte("a")); err != nil || string(v) != "1" {
+		t.Fatalf("snapshot Get(a) = %q, %v; want 1", v, err)
+	}
+	iter, err := snap.NewIterator(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := fmt.Sprint(collect(t, iter))
+	if want := "[a=1 b=2]"; got != want {
+		t.Fatalf("snapshot iteration = %s, want %s", got, want)
+	}
+}
+
+// TestEngineClose verifies that a closed engine rejects further use.
+func TestEngineClose(t *testing.T) {
+	e, err := memengine.New(1<<16, bytes.Compare)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Put([]byte("a"), nil); !errors.Is(err, memengine.ErrClosed) {
+		t.Fatalf("Put after Close: expected ErrClosed, got %v", err)
+	}
+	if _, err := e.Get([]byte("a")); !errors.Is(err, memengine.ErrClosed) {
+		t.Fatalf("Get after Close: expected ErrClosed, got %v", err)
+	}
+}
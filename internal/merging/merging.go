@@ -0,0 +1,261 @@
+// Package merging merges several sorted iterators into a single one.
+package merging
+
+import (
+	"gosuda.org/sseuda"
+	"gosuda.org/sseuda/internal/bounds"
+)
+
+// Options configures an Iterator.
+type Options struct {
+	// Compare orders keys. Every child must be sorted by it.
+	Compare func(key1, key2 []byte) int
+
+	// IsTombstone reports whether a value marks its key as deleted. A key whose newest entry
+	// is a tombstone is skipped entirely. When nil, every key is surfaced.
+	IsTombstone func(value []byte) bool
+
+	// Bounds confine the merged iteration. Children should be confined to the same bounds,
+	// so that they can skip data outside of them, but the merged iteration enforces the
+	// bounds on its own. Nil leaves the iteration unbounded.
+	Bounds *sseuda.IterOptions
+}
+
+// Iterator merges child iterators ordered newest first. When several children hold the same
+// key, the newest one provides the entry and the others are stepped past it. A heap keyed
+// by the children's current keys keeps each step logarithmic in the number of children: a
+// min-heap while moving forward, and a max-heap while moving backward. Changing direction
+// repositions every child around the current key.
+type Iterator struct {
+	opts    Options
+	iters   []sseuda.Iterator
+	heap    []int  // Indexes of the valid children; heap[0] holds the current entry.
+	key     []byte // Copy of the current key, valid while the children are stepped past it.
+	reverse bool   // Whether the heap is ordered for backward iteration.
+	bounds  bounds.Bounds
+}
+
+var _ sseuda.Iterator = (*Iterator)(nil)
+
+// NewIterator returns an iterator over the union of `iters`, where iters[0] is the newest.
+// The iterator takes ownership of the children and closes them in Close.
+func NewIterator(opts *Options, iters ...sseuda.Iterator) *Iterator {
+	return &Iterator{
+		opts:   *opts,
+		iters:  iters,
+		heap:   make([]int, 0, len(iters)),
+		bounds: bounds.New(opts.Compare, opts.Bounds),
+	}
+}
+
+// less orders children by key in the direction of iteration, and children holding the same
+// key newest first.
+func (g *Iterator) less(i, j int) bool {
+	a, b := g.heap[i], g.heap[j]
+	if c := g.opts.Compare(g.iters[a].Key(), g.iters[b].Key()); c != 0 {
+		return (c < 0) != g.reverse
+	}
+	return a < b
+}
+
+func (g *Iterator) up(i int) {
+	for i > 0 {
+		parent := (i - 1) / 2
+		if !g.less(i, parent) {
+			return
+		}
+		g.heap[i], g.heap[parent] = g.heap[parent], g.heap[i]
+		i = parent
+	}
+}
+
+func (g *Iterator) down(i int) {
+	for {
+		smallest := i
+		if left := 2*i + 1; left < len(g.heap) && g.less(left, smallest) {
+			smallest = left
+		}
+		if right := 2*i + 2; right < len(g.heap) && g.less(right, smallest) {
+			smallest = right
+		}
+		if smallest == i {
+			return
+		}
+		g.heap[i], g.heap[smallest] = g.heap[smallest], g.heap[i]
+		i = smallest
+	}
+}
+
+// init rebuilds the heap from the children that are valid after repositioning,
+// for iteration in the direction given by `reverse`.
+func (g *Iterator) init(reverse bool) {
+	g.reverse = reverse
+	g.heap = g.heap[:0]
+	for i, iter := range g.iters {
+		if iter.Valid() {
+			g.heap = append(g.heap, i)
+		}
+	}
+	for i := len(g.heap)/2 - 1; i >= 0; i-- {
+		g.down(i)
+	}
+}
+
+// stepTop moves the child at the top of the heap in the direction of iteration and restores
+// the heap order.
+func (g *Iterator) stepTop() {
+	top := g.iters[g.heap[0]]
+	if (!g.reverse && top.Next()) || (g.reverse && top.Prev()) {
+		g.down(0)
+		return
+	}
+	last := len(g.heap) - 1
+	g.heap[0] = g.heap[last]
+	g.heap = g.heap[:last]
+	if last > 0 {
+		g.down(0)
+	}
+}
+
+// skipKey steps every child past the current key.
+func (g *Iterator) skipKey() {
+	g.key = append(g.key[:0], g.iters[g.heap[0]].Key()...)
+	for len(g.heap) > 0 && g.opts.Compare(g.iters[g.heap[0]].Key(), g.key) == 0 {
+		g.stepTop()
+	}
+}
+
+// skipTombstones steps past keys whose newest entry is a tombstone, and ends the iteration
+// once it leaves the bounds in the direction of iteration.
+func (g *Iterator) skipTombstones() bool {
+	if g.opts.IsTombstone != nil {
+		for len(g.heap) > 0 && g.opts.IsTombstone(g.iters[g.heap[0]].Value()) {
+			g.skipKey()
+		}
+	}
+	if len(g.heap) > 0 {
+		key := g.iters[g.heap[0]].Key()
+		if (!g.reverse && !g.bounds.Forward(key)) || (g.reverse && !g.bounds.Backward(key)) {
+			g.heap = g.heap[:0]
+		}
+	}
+	return len(g.heap) > 0
+}
+
+func (g *Iterator) First() bool {
+	if g.bounds.Lower != nil {
+		return g.Seek(g.bounds.Lower)
+	}
+	for _, iter := range g.iters {
+		iter.First()
+	}
+	g.init(false)
+	return g.skipTombstones()
+}
+
+func (g *Iterator) Last() bool {
+	if g.bounds.Upper != nil {
+		return g.SeekLT(g.bounds.Upper)
+	}
+	for _, iter := range g.iters {
+		iter.Last()
+	}
+	g.init(true)
+	return g.skipTombstones()
+}
+
+func (g *Iterator) Seek(key []byte) bool {
+	key = g.bounds.SeekGE(key)
+	for _, iter := range g.iters {
+		iter.Seek(key)
+	}
+	g.init(false)
+	return g.skipTombstones()
+}
+
+func (g *Iterator) SeekLT(key []byte) bool {
+	key = g.bounds.SeekLT(key)
+	for _, iter := range g.iters {
+		iter.SeekLT(key)
+	}
+	g.init(true)
+	return g.skipTombstones()
+}
+
+// SeekLE leaves every child holding `key` on it, so the newest of them provides the entry.
+func (g *Iterator) SeekLE(key []byte) bool {
+	key, lt := g.bounds.SeekLE(key)
+	if lt {
+		return g.SeekLT(key)
+	}
+	for _, iter := range g.iters {
+		iter.SeekLE(key)
+	}
+	g.init(true)
+	return g.skipTombstones()
+}
+
+func (g *Iterator) Valid() bool {
+	return len(g.heap) > 0
+}
+
+// Next steps every child positioned on the current key, so that older duplicates are skipped.
+// After backward steps, the children are first repositioned at the current key.
+func (g *Iterator) Next() bool {
+	if len(g.heap) == 0 {
+		return false
+	}
+	if g.reverse {
+		g.key = append(g.key[:0], g.Key()...)
+		for _, iter := range g.iters {
+			iter.Seek(g.key)
+		}
+		g.init(false)
+	}
+	g.skipKey()
+	return g.skipTombstones()
+}
+
+// Prev steps every child positioned on the current key backward. After forward steps, the
+// children are instead repositioned before the current key, which skips it in every child.
+func (g *Iterator) Prev() bool {
+	if len(g.heap) == 0 {
+		return false
+	}
+	if !g.reverse {
+		g.key = append(g.key[:0], g.Key()...)
+		for _, iter := range g.iters {
+			iter.SeekLT(g.key)
+		}
+		g.init(true)
+	} else {
+		g.skipKey()
+	}
+	return g.skipTombstones()
+}
+
+func (g *Iterator) Key() []byte {
+	if len(g.heap) == 0 {
+		return nil
+	}
+	return g.iters[g.heap[0]].Key()
+}
+
+func (g *Iterator) Value() []byte {
+	if len(g.heap) == 0 {
+		return nil
+	}
+	return g.iters[g.heap[0]].Value()
+}
+
+// Close closes every child and returns the first error.
+func (g *Iterator) Close() error {
+	var err error
+	for _, iter := range g.iters {
+		if cerr := iter.Close(); err == nil {
+			err = cerr
+		}
+	}
+	g.heap = g.heap[:0]
+	return err
+}
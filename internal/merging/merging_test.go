@@ -0,0 +1,216 @@
+package merging_test
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+
+	"gosuda.org/sseuda"
+	"gosuda.org/sseuda/internal/merging"
+)
+
+// sliceIter iterates over sorted key-value pairs held in memory.
+type sliceIter struct {
+	keys, values []string
+	pos          int
+}
+
+func (g *sliceIter) First() bool { g.pos = 0; return g.Valid() }
+func (g *sliceIter) Last() bool  { g.pos = len(g.keys) - 1; return g.Valid() }
+func (g *sliceIter) Seek(key []byte) bool {
+	g.pos = sort.SearchStrings(g.keys, string(key))
+	return g.Valid()
+}
+func (g *sliceIter) SeekLT(key []byte) bool {
+	g.pos = sort.SearchStrings(g.keys, string(key)) - 1
+	return g.Valid()
+}
+func (g *sliceIter) SeekLE(key []byte) bool {
+	g.pos = sort.SearchStrings(g.keys, string(key)+"\x00") - 1
+	return g.Valid()
+}
+func (g *sliceIter) Valid() bool   { return g.pos >= 0 && g.pos < len(g.keys) }
+func (g *sliceIter) Next() bool    { g.pos++; return g.Valid() }
+func (g *sliceIter) Prev() bool    { g.pos--; return g.Valid() }
+func (g *sliceIter) Key() []byte   { return []byte(g.keys[g.pos]) }
+func (g *sliceIter) Value() []byte { return []byte(g.values[g.pos]) }
+func (g *sliceIter) Close() error  { return nil }
+
+// newSliceIter builds an iterator from "key=value" pairs.
+func newSliceIter(pairs ...string) *sliceIter {
+	slices.Sort(pairs)
+	iter := &sliceIter{}
+	for _, pair := range pairs {
+		key, value, _ := strings.Cut(pair, "=")
+		iter.keys = append(iter.keys, key)
+		iter.values = append(iter.values, value)
+	}
+	return iter
+}
+
+func isTombstone(value []byte) bool {
+	return len(value) == 0
+}
+
+func scan(iter sseuda.Iterator, valid bool) string {
+	var out []string
+	for ; valid; valid = iter.Next() {
+		out = append(out, string(iter.Key())+"="+string(iter.Value()))
+	}
+	return strings.Join(out, " ")
+}
+
+func scanReverse(iter sseuda.Iterator, valid bool) string {
+	var out []string
+	for ; valid; valid = iter.Prev() {
+		out = append(out, string(iter.Key())+"="+string(iter.Value()))
+	}
+	slices.Reverse(out)
+	return strings.Join(out, " ")
+}
+
+// TestIteratorRecency verifies that the newest child wins for duplicate keys and that keys
+// whose newest entry is a tombstone are hidden, with and without tombstone handling.
+func TestIteratorRecency(t *testing.T) {
+	children := func() []sseuda.Iterator {
+		return []sseuda.Iterator{
+			newSliceIter("b=new", "d="),
+			newSliceIter("a=mid", "b=mid", "c=mid"),
+			newSliceIter("a=old", "d=old", "e=old"),
+		}
+	}
+
+	iter := merging.NewIterator(&merging.Options{Compare: bytes.Compare, IsTombstone: isTombstone}, children()...)
+	if got, want := scan(iter, iter.First()), "a=mid b=new c=mid e=old"; got != want {
+		t.Fatalf("First: got %q, want %q", got, want)
+	}
+	if got, want := scan(iter, iter.Seek([]byte("c5"))), "e=old"; got != want {
+		t.Fatalf("Seek past a tombstone: got %q, want %q", got, want)
+	}
+	if got, want := scanReverse(iter, iter.Last()), "a=mid b=new c=mid e=old"; got != want {
+		t.Fatalf("Last: got %q, want %q", got, want)
+	}
+	if got, want := scanReverse(iter, iter.SeekLE([]byte("d"))), "a=mid b=new c=mid"; got != want {
+		t.Fatalf("SeekLE on a tombstone: got %q, want %q", got, want)
+	}
+	iter.Close()
+
+	iter = merging.NewIterator(&merging.Options{Compare: bytes.Compare}, children()...)
+	if got, want := scan(iter, iter.Seek([]byte("b"))), "b=new c=mid d= e=old"; got != want {
+		t.Fatalf("Seek without tombstone handling: got %q, want %q", got, want)
+	}
+	iter.Close()
+}
+
+// TestIteratorRandom compares the merge of random children against a model.
+func TestIteratorRandom(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	const numChildren, numKeys = 8, 200
+
+	model := make(map[string]string)
+	iters := make([]sseuda.Iterator, numChildren)
+	for i := numChildren - 1; i >= 0; i-- { // Oldest first, so newer writes override the model.
+		var pairs []string
+		seen := make(map[string]bool)
+		for j := 0; j < numKeys/2; j++ {
+			key := fmt.Sprintf("key%03d", rng.Intn(numKeys))
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			value := fmt.Sprintf("v%d", i)
+			if rng.Intn(4) == 0 {
+				value = ""
+			}
+			pairs = append(pairs, key+"="+value)
+			model[key] = value
+		}
+		iters[i] = newSliceIter(pairs...)
+	}
+
+	var want []string
+	for key, value := range model {
+		if value != "" {
+			want = append(want, key+"="+value)
+		}
+	}
+	slices.Sort(want)
+
+	iter := merging.NewIterator(&merging.Options{Compare: bytes.Compare, IsTombstone: isTombstone}, iters...)
+	defer iter.Close()
+	if got := scan(iter, iter.First()); got != strings.Join(want, " ") {
+		t.Fatalf("First:\ngot  %s\nwant %s", got, strings.Join(want, " "))
+	}
+	if got := scanReverse(iter, iter.Last()); got != strings.Join(want, " ") {
+		t.Fatalf("Last:\ngot  %s\nwant %s", got, strings.Join(want, " "))
+	}
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%03d", rng.Intn(numKeys+1))
+		start := sort.SearchStrings(want, key)
+		if got := scan(iter, iter.Seek([]byte(key))); got != strings.Join(want[start:], " ") {
+			t.Fatalf("Seek(%s):\ngot  %s\nwant %s", key, got, strings.Join(want[start:], " "))
+		}
+		if got := scanReverse(iter, iter.SeekLT([]byte(key))); got != strings.Join(want[:start], " ") {
+			t.Fatalf("SeekLT(%s):\ngot  %s\nwant %s", key, got, strings.Join(want[:start], " "))
+		}
+	}
+}
+
+// TestIteratorDirectionChange verifies that alternating Next and Prev visits neighbouring keys,
+// even when older children hold duplicates and tombstones around the current key.
+func TestIteratorDirectionChange(t *testing.T) {
+	iter := merging.NewIterator(&merging.Options{Compare: bytes.Compare, IsTombstone: isTombstone},
+		newSliceIter("b=new", "d=", "f=new"),
+		newSliceIter("a=old", "b=old", "c=old", "d=old", "e=old", "f=old"),
+	)
+	defer iter.Close()
+
+	want := []string{"a=old", "b=new", "c=old", "e=old", "f=new"}
+	valid := iter.First()
+	for i := 0; i < len(want); i++ {
+		if !valid || string(iter.Key())+"="+string(iter.Value()) != want[i] {
+			t.Fatalf("step %d: got %s (valid=%v), want %s", i, iter.Key(), valid, want[i])
+		}
+		if i > 0 {
+			if !iter.Prev() || string(iter.Key())+"="+string(iter.Value()) != want[i-1] {
+				t.Fatalf("Prev from %s: got %s, want %s", want[i], iter.Key(), want[i-1])
+			}
+			iter.Next()
+		}
+		valid = iter.Next()
+	}
+	if valid {
+		t.Fatalf("expected the iterator to be exhausted, got %s", iter.Key())
+	}
+}
+
+// TestIteratorBounds verifies that the merged iteration enforces its bounds even though the
+// children do not honor them.
+func TestIteratorBounds(t *testing.T) {
+	iter := merging.NewIterator(&merging.Options{
+		Compare:     bytes.Compare,
+		IsTombstone: isTombstone,
+		Bounds:      &sseuda.IterOptions{LowerBound: []byte("b"), UpperBound: []byte("e")},
+	},
+		newSliceIter("b=new", "d=", "f=new"),
+		newSliceIter("a=old", "b=old", "c=old", "d=old", "e=old"),
+	)
+	defer iter.Close()
+
+	if got, want := scan(iter, iter.First()), "b=new c=old"; got != want {
+		t.Fatalf("First: got %q, want %q", got, want)
+	}
+	if got, want := scanReverse(iter, iter.Last()), "b=new c=old"; got != want {
+		t.Fatalf("Last: got %q, want %q", got, want)
+	}
+	if got, want := scan(iter, iter.Seek([]byte("a"))), "b=new c=old"; got != want {
+		t.Fatalf("Seek below the lower bound: got %q, want %q", got, want)
+	}
+	if got, want := scanReverse(iter, iter.SeekLE([]byte("z"))), "b=new c=old"; got != want {
+		t.Fatalf("SeekLE above the upper bound: got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,351 @@
+package marena
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// ARENA_CHAIN_MAX_CHUNKS is the maximum number of chunks in a Chain.
+	ARENA_CHAIN_MAX_CHUNKS = 1 << 12
+
+	// ARENA_CHAIN_MAX_CHUNK_SIZE is the maximum size of a single chunk of a Chain.
+	ARENA_CHAIN_MAX_CHUNK_SIZE = 1 << 26
+
+	// ARENA_CHAIN_MAX_ALLOC_SIZE is the maximum size of a single Chain allocation.
+	ARENA_CHAIN_MAX_ALLOC_SIZE = 1<<26 - 1
+)
+
+/*
+64-bit chain address format:
+High 12 bits   = chunk id,
+Middle 26 bits = offset in the chunk,
+Low 26 bits    = requested memory size.
+*/
+
+const (
+	chainSizeBits   = 26
+	chainOffsetBits = 26
+	chainFieldMask  = 1<<26 - 1
+
+	// chunkTail is the room a heap chunk has past its end, which no allocation gets. A skip list
+	// node is viewed as one of the maximum height even when its allocation is shorter, and the
+	// tail keeps such a view of a node at the end of a chunk within the chunk's Go allocation.
+	chunkTail = 256
+)
+
+// chainAddress packs a chunk id, an offset in the chunk and a size into a chain address.
+func chainAddress(id, offset, size uint64) uint64 {
+	return id<<(chainOffsetBits+chainSizeBits) | offset<<chainSizeBits | size
+}
+
+// chunk is one buffer of a Chain. Allocations move its cursor forward atomically, like Arena's.
+type chunk struct {
+	id      uint64
+	buffer  []byte
+	cursor  int64
+	mapped  bool            // Whether the buffer is a memory mapping, unmapped by release.
+	cleanup runtime.Cleanup // Unmaps the buffer of a mapped chunk that was never released.
+}
+
+// reserve reserves `size` bytes of the chunk and returns their offset, or false if the chunk
+// is full. A failed reservation may leave the cursor past the end of the chunk.
+func (g *chunk) reserve(size int64) (int64, bool) {
+	if atomic.LoadInt64(&g.cursor)+size > int64(len(g.buffer)) {
+		return 0, false
+	}
+	end := atomic.AddInt64(&g.cursor, size)
+	if end > int64(len(g.buffer)) {
+		return 0, false
+	}
+	return end - size, true
+}
+
+// used returns the number of bytes reserved in the chunk.
+func (g *chunk) used() int64 {
+	return min(atomic.LoadInt64(&g.cursor), int64(len(g.buffer)))
+}
+
+// Chain is an arena that grows on demand. It starts with one chunk and, whenever an
+// allocation does not fit in the current chunk, moves on to the next, chaining a new one twice
+// as large as the last up to ARENA_CHAIN_MAX_CHUNK_SIZE, or as large as the allocation needs.
+// Chunks are never moved, so earlier allocations stay valid as the chain grows.
+//
+// Allocations are lock-free within a chunk; only moving to the next chunk takes a lock.
+// Addresses pack the chunk id with the offset and size, so View is a constant-time lookup, and
+// a single allocation holds at most ARENA_CHAIN_MAX_ALLOC_SIZE bytes. Offsets pack the chunk id
+// with the offset alone, and take 38 bits, so a skip list in a chain links its nodes with
+// 64-bit offsets.
+type Chain struct {
+	mu        sync.Mutex               // Serializes the chaining of chunks and the moves of `current`.
+	mapped    bool                     // Whether chunks are memory mappings, as from NewMmapChain.
+	chunks    atomic.Pointer[[]*chunk] // Chunks in order of id. Replaced, never modified, when a chunk is chained.
+	current   atomic.Pointer[chunk]    // Chunk allocations are served from. Grow may chain chunks past it.
+	next      int64                    // Size of the next chunk to chain, before it is fitted to an allocation.
+	limit     int64                    // Maximum total size of the chunks.
+	allocated int64                    // Total size of the chunks.
+}
+
+// NewChain creates a Chain whose first chunk holds `size` bytes, rounded up to ARENA_PAGESIZE,
+// and whose chunks may add up to at most `limit` bytes, or to the first chunk if it is larger.
+// A `limit` <= 0 leaves the chain bounded only by ARENA_CHAIN_MAX_CHUNKS.
+func NewChain(size, limit int64) *Chain {
+	g, _ := newChain(size, limit, false) // Chunks on the heap never fail to allocate.
+	return g
+}
+
+func newChain(size, limit int64, mapped bool) (*Chain, error) {
+	size = min(max(size, ARENA_PAGESIZE), ARENA_CHAIN_MAX_CHUNK_SIZE)
+	size = ((size + (ARENA_PAGESIZE - 1)) / ARENA_PAGESIZE) * ARENA_PAGESIZE
+	if limit <= 0 {
+		limit = ARENA_CHAIN_MAX_CHUNKS * ARENA_CHAIN_MAX_CHUNK_SIZE
+	}
+	limit = max(limit, size)
+
+	g := &Chain{limit: limit, next: size, mapped: mapped}
+	g.chunks.Store(&[]*chunk{})
+	first, err := g.chain(size)
+	if err != nil {
+		return nil, err
+	}
+	g.current.Store(first)
+	return g, nil
+}
+
+// chain appends a chunk that can hold `size` bytes: as large as the next chunk is due to be,
+// or as large as `size` needs, and cut short by the limit. The first chunk reserves
+// ARENA_MIN_ADDRESS bytes, so that no allocation gets the invalid address. It returns nil if
+// the chain has reached its limit, or if the chunk fails to map, with the error.
+// The caller must hold `mu`, except in newChain.
+func (g *Chain) chain(size int64) (*chunk, error) {
+	chunks := *g.chunks.Load()
+	chunkSize := g.next
+	if size > chunkSize {
+		chunkSize = min(((size+(ARENA_PAGESIZE-1))/ARENA_PAGESIZE)*ARENA_PAGESIZE, ARENA_CHAIN_MAX_CHUNK_SIZE)
+	}
+	chunkSize = min(chunkSize, g.limit-g.allocated)
+	if len(chunks) >= ARENA_CHAIN_MAX_CHUNKS || chunkSize <= 0 || chunkSize < size {
+		return nil, nil
+	}
+
+	c := &chunk{id: uint64(len(chunks)), mapped: g.mapped}
+	if c.mapped {
+		buffer, err := mmap(nil, chunkSize)
+		if err != nil {
+			return nil, err
+		}
+		c.buffer = buffer
+		c.cleanup = runtime.AddCleanup(c, func(buffer []byte) { munmap(buffer) }, buffer)
+	} else {
+		c.buffer = make([]byte, chunkSize+chunkTail)[:chunkSize]
+	}
+	if c.id == 0 {
+		c.cursor = ARENA_MIN_ADDRESS
+	}
+	g.allocated += chunkSize
+	g.next = min(chunkSize*2, ARENA_CHAIN_MAX_CHUNK_SIZE)
+	grown := append(chunks[:len(chunks):len(chunks)], c)
+	g.chunks.Store(&grown)
+	return c, nil
+}
+
+// advance moves allocations past `full`, the current chunk that could not hold `size` bytes,
+// to the next chunk, chaining one unless Grow already has. It reports false if the chain has
+// reached its limit or fails to map a chunk. If another goroutine has already moved past
+// `full`, it only reports true.
+func (g *Chain) advance(full *chunk, size int64) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.current.Load() != full {
+		return true
+	}
+
+	chunks := *g.chunks.Load()
+	var next *chunk
+	if full.id+1 < uint64(len(chunks)) {
+		next = chunks[full.id+1]
+	} else {
+		next, _ = g.chain(size)
+	}
+	if next == nil {
+		return false
+	}
+	g.current.Store(next)
+	return true
+}
+
+// reserve reserves `size` contiguous bytes, moving to the next chunk if the current one cannot
+// hold them. It returns the chunk and the offset of the bytes in it, or false on failure.
+func (g *Chain) reserve(size int64) (*chunk, int64, bool) {
+	if size > ARENA_CHAIN_MAX_CHUNK_SIZE {
+		return nil, 0, false
+	}
+	for {
+		c := g.current.Load()
+		if offset, ok := c.reserve(size); ok {
+			return c, offset, true
+		}
+		if !g.advance(c, size) {
+			return nil, 0, false
+		}
+	}
+}
+
+// Allocate reserves a block of the specified size in the chain.
+// Returns a chain address (chunk id, offset and size) or ARENA_INVALID_ADDRESS on failure.
+func (g *Chain) Allocate(size int) uint64 {
+	if size < 0 || size > ARENA_CHAIN_MAX_ALLOC_SIZE {
+		return ARENA_INVALID_ADDRESS
+	}
+
+	c, offset, ok := g.reserve(align(int64(size)))
+	if !ok {
+		return ARENA_INVALID_ADDRESS
+	}
+	return chainAddress(c.id, uint64(offset), uint64(size))
+}
+
+// AllocateMultiple reserves multiple blocks in a single operation. The blocks are contiguous,
+// in the same chunk.
+// isizes_oaddrs: pointers to the sizes; on success, overwritten with final chain addresses.
+// Returns true if all allocations succeed, false otherwise.
+func (g *Chain) AllocateMultiple(isizes_oaddrs ...*uint64) bool {
+	var totalSize int64
+	for _, isize_oaddr := range isizes_oaddrs {
+		if *isize_oaddr > ARENA_CHAIN_MAX_ALLOC_SIZE {
+			return false
+		}
+		totalSize += align(int64(*isize_oaddr))
+	}
+
+	c, offset, ok := g.reserve(totalSize)
+	if !ok {
+		return false
+	}
+
+	for _, isize_oaddr := range isizes_oaddrs {
+		size := *isize_oaddr
+		*isize_oaddr = chainAddress(c.id, uint64(offset), size)
+		offset += align(int64(size))
+	}
+
+	return true
+}
+
+// Grow chains chunks past the current one until reservations of the given sizes, made in
+// order with nothing else allocating meanwhile, are sure to succeed. Reservations no larger
+// than those succeed in their place as well, since chunks are filled in turn and each
+// reservation then ends no later than the one it stands for. A size covers the blocks of one
+// Allocate or AllocateMultiple call, each rounded up to 8 bytes.
+// It reports false if the chain cannot grow that much; the chunks it chained are kept.
+func (g *Chain) Grow(sizes ...int64) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	chunks := *g.chunks.Load()
+	c := g.current.Load()
+	id, used := c.id, c.used()
+	for _, size := range sizes {
+		size = align(size)
+		if size > ARENA_CHAIN_MAX_CHUNK_SIZE {
+			return false
+		}
+		for used+size > int64(len(chunks[id].buffer)) {
+			id, used = id+1, 0
+			if id == uint64(len(chunks)) {
+				if c, _ := g.chain(size); c == nil {
+					return false
+				}
+				chunks = *g.chunks.Load()
+			}
+		}
+		used += size
+	}
+	return true
+}
+
+// View returns a slice of the chunk buffer corresponding to the given chain address.
+// Returns nil if the address range is invalid.
+func (g *Chain) View(address uint64) []byte {
+	id := address >> (chainOffsetBits + chainSizeBits)
+	offset := (address >> chainSizeBits) & chainFieldMask
+	size := address & chainFieldMask
+
+	chunks := *g.chunks.Load()
+	if id >= uint64(len(chunks)) || (id == 0 && offset < ARENA_MIN_ADDRESS) {
+		return nil
+	}
+	buffer := chunks[id].buffer
+	if offset+size > uint64(len(buffer)) {
+		return nil
+	}
+
+	return buffer[offset : offset+size]
+}
+
+// Offset returns the offset in the chain of the block at the given chain address: its chunk id
+// and its offset in the chunk, packed.
+func (g *Chain) Offset(address uint64) uint64 {
+	return address >> chainSizeBits
+}
+
+// Index returns a pointer to the byte at the given offset in the chain.
+func (g *Chain) Index(offset uint64) *byte {
+	id := offset >> chainOffsetBits
+	return &(*g.chunks.Load())[id].buffer[offset&chainFieldMask]
+}
+
+// Reset drops every chunk but the first, zeroes the used part of the first, and rewinds its
+// cursor to the minimal valid address; the rest of the first chunk was never handed out, so it
+// is still zero. Dropped chunks are released. Addresses handed out before the call must no
+// longer be used.
+func (g *Chain) Reset() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	chunks := *g.chunks.Load()
+	if len(chunks) == 0 {
+		return // Released.
+	}
+	for _, c := range chunks[1:] {
+		c.release()
+	}
+	first := chunks[0]
+	clear(first.buffer[:first.used()])
+	atomic.StoreInt64(&first.cursor, ARENA_MIN_ADDRESS)
+	g.allocated = int64(len(first.buffer))
+	g.next = min(g.allocated*2, ARENA_CHAIN_MAX_CHUNK_SIZE)
+	g.chunks.Store(&[]*chunk{first})
+	g.current.Store(first)
+}
+
+// Used returns the number of bytes consumed in the chain, including the reserved prefix and
+// the unused tails of the chunks that filled up, but not the chunks Grow chained ahead.
+func (g *Chain) Used() int64 {
+	c := g.current.Load() // Loaded first: a chunk is published in `chunks` before it becomes current.
+	var used int64
+	for _, full := range (*g.chunks.Load())[:c.id] {
+		used += int64(len(full.buffer))
+	}
+	return used + c.used()
+}
+
+// Limit returns the maximum total size of the chunks.
+func (g *Chain) Limit() int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.limit
+}
+
+// setLimit changes the maximum total size of the chunks of a chain reused by an ArenaPool.
+func (g *Chain) setLimit(limit int64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.limit = limit
+}
+
+// Chunks returns the number of chunks in the chain, including those Grow chained ahead.
+func (g *Chain) Chunks() int {
+	return len(*g.chunks.Load())
+}
@@ -0,0 +1,191 @@
+package marena_test
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+
+	"gosuda.org/sseuda/internal/oldsepia/marena"
+)
+
+// TestChainGrows verifies that a chain chains chunks as it fills up, and that earlier
+// allocations keep their contents.
+func TestChainGrows(t *testing.T) {
+	c := marena.NewChain(marena.ARENA_PAGESIZE, 0)
+	var addrs []uint64
+	for i := 0; i < 1000; i++ {
+		addr := c.Allocate(1000)
+		if addr == marena.ARENA_INVALID_ADDRESS {
+			t.Fatalf("allocation %d failed", i)
+		}
+		view := c.View(addr)
+		if len(view) != 1000 {
+			t.Fatalf("len(View(addr)) = %d, want 1000", len(view))
+		}
+		for j := range view {
+			view[j] = byte(i)
+		}
+		addrs = append(addrs, addr)
+	}
+	if c.Chunks() < 2 {
+		t.Fatalf("Chunks() = %d after filling the first chunk, want more than 1", c.Chunks())
+	}
+	if used := c.Used(); used < 1000*1000 {
+		t.Errorf("Used() = %d, want at least %d", used, 1000*1000)
+	}
+	for i, addr := range addrs {
+		if !bytes.Equal(c.View(addr), bytes.Repeat([]byte{byte(i)}, 1000)) {
+			t.Fatalf("allocation %d lost its contents", i)
+		}
+	}
+
+	// An allocation larger than the next chunk gets a chunk of its own.
+	addr := c.Allocate(marena.ARENA_CHAIN_MAX_ALLOC_SIZE)
+	if len(c.View(addr)) != marena.ARENA_CHAIN_MAX_ALLOC_SIZE {
+		t.Fatalf("large allocation failed")
+	}
+}
+
+// TestChainAllocateMultiple verifies that blocks allocated together are contiguous.
+func TestChainAllocateMultiple(t *testing.T) {
+	c := marena.NewChain(marena.ARENA_PAGESIZE, 0)
+	c.Allocate(marena.ARENA_PAGESIZE - 256) // Leaves too little room for the blocks below.
+	var addr1, addr2 uint64 = 200, 300
+	if !c.AllocateMultiple(&addr1, &addr2) {
+		t.Fatal("AllocateMultiple failed")
+	}
+	view1, view2 := c.View(addr1), c.View(addr2)
+	if len(view1) != 200 || len(view2) != 300 {
+		t.Fatalf("views of %d and %d bytes, want 200 and 300", len(view1), len(view2))
+	}
+	if &view1[:cap(view1)][200] != &view2[0] {
+		t.Errorf("blocks are not contiguous")
+	}
+	if c.Chunks() != 2 {
+		t.Errorf("Chunks() = %d, want 2", c.Chunks())
+	}
+}
+
+// TestChainGrow verifies that Grow chains enough chunks ahead for a run of allocations larger
+// than any one chunk, that smaller allocations fit in what it chained, that it stops at the
+// limit, and that offsets resolve to the bytes of their blocks.
+func TestChainGrow(t *testing.T) {
+	c := marena.NewChain(marena.ARENA_PAGESIZE, 8*marena.ARENA_PAGESIZE)
+	c.Allocate(marena.ARENA_PAGESIZE - 1024)
+	sizes := make([]int64, 5*marena.ARENA_PAGESIZE/1024)
+	for i := range sizes {
+		sizes[i] = 1024
+	}
+	if !c.Grow(sizes...) {
+		t.Fatal("Grow within the limit failed")
+	}
+	chunks := c.Chunks()
+	if chunks < 3 {
+		t.Fatalf("Chunks() = %d after Grow, want at least 3", chunks)
+	}
+	for i := range sizes {
+		addr := c.Allocate(1000)
+		if addr == marena.ARENA_INVALID_ADDRESS {
+			t.Fatalf("allocation %d failed", i)
+		}
+		view := c.View(addr)
+		view[0] = byte(i)
+		if c.Index(c.Offset(addr)) != &view[0] {
+			t.Fatalf("Index(Offset(addr)) of allocation %d is not its first byte", i)
+		}
+	}
+	if c.Chunks() != chunks {
+		t.Errorf("Chunks() = %d after allocating what Grow made room for, want %d", c.Chunks(), chunks)
+	}
+	if c.Grow(8 * marena.ARENA_PAGESIZE) {
+		t.Error("Grow past the limit succeeded")
+	}
+	if c.Grow(marena.ARENA_CHAIN_MAX_CHUNK_SIZE + 1) {
+		t.Error("Grow for an allocation larger than a chunk succeeded")
+	}
+}
+
+// TestChainFailures verifies that a chain rejects oversized allocations and stops at its limit.
+func TestChainFailures(t *testing.T) {
+	c := marena.NewChain(marena.ARENA_PAGESIZE, 2*marena.ARENA_PAGESIZE)
+	if c.Allocate(marena.ARENA_CHAIN_MAX_ALLOC_SIZE+1) != marena.ARENA_INVALID_ADDRESS {
+		t.Error("allocation larger than ARENA_CHAIN_MAX_ALLOC_SIZE should fail")
+	}
+	var addr1, addr2 uint64 = marena.ARENA_CHAIN_MAX_ALLOC_SIZE, marena.ARENA_CHAIN_MAX_ALLOC_SIZE
+	if c.AllocateMultiple(&addr1, &addr2) {
+		t.Error("AllocateMultiple larger than a chunk should fail")
+	}
+
+	// The second chunk fits within the limit, a third one does not.
+	n := 0
+	for c.Allocate(1024) != marena.ARENA_INVALID_ADDRESS {
+		n++
+	}
+	if want := (2*marena.ARENA_PAGESIZE - marena.ARENA_MIN_ADDRESS) / 1024; n != want {
+		t.Errorf("%d allocations before the limit, want %d", n, want)
+	}
+	if c.Chunks() != 2 {
+		t.Errorf("Chunks() = %d, want 2", c.Chunks())
+	}
+	if c.View(marena.ARENA_INVALID_ADDRESS) != nil {
+		t.Error("View of the invalid address should be nil")
+	}
+}
+
+// TestChainConcurrent allocates from many goroutines at once, so that several of them race
+// to chain the next chunk.
+func TestChainConcurrent(t *testing.T) {
+	c := marena.NewChain(marena.ARENA_PAGESIZE, 0)
+	const workers, allocs = 8, 2000
+	addrs := make([][]uint64, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < allocs; i++ {
+				addr := c.Allocate(100)
+				if addr == marena.ARENA_INVALID_ADDRESS {
+					t.Error("allocation failed")
+					return
+				}
+				view := c.View(addr)
+				for j := range view {
+					view[j] = byte(w)
+				}
+				addrs[w] = append(addrs[w], addr)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for w := range addrs {
+		for _, addr := range addrs[w] {
+			if !bytes.Equal(c.View(addr), bytes.Repeat([]byte{byte(w)}, 100)) {
+				t.Fatalf("allocation of worker %d was overwritten", w)
+			}
+		}
+	}
+}
+
+func TestChainReset(t *testing.T) {
+	c := marena.NewChain(marena.ARENA_PAGESIZE, 0)
+	for c.Chunks() < 3 {
+		if c.Allocate(4096) == marena.ARENA_INVALID_ADDRESS {
+			t.Fatal("Allocation failed before Reset")
+		}
+	}
+
+	c.Reset()
+
+	if c.Chunks() != 1 || c.Used() != marena.ARENA_MIN_ADDRESS {
+		t.Errorf("after Reset: Chunks() = %d, Used() = %d; want 1 and %d", c.Chunks(), c.Used(), marena.ARENA_MIN_ADDRESS)
+	}
+	addr := c.Allocate(100)
+	if addr == marena.ARENA_INVALID_ADDRESS {
+		t.Fatal("Allocation failed after Reset")
+	}
+	if !bytes.Equal(c.View(addr), make([]byte, 100)) {
+		t.Error("Reset did not zero the first chunk")
+	}
+}
@@ -1,18 +1,31 @@
 package marena
 
 import (
+	"encoding/binary"
 	"errors"
+	"runtime"
 	"sync/atomic"
 )
 
 var (
 	ErrAllocationFailed = errors.New("marena: allocation failed")
+	ErrArenaTooLarge    = errors.New("marena: arena size exceeds the limit of its addressing mode")
 )
 
 const (
 	// ARENA_MAX_ALLOC_SIZE defines the maximum allocatable size.
 	ARENA_MAX_ALLOC_SIZE = 1<<31 - 1
 
+	// ARENA_MAX_SIZE is the maximum size of an arena with compact addresses.
+	ARENA_MAX_SIZE = 1 << 31
+
+	// ARENA_WIDE_MAX_SIZE is the maximum size of an arena with wide addresses, and of a single
+	// allocation in it.
+	ARENA_WIDE_MAX_SIZE = 1 << 48
+
+	// ARENA_WIDE_HEADER_SIZE is the size of the header that precedes every wide allocation.
+	ARENA_WIDE_HEADER_SIZE = 8
+
 	// ARENA_PAGESIZE is the fixed page size used for alignment.
 	ARENA_PAGESIZE = 1 << 16
 
@@ -24,31 +37,56 @@ const (
 )
 
 /*
-64-bit address format:
+64-bit compact address format:
 High 32 bits = offset in the arena,
 Low 32 bits  = requested memory size.
+
+64-bit wide address format:
+All 64 bits  = offset in the arena. The requested memory size is stored in the
+               ARENA_WIDE_HEADER_SIZE bytes right before the offset, little-endian.
 */
 
-// NewArena creates a new Arena with a buffer aligned to ARENA_PAGESIZE.
-// It ensures that the requested size does not exceed ARENA_MAX_ALLOC_SIZE.
-func NewArena(size int64) *Arena {
+// NewArena creates a new Arena with compact addresses and a buffer aligned to ARENA_PAGESIZE.
+// It returns ErrArenaTooLarge if the aligned size exceeds ARENA_MAX_SIZE.
+func NewArena(size int64) (*Arena, error) {
 	size = ((size + (ARENA_PAGESIZE - 1)) / ARENA_PAGESIZE) * ARENA_PAGESIZE
-	if size > ARENA_MAX_ALLOC_SIZE {
-		size = 1 << 31
+	if size > ARENA_MAX_SIZE {
+		return nil, ErrArenaTooLarge
 	}
 
 	return &Arena{
 		buffer: make([]byte, size),
 		size:   size,
 		cursor: ARENA_MIN_ADDRESS, // allocate zero value
+	}, nil
+}
+
+// NewWideArena creates a new Arena with wide addresses and a buffer aligned to ARENA_PAGESIZE,
+// for arenas or allocations beyond the 4 GiB reach of compact addresses. Each allocation
+// costs ARENA_WIDE_HEADER_SIZE extra bytes.
+// It returns ErrArenaTooLarge if the aligned size exceeds ARENA_WIDE_MAX_SIZE.
+func NewWideArena(size int64) (*Arena, error) {
+	if size > ARENA_WIDE_MAX_SIZE {
+		return nil, ErrArenaTooLarge
 	}
+	size = ((size + (ARENA_PAGESIZE - 1)) / ARENA_PAGESIZE) * ARENA_PAGESIZE
+
+	return &Arena{
+		buffer: make([]byte, size),
+		size:   size,
+		cursor: ARENA_MIN_ADDRESS, // allocate zero value
+		wide:   true,
+	}, nil
 }
 
 // Arena represents a memory arena with a buffer, total size, and cursor offset.
 type Arena struct {
-	buffer []byte
-	size   int64
-	cursor int64
+	buffer  []byte
+	size    int64
+	cursor  int64
+	wide    bool            // Whether addresses use the wide format.
+	mapped  bool            // Whether the buffer is a memory mapping, unmapped by Release.
+	cleanup runtime.Cleanup // Unmaps the buffer of a mapped arena that was never released.
 }
 
 // align rounds n up to an 8-byte boundary.
@@ -56,14 +94,40 @@ func align(n int64) int64 {
 	return ((n + 7) >> 3) << 3
 }
 
+// maxAllocSize returns the maximum size of a single allocation in the arena.
+func (g *Arena) maxAllocSize() uint64 {
+	if g.wide {
+		return ARENA_WIDE_MAX_SIZE
+	}
+	return ARENA_MAX_ALLOC_SIZE
+}
+
+// blockSize returns the number of arena bytes taken by an allocation of `size` bytes.
+func (g *Arena) blockSize(size int64) int64 {
+	if g.wide {
+		return ARENA_WIDE_HEADER_SIZE + align(size)
+	}
+	return align(size)
+}
+
+// address returns the address of an allocation of `size` bytes whose block starts at `offset`.
+// In wide mode, it writes the header of the block.
+func (g *Arena) address(offset int64, size uint64) uint64 {
+	if g.wide {
+		binary.LittleEndian.PutUint64(g.buffer[offset:], size)
+		return uint64(offset + ARENA_WIDE_HEADER_SIZE)
+	}
+	return uint64(offset)<<32 | size
+}
+
 // Allocate reserves a block of the specified size in the arena.
-// Returns a 64-bit address (offset << 32 | size) or ARENA_INVALID_ADDRESS on failure.
+// Returns a 64-bit address in the arena's format or ARENA_INVALID_ADDRESS on failure.
 func (g *Arena) Allocate(size int) uint64 {
-	if uint64(size) > ARENA_MAX_ALLOC_SIZE {
+	if uint64(size) > g.maxAllocSize() {
 		return ARENA_INVALID_ADDRESS
 	}
 
-	sizeAligned := align(int64(size))
+	sizeAligned := g.blockSize(int64(size))
 	if atomic.LoadInt64(&g.cursor)+sizeAligned > g.size {
 		return ARENA_INVALID_ADDRESS
 	}
@@ -74,7 +138,7 @@ func (g *Arena) Allocate(size int) uint64 {
 		return ARENA_INVALID_ADDRESS
 	}
 
-	return uint64(indexStart)<<32 | uint64(size)
+	return g.address(indexStart, uint64(size))
 }
 
 // AllocateMultiple reserves multiple blocks in a single operation.
@@ -83,10 +147,10 @@ func (g *Arena) Allocate(size int) uint64 {
 func (g *Arena) AllocateMultiple(isizes_oaddrs ...*uint64) bool {
 	var totalSize int64
 	for _, isize_oaddr := range isizes_oaddrs {
-		if *isize_oaddr > ARENA_MAX_ALLOC_SIZE {
+		if *isize_oaddr > g.maxAllocSize() {
 			return false
 		}
-		totalSize += align(int64(*isize_oaddr))
+		totalSize += g.blockSize(int64(*isize_oaddr))
 	}
 
 	if atomic.LoadInt64(&g.cursor)+totalSize > g.size {
@@ -101,8 +165,8 @@ func (g *Arena) AllocateMultiple(isizes_oaddrs ...*uint64) bool {
 
 	for _, isize_oaddr := range isizes_oaddrs {
 		size := int64(*isize_oaddr)
-		*isize_oaddr = uint64(indexStart)<<32 | uint64(size)
-		indexStart += align(size)
+		*isize_oaddr = g.address(indexStart, uint64(size))
+		indexStart += g.blockSize(size)
 	}
 
 	return true
@@ -111,6 +175,17 @@ func (g *Arena) AllocateMultiple(isizes_oaddrs ...*uint64) bool {
 // View returns a slice of the arena's buffer corresponding to the given address.
 // Returns nil if the address range is invalid.
 func (g *Arena) View(address uint64) []byte {
+	if g.wide {
+		if address < ARENA_MIN_ADDRESS+ARENA_WIDE_HEADER_SIZE || address > uint64(g.size) {
+			return nil
+		}
+		size := binary.LittleEndian.Uint64(g.buffer[address-ARENA_WIDE_HEADER_SIZE:])
+		if size > uint64(g.size)-address {
+			return nil
+		}
+		return g.buffer[address : address+size]
+	}
+
 	offset := address >> 32
 	size := address & (1<<32 - 1)
 
@@ -121,11 +196,24 @@ func (g *Arena) View(address uint64) []byte {
 	return g.buffer[offset : offset+size]
 }
 
+// Offset returns the offset in the arena of the block at the given address.
+func (g *Arena) Offset(address uint64) uint64 {
+	if g.wide {
+		return address
+	}
+	return address >> 32
+}
+
 // Index returns a pointer to the byte at the given offset in the arena.
-func (g *Arena) Index(offset uint32) *byte {
+func (g *Arena) Index(offset uint64) *byte {
 	return &g.buffer[offset]
 }
 
+// Wide reports whether the arena uses wide addresses.
+func (g *Arena) Wide() bool {
+	return g.wide
+}
+
 // Reset resets the Arena cursor to the minimal valid address.
 func (g *Arena) Reset() {
 	atomic.StoreInt64(&g.cursor, ARENA_MIN_ADDRESS)
@@ -142,12 +230,17 @@ func (g *Arena) Remaining() int64 {
 	return g.size - atomic.LoadInt64(&g.cursor)
 }
 
-// Size extracts the size portion from a 64-bit address.
+// Used returns the number of bytes consumed in the Arena, including the reserved prefix.
+func (g *Arena) Used() int64 {
+	return atomic.LoadInt64(&g.cursor)
+}
+
+// Size extracts the size portion from a 64-bit compact address.
 func Size(address uint64) uint32 {
 	return uint32(address & (1<<32 - 1))
 }
 
-// Offset extracts the offset portion from a 64-bit address.
+// Offset extracts the offset portion from a 64-bit compact address.
 func Offset(address uint64) uint32 {
 	return uint32(address >> 32)
 }
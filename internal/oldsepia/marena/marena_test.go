@@ -6,9 +6,18 @@ import (
 	"gosuda.org/sseuda/internal/oldsepia/marena"
 )
 
+func newArena(t *testing.T, size int64) *marena.Arena {
+	t.Helper()
+	a, err := marena.NewArena(size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
 // TestNewArena verifies that a new arena is created.
 func TestNewArena(t *testing.T) {
-	a := marena.NewArena(1024)
+	a := newArena(t, 1024)
 	if a == nil {
 		t.Fatal("NewArena returned nil")
 	}
@@ -21,7 +30,7 @@ func TestNewArena(t *testing.T) {
 
 // TestAllocate checks the Allocate function for a valid allocation.
 func TestAllocate(t *testing.T) {
-	a := marena.NewArena(65536)
+	a := newArena(t, 65536)
 	addr := a.Allocate(100)
 	if addr == marena.ARENA_INVALID_ADDRESS {
 		t.Fatal("Allocation returned invalid address")
@@ -39,7 +48,7 @@ func TestAllocate(t *testing.T) {
 
 // TestAllocateMultiple verifies that multiple allocations can succeed in one operation.
 func TestAllocateMultiple(t *testing.T) {
-	a := marena.NewArena(65536)
+	a := newArena(t, 65536)
 	var addr1, addr2, addr3 uint64 = 50, 200, 300
 	ok := a.AllocateMultiple(&addr1, &addr2, &addr3)
 	if !ok {
@@ -58,7 +67,7 @@ func TestAllocateMultiple(t *testing.T) {
 
 // TestView checks that the buffer view returned matches the allocated size and that modifications persist.
 func TestView(t *testing.T) {
-	a := marena.NewArena(65536)
+	a := newArena(t, 65536)
 	addr := a.Allocate(100)
 	if addr == marena.ARENA_INVALID_ADDRESS {
 		t.Fatal("Allocation failed")
@@ -83,7 +92,7 @@ func TestView(t *testing.T) {
 
 // TestSizeAndOffset directly tests the Size and Offset functions.
 func TestSizeAndOffset(t *testing.T) {
-	a := marena.NewArena(65536)
+	a := newArena(t, 65536)
 	addr := a.Allocate(100)
 	size := marena.Size(addr)
 	off := marena.Offset(addr)
@@ -98,7 +107,7 @@ func TestSizeAndOffset(t *testing.T) {
 // TestAllocationFailures verifies various allocation failure scenarios.
 func TestAllocationFailures(t *testing.T) {
 	t.Run("exceeds max size", func(t *testing.T) {
-		a := marena.NewArena(marena.ARENA_PAGESIZE)
+		a := newArena(t, marena.ARENA_PAGESIZE)
 		addr := a.Allocate(1 << 31)
 		if addr != marena.ARENA_INVALID_ADDRESS {
 			t.Error("allocation should fail when size exceeds ARENA_MAX_ALLOC_SIZE")
@@ -107,7 +116,7 @@ func TestAllocationFailures(t *testing.T) {
 
 	t.Run("insufficient space", func(t *testing.T) {
 		// Create a minimal arena that will be aligned to ARENA_PAGESIZE
-		a := marena.NewArena(marena.ARENA_PAGESIZE)
+		a := newArena(t, marena.ARENA_PAGESIZE)
 		// First allocation - use almost all space, considering alignment
 		addr1 := a.Allocate(marena.ARENA_PAGESIZE - marena.ARENA_MIN_ADDRESS - 16)
 		if addr1 == marena.ARENA_INVALID_ADDRESS {
@@ -125,7 +134,7 @@ func TestAllocationFailures(t *testing.T) {
 func TestAllocateMultipleFailures(t *testing.T) {
 	t.Run("exceeds total space", func(t *testing.T) {
 		// Create arena with minimum page size
-		a := marena.NewArena(marena.ARENA_PAGESIZE)
+		a := newArena(t, marena.ARENA_PAGESIZE)
 		// Request allocations that together exceed available space
 		spacePerAlloc := (marena.ARENA_PAGESIZE - marena.ARENA_MIN_ADDRESS) / 2
 		var addr1, addr2 uint64 = uint64(spacePerAlloc), uint64(spacePerAlloc + 64)
@@ -136,7 +145,7 @@ func TestAllocateMultipleFailures(t *testing.T) {
 	})
 
 	t.Run("individual size too large", func(t *testing.T) {
-		a := marena.NewArena(65536)
+		a := newArena(t, 65536)
 		var addr1, addr2 uint64 = 100, 1 << 31
 		ok := a.AllocateMultiple(&addr1, &addr2)
 		if ok {
@@ -146,7 +155,7 @@ func TestAllocateMultipleFailures(t *testing.T) {
 }
 
 func TestArenaReset(t *testing.T) {
-	a := marena.NewArena(1024)
+	a := newArena(t, 1024)
 	addr := a.Allocate(100)
 	if addr == marena.ARENA_INVALID_ADDRESS {
 		t.Fatal("Allocation failed before Reset")
@@ -160,7 +169,7 @@ func TestArenaReset(t *testing.T) {
 }
 
 func TestArenaRemaining(t *testing.T) {
-	a := marena.NewArena(marena.ARENA_PAGESIZE)
+	a := newArena(t, marena.ARENA_PAGESIZE)
 	initialRemaining := a.Remaining()
 	if initialRemaining != marena.ARENA_PAGESIZE-marena.ARENA_MIN_ADDRESS {
 		t.Errorf("Expected initial remaining to be %d, got %d",
@@ -174,3 +183,50 @@ func TestArenaRemaining(t *testing.T) {
 		t.Errorf("Expected new remaining = %d, got %d", expected, newRemaining)
 	}
 }
+
+// TestArenaTooLarge verifies that sizes beyond the limit of an addressing mode are rejected
+// rather than clamped.
+func TestArenaTooLarge(t *testing.T) {
+	if _, err := marena.NewArena(marena.ARENA_MAX_SIZE + 1); err != marena.ErrArenaTooLarge {
+		t.Errorf("NewArena(ARENA_MAX_SIZE+1) error = %v, want ErrArenaTooLarge", err)
+	}
+	if _, err := marena.NewWideArena(marena.ARENA_WIDE_MAX_SIZE + 1); err != marena.ErrArenaTooLarge {
+		t.Errorf("NewWideArena(ARENA_WIDE_MAX_SIZE+1) error = %v, want ErrArenaTooLarge", err)
+	}
+}
+
+// TestWideArena verifies allocations and views of an arena in the wide addressing mode.
+func TestWideArena(t *testing.T) {
+	a, err := marena.NewWideArena(65536)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !a.Wide() {
+		t.Fatal("Wide() = false for a wide arena")
+	}
+
+	addr := a.Allocate(100)
+	if addr == marena.ARENA_INVALID_ADDRESS {
+		t.Fatal("Allocation returned invalid address")
+	}
+	if view := a.View(addr); len(view) != 100 {
+		t.Errorf("len(View(addr)) = %d, want 100", len(view))
+	}
+	if a.Offset(addr) != addr {
+		t.Errorf("Offset(addr) = %d, want the address itself, %d", a.Offset(addr), addr)
+	}
+
+	var addr1, addr2 uint64 = 0, 300
+	if !a.AllocateMultiple(&addr1, &addr2) {
+		t.Fatal("AllocateMultiple failed")
+	}
+	if len(a.View(addr1)) != 0 || len(a.View(addr2)) != 300 {
+		t.Errorf("views of %d and %d bytes, want 0 and 300", len(a.View(addr1)), len(a.View(addr2)))
+	}
+	if a.View(1<<40) != nil {
+		t.Error("View of an address past the end of the arena should be nil")
+	}
+	if a.View(marena.ARENA_INVALID_ADDRESS) != nil {
+		t.Error("View of the invalid address should be nil")
+	}
+}
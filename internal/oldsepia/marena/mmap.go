@@ -0,0 +1,129 @@
+package marena
+
+import (
+	"errors"
+	"os"
+	"runtime"
+)
+
+// ErrMmapUnsupported is returned by NewMmapArena and NewMmapChain on platforms without memory
+// mappings.
+var ErrMmapUnsupported = errors.New("marena: memory-mapped arenas are not supported on this platform")
+
+// MmapOptions configures an arena created by NewMmapArena.
+type MmapOptions struct {
+	// Path, if set, backs the arena with the file at Path, created or truncated to the size of
+	// the arena. Otherwise the mapping is anonymous. Release leaves the file in place.
+	Path string
+
+	// Wide selects wide addresses, as NewWideArena does.
+	Wide bool
+}
+
+// NewMmapArena creates a new Arena whose buffer is a memory mapping aligned to ARENA_PAGESIZE,
+// outside of the Go heap: it neither counts against the heap nor paces the garbage collector.
+// The mapping starts zeroed, like the buffer of NewArena. A nil `opts` maps anonymous memory
+// with compact addresses.
+//
+// The mapping is unmapped by Release or, failing that, once the arena becomes unreachable.
+// Views of the arena must not outlive it.
+// It returns ErrArenaTooLarge if the aligned size exceeds the limit of the addressing mode.
+func NewMmapArena(size int64, opts *MmapOptions) (*Arena, error) {
+	if opts == nil {
+		opts = &MmapOptions{}
+	}
+	limit := int64(ARENA_MAX_SIZE)
+	if opts.Wide {
+		limit = ARENA_WIDE_MAX_SIZE
+	}
+	if size > limit { // Checked before rounding too, which could overflow.
+		return nil, ErrArenaTooLarge
+	}
+	size = ((max(size, 1) + (ARENA_PAGESIZE - 1)) / ARENA_PAGESIZE) * ARENA_PAGESIZE
+	if size > limit {
+		return nil, ErrArenaTooLarge
+	}
+
+	var file *os.File
+	if opts.Path != "" {
+		var err error
+		if file, err = os.OpenFile(opts.Path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644); err != nil {
+			return nil, err
+		}
+		// The mapping outlives the descriptor.
+		defer file.Close()
+		if err := file.Truncate(size); err != nil {
+			return nil, err
+		}
+	}
+	buffer, err := mmap(file, size)
+	if err != nil {
+		return nil, err
+	}
+
+	g := &Arena{
+		buffer: buffer,
+		size:   size,
+		cursor: ARENA_MIN_ADDRESS, // allocate zero value
+		wide:   opts.Wide,
+		mapped: true,
+	}
+	g.cleanup = runtime.AddCleanup(g, func(buffer []byte) { munmap(buffer) }, buffer)
+	return g, nil
+}
+
+// Release frees the arena's buffer: a mapped buffer is unmapped at once, a heap buffer is left
+// to the garbage collector. The arena is empty afterwards, so every allocation fails and every
+// view is nil. Views taken before the call must no longer be used; touching an unmapped buffer
+// crashes the process. Release must not run concurrently with other methods of the arena.
+func (g *Arena) Release() error {
+	buffer := g.buffer
+	g.buffer, g.size, g.cursor = nil, 0, 0
+	if !g.mapped || buffer == nil {
+		return nil
+	}
+	g.cleanup.Stop()
+	return munmap(buffer)
+}
+
+// NewMmapChain creates a Chain like NewChain, except that every chunk is an anonymous memory
+// mapping outside of the Go heap, as the buffer of NewMmapArena is. An allocation that needs a
+// chunk which fails to map fails, as one past the limit does.
+//
+// The chunks are unmapped by Reset, which drops all but the first, and by Release or, failing
+// that, once they become unreachable. Views of the chain must not outlive it.
+func NewMmapChain(size, limit int64) (*Chain, error) {
+	return newChain(size, limit, true)
+}
+
+// Release frees the chain's chunks: mapped chunks are unmapped at once, heap chunks are left to
+// the garbage collector. The chain is empty afterwards, so every allocation fails and every view
+// is nil. Views taken before the call must no longer be used; touching an unmapped chunk
+// crashes the process. Release must not run concurrently with other methods of the chain.
+func (g *Chain) Release() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	chunks := *g.chunks.Load()
+	g.chunks.Store(&[]*chunk{})
+	g.current.Store(&chunk{})
+	g.limit, g.allocated = 0, 0
+	var err error
+	for _, c := range chunks {
+		if releaseErr := c.release(); err == nil {
+			err = releaseErr
+		}
+	}
+	return err
+}
+
+// release frees the chunk's buffer, unmapping it if it is a memory mapping.
+func (g *chunk) release() error {
+	buffer := g.buffer
+	g.buffer = nil
+	if !g.mapped || buffer == nil {
+		return nil
+	}
+	g.cleanup.Stop()
+	return munmap(buffer)
+}
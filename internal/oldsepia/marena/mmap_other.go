@@ -0,0 +1,15 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package marena
+
+import "os"
+
+// mmap always fails: the platform has no memory mappings the arena can use.
+func mmap(file *os.File, size int64) ([]byte, error) {
+	return nil, ErrMmapUnsupported
+}
+
+// munmap is never called, since mmap never succeeds.
+func munmap(buffer []byte) error {
+	return ErrMmapUnsupported
+}
@@ -0,0 +1,139 @@
+package marena_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"gosuda.org/sseuda/internal/oldsepia/marena"
+)
+
+func newMmapArena(t *testing.T, size int64, opts *marena.MmapOptions) *marena.Arena {
+	t.Helper()
+	a, err := marena.NewMmapArena(size, opts)
+	if errors.Is(err, marena.ErrMmapUnsupported) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+// TestMmapArena verifies that a mapped arena allocates like a heap arena, stays off the Go heap,
+// and is empty once released.
+func TestMmapArena(t *testing.T) {
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	a := newMmapArena(t, 256<<20, nil)
+	runtime.ReadMemStats(&after)
+	if after.HeapSys >= before.HeapSys+64<<20 {
+		t.Errorf("heap grew by %d bytes for a mapped arena", after.HeapSys-before.HeapSys)
+	}
+
+	if a.Remaining() != 256<<20-marena.ARENA_MIN_ADDRESS {
+		t.Errorf("Remaining() = %d, want %d", a.Remaining(), 256<<20-marena.ARENA_MIN_ADDRESS)
+	}
+	addr := a.Allocate(100)
+	view := a.View(addr)
+	if !bytes.Equal(view, make([]byte, 100)) {
+		t.Fatalf("View(addr) = %v, want 100 zero bytes", view)
+	}
+	copy(view, "hello")
+	if !bytes.HasPrefix(a.View(addr), []byte("hello")) {
+		t.Error("write through a view was lost")
+	}
+	a.Reset()
+	if !bytes.Equal(a.View(addr), make([]byte, 100)) {
+		t.Error("Reset did not zero the mapping")
+	}
+
+	if err := a.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if a.Allocate(100) != marena.ARENA_INVALID_ADDRESS || a.View(addr) != nil || a.Remaining() != 0 {
+		t.Error("a released arena should be empty")
+	}
+	if err := a.Release(); err != nil {
+		t.Errorf("second Release() = %v, want nil", err)
+	}
+}
+
+// TestMmapArenaFile verifies that a file-backed arena writes through to its file, and that
+// sizes beyond the addressing mode are rejected.
+func TestMmapArenaFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "arena")
+	a := newMmapArena(t, 1000, &marena.MmapOptions{Path: path, Wide: true})
+	if !a.Wide() {
+		t.Error("Wide() = false for a wide mapped arena")
+	}
+	addr := a.Allocate(5)
+	copy(a.View(addr), "hello")
+	if err := a.Release(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != marena.ARENA_PAGESIZE {
+		t.Errorf("file size = %d, want %d", len(data), marena.ARENA_PAGESIZE)
+	}
+	if string(data[addr:addr+5]) != "hello" {
+		t.Errorf("file holds %q at the allocation, want hello", data[addr:addr+5])
+	}
+
+	if _, err := marena.NewMmapArena(marena.ARENA_MAX_SIZE+1, nil); err != marena.ErrArenaTooLarge {
+		t.Errorf("NewMmapArena(ARENA_MAX_SIZE+1) error = %v, want ErrArenaTooLarge", err)
+	}
+}
+
+// TestMmapChain verifies that a mapped chain grows like a heap chain, that Reset unmaps the
+// chunks it drops and zeroes the first, and that the chain is empty once released.
+func TestMmapChain(t *testing.T) {
+	c, err := marena.NewMmapChain(marena.ARENA_PAGESIZE, 0)
+	if errors.Is(err, marena.ErrMmapUnsupported) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var addrs []uint64
+	for c.Chunks() < 3 {
+		addr := c.Allocate(1000)
+		view := c.View(addr)
+		if !bytes.Equal(view, make([]byte, 1000)) {
+			t.Fatalf("View(addr) of allocation %d is not 1000 zero bytes", len(addrs))
+		}
+		view[0] = byte(len(addrs))
+		addrs = append(addrs, addr)
+	}
+	for i, addr := range addrs {
+		if c.View(addr)[0] != byte(i) {
+			t.Fatalf("allocation %d lost its contents", i)
+		}
+	}
+
+	c.Reset()
+	if c.Chunks() != 1 {
+		t.Errorf("Chunks() = %d after Reset, want 1", c.Chunks())
+	}
+	if !bytes.Equal(c.View(c.Allocate(1000)), make([]byte, 1000)) {
+		t.Error("Reset did not zero the first chunk")
+	}
+
+	if err := c.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if c.Chunks() != 0 || c.Allocate(100) != marena.ARENA_INVALID_ADDRESS || c.View(addrs[0]) != nil || c.Used() != 0 {
+		t.Error("a released chain should be empty")
+	}
+	if err := c.Release(); err != nil {
+		t.Errorf("second Release() = %v, want nil", err)
+	}
+}
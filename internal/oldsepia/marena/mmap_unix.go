@@ -0,0 +1,22 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package marena
+
+import (
+	"os"
+	"syscall"
+)
+
+// mmap maps `size` bytes of `file` for reading and writing, shared with the file, or `size`
+// bytes of anonymous memory if `file` is nil.
+func mmap(file *os.File, size int64) ([]byte, error) {
+	if file == nil {
+		return syscall.Mmap(-1, 0, int(size), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_ANON|syscall.MAP_PRIVATE)
+	}
+	return syscall.Mmap(int(file.Fd()), 0, int(size), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+}
+
+// munmap unmaps a buffer returned by mmap.
+func munmap(buffer []byte) error {
+	return syscall.Munmap(buffer)
+}
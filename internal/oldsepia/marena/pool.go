@@ -0,0 +1,227 @@
+package marena
+
+import (
+	"errors"
+	"slices"
+	"sync"
+)
+
+var (
+	ErrArenaBudgetExceeded = errors.New("marena: arena pool budget exceeded")
+	ErrArenaPoolClosed     = errors.New("marena: arena pool closed")
+)
+
+// ArenaPoolOptions configures an ArenaPool.
+type ArenaPoolOptions struct {
+	// ChunkSize is the size of the first chunk of every chain of the pool, rounded up to
+	// ARENA_PAGESIZE as NewChain does. A recycled chain keeps its first chunk and drops the rest.
+	ChunkSize int64
+
+	// Budget bounds the memory of the chains the pool has handed out, kept for reuse or is
+	// zeroing. A chain in use counts for its limit, since it may grow up to it, and a chain kept
+	// for reuse or zeroing counts for its first chunk. Zero means no bound.
+	Budget int64
+
+	// MaxFree is the number of chains kept for reuse; the pool releases the ones returned
+	// beyond it. Defaults to 1.
+	MaxFree int
+}
+
+// ArenaPool recycles chains that share the size of their first chunk. A chain handed back by Put
+// is reset in the background, zeroing only the used part of its first chunk, so that neither
+// Put nor Get pays for the zeroing on the caller's goroutine. Every chain the pool has created
+// counts against its budget until the pool releases it, which lets several users of one pool
+// share a single memory bound.
+//
+// An ArenaPool is safe for concurrent use.
+type ArenaPool struct {
+	opts ArenaPoolOptions
+
+	mu        sync.Mutex
+	changed   chan struct{} // Closed, and replaced, whenever a chain is returned or the pool closed.
+	free      []*Chain      // Reset chains, ready for reuse.
+	zeroing   int           // Number of chains being reset in the background.
+	allocated int64         // Memory of the chains that count against the budget.
+	closed    bool
+}
+
+// defaultArenaPool is created by the first call to DefaultArenaPool.
+var defaultArenaPool = sync.OnceValue(func() *ArenaPool {
+	return NewArenaPool(&ArenaPoolOptions{ChunkSize: ARENA_PAGESIZE})
+})
+
+// DefaultArenaPool returns the pool shared by every user in the process that brings no pool of
+// its own. Its chains start with a chunk of ARENA_PAGESIZE bytes, so that they suit any limit,
+// and it has no budget. It must not be closed.
+func DefaultArenaPool() *ArenaPool {
+	return defaultArenaPool()
+}
+
+// NewArenaPool creates an ArenaPool.
+func NewArenaPool(opts *ArenaPoolOptions) *ArenaPool {
+	o := *opts
+	o.ChunkSize = min(max(o.ChunkSize, ARENA_PAGESIZE), ARENA_CHAIN_MAX_CHUNK_SIZE)
+	o.ChunkSize = ((o.ChunkSize + (ARENA_PAGESIZE - 1)) / ARENA_PAGESIZE) * ARENA_PAGESIZE
+	if o.MaxFree <= 0 {
+		o.MaxFree = 1
+	}
+	return &ArenaPool{opts: o, changed: make(chan struct{})}
+}
+
+// ChunkSize returns the size of the first chunk of the chains of the pool.
+func (g *ArenaPool) ChunkSize() int64 {
+	return g.opts.ChunkSize
+}
+
+// Allocated returns the memory of the chains that count against the budget.
+func (g *ArenaPool) Allocated() int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.allocated
+}
+
+// Free returns the number of reset chains ready for reuse.
+func (g *ArenaPool) Free() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.free)
+}
+
+// fits reports whether `size` more bytes fit in the budget. The caller must hold `mu`.
+func (g *ArenaPool) fits(size int64) bool {
+	return g.opts.Budget <= 0 || g.allocated+size <= g.opts.Budget
+}
+
+// available reports whether Get can hand out a chain of `limit` bytes without exceeding the
+// budget, possibly once a chain being reset is ready. The caller must hold `mu`.
+func (g *ArenaPool) available(limit int64) bool {
+	return g.fits(limit) || ((len(g.free) > 0 || g.zeroing > 0) && g.fits(limit-g.opts.ChunkSize))
+}
+
+// notify wakes the goroutines waiting for the pool to change. The caller must hold `mu`.
+func (g *ArenaPool) notify() {
+	close(g.changed)
+	g.changed = make(chan struct{})
+}
+
+// Get returns an empty chain that may grow up to `limit` bytes, with memory-mapped chunks if
+// `mapped` is set, as NewMmapChain does: a reset one kept for reuse, a new one if the budget
+// allows it, or else one that is being reset, once it is done. A `limit` below the pool's
+// ChunkSize is raised to it. It returns ErrArenaBudgetExceeded if the budget is spent on chains
+// in use.
+func (g *ArenaPool) Get(limit int64, mapped bool) (*Chain, error) {
+	limit = max(limit, g.opts.ChunkSize)
+	g.mu.Lock()
+	for {
+		i := slices.IndexFunc(g.free, func(chain *Chain) bool { return chain.mapped == mapped })
+		switch {
+		case g.closed:
+			g.mu.Unlock()
+			return nil, ErrArenaPoolClosed
+		case i >= 0 && g.fits(limit-g.opts.ChunkSize):
+			chain := g.free[i]
+			g.free = slices.Delete(g.free, i, i+1)
+			g.allocated += limit - g.opts.ChunkSize
+			g.mu.Unlock()
+			chain.setLimit(limit)
+			return chain, nil
+		case g.fits(limit):
+			g.allocated += limit
+			g.mu.Unlock()
+			chain, err := newChain(g.opts.ChunkSize, limit, mapped)
+			if err != nil {
+				g.mu.Lock()
+				g.allocated -= limit
+				g.notify()
+				g.mu.Unlock()
+			}
+			return chain, err
+		case i < 0 && len(g.free) > 0 && g.fits(limit-g.opts.ChunkSize):
+			// Only chains of the other kind are kept; releasing one makes room for a new chain.
+			g.allocated -= g.opts.ChunkSize
+			g.free[len(g.free)-1].Release()
+			g.free = g.free[:len(g.free)-1]
+			continue
+		case !g.available(limit):
+			g.mu.Unlock()
+			return nil, ErrArenaBudgetExceeded
+		}
+		changed := g.changed
+		g.mu.Unlock()
+		<-changed
+		g.mu.Lock()
+	}
+}
+
+// Put hands `chain`, which must come from Get, back to the pool. Addresses handed out by the
+// chain must no longer be used. The chain is reset in the background and kept for reuse, or
+// released if the pool already keeps MaxFree chains or is closed.
+func (g *ArenaPool) Put(chain *Chain) {
+	limit := chain.Limit()
+	g.mu.Lock()
+	if g.closed || len(g.free)+g.zeroing >= g.opts.MaxFree {
+		g.mu.Unlock()
+		chain.Release()
+
+		g.mu.Lock()
+		g.allocated -= limit
+		g.notify()
+		g.mu.Unlock()
+		return
+	}
+	g.zeroing++
+	g.allocated -= limit - g.opts.ChunkSize // Only the first chunk survives the reset.
+	g.notify()
+	g.mu.Unlock()
+
+	go func() {
+		chain.Reset()
+
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		g.zeroing--
+		g.notify()
+		if g.closed {
+			g.allocated -= g.opts.ChunkSize
+			chain.Release()
+			return
+		}
+		g.free = append(g.free, chain)
+	}()
+}
+
+// Wait blocks until Get can return a chain of `limit` bytes without exceeding the budget, or
+// until `cancel` is closed. It may return early, so the caller must be prepared for Get to fail
+// anyway.
+func (g *ArenaPool) Wait(limit int64, cancel <-chan struct{}) {
+	limit = max(limit, g.opts.ChunkSize)
+	g.mu.Lock()
+	if g.closed || g.available(limit) {
+		g.mu.Unlock()
+		return
+	}
+	changed := g.changed
+	g.mu.Unlock()
+
+	select {
+	case <-changed:
+	case <-cancel:
+	}
+}
+
+// Close releases the chains kept for reuse. Chains handed back afterwards, or still being
+// reset, are released as well, and Get fails with ErrArenaPoolClosed.
+func (g *ArenaPool) Close() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		return
+	}
+	g.closed = true
+	for _, chain := range g.free {
+		g.allocated -= g.opts.ChunkSize
+		chain.Release()
+	}
+	g.free = nil
+	g.notify()
+}
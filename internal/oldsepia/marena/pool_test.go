@@ -0,0 +1,158 @@
+package marena_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"gosuda.org/sseuda/internal/oldsepia/marena"
+)
+
+func newArenaPool(t *testing.T, opts *marena.ArenaPoolOptions) *marena.ArenaPool {
+	t.Helper()
+	p := marena.NewArenaPool(opts)
+	t.Cleanup(p.Close)
+	return p
+}
+
+// waitFree waits until `p` keeps `n` reset chains.
+func waitFree(t *testing.T, p *marena.ArenaPool, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); p.Free() != n; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Free() = %d, want %d", p.Free(), n)
+		}
+	}
+}
+
+// TestArenaPoolReuse verifies that a chain handed back is reset to its first chunk, zeroed and
+// handed out again, and that chains beyond MaxFree are released.
+func TestArenaPoolReuse(t *testing.T) {
+	p := newArenaPool(t, &marena.ArenaPoolOptions{ChunkSize: 1000})
+	if p.ChunkSize() != marena.ARENA_PAGESIZE {
+		t.Errorf("ChunkSize() = %d, want %d", p.ChunkSize(), marena.ARENA_PAGESIZE)
+	}
+	c1, err := p.Get(4*marena.ARENA_PAGESIZE, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := p.Get(0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c2.Limit() != marena.ARENA_PAGESIZE {
+		t.Errorf("Limit() = %d, want the limit raised to the chunk size", c2.Limit())
+	}
+	addr := c1.Allocate(100)
+	copy(c1.View(addr), bytes.Repeat([]byte{0xff}, 100))
+	c1.Allocate(marena.ARENA_PAGESIZE) // Chains a second chunk.
+	if c1.Chunks() != 2 {
+		t.Fatalf("Chunks() = %d, want 2", c1.Chunks())
+	}
+
+	p.Put(c1)
+	p.Put(c2) // Beyond MaxFree, so released.
+	waitFree(t, p, 1)
+	if p.Allocated() != marena.ARENA_PAGESIZE {
+		t.Errorf("Allocated() = %d, want one chunk", p.Allocated())
+	}
+	if c2.Chunks() != 0 {
+		t.Error("chain beyond MaxFree was not released")
+	}
+
+	c, err := p.Get(2*marena.ARENA_PAGESIZE, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c != c1 || c.Chunks() != 1 || c.Used() != marena.ARENA_MIN_ADDRESS || c.Limit() != 2*marena.ARENA_PAGESIZE {
+		t.Fatal("Get did not hand the reset chain out again")
+	}
+	if !bytes.Equal(c.View(addr), make([]byte, 100)) {
+		t.Error("chain handed back was not zeroed")
+	}
+	if p.Allocated() != 2*marena.ARENA_PAGESIZE {
+		t.Errorf("Allocated() = %d, want the new limit", p.Allocated())
+	}
+}
+
+// TestArenaPoolBudget verifies that the budget bounds the limits of the chains handed out, and
+// that a chain handed back makes room for the next Get.
+func TestArenaPoolBudget(t *testing.T) {
+	const limit = 2 * marena.ARENA_PAGESIZE
+	p := newArenaPool(t, &marena.ArenaPoolOptions{ChunkSize: marena.ARENA_PAGESIZE, Budget: 2 * limit})
+	c1, _ := p.Get(limit, false)
+	c2, err := p.Get(limit, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Get(limit, false); err != marena.ErrArenaBudgetExceeded {
+		t.Fatalf("Get beyond the budget error = %v, want ErrArenaBudgetExceeded", err)
+	}
+
+	cancel := make(chan struct{})
+	close(cancel)
+	p.Wait(limit, cancel) // Returns at once.
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.Wait(limit, nil)
+	}()
+	p.Put(c1)
+	<-done
+
+	// The chain may still be resetting; Get waits for it rather than exceeding the budget.
+	c, err := p.Get(limit, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c != c1 {
+		t.Error("Get did not reuse the chain handed back")
+	}
+	if p.Allocated() != 2*limit {
+		t.Errorf("Allocated() = %d, want two chains", p.Allocated())
+	}
+	p.Put(c)
+	p.Put(c2)
+}
+
+// TestArenaPoolClose verifies that a closed pool releases its chains, including those handed
+// back after Close.
+func TestArenaPoolClose(t *testing.T) {
+	p := newArenaPool(t, &marena.ArenaPoolOptions{ChunkSize: marena.ARENA_PAGESIZE, MaxFree: 2})
+	c1, _ := p.Get(0, false)
+	c2, _ := p.Get(0, false)
+	p.Put(c1)
+	waitFree(t, p, 1)
+
+	p.Close()
+	p.Put(c2)
+	if p.Allocated() != 0 || c1.Chunks() != 0 || c2.Chunks() != 0 {
+		t.Errorf("Allocated() = %d after Close, want every chain released", p.Allocated())
+	}
+	if _, err := p.Get(0, false); err != marena.ErrArenaPoolClosed {
+		t.Errorf("Get after Close error = %v, want ErrArenaPoolClosed", err)
+	}
+}
+
+// TestDefaultArenaPool verifies that the default pool is shared, and hands out chains for
+// limits both below and above its chunk size.
+func TestDefaultArenaPool(t *testing.T) {
+	p := marena.DefaultArenaPool()
+	if marena.DefaultArenaPool() != p {
+		t.Fatal("DefaultArenaPool returned a different pool")
+	}
+	if p.ChunkSize() != marena.ARENA_PAGESIZE {
+		t.Errorf("ChunkSize() = %d, want %d", p.ChunkSize(), marena.ARENA_PAGESIZE)
+	}
+	for _, limit := range []int64{1000, 8 * marena.ARENA_PAGESIZE} {
+		c, err := p.Get(limit, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Limit() != max(limit, marena.ARENA_PAGESIZE) {
+			t.Errorf("Limit() = %d for a limit of %d", c.Limit(), limit)
+		}
+		p.Put(c)
+	}
+}
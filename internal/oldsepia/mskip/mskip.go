@@ -2,114 +2,227 @@
 package mskip
 
 import (
+	"errors"
 	"sync"
 	"sync/atomic"
 	"unsafe"
 
 	"gosuda.org/sseuda"
+	"gosuda.org/sseuda/internal/bounds"
 	"gosuda.org/sseuda/internal/oldsepia/marena"
 	"gosuda.org/sseuda/internal/oldsepia/splitmix64"
 )
 
+// ErrAddressingMode is returned when a skip list is created in an arena whose addressing mode
+// does not match the width of its links.
+var ErrAddressingMode = errors.New("mskip: arena addressing mode does not match the skip list")
+
 const (
 	MSKIP_MAX_LEVEL = 24 // Defines the maximum height of the skip list. Higher values improve search performance in large lists but increase memory consumption per node.
+
+	MSKIP_WIDE_NODE_MAX_SIZE = int(wideNodeMaxSize) // Bytes taken by a WideSkipList node of the maximum height, an upper bound for any node, excluding its key and value.
 )
 
-// mskipNode's memory layout within the arena:
-//   keyPtr:    uint64      // Offset to the key's bytes in the arena.
-//   valuePtr:  uint64      // Offset to the value's bytes in the arena.
+// nodeTombstone is the `valuePtr` of a deleted key. It can never be a real arena address, so
+// it stays distinct both from an empty value, which has a valid zero-length address, and from
+// the head's invalid one.
+const nodeTombstone = ^uint64(0)
+
+// mskipNode's memory layout within the arena, for a link type `P` of uint32 or uint64:
+//   keyPtr:    uint64      // Address of the key's bytes in the arena.
+//   valuePtr:  uint64      // Address of the value's bytes in the arena, or nodeTombstone.
 //   level:     int32       // The node's current height, from 1 to MSKIP_MAX_LEVEL.
-//   reserved:  4 bytes     // Padding for alignment.
-//   nexts:     uint32[level] // Array of offsets to next nodes, one for each level.
+//   prev:      P           // Offset to the previous node at level 0, after padding to P's alignment.
+//   nexts:     P[level]    // Array of offsets to next nodes, one for each level.
+
+// link is the type of the arena offsets that link nodes together. uint32 keeps nodes compact,
+// but confines the skip list to the first 4 GiB of its arena; uint64 lifts the limit.
+type link interface {
+	uint32 | uint64
+}
 
 // mskipNode represents an individual node in the skip list.
 // The actual memory footprint of a node dynamically adjusts based on its `level`.
-type mskipNode struct {
-	keyPtr   uint64                  // Stores the arena offset for the node's key.
-	valuePtr uint64                  // Stores the arena offset for the node's value.
-	level    int32                   // Indicates the height or level of the node (1 to MSKIP_MAX_LEVEL).
-	nexts    [MSKIP_MAX_LEVEL]uint32 // An array of arena offsets pointing to the next nodes at each level.
+type mskipNode[P link] struct {
+	keyPtr   uint64             // Stores the arena address of the node's key.
+	valuePtr uint64             // Stores the arena address of the node's value.
+	level    int32              // Indicates the height or level of the node (1 to MSKIP_MAX_LEVEL).
+	prev     P                  // Arena offset of the previous node at level 0, for backward iteration.
+	nexts    [MSKIP_MAX_LEVEL]P // An array of arena offsets pointing to the next nodes at each level.
 }
 
-// Constants defining the memory offsets and sizes of `mskipNode` fields.
+// Constants defining the memory offsets and sizes of `mskipNode` fields for both link types.
 // These are used for compile-time assertions and dynamic size calculations, ensuring memory layout consistency.
 const (
-	nodeKeyPtrOffset   = unsafe.Offsetof(mskipNode{}.keyPtr)   // Byte offset of the `keyPtr` field.
-	nodeValuePtrOffset = unsafe.Offsetof(mskipNode{}.valuePtr) // Byte offset of the `valuePtr` field.
-	nodeLevelOffset    = unsafe.Offsetof(mskipNode{}.level)    // Byte offset of the `level` field.
-	nodeNextsOffset    = unsafe.Offsetof(mskipNode{}.nexts)    // Byte offset of the `nexts` array.
-	nodeMaxSize        = unsafe.Sizeof(mskipNode{})            // The maximum size a node can occupy assumes MSKIP_MAX_LEVEL is used.
+	nodeKeyPtrOffset    = unsafe.Offsetof(mskipNode[uint32]{}.keyPtr)   // Byte offset of the `keyPtr` field.
+	nodeValuePtrOffset  = unsafe.Offsetof(mskipNode[uint32]{}.valuePtr) // Byte offset of the `valuePtr` field.
+	nodeLevelOffset     = unsafe.Offsetof(mskipNode[uint32]{}.level)    // Byte offset of the `level` field.
+	nodePrevOffset      = unsafe.Offsetof(mskipNode[uint32]{}.prev)     // Byte offset of the `prev` field.
+	nodeNextsOffset     = unsafe.Offsetof(mskipNode[uint32]{}.nexts)    // Byte offset of the `nexts` array.
+	nodeMaxSize         = unsafe.Sizeof(mskipNode[uint32]{})            // The maximum size a node can occupy assumes MSKIP_MAX_LEVEL is used.
+	wideNodePrevOffset  = unsafe.Offsetof(mskipNode[uint64]{}.prev)     // Byte offset of the `prev` field of a wide node.
+	wideNodeNextsOffset = unsafe.Offsetof(mskipNode[uint64]{}.nexts)    // Byte offset of the `nexts` array of a wide node.
+	wideNodeMaxSize     = unsafe.Sizeof(mskipNode[uint64]{})            // The maximum size of a wide node.
 )
 
 // Compile-time checks to protect against unintended changes in `mskipNode`'s memory layout.
-var _ = [1]struct{}{}[nodeKeyPtrOffset-0]   // `keyPtr` must be at offset 0.
-var _ = [1]struct{}{}[nodeValuePtrOffset-8] // `valuePtr` must be at offset 8.
-var _ = [1]struct{}{}[nodeLevelOffset-16]   // `level` must be at offset 16.
-var _ = [1]struct{}{}[nodeNextsOffset-20]   // `nexts` must be at offset 20.
-var _ = [1]struct{}{}[nodeMaxSize-120]      // Total size must be 120 bytes.
+var _ = [1]struct{}{}[nodeKeyPtrOffset-0]     // `keyPtr` must be at offset 0.
+var _ = [1]struct{}{}[nodeValuePtrOffset-8]   // `valuePtr` must be at offset 8.
+var _ = [1]struct{}{}[nodeLevelOffset-16]     // `level` must be at offset 16.
+var _ = [1]struct{}{}[nodePrevOffset-20]      // `prev` must be at offset 20.
+var _ = [1]struct{}{}[nodeNextsOffset-24]     // `nexts` must be at offset 24.
+var _ = [1]struct{}{}[nodeMaxSize-120]        // Total size must be 120 bytes.
+var _ = [1]struct{}{}[wideNodePrevOffset-24]  // A wide node's `prev` must be at offset 24, after padding.
+var _ = [1]struct{}{}[wideNodeNextsOffset-32] // A wide node's `nexts` must be at offset 32.
+var _ = [1]struct{}{}[wideNodeMaxSize-224]    // A wide node's total size must be 224 bytes.
 
 // sizeNode computes the precise memory required for a node given its `nodeLevel`.
 // This function optimizes memory usage by allocating only for the explicit `nodeLevel`,
 // rather than the maximum possible level.
-func sizeNode(nodeLevel int32) uintptr {
-	return uintptr(nodeMaxSize - MSKIP_MAX_LEVEL*4 + uintptr(nodeLevel)*4)
+func sizeNode[P link](nodeLevel int32) uintptr {
+	var node mskipNode[P]
+	return unsafe.Sizeof(node) - (MSKIP_MAX_LEVEL-uintptr(nodeLevel))*unsafe.Sizeof(node.prev)
+}
+
+// loadLink, storeLink and casLink access a link atomically, with the operation of its width.
+func loadLink[P link](p *P) P {
+	if unsafe.Sizeof(*p) == 4 {
+		return P(atomic.LoadUint32((*uint32)(unsafe.Pointer(p))))
+	}
+	return P(atomic.LoadUint64((*uint64)(unsafe.Pointer(p))))
+}
+
+func storeLink[P link](p *P, v P) {
+	if unsafe.Sizeof(*p) == 4 {
+		atomic.StoreUint32((*uint32)(unsafe.Pointer(p)), uint32(v))
+		return
+	}
+	atomic.StoreUint64((*uint64)(unsafe.Pointer(p)), uint64(v))
+}
+
+func casLink[P link](p *P, old, new P) bool {
+	if unsafe.Sizeof(*p) == 4 {
+		return atomic.CompareAndSwapUint32((*uint32)(unsafe.Pointer(p)), uint32(old), uint32(new))
+	}
+	return atomic.CompareAndSwapUint64((*uint64)(unsafe.Pointer(p)), uint64(old), uint64(new))
 }
 
-// SkipList is a memory-optimized skip list implementation that uses an arena allocator
+// allocator is the memory a skip list lives in: a marena.Arena or a marena.Chain. Keys and
+// values are reached through the addresses it allocates, and nodes through their offsets.
+type allocator interface {
+	Allocate(size int) uint64
+	AllocateMultiple(isizes_oaddrs ...*uint64) bool
+	View(address uint64) []byte
+	Offset(address uint64) uint64
+	Index(offset uint64) *byte
+}
+
+var (
+	_ allocator = (*marena.Arena)(nil)
+	_ allocator = (*marena.Chain)(nil)
+)
+
+// skipList is a memory-optimized skip list implementation that uses an arena allocator
 // for efficient memory management of nodes, keys, and values, which are stored as byte slices.
-type SkipList struct {
-	arena    *marena.Arena               // Manages all memory allocations for the skip list.
-	seed     uint64                      // Seed for the random level generation, ensuring probabilistic balance.
-	head     uint32                      // Arena offset pointing to the head node of the skip list.
-	compare  func(key1, key2 []byte) int // Function to compare keys: -1 (key1 < key2), 0 (key1 == key2), or 1 (key1 > key2).
-	refCount int64                       // Atomically managed reference count for the skip list instance.
+// Its nodes are linked by arena offsets of type `P`; it is exposed as SkipList and WideSkipList.
+//
+// Insert is safe for concurrent use, and iterators may run concurrently with inserts without
+// any locking. As in Pebble's arenaskl, a new node is fully written before it is published,
+// and it is linked level by level, bottom up, with a compare-and-swap on its predecessor's
+// `nexts` entry; a failed swap re-reads the splice at that level and retries. A node that is
+// reachable at level 0 is therefore always complete, and readers never observe a half-linked
+// node. Keys are never unlinked, so a stale predecessor remains a valid starting point.
+//
+// Level 0 is doubly linked for backward iteration. A node's `prev` link is set before it is
+// published, and its successor's `prev` link is swapped to it right after; a reader that finds
+// a lagging `prev` link walks forward from it to the true predecessor.
+type skipList[P link] struct {
+	arena     allocator                   // Manages all memory allocations for the skip list.
+	seed      uint64                      // Seed for the random level generation, ensuring probabilistic balance. Updated atomically.
+	head      P                           // Arena offset pointing to the head node of the skip list.
+	compare   func(key1, key2 []byte) int // Function to compare keys: -1 (key1 < key2), 0 (key1 == key2), or 1 (key1 > key2).
+	refCount  int64                       // Atomically managed reference count for the skip list instance.
+	iterators *sync.Pool                  // Pool of the skip list's iterator type.
 }
 
+// SkipList is a skip list whose nodes are linked by 32-bit arena offsets. It requires an arena
+// with compact addresses, and holds at most 4 GiB.
+type SkipList = skipList[uint32]
+
+// WideSkipList is a skip list whose nodes are linked by 64-bit offsets, for chains and for
+// arenas beyond 4 GiB, which must then use wide addresses. Its nodes take more room.
+type WideSkipList = skipList[uint64]
+
 // IncRef atomically increments the skip list's reference count.
 // It returns the updated reference count.
-func (g *SkipList) IncRef() int64 {
+func (g *skipList[P]) IncRef() int64 {
 	return atomic.AddInt64(&g.refCount, 1)
 }
 
 // DecRef atomically decrements the skip list's reference count.
 // It returns the updated reference count.
-func (g *SkipList) DecRef() int64 {
+func (g *skipList[P]) DecRef() int64 {
 	return atomic.AddInt64(&g.refCount, -1)
 }
 
 // RefCount returns the current, atomically loaded reference count of the skip list.
-func (g *SkipList) RefCount() int64 {
+func (g *skipList[P]) RefCount() int64 {
 	return atomic.LoadInt64(&g.refCount)
 }
 
 // NewSkipList initializes and returns a new SkipList instance.
-// It requires an `arena` for memory management, a `compare` function for key ordering, and a `seed` for level randomization.
-// Returns an error if the initial allocation for the head node fails.
+// It requires an `arena` with compact addresses for memory management, a `compare` function for key ordering, and a `seed` for level randomization.
+// Returns an error if the arena uses wide addresses, or if the initial allocation for the head node fails.
 func NewSkipList(arena *marena.Arena, compare func(key1, key2 []byte) int, seed uint64) (*SkipList, error) {
-	g := &SkipList{
-		arena:    arena,
-		seed:     seed,
-		head:     0,
-		compare:  compare,
-		refCount: 1,
+	if arena.Wide() {
+		return nil, ErrAddressingMode
+	}
+	return newSkipList[uint32](arena, compare, seed, &iteratorPool)
+}
+
+// NewWideSkipList initializes and returns a new WideSkipList instance, like NewSkipList.
+// It requires an `arena` with wide addresses.
+func NewWideSkipList(arena *marena.Arena, compare func(key1, key2 []byte) int, seed uint64) (*WideSkipList, error) {
+	if !arena.Wide() {
+		return nil, ErrAddressingMode
+	}
+	return newSkipList[uint64](arena, compare, seed, &wideIteratorPool)
+}
+
+// NewChainSkipList initializes and returns a new WideSkipList in `chain`, like NewSkipList, so
+// that the skip list grows with the chain rather than failing once a fixed arena fills up.
+// Chain offsets take more than 32 bits, hence the 64-bit links.
+func NewChainSkipList(chain *marena.Chain, compare func(key1, key2 []byte) int, seed uint64) (*WideSkipList, error) {
+	return newSkipList[uint64](chain, compare, seed, &wideIteratorPool)
+}
+
+func newSkipList[P link](arena allocator, compare func(key1, key2 []byte) int, seed uint64, iterators *sync.Pool) (*skipList[P], error) {
+	g := &skipList[P]{
+		arena:     arena,
+		seed:      seed,
+		head:      0,
+		compare:   compare,
+		refCount:  1,
+		iterators: iterators,
 	}
 
 	// Allocate and set up the head node to its maximum possible level.
-	headSize := sizeNode(MSKIP_MAX_LEVEL)
+	headSize := sizeNode[P](MSKIP_MAX_LEVEL)
 	headPtr := arena.Allocate(int(headSize))
 	if headPtr == marena.ARENA_INVALID_ADDRESS {
 		return nil, marena.ErrAllocationFailed
 	}
 
 	// Initialize the head node's fields.
-	head := g.getNode(marena.Offset(headPtr))
+	head := g.getNode(P(arena.Offset(headPtr)))
 	head.level = MSKIP_MAX_LEVEL
 	head.keyPtr = marena.ARENA_INVALID_ADDRESS
 	head.valuePtr = marena.ARENA_INVALID_ADDRESS
+	head.prev = marena.ARENA_INVALID_ADDRESS
 	for i := int32(0); i < MSKIP_MAX_LEVEL; i++ {
 		head.nexts[i] = marena.ARENA_INVALID_ADDRESS
 	}
-	g.head = marena.Offset(headPtr)
+	g.head = P(arena.Offset(headPtr))
 
 	return g, nil
 }
@@ -117,9 +230,9 @@ func NewSkipList(arena *marena.Arena, compare func(key1, key2 []byte) int, seed
 // randLevel determines a random level for a new node using a geometric distribution.
 // This approach maintains the probabilistic balance of the skip list, where the likelihood
 // of a node having level `k` is (1/2)^(k-1).
-func (g *SkipList) randLevel() int32 {
+func (g *skipList[P]) randLevel() int32 {
 	level := int32(1)
-	for level < MSKIP_MAX_LEVEL && splitmix64.Splitmix64(&g.seed)%2 == 0 {
+	for r := splitmix64.Splitmix64Atomic(&g.seed); level < MSKIP_MAX_LEVEL && r&1 == 0; r >>= 1 {
 		level++
 	}
 	return level
@@ -127,8 +240,65 @@ func (g *SkipList) randLevel() int32 {
 
 // getNode transforms an arena offset (`ptr`) into an `mskipNode` pointer.
 // This operation is `unsafe` and directly interacts with the arena's memory.
-func (g *SkipList) getNode(ptr uint32) *mskipNode {
-	return (*mskipNode)(unsafe.Pointer(g.arena.Index(ptr)))
+func (g *skipList[P]) getNode(ptr P) *mskipNode[P] {
+	return (*mskipNode[P])(unsafe.Pointer(g.arena.Index(uint64(ptr))))
+}
+
+// nodeKey returns the key of the node at `ptr`. Keys never change once a node is published.
+func (g *skipList[P]) nodeKey(ptr P) []byte {
+	return g.arena.View(g.getNode(ptr).keyPtr)
+}
+
+// loadNext atomically loads the successor of the node at `ptr` on level `i`.
+func (g *skipList[P]) loadNext(ptr P, i int) P {
+	return loadLink(&g.getNode(ptr).nexts[i])
+}
+
+// loadValue atomically loads the value address of the node at `ptr`.
+func (g *skipList[P]) loadValue(ptr P) uint64 {
+	return atomic.LoadUint64(&g.getNode(ptr).valuePtr)
+}
+
+// isTombstone reports whether the node at `ptr` marks its key as deleted.
+func (g *skipList[P]) isTombstone(ptr P) bool {
+	return g.loadValue(ptr) == nodeTombstone
+}
+
+// findPrev returns the predecessor of the node at `ptr` at level 0, which may be the head.
+// The node's `prev` link may lag behind a concurrent insert right before it; the true
+// predecessor is then reached by walking forward, since nodes are never unlinked.
+func (g *skipList[P]) findPrev(ptr P) P {
+	prev := loadLink(&g.getNode(ptr).prev)
+	for {
+		next := g.loadNext(prev, 0)
+		if next == ptr || next == marena.ARENA_INVALID_ADDRESS {
+			return prev
+		}
+		prev = next
+	}
+}
+
+// findLast returns the last node of the list, or the head if the list is empty.
+func (g *skipList[P]) findLast() P {
+	ptr := g.head
+	for i := MSKIP_MAX_LEVEL - 1; i >= 0; i-- {
+		for next := g.loadNext(ptr, i); next != marena.ARENA_INVALID_ADDRESS; next = g.loadNext(ptr, i) {
+			ptr = next
+		}
+	}
+	return ptr
+}
+
+// findSplice walks level `i` forward from `prev`, whose key must be less than `key`, and
+// returns the last node with key < `key` along with its successor on that level.
+func (g *skipList[P]) findSplice(key []byte, prev P, i int) (P, P) {
+	for {
+		next := g.loadNext(prev, i)
+		if next == marena.ARENA_INVALID_ADDRESS || g.compare(key, g.nodeKey(next)) <= 0 {
+			return prev, next // Either end of list or found a node >= `key`.
+		}
+		prev = next
+	}
 }
 
 // seeklt locates the node with the largest key strictly less than `key`.
@@ -136,11 +306,11 @@ func (g *SkipList) getNode(ptr uint32) *mskipNode {
 // the path taken at each level. This path is crucial for efficient insertion.
 // If `log` is `nil`, a dummy log is used, and no path is recorded.
 // Returns the arena offset of the located node.
-func (g *SkipList) seeklt(key []byte, log *[MSKIP_MAX_LEVEL]uint32) uint32 {
+func (g *skipList[P]) seeklt(key []byte, log *[MSKIP_MAX_LEVEL]P) P {
 	ptr := g.head
 
 	// Initialize log if not provided.
-	var dummyLog [MSKIP_MAX_LEVEL]uint32
+	var dummyLog [MSKIP_MAX_LEVEL]P
 	if log == nil {
 		log = &dummyLog
 	}
@@ -148,13 +318,7 @@ func (g *SkipList) seeklt(key []byte, log *[MSKIP_MAX_LEVEL]uint32) uint32 {
 	// Traverse from the highest level down to find the predecessor node.
 	for i := MSKIP_MAX_LEVEL - 1; i >= 0; i-- {
 		// Invariant: `ptr` becomes the last node with key < `key` at this level.
-		for {
-			next := g.getNode(ptr).nexts[i]
-			if next == marena.ARENA_INVALID_ADDRESS || g.compare(key, g.arena.View(g.getNode(next).keyPtr)) <= 0 {
-				break // Either end of list or found a node >= `key`.
-			}
-			ptr = next
-		}
+		ptr, _ = g.findSplice(key, ptr, i)
 		log[i] = ptr // Record the path at level `i`.
 	}
 
@@ -162,154 +326,278 @@ func (g *SkipList) seeklt(key []byte, log *[MSKIP_MAX_LEVEL]uint32) uint32 {
 }
 
 // insertNext inserts a new key-value pair based on the insertion `log` from `seeklt`.
-// If `key` already exists, its `value` is updated. If `value` is `nil`, the existing entry is marked as deleted.
+// If `key` already exists, its `value` is updated. If `tombstone` is set, `value` is ignored and
+// the entry is marked as deleted instead.
+// The `log` may be stale: each level's splice is re-read from it before linking, and again after
+// every failed compare-and-swap, so concurrent inserts are safe.
 //
 // Parameters:
 //   - log: An array containing the skip list path used to find the insertion point.
 //   - key: The key to be inserted or updated.
-//   - value: The value to associate with the key; `nil` marks the key for deletion.
+//   - value: The value to associate with the key; a nil value is stored as an empty one.
+//   - tombstone: Whether to mark the key as deleted rather than store `value`.
 //
 // Returns: The arena offset of the new or updated node, or `marena.ARENA_INVALID_ADDRESS` if allocation fails.
-func (g *SkipList) insertNext(log *[MSKIP_MAX_LEVEL]uint32, key []byte, value []byte) uint32 {
-	next := g.getNode(log[0]).nexts[0]
+func (g *skipList[P]) insertNext(log *[MSKIP_MAX_LEVEL]P, key []byte, value []byte, tombstone bool) P {
 	// If key exists, update its value.
-	if next != marena.ARENA_INVALID_ADDRESS && g.compare(key, g.arena.View(g.getNode(next).keyPtr)) == 0 {
-		if value == nil {
-			g.getNode(next).valuePtr = marena.ARENA_INVALID_ADDRESS // Mark as deleted by setting valuePtr to invalid.
-		} else {
-			newValueAddr := g.arena.Allocate(len(value))
+	if _, next := g.findSplice(key, log[0], 0); next != marena.ARENA_INVALID_ADDRESS && g.compare(key, g.nodeKey(next)) == 0 {
+		newValueAddr := uint64(nodeTombstone)
+		if !tombstone {
+			newValueAddr = g.arena.Allocate(len(value))
 			if newValueAddr == marena.ARENA_INVALID_ADDRESS {
 				return marena.ARENA_INVALID_ADDRESS // Allocation failed for new value.
 			}
 			copy(g.arena.View(newValueAddr), value)
-			g.getNode(next).valuePtr = newValueAddr
 		}
+		atomic.StoreUint64(&g.getNode(next).valuePtr, newValueAddr)
 		return next
 	}
 
 	// Determine new node's level and calculate sizes for allocation.
 	level := g.randLevel()
-	var newNodeSize uint64 = uint64(sizeNode(level))
+	var newNodeSize uint64 = uint64(sizeNode[P](level))
 	var newKeySize uint64 = uint64(len(key))
+	var newValueSize uint64 = uint64(len(value))
+	if tombstone {
+		newValueSize = 0
+	}
 
-	// Allocate memory for the new node and its key.
-	if !g.arena.AllocateMultiple(&newNodeSize, &newKeySize) {
-		return marena.ARENA_INVALID_ADDRESS // Failed to allocate for node or key.
+	// Allocate memory for the new node, its key and its value in one step.
+	if !g.arena.AllocateMultiple(&newNodeSize, &newKeySize, &newValueSize) {
+		return marena.ARENA_INVALID_ADDRESS // Failed to allocate for node, key or value.
 	}
 
-	// Initialize the new node.
-	node := g.getNode(marena.Offset(newNodeSize))
+	// Initialize the new node. It is invisible to other goroutines until it is linked.
+	ptr := P(g.arena.Offset(newNodeSize))
+	node := g.getNode(ptr)
 	node.level = level
 	node.keyPtr = newKeySize
 	copy(g.arena.View(node.keyPtr), key)
-
-	// Allocate and copy the value if not nil.
-	if value == nil {
-		node.valuePtr = marena.ARENA_INVALID_ADDRESS // Mark as deleted.
+	if tombstone {
+		node.valuePtr = nodeTombstone
 	} else {
-		newValueAddr := g.arena.Allocate(len(value))
-		if newValueAddr == marena.ARENA_INVALID_ADDRESS {
-			return marena.ARENA_INVALID_ADDRESS // Failed to allocate for value.
-		}
-		copy(g.arena.View(newValueAddr), value)
-		node.valuePtr = newValueAddr
+		node.valuePtr = newValueSize
+		copy(g.arena.View(node.valuePtr), value)
 	}
 
-	// Update `nexts` pointers to link the new node into the skip list at appropriate levels.
-	for i := int32(0); i < level; i++ {
-		node.nexts[i] = g.getNode(log[i]).nexts[i]              // New node points to what the predecessor at this level was pointing to.
-		g.getNode(log[i]).nexts[i] = marena.Offset(newNodeSize) // Predecessor now points to the new node.
+	// Link the new node bottom up. Linking at level 0 publishes it; the upper levels only
+	// speed up searches, so readers tolerate a node that is not linked there yet.
+	for i := 0; i < int(level); i++ {
+		prev := log[i]
+		for {
+			var next P
+			prev, next = g.findSplice(key, prev, i)
+			if i == 0 && next != marena.ARENA_INVALID_ADDRESS && g.compare(key, g.nodeKey(next)) == 0 {
+				// A concurrent insert linked the same key first: the new node is abandoned,
+				// and its value is written to the winner instead.
+				atomic.StoreUint64(&g.getNode(next).valuePtr, node.valuePtr)
+				return next
+			}
+			storeLink(&node.nexts[i], next) // New node points to what the predecessor at this level was pointing to.
+			if i > 0 {
+				if casLink(&g.getNode(prev).nexts[i], next, ptr) {
+					break // Predecessor now points to the new node.
+				}
+				continue
+			}
+
+			storeLink(&node.prev, prev)
+			if next != marena.ARENA_INVALID_ADDRESS {
+				// If the insert that linked `next` has not swapped its successor's `prev` link yet,
+				// help it along, so that the swap below cannot be overwritten by a stale one.
+				if nextPrev := loadLink(&g.getNode(next).prev); nextPrev != prev && g.loadNext(prev, 0) == next {
+					casLink(&g.getNode(next).prev, nextPrev, prev)
+				}
+			}
+			if casLink(&g.getNode(prev).nexts[0], next, ptr) {
+				if next != marena.ARENA_INVALID_ADDRESS {
+					casLink(&g.getNode(next).prev, prev, ptr)
+				}
+				break
+			}
+		}
 	}
 
-	return marena.Offset(newNodeSize)
+	return ptr
 }
 
 // Insert adds or updates a key-value pair in the skip list.
-// Keys and values are managed as byte slices within the arena allocator.
+// Keys and values are managed as byte slices within the arena allocator. A nil `value` is
+// stored as an empty value, which is distinct from a deleted key; use `Delete` to remove a key.
 // Returns `true` on successful insertion/update, `false` if memory allocation fails.
-func (g *SkipList) Insert(key []byte, value []byte) bool {
-	var log [MSKIP_MAX_LEVEL]uint32
+func (g *skipList[P]) Insert(key []byte, value []byte) bool {
+	var log [MSKIP_MAX_LEVEL]P
 	g.seeklt(key, &log)
-	return g.insertNext(&log, key, value) != marena.ARENA_INVALID_ADDRESS
+	return g.insertNext(&log, key, value, false) != marena.ARENA_INVALID_ADDRESS
 }
 
-// iteratorPool reuses SkipListIterator instances to reduce memory allocations.
-var iteratorPool = sync.Pool{
-	New: func() interface{} {
-		return &SkipListIterator{}
-	},
+// Delete marks `key` as deleted by storing a tombstone for it, inserting a node if the key is
+// not present yet. Nodes are never unlinked, so iterators and lookups skip the tombstone instead.
+// Returns `true` on success, `false` if memory allocation fails.
+func (g *skipList[P]) Delete(key []byte) bool {
+	var log [MSKIP_MAX_LEVEL]P
+	g.seeklt(key, &log)
+	return g.insertNext(&log, key, nil, true) != marena.ARENA_INVALID_ADDRESS
 }
 
-// SkipListIterator enables bidirectional traversal of skip list entries.
+// SeekGE returns the first entry whose key is >= `key`, tombstones included, without the cost
+// of an iterator. `deleted` reports whether the entry is a tombstone, in which case `value` is
+// nil; `ok` is false if every key is < `key`. The returned slices alias the arena.
+func (g *skipList[P]) SeekGE(key []byte) (foundKey, value []byte, deleted, ok bool) {
+	next := g.loadNext(g.seeklt(key, nil), 0)
+	if next == marena.ARENA_INVALID_ADDRESS {
+		return nil, nil, false, false
+	}
+	valuePtr := g.loadValue(next)
+	if valuePtr == nodeTombstone {
+		return g.nodeKey(next), nil, true, true
+	}
+	return g.nodeKey(next), g.arena.View(valuePtr), false, true
+}
+
+// Get looks `key` up directly, without the cost of an iterator. `found` reports whether the
+// skip list holds an entry for `key`, and `deleted` whether that entry is a tombstone, in
+// which case `value` is nil. The returned value aliases the arena.
+func (g *skipList[P]) Get(key []byte) (value []byte, found, deleted bool) {
+	foundKey, value, deleted, ok := g.SeekGE(key)
+	if !ok || g.compare(key, foundKey) != 0 {
+		return nil, false, false
+	}
+	return value, true, deleted
+}
+
+// iteratorPool and wideIteratorPool reuse iterator instances to reduce memory allocations.
+var (
+	iteratorPool = sync.Pool{
+		New: func() interface{} {
+			return &SkipListIterator{}
+		},
+	}
+	wideIteratorPool = sync.Pool{
+		New: func() interface{} {
+			return &WideSkipListIterator{}
+		},
+	}
+)
+
+// skipListIterator enables bidirectional traversal of skip list entries.
 // It tracks its current position and supports forward, backward, and seek operations.
-type SkipListIterator struct {
-	skl     *SkipList // Reference to the skip list being iterated.
-	current uint32    // Arena offset of the current node.
+// Positioning never leaves the iterator's bounds: seeks are clamped to them, and stepping
+// past them invalidates the iterator.
+type skipListIterator[P link] struct {
+	skl     *skipList[P]  // Reference to the skip list being iterated.
+	current P             // Arena offset of the current node.
+	bounds  bounds.Bounds // Key range the iterator is confined to.
 }
 
-var _ sseuda.Iterator = (*SkipListIterator)(nil)
+// SkipListIterator iterates over a SkipList.
+type SkipListIterator = skipListIterator[uint32]
+
+// WideSkipListIterator iterates over a WideSkipList.
+type WideSkipListIterator = skipListIterator[uint64]
+
+var (
+	_ sseuda.Iterator = (*SkipListIterator)(nil)
+	_ sseuda.Iterator = (*WideSkipListIterator)(nil)
+)
 
-// Iterator returns a new SkipListIterator for traversing the skip list.
+// Iterator returns a new iterator for traversing the whole skip list.
 // The iterator is initially invalid and must be positioned using methods like `First()`, `SeekLT()`, or `SeekLE()`.
 // It's crucial to call `Close()` on the iterator when it's no longer needed to release resources.
-func (g *SkipList) Iterator() *SkipListIterator {
+func (g *skipList[P]) Iterator() *skipListIterator[P] {
+	return g.IteratorWithOptions(nil)
+}
+
+// IteratorWithOptions returns a new iterator confined to the bounds of `opts`.
+// A nil `opts` is unbounded, as with `Iterator()`.
+func (g *skipList[P]) IteratorWithOptions(opts *sseuda.IterOptions) *skipListIterator[P] {
 	g.IncRef() // Increment the skip list's reference count.
-	iter := iteratorPool.Get().(*SkipListIterator)
+	iter := g.iterators.Get().(*skipListIterator[P])
 	iter.skl = g
 	iter.current = marena.ARENA_INVALID_ADDRESS // Initialize to an invalid position.
+	iter.bounds = bounds.New(g.compare, opts)
 	return iter
 }
 
 // First attempts to position the iterator at the smallest key in the skip list.
 // Returns `true` if successful (i.e., the skip list is not empty), otherwise `false`.
-func (g *SkipListIterator) First() bool {
+func (g *skipListIterator[P]) First() bool {
+	if g.bounds.Lower != nil {
+		return g.Seek(g.bounds.Lower)
+	}
 	g.current = g.skl.head // Start from the head node.
-	g.Next()               // Advance to the first actual data node.
-	return g.Valid()
+	g.next()               // Advance to the first actual data node.
+	return g.checkForward()
 }
 
-// seeklt positions the iterator to the largest key strictly less than `key`.
+// Last positions the iterator at the largest live key in the skip list.
+func (g *skipListIterator[P]) Last() bool {
+	if g.bounds.Upper != nil {
+		return g.SeekLT(g.bounds.Upper)
+	}
+	g.current = g.skl.findLast()
+	g.skipBackward()
+	return g.checkBackward()
+}
+
+// SeekLT positions the iterator at the largest live key strictly less than `key`.
 // The iterator becomes invalid if no such key exists.
-func (g *SkipListIterator) seeklt(key []byte) {
-	var log [MSKIP_MAX_LEVEL]uint32 // A log is used internally but not exposed to the iterator user.
-	g.current = g.skl.seeklt(key, &log)
+func (g *skipListIterator[P]) SeekLT(key []byte) bool {
+	g.current = g.skl.seeklt(g.bounds.SeekLT(key), nil)
+	g.skipBackward()
+	return g.checkBackward()
 }
 
-// seekle positions the iterator at the largest key less than or equal to `key`.
-// If `key` is found, the iterator points to that exact key.
+// SeekLE positions the iterator at the largest live key less than or equal to `key`.
+// If `key` is live, the iterator points to that exact key.
 // If no such key exists, the iterator becomes invalid.
-func (g *SkipListIterator) seekle(key []byte) {
-	var log [MSKIP_MAX_LEVEL]uint32
-	// Find the largest key strictly less than `key`.
-	prevNodePtr := g.skl.seeklt(key, &log)
-
-	// If `prevNodePtr` is the head, it means all keys in the skip list are greater than or equal to `key`.
-	// Check if the very first node matches `key`.
-	if prevNodePtr == g.skl.head {
-		firstNodePtr := g.skl.getNode(g.skl.head).nexts[0]
-		if firstNodePtr != marena.ARENA_INVALID_ADDRESS && g.skl.compare(key, g.skl.arena.View(g.skl.getNode(firstNodePtr).keyPtr)) == 0 {
-			g.current = firstNodePtr // Found an exact match at the beginning.
-		} else {
-			g.current = marena.ARENA_INVALID_ADDRESS // No key <= `key` found.
-		}
-		return
+func (g *skipListIterator[P]) SeekLE(key []byte) bool {
+	key, lt := g.bounds.SeekLE(key)
+	if lt {
+		return g.SeekLT(key)
 	}
 
-	// Otherwise, `prevNodePtr` points to a node whose key is < `key`.
-	// Now, check if the node immediately following `prevNodePtr` is an exact match for `key`.
-	g.current = prevNodePtr // Initialize iterator to the node found by `seeklt`.
+	// Find the largest key strictly less than `key`, then check whether its successor is `key` itself.
+	g.current = g.skl.seeklt(key, nil)
+	next := g.skl.loadNext(g.current, 0)
+	if next != marena.ARENA_INVALID_ADDRESS && g.skl.compare(key, g.skl.nodeKey(next)) == 0 {
+		g.current = next
+	}
+	g.skipBackward()
+	return g.checkBackward()
+}
 
-	nextNodePtr := g.skl.getNode(g.current).nexts[0]
-	if nextNodePtr != marena.ARENA_INVALID_ADDRESS && g.skl.compare(key, g.skl.arena.View(g.skl.getNode(nextNodePtr).keyPtr)) == 0 {
-		g.current = nextNodePtr // Move to the exact match.
+// checkForward invalidates the iterator if forward movement has left its bounds.
+func (g *skipListIterator[P]) checkForward() bool {
+	if g.Valid() && !g.bounds.Forward(g.Key()) {
+		g.current = marena.ARENA_INVALID_ADDRESS
 	}
-	// If `nextNodePtr` isn't an exact match, `g.current` remains `prevNodePtr`, which is the largest key <= `key`.
-	// This is the correct behavior for `SeekLE`.
+	return g.Valid()
+}
+
+// checkBackward invalidates the iterator if backward movement has left its bounds.
+func (g *skipListIterator[P]) checkBackward() bool {
+	if g.Valid() && !g.bounds.Backward(g.Key()) {
+		g.current = marena.ARENA_INVALID_ADDRESS
+	}
+	return g.Valid()
+}
+
+// skipBackward moves the iterator backward from its position while it rests on a tombstone.
+// Reaching the head invalidates the iterator.
+func (g *skipListIterator[P]) skipBackward() bool {
+	for g.current != g.skl.head && g.skl.isTombstone(g.current) {
+		g.current = g.skl.findPrev(g.current)
+	}
+	if g.current == g.skl.head {
+		g.current = marena.ARENA_INVALID_ADDRESS
+	}
+	return g.Valid()
 }
 
 // Valid reports whether the iterator is currently positioned at a valid key-value pair.
 // Returns `true` if valid, `false` otherwise (e.g., past the end or uninitialized).
-func (g *SkipListIterator) Valid() bool {
+func (g *skipListIterator[P]) Valid() bool {
 	return g.current != marena.ARENA_INVALID_ADDRESS
 }
 
@@ -317,89 +605,82 @@ func (g *SkipListIterator) Valid() bool {
 // If the iterator is already invalid or at the end of the list, it remains invalid.
 // `Next` automatically skips "tombstone" (soft-deleted) entries.
 // Returns `true` if the iterator is now valid, `false` otherwise.
-func (g *SkipListIterator) Next() bool {
+func (g *skipListIterator[P]) Next() bool {
 	if !g.Valid() {
 		return false
 	}
+	g.next()
+	return g.checkForward()
+}
 
+// next moves the iterator to the next live entry, ignoring its bounds.
+func (g *skipListIterator[P]) next() {
 	for {
-		node := g.skl.getNode(g.current)
-		g.current = node.nexts[0] // Move to the next node at level 0.
-		if !g.Valid() || g.Value() != nil {
-			break // Stop if invalid or found a non-nil (valid) value.
+		g.current = g.skl.loadNext(g.current, 0) // Move to the next node at level 0.
+		if !g.Valid() || !g.skl.isTombstone(g.current) {
+			break // Stop if invalid or found a live entry.
 		}
 	}
-	return g.Valid()
 }
 
-// Prev moves the iterator to the previous valid key-value pair in the skip list.
+// Prev moves the iterator to the previous valid key-value pair in the skip list, following
+// the backward links at level 0. Like `Next`, it skips tombstones.
 // If the iterator is invalid or at the first key, it becomes invalid.
 // Returns `true` if the iterator is now valid, `false` otherwise.
-func (g *SkipListIterator) Prev() bool {
+func (g *skipListIterator[P]) Prev() bool {
 	if !g.Valid() {
 		return false
 	}
-
-	// Use seeklt to find the node strictly before the current node's key.
-	currentKeyBytes := g.skl.arena.View(g.skl.getNode(g.current).keyPtr)
-	prevNodePtr := g.skl.seeklt(currentKeyBytes, nil)
-
-	if prevNodePtr == g.skl.head {
-		g.current = marena.ARENA_INVALID_ADDRESS // No previous element found (current was the first or only).
-		return false
-	}
-	g.current = prevNodePtr
-	// Note: `seeklt` might return a tombstone entry if `prevNodePtr`'s value is nil.
-	// The `Next()` method handles skipping tombstones. `Prev()` does not automatically.
-	// This might need further refinement depending on desired Prev() behavior with tombstones.
-	return true
+	g.current = g.skl.findPrev(g.current)
+	g.skipBackward()
+	return g.checkBackward()
 }
 
 // Key returns the key of the current entry.
 // Returns `nil` if the iterator is not valid.
-func (g *SkipListIterator) Key() []byte {
+func (g *skipListIterator[P]) Key() []byte {
 	if !g.Valid() {
 		return nil
 	}
-	node := g.skl.getNode(g.current)
-	return g.skl.arena.View(node.keyPtr)
+	return g.skl.nodeKey(g.current)
 }
 
 // Value returns the value of the current entry.
-// Returns `nil` if the iterator is not valid, or if the entry is a tombstone.
-func (g *SkipListIterator) Value() []byte {
+// Returns `nil` if the iterator is not valid, or if the entry is a tombstone; an empty value is
+// returned as a non-nil, zero-length slice.
+func (g *skipListIterator[P]) Value() []byte {
 	if !g.Valid() {
 		return nil
 	}
-	node := g.skl.getNode(g.current)
-	if node.valuePtr == marena.ARENA_INVALID_ADDRESS {
-		return nil // Value indicates a tombstone or no value.
+	valuePtr := g.skl.loadValue(g.current)
+	if valuePtr == nodeTombstone {
+		return nil // The entry was deleted concurrently.
 	}
-	return g.skl.arena.View(node.valuePtr)
+	return g.skl.arena.View(valuePtr)
 }
 
 // Seek positions the iterator to the first key greater than or equal to `key`.
-// If no such key exists, the iterator will be invalid.
-func (g *SkipListIterator) Seek(key []byte) bool {
-	g.seekle(key) // First, find the largest key less than or equal to `key`.
-	// If `seekle` positioned the iterator at a key strictly less than `key`,
-	// advance to the next element until the condition `currentKey >= key` is met.
-	if g.Valid() && g.skl.compare(g.Key(), key) < 0 {
-		g.Next()
-	}
-	return g.Valid()
+// Like `Next`, it skips tombstones. If no such key exists, the iterator will be invalid.
+func (g *skipListIterator[P]) Seek(key []byte) bool {
+	// Start from the largest key strictly less than `key` (or the head, if every key is >= `key`)
+	// and step onto the first live entry after it.
+	g.current = g.skl.seeklt(g.bounds.SeekGE(key), nil)
+	g.next()
+	return g.checkForward()
 }
 
 // Close releases the iterator's underlying resources and returns it to the pool.
 // After calling `Close`, the iterator becomes invalid and should not be used further.
 // This method also decrements the reference count of the associated skip list.
-func (g *SkipListIterator) Close() error {
+func (g *skipListIterator[P]) Close() error {
 	if g == nil {
 		return nil
 	}
 	g.skl.DecRef() // Decrement the skip list's reference count.
+	iterators := g.skl.iterators
 	g.skl = nil
 	g.current = marena.ARENA_INVALID_ADDRESS
-	iteratorPool.Put(g) // Return the iterator to the pool for reuse.
+	g.bounds = bounds.Bounds{}
+	iterators.Put(g) // Return the iterator to the pool for reuse.
 	return nil
 }
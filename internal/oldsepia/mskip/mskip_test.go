@@ -5,12 +5,34 @@ import (
 	"bytes"
 	"fmt"
 	"math/rand/v2"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 
+	"gosuda.org/sseuda"
 	"gosuda.org/sseuda/internal/oldsepia/marena"
 )
 
+func newArena(tb testing.TB, size int64) *marena.Arena {
+	tb.Helper()
+	arena, err := marena.NewArena(size)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return arena
+}
+
+func mustWideArena(tb testing.TB, size int64) *marena.Arena {
+	tb.Helper()
+	arena, err := marena.NewWideArena(size)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return arena
+}
+
 // TestSkipListInsert verifies the basic operations of the skiplist:
 // 1. Creation and initialization of an empty skiplist
 // 2. Searching in an empty skiplist returns the head node
@@ -20,7 +42,7 @@ import (
 // 6. Proper linking of nodes in the skiplist
 func TestSkipListInsert(t *testing.T) {
 	// Initialize arena with 1MB capacity
-	arena := marena.NewArena(1 << 20)
+	arena := newArena(t, 1<<20)
 
 	// Create skiplist with bytes.Compare as the comparison function
 	skl, err := NewSkipList(arena, bytes.Compare, 42)
@@ -44,7 +66,7 @@ func TestSkipListInsert(t *testing.T) {
 		t.Fatalf("expected head node, got %d", before)
 	}
 
-	newnode := skl.insertNext(&log, key1, value1)
+	newnode := skl.insertNext(&log, key1, value1, false)
 	if newnode == 0 {
 		t.Fatalf("insertNext failed")
 	}
@@ -68,7 +90,7 @@ func TestSkipListInsert(t *testing.T) {
 		t.Fatalf("expected newnode = %d, got %d", newnode, before)
 	}
 
-	newnode = skl.insertNext(&log, key2, value2)
+	newnode = skl.insertNext(&log, key2, value2, false)
 	if newnode == 0 {
 		t.Fatalf("insertNext failed")
 	}
@@ -83,7 +105,7 @@ func TestSkipListInsert(t *testing.T) {
 		t.Fatalf("expected newnode = %d, got %d", newnode, before)
 	}
 
-	newnode = skl.insertNext(&log, key3, value3)
+	newnode = skl.insertNext(&log, key3, value3, false)
 	if newnode == 0 {
 		t.Fatalf("insertNext failed")
 	}
@@ -91,7 +113,7 @@ func TestSkipListInsert(t *testing.T) {
 	// Test 5: Value overwrite for existing key
 	value1_updated := []byte("value1_updated")
 	_ = skl.seeklt(key1, &log)
-	newnode = skl.insertNext(&log, key1, value1_updated)
+	newnode = skl.insertNext(&log, key1, value1_updated, false)
 	if newnode == 0 {
 		t.Fatalf("value overwrite failed")
 	}
@@ -113,7 +135,7 @@ func TestSkipListInsert(t *testing.T) {
 // 3. Backward iteration from a given position
 func TestSkipListIterator(t *testing.T) {
 	// Initialize arena with 1MB capacity
-	arena := marena.NewArena(1 << 20)
+	arena := newArena(t, 1<<20)
 
 	// Create skiplist with string comparison
 	compareStrings := func(a, b []byte) int {
@@ -163,7 +185,7 @@ func TestSkipListIterator(t *testing.T) {
 	}
 
 	// Test SeekLE (Less than or Equal)
-	iter.seekle([]byte("cherry"))
+	iter.SeekLE([]byte("cherry"))
 	if !iter.Valid() {
 		t.Fatal("SeekLE: iterator should be valid")
 	}
@@ -175,7 +197,7 @@ func TestSkipListIterator(t *testing.T) {
 	}
 
 	// Test SeekLT (Less Than)
-	iter.seeklt([]byte("cherry"))
+	iter.SeekLT([]byte("cherry"))
 	if !iter.Valid() {
 		t.Fatal("SeekLT: iterator should be valid")
 	}
@@ -187,7 +209,7 @@ func TestSkipListIterator(t *testing.T) {
 	}
 
 	// Test backward iteration from 'fig'
-	iter.seekle([]byte("fig"))
+	iter.SeekLE([]byte("fig"))
 	expectedReverse := []string{"fig", "date", "cherry", "banana", "apple"}
 	i = 0
 	for ; iter.Valid(); iter.Prev() {
@@ -219,7 +241,7 @@ func TestSkipListIterator(t *testing.T) {
 // - Skiplist level distribution effects
 func BenchmarkSkipListRandomSeek(b *testing.B) {
 	// Initialize arena with 100MB capacity
-	arena := marena.NewArena(100 << 20)
+	arena := newArena(b, 100<<20)
 
 	// Create skiplist with deterministic seed for reproducible results
 	skl, err := NewSkipList(arena, bytes.Compare, 42)
@@ -239,7 +261,7 @@ func BenchmarkSkipListRandomSeek(b *testing.B) {
 	for i, key := range keys {
 		value := []byte(fmt.Sprintf("value%08d", i))
 		skl.seeklt(key, &log)
-		if skl.insertNext(&log, key, value) == 0 {
+		if skl.insertNext(&log, key, value, false) == 0 {
 			b.Fatal("insert failed")
 		}
 	}
@@ -277,7 +299,7 @@ func BenchmarkSkipListRandomSeek(b *testing.B) {
 // - Memory access patterns for in-order traversal
 func BenchmarkIteratorScanSequential(b *testing.B) {
 	// Initialize arena with 100MB capacity
-	arena := marena.NewArena(100 << 20)
+	arena := newArena(b, 100<<20)
 
 	// Create skiplist with deterministic seed for reproducible results
 	skl, err := NewSkipList(arena, bytes.Compare, 42)
@@ -297,7 +319,7 @@ func BenchmarkIteratorScanSequential(b *testing.B) {
 	for i, key := range keys {
 		value := []byte(fmt.Sprintf("value%08d", i))
 		skl.seeklt(key, &log)
-		if skl.insertNext(&log, key, value) == 0 {
+		if skl.insertNext(&log, key, value, false) == 0 {
 			b.Fatal("insert failed")
 		}
 	}
@@ -320,3 +342,453 @@ func BenchmarkIteratorScanSequential(b *testing.B) {
 		}
 	}
 }
+
+// TestSkipListIteratorSeek verifies that Seek lands on the first live key >= the target,
+// including targets before the first key and targets that are tombstones.
+func TestSkipListIteratorSeek(t *testing.T) {
+	arena := newArena(t, 1<<20)
+	skl, err := NewSkipList(arena, bytes.Compare, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"b", "d", "f"} {
+		if !skl.Insert([]byte(k), []byte(k)) {
+			t.Fatalf("failed to insert key %s", k)
+		}
+	}
+	skl.Delete([]byte("d")) // Tombstone.
+
+	iter := skl.Iterator()
+	defer iter.Close()
+
+	cases := []struct{ target, want string }{
+		{"a", "b"}, // Before the first key.
+		{"b", "b"}, // Exact match.
+		{"c", "f"}, // Between keys; "d" is a tombstone.
+		{"d", "f"}, // Exact match on a tombstone.
+		{"f", "f"},
+		{"g", ""}, // Past the last key.
+	}
+	for _, c := range cases {
+		valid := iter.Seek([]byte(c.target))
+		if c.want == "" {
+			if valid {
+				t.Errorf("Seek(%s): expected invalid iterator, got %s", c.target, iter.Key())
+			}
+			continue
+		}
+		if !valid || string(iter.Key()) != c.want {
+			t.Errorf("Seek(%s): expected %s, got %s (valid=%v)", c.target, c.want, iter.Key(), valid)
+		}
+	}
+}
+
+// TestSkipListConcurrentInsert inserts from many goroutines at once, with overlapping keys,
+// while readers iterate without locks. Run it with -race: every reader must see keys in
+// strictly increasing order in both directions, and every key must be present once the
+// writers are done.
+func TestSkipListConcurrentInsert(t *testing.T) {
+	const (
+		writers = 8
+		readers = 4
+		keys    = 2000
+	)
+	arena := newArena(t, 64<<20)
+	skl, err := NewSkipList(arena, bytes.Compare, 99)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg, rwg sync.WaitGroup
+	var done atomic.Bool
+	for r := 0; r < readers; r++ {
+		rwg.Add(1)
+		go func() {
+			defer rwg.Done()
+			for !done.Load() {
+				iter := skl.Iterator()
+				var prev []byte
+				for valid := iter.First(); valid; valid = iter.Next() {
+					if prev != nil && bytes.Compare(prev, iter.Key()) >= 0 {
+						t.Errorf("keys out of order: %s then %s", prev, iter.Key())
+					}
+					if !bytes.HasPrefix(iter.Value(), []byte("value")) {
+						t.Errorf("key %s: unexpected value %q", iter.Key(), iter.Value())
+					}
+					prev = iter.Key()
+				}
+				prev = nil
+				for valid := iter.Last(); valid; valid = iter.Prev() {
+					if prev != nil && bytes.Compare(prev, iter.Key()) <= 0 {
+						t.Errorf("keys out of order backward: %s then %s", prev, iter.Key())
+					}
+					prev = iter.Key()
+				}
+				iter.Close()
+			}
+		}()
+	}
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Every key is inserted by two writers, in different orders.
+			for _, i := range rand.Perm(keys) {
+				if i%writers != w && i%writers != (w+1)%writers {
+					continue
+				}
+				if !skl.Insert([]byte(fmt.Sprintf("key%06d", i)), []byte(fmt.Sprintf("value%d", w))) {
+					t.Errorf("failed to insert key%06d", i)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	done.Store(true)
+	rwg.Wait()
+
+	iter := skl.Iterator()
+	defer iter.Close()
+	n := 0
+	for valid := iter.First(); valid; valid = iter.Next() {
+		if want := fmt.Sprintf("key%06d", n); string(iter.Key()) != want {
+			t.Fatalf("key %d: expected %s, got %s", n, want, iter.Key())
+		}
+		n++
+	}
+	if n != keys {
+		t.Fatalf("expected %d keys, got %d", keys, n)
+	}
+	for valid := iter.Last(); valid; valid = iter.Prev() {
+		n--
+		if want := fmt.Sprintf("key%06d", n); string(iter.Key()) != want {
+			t.Fatalf("key %d backward: expected %s, got %s", n, want, iter.Key())
+		}
+	}
+	if n != 0 {
+		t.Fatalf("backward iteration missed %d keys", n)
+	}
+	for i := 0; i < keys; i++ {
+		if !iter.Seek([]byte(fmt.Sprintf("key%06d", i))) || string(iter.Key()) != fmt.Sprintf("key%06d", i) {
+			t.Fatalf("Seek(key%06d) missed the key", i)
+		}
+	}
+}
+
+// TestSkipListIteratorReverse verifies Last, Prev, SeekLT and SeekLE, all of which skip tombstones.
+func TestSkipListIteratorReverse(t *testing.T) {
+	arena := newArena(t, 1<<20)
+	skl, err := NewSkipList(arena, bytes.Compare, 11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"a", "b", "c", "d", "e", "f"} {
+		if !skl.Insert([]byte(k), []byte(k)) {
+			t.Fatalf("failed to insert key %s", k)
+		}
+	}
+	skl.Delete([]byte("a")) // Tombstones.
+	skl.Delete([]byte("d"))
+	skl.Delete([]byte("f"))
+
+	iter := skl.Iterator()
+	defer iter.Close()
+
+	var got []string
+	for valid := iter.Last(); valid; valid = iter.Prev() {
+		got = append(got, string(iter.Key()))
+	}
+	if want := "[e c b]"; fmt.Sprint(got) != want {
+		t.Fatalf("backward iteration: expected %s, got %v", want, got)
+	}
+
+	cases := []struct {
+		seek         func([]byte) bool
+		name, target string
+		want         string
+	}{
+		{iter.SeekLT, "SeekLT", "a", ""},
+		{iter.SeekLT, "SeekLT", "c", "b"},
+		{iter.SeekLT, "SeekLT", "e", "c"}, // "d" is a tombstone.
+		{iter.SeekLT, "SeekLT", "z", "e"}, // "f" is a tombstone.
+		{iter.SeekLE, "SeekLE", "a", ""},
+		{iter.SeekLE, "SeekLE", "b", "b"},
+		{iter.SeekLE, "SeekLE", "d", "c"}, // Exact match on a tombstone.
+		{iter.SeekLE, "SeekLE", "dd", "c"},
+		{iter.SeekLE, "SeekLE", "f", "e"},
+	}
+	for _, c := range cases {
+		valid := c.seek([]byte(c.target))
+		if c.want == "" {
+			if valid {
+				t.Errorf("%s(%s): expected invalid iterator, got %s", c.name, c.target, iter.Key())
+			}
+			continue
+		}
+		if !valid || string(iter.Key()) != c.want {
+			t.Errorf("%s(%s): expected %s, got %s (valid=%v)", c.name, c.target, c.want, iter.Key(), valid)
+		}
+	}
+
+	// Switching directions steps to the neighbouring live keys.
+	if !iter.SeekLE([]byte("c")) || !iter.Next() || string(iter.Key()) != "e" || !iter.Prev() || string(iter.Key()) != "c" {
+		t.Fatalf("direction switch: got %s (valid=%v)", iter.Key(), iter.Valid())
+	}
+}
+
+// TestSkipListIteratorBounds verifies that a bounded iterator clamps seeks to its bounds and
+// never steps outside of them, in either direction.
+func TestSkipListIteratorBounds(t *testing.T) {
+	arena := newArena(t, 1<<20)
+	skl, err := NewSkipList(arena, bytes.Compare, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"a", "b", "ba", "bb", "c", "d"} {
+		if !skl.Insert([]byte(k), []byte(k)) {
+			t.Fatalf("failed to insert key %s", k)
+		}
+	}
+
+	scan := func(opts *sseuda.IterOptions) (string, string) {
+		iter := skl.IteratorWithOptions(opts)
+		defer iter.Close()
+		var forward, backward []string
+		for valid := iter.First(); valid; valid = iter.Next() {
+			forward = append(forward, string(iter.Key()))
+		}
+		for valid := iter.Last(); valid; valid = iter.Prev() {
+			backward = append(backward, string(iter.Key()))
+		}
+		return fmt.Sprint(forward), fmt.Sprint(backward)
+	}
+	cases := []struct {
+		opts              sseuda.IterOptions
+		forward, backward string
+	}{
+		{sseuda.IterOptions{LowerBound: []byte("b"), UpperBound: []byte("c")}, "[b ba bb]", "[bb ba b]"},
+		{sseuda.IterOptions{LowerBound: []byte("bb")}, "[bb c d]", "[d c bb]"},
+		{sseuda.IterOptions{UpperBound: []byte("b")}, "[a]", "[a]"},
+		{sseuda.IterOptions{Prefix: []byte("b")}, "[b ba bb]", "[bb ba b]"},
+		{sseuda.IterOptions{LowerBound: []byte("x")}, "[]", "[]"},
+	}
+	for _, c := range cases {
+		forward, backward := scan(&c.opts)
+		if forward != c.forward || backward != c.backward {
+			t.Errorf("%+v: got %s and %s, want %s and %s", c.opts, forward, backward, c.forward, c.backward)
+		}
+	}
+
+	iter := skl.IteratorWithOptions(&sseuda.IterOptions{LowerBound: []byte("b"), UpperBound: []byte("c")})
+	defer iter.Close()
+	if !iter.Seek([]byte("a")) || string(iter.Key()) != "b" {
+		t.Fatalf("Seek below the lower bound landed on %s", iter.Key())
+	}
+	if !iter.SeekLE([]byte("z")) || string(iter.Key()) != "bb" {
+		t.Fatalf("SeekLE above the upper bound landed on %s", iter.Key())
+	}
+	if iter.Seek([]byte("c")) || iter.SeekLT([]byte("b")) {
+		t.Fatalf("seeks outside the bounds landed on %s", iter.Key())
+	}
+}
+
+// TestSkipListGet verifies direct lookups of present, deleted and missing keys.
+func TestSkipListGet(t *testing.T) {
+	arena := newArena(t, 1<<20)
+	skl, err := NewSkipList(arena, bytes.Compare, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	skl.Insert([]byte("a"), []byte("1"))
+	skl.Insert([]byte("b"), []byte("2"))
+	skl.Delete([]byte("b")) // Tombstone.
+
+	cases := []struct {
+		key            string
+		value          string
+		found, deleted bool
+	}{
+		{"a", "1", true, false},
+		{"b", "", true, true},
+		{"aa", "", false, false},
+		{"c", "", false, false},
+	}
+	for _, c := range cases {
+		value, found, deleted := skl.Get([]byte(c.key))
+		if string(value) != c.value || found != c.found || deleted != c.deleted {
+			t.Errorf("Get(%s) = %q, %v, %v; want %q, %v, %v", c.key, value, found, deleted, c.value, c.found, c.deleted)
+		}
+	}
+
+	if key, value, deleted, ok := skl.SeekGE([]byte("aa")); !ok || string(key) != "b" || value != nil || !deleted {
+		t.Errorf("SeekGE(aa) = %s, %q, %v, %v; want the tombstone of b", key, value, deleted, ok)
+	}
+	if skl.RefCount() != 1 {
+		t.Errorf("RefCount = %d after lookups, want 1", skl.RefCount())
+	}
+}
+
+// TestSkipListDelete verifies that an empty value stays distinct from a deleted key, and that
+// deleting, re-inserting and deleting a never-inserted key behave consistently in both directions.
+func TestSkipListDelete(t *testing.T) {
+	arena := newArena(t, 1<<20)
+	skl, err := NewSkipList(arena, bytes.Compare, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	skl.Insert([]byte("a"), []byte("1"))
+	skl.Insert([]byte("b"), []byte{}) // Empty but present.
+	skl.Insert([]byte("c"), nil)      // Stored as an empty value.
+	skl.Insert([]byte("d"), []byte("4"))
+	skl.Delete([]byte("d"))
+	skl.Delete([]byte("e")) // Never inserted.
+	skl.Insert([]byte("f"), []byte("6"))
+	skl.Delete([]byte("f"))
+	skl.Insert([]byte("f"), []byte{}) // Revived with an empty value.
+
+	for _, c := range []struct {
+		key            string
+		found, deleted bool
+	}{
+		{"a", true, false},
+		{"b", true, false},
+		{"c", true, false},
+		{"d", true, true},
+		{"e", true, true},
+		{"f", true, false},
+	} {
+		value, found, deleted := skl.Get([]byte(c.key))
+		if found != c.found || deleted != c.deleted || (!deleted && value == nil) || (deleted && value != nil) {
+			t.Errorf("Get(%s) = %q, %v, %v; want found %v, deleted %v", c.key, value, found, deleted, c.found, c.deleted)
+		}
+	}
+
+	want := []string{"a", "b", "c", "f"}
+	iter := skl.Iterator()
+	defer iter.Close()
+	var got []string
+	for valid := iter.First(); valid; valid = iter.Next() {
+		if iter.Value() == nil {
+			t.Errorf("Value(%s) = nil, want a non-nil value", iter.Key())
+		}
+		got = append(got, string(iter.Key()))
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("forward = %q, want %q", got, want)
+	}
+	got = got[:0]
+	for valid := iter.Last(); valid; valid = iter.Prev() {
+		if iter.Value() == nil {
+			t.Errorf("Value(%s) = nil, want a non-nil value", iter.Key())
+		}
+		got = append(got, string(iter.Key()))
+	}
+	slices.Reverse(want)
+	if !slices.Equal(got, want) {
+		t.Errorf("backward = %q, want %q", got, want)
+	}
+}
+
+// TestWideSkipList verifies that the skip list linked by 64-bit offsets behaves like the compact
+// one, and that each variant rejects the arenas of the other addressing mode.
+func TestWideSkipList(t *testing.T) {
+	if _, err := NewSkipList(mustWideArena(t, 1<<20), bytes.Compare, 1); err != ErrAddressingMode {
+		t.Errorf("NewSkipList(wide arena) error = %v, want ErrAddressingMode", err)
+	}
+	if _, err := NewWideSkipList(newArena(t, 1<<20), bytes.Compare, 1); err != ErrAddressingMode {
+		t.Errorf("NewWideSkipList(compact arena) error = %v, want ErrAddressingMode", err)
+	}
+
+	skl, err := NewWideSkipList(mustWideArena(t, 4<<20), bytes.Compare, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const keys = 1000
+	for _, i := range rand.Perm(keys) {
+		if !skl.Insert([]byte(fmt.Sprintf("key%06d", i)), []byte(fmt.Sprintf("value%d", i))) {
+			t.Fatalf("failed to insert key%06d", i)
+		}
+	}
+	skl.Delete([]byte("key000500"))
+
+	value, found, deleted := skl.Get([]byte("key000042"))
+	if !found || deleted || string(value) != "value42" {
+		t.Errorf("Get(key000042) = %q, %v, %v; want value42", value, found, deleted)
+	}
+	if _, found, deleted := skl.Get([]byte("key000500")); !found || !deleted {
+		t.Errorf("Get(key000500) = %v, %v; want the tombstone", found, deleted)
+	}
+
+	iter := skl.Iterator()
+	defer iter.Close()
+	n := 0
+	for valid := iter.First(); valid; valid = iter.Next() {
+		if n == 500 {
+			n++
+		}
+		if want := fmt.Sprintf("key%06d", n); string(iter.Key()) != want {
+			t.Fatalf("key %d: expected %s, got %s", n, want, iter.Key())
+		}
+		n++
+	}
+	if n != keys {
+		t.Fatalf("expected %d keys, got %d", keys-1, n-1)
+	}
+	for valid := iter.Last(); valid; valid = iter.Prev() {
+		n--
+		if n == 500 {
+			n--
+		}
+		if want := fmt.Sprintf("key%06d", n); string(iter.Key()) != want {
+			t.Fatalf("key %d backward: expected %s, got %s", n, want, iter.Key())
+		}
+	}
+	if n != 0 {
+		t.Fatalf("backward iteration missed %d keys", n)
+	}
+	if !iter.SeekLT([]byte("key000501")) || string(iter.Key()) != "key000499" {
+		t.Errorf("SeekLT(key000501) did not skip the tombstone of key000500")
+	}
+}
+
+// TestChainSkipList verifies that a skip list in a marena.Chain keeps working as the chain
+// grows past its first chunk, and that inserts fail once the chain reaches its limit.
+func TestChainSkipList(t *testing.T) {
+	chain := marena.NewChain(marena.ARENA_PAGESIZE, 1<<20)
+	skl, err := NewChainSkipList(chain, bytes.Compare, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := bytes.Repeat([]byte{'v'}, 1000)
+	n := 0
+	for ; ; n++ {
+		if !skl.Insert([]byte(fmt.Sprintf("key%06d", n)), value) {
+			break
+		}
+	}
+	if chain.Chunks() < 3 {
+		t.Fatalf("Chunks() = %d after %d inserts, want the skip list to span several chunks", chain.Chunks(), n)
+	}
+	if n < 900 {
+		t.Fatalf("%d inserts before the limit of 1 MiB, want at least 900", n)
+	}
+
+	for _, i := range []int{0, n / 2, n - 1} {
+		key := fmt.Sprintf("key%06d", i)
+		if got, found, _ := skl.Get([]byte(key)); !found || !bytes.Equal(got, value) {
+			t.Errorf("Get(%s) = %d bytes, %v; want the value", key, len(got), found)
+		}
+	}
+	iter := skl.Iterator()
+	defer iter.Close()
+	i := 0
+	for valid := iter.First(); valid; valid = iter.Next() {
+		if want := fmt.Sprintf("key%06d", i); string(iter.Key()) != want {
+			t.Fatalf("key %d: expected %s, got %s", i, want, iter.Key())
+		}
+		i++
+	}
+	if i != n {
+		t.Errorf("iterated %d keys, want %d", i, n)
+	}
+}
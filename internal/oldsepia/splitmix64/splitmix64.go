@@ -1,5 +1,7 @@
 package splitmix64
 
+import "sync/atomic"
+
 const IncrementConstant = 0x9e3779b97f4a7c15
 
 func next(x0 uint64) uint64 {
@@ -12,3 +14,9 @@ func Splitmix64(state *uint64) uint64 {
 	*state += IncrementConstant
 	return next(*state)
 }
+
+// Splitmix64Atomic is Splitmix64 with an atomic update of `state`,
+// so that concurrent callers each draw a distinct value.
+func Splitmix64Atomic(state *uint64) uint64 {
+	return next(atomic.AddUint64(state, IncrementConstant))
+}
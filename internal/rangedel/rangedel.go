@@ -0,0 +1,134 @@
+// Package rangedel implements range deletion tombstones: single writes that delete every user
+// key in [Start, End) at once.
+//
+// Tombstones may overlap arbitrarily. A List fragments them into non-overlapping spans, each
+// carrying the sequence numbers of every tombstone that covers all of it, so that the
+// tombstones of a key are found with a single binary search.
+package rangedel
+
+import (
+	"cmp"
+	"slices"
+	"sort"
+)
+
+// Tombstone deletes every user key in [Start, End) whose version is older than Seq.
+type Tombstone struct {
+	Start []byte // Inclusive.
+	End   []byte // Exclusive.
+	Seq   uint64
+}
+
+// Fragment is a span of user keys that no tombstone boundary splits.
+type Fragment struct {
+	Start []byte   // Inclusive.
+	End   []byte   // Exclusive.
+	Seqs  []uint64 // Sequence numbers of the tombstones covering the span, newest first.
+}
+
+// List is an immutable, fragmented set of tombstones. The zero List is empty.
+type List struct {
+	compare   func(key1, key2 []byte) int
+	fragments []Fragment // Sorted by Start; spans never overlap.
+}
+
+// New fragments `tombstones`, whose user keys are ordered by `compare`. Empty tombstones are
+// dropped. The fragments alias the keys of `tombstones`.
+func New(compare func(key1, key2 []byte) int, tombstones []Tombstone) *List {
+	g := &List{compare: compare}
+	live := make([]Tombstone, 0, len(tombstones))
+	keys := make([][]byte, 0, 2*len(tombstones))
+	for _, t := range tombstones {
+		if compare(t.Start, t.End) < 0 {
+			live = append(live, t)
+			keys = append(keys, t.Start, t.End)
+		}
+	}
+	slices.SortFunc(live, func(a, b Tombstone) int {
+		return compare(a.Start, b.Start)
+	})
+	slices.SortFunc(keys, compare)
+	keys = slices.CompactFunc(keys, func(a, b []byte) bool {
+		return compare(a, b) == 0
+	})
+
+	// Sweep the boundaries in order. Every boundary between two consecutive ones is either
+	// the start or the end of a tombstone, so a tombstone that covers the left boundary of a
+	// span covers the whole span.
+	var active []Tombstone
+	next := 0
+	for i := 0; i+1 < len(keys); i++ {
+		start, end := keys[i], keys[i+1]
+		active = slices.DeleteFunc(active, func(t Tombstone) bool {
+			return compare(t.End, start) <= 0
+		})
+		for ; next < len(live) && compare(live[next].Start, start) <= 0; next++ {
+			active = append(active, live[next])
+		}
+		if len(active) == 0 {
+			continue
+		}
+
+		seqs := make([]uint64, 0, len(active))
+		for _, t := range active {
+			seqs = append(seqs, t.Seq)
+		}
+		slices.SortFunc(seqs, func(a, b uint64) int {
+			return cmp.Compare(b, a)
+		})
+		g.fragments = append(g.fragments, Fragment{Start: start, End: end, Seqs: slices.Compact(seqs)})
+	}
+	return g
+}
+
+// Empty reports whether the list holds no tombstone.
+func (g *List) Empty() bool {
+	return len(g.fragments) == 0
+}
+
+// Fragments returns the fragments of the list, sorted by Start.
+func (g *List) Fragments() []Fragment {
+	return g.fragments
+}
+
+// AppendTombstones appends to `dst` a tombstone for every fragment and sequence number of the
+// list no newer than `seq`, so that lists can be combined by fragmenting them together.
+func (g *List) AppendTombstones(dst []Tombstone, seq uint64) []Tombstone {
+	for _, f := range g.fragments {
+		for _, s := range f.Seqs {
+			if s <= seq {
+				dst = append(dst, Tombstone{Start: f.Start, End: f.End, Seq: s})
+			}
+		}
+	}
+	return dst
+}
+
+// Covering returns the sequence numbers of the tombstones that cover `key`, newest first, or
+// nil if none does.
+func (g *List) Covering(key []byte) []uint64 {
+	i := sort.Search(len(g.fragments), func(i int) bool {
+		return g.compare(g.fragments[i].End, key) > 0
+	})
+	if i == len(g.fragments) || g.compare(g.fragments[i].Start, key) > 0 {
+		return nil
+	}
+	return g.fragments[i].Seqs
+}
+
+// MaxSeq returns the sequence number of the newest tombstone covering `key` that is visible at
+// sequence number `seq`, or 0 if there is none.
+func (g *List) MaxSeq(key []byte, seq uint64) uint64 {
+	for _, s := range g.Covering(key) {
+		if s <= seq {
+			return s
+		}
+	}
+	return 0
+}
+
+// Covers reports whether the version of `key` written at `keySeq` is deleted for a reader at
+// sequence number `seq`.
+func (g *List) Covers(key []byte, keySeq, seq uint64) bool {
+	return keySeq < g.MaxSeq(key, seq)
+}
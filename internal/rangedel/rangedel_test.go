@@ -0,0 +1,96 @@
+package rangedel_test
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"testing"
+
+	"gosuda.org/sseuda/internal/rangedel"
+)
+
+func tombstone(start, end string, seq uint64) rangedel.Tombstone {
+	return rangedel.Tombstone{Start: []byte(start), End: []byte(end), Seq: seq}
+}
+
+// format renders fragments as "[start,end)#seq,seq ...".
+func format(fragments []rangedel.Fragment) string {
+	var b bytes.Buffer
+	for i, f := range fragments {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		fmt.Fprintf(&b, "[%s,%s)#", f.Start, f.End)
+		for j, seq := range f.Seqs {
+			if j > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprint(&b, seq)
+		}
+	}
+	return b.String()
+}
+
+// TestFragment verifies that overlapping tombstones are split at every boundary, and that
+// empty tombstones are dropped.
+func TestFragment(t *testing.T) {
+	list := rangedel.New(bytes.Compare, []rangedel.Tombstone{
+		tombstone("c", "g", 5),
+		tombstone("a", "e", 3),
+		tombstone("f", "f", 9), // Empty.
+		tombstone("e", "h", 7),
+		tombstone("c", "g", 5), // Duplicate.
+		tombstone("x", "z", 1),
+	})
+	want := "[a,c)#3 [c,e)#5,3 [e,g)#7,5 [g,h)#7 [x,z)#1"
+	if got := format(list.Fragments()); got != want {
+		t.Fatalf("fragments = %s, want %s", got, want)
+	}
+
+	// Fragmenting fragments again changes nothing.
+	again := rangedel.New(bytes.Compare, list.AppendTombstones(nil, 100))
+	if got := format(again.Fragments()); got != want {
+		t.Fatalf("refragmented = %s, want %s", got, want)
+	}
+	visible := rangedel.New(bytes.Compare, list.AppendTombstones(nil, 4))
+	if got, want := format(visible.Fragments()), "[a,c)#3 [c,e)#3 [x,z)#1"; got != want {
+		t.Fatalf("fragments visible at 4 = %s, want %s", got, want)
+	}
+
+	if !rangedel.New(bytes.Compare, nil).Empty() || list.Empty() {
+		t.Fatalf("Empty is wrong")
+	}
+}
+
+// TestCovers verifies lookups of the tombstones covering a key.
+func TestCovers(t *testing.T) {
+	list := rangedel.New(bytes.Compare, []rangedel.Tombstone{
+		tombstone("b", "d", 10),
+		tombstone("c", "f", 20),
+	})
+
+	cases := []struct {
+		key    string
+		seqs   []uint64
+		maxSeq uint64 // At sequence number 15.
+	}{
+		{"a", nil, 0},
+		{"b", []uint64{10}, 10},
+		{"c", []uint64{20, 10}, 10},
+		{"d", []uint64{20}, 0},
+		{"ez", []uint64{20}, 0},
+		{"f", nil, 0},
+	}
+	for _, c := range cases {
+		if got := list.Covering([]byte(c.key)); !slices.Equal(got, c.seqs) {
+			t.Errorf("Covering(%s) = %v, want %v", c.key, got, c.seqs)
+		}
+		if got := list.MaxSeq([]byte(c.key), 15); got != c.maxSeq {
+			t.Errorf("MaxSeq(%s, 15) = %d, want %d", c.key, got, c.maxSeq)
+		}
+	}
+
+	if !list.Covers([]byte("c"), 15, 25) || list.Covers([]byte("c"), 15, 19) || list.Covers([]byte("c"), 20, 25) {
+		t.Fatalf("Covers ignores sequence numbers")
+	}
+}
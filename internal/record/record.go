@@ -0,0 +1,125 @@
+// Package record implements the checksummed, length-framed record format shared by the
+// write-ahead log and the manifest.
+//
+// Each record is laid out as:
+//
+//	+-----------------+-----------------+-------------------+
+//	| CRC32C (4 bytes)| Length (4 bytes)| Payload (Length)  |
+//	+-----------------+-----------------+-------------------+
+//
+// Both integers are little-endian. The checksum covers the length field and the payload,
+// so a torn write is detected whether it cuts through the header or the payload.
+package record
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+var (
+	ErrCorrupt  = errors.New("record: checksum mismatch")
+	ErrTooLarge = errors.New("record: payload too large")
+)
+
+const (
+	// RECORD_HEADER_SIZE is the size of the checksum and length prefix of every record.
+	RECORD_HEADER_SIZE = 8
+
+	// RECORD_MAX_SIZE is the largest payload a single record may carry.
+	RECORD_MAX_SIZE = 1<<31 - 1
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// checksum computes the CRC32C of the encoded length followed by the payload.
+func checksum(header []byte, payload []byte) uint32 {
+	crc := crc32.Update(0, crcTable, header[4:RECORD_HEADER_SIZE])
+	return crc32.Update(crc, crcTable, payload)
+}
+
+// Writer frames records onto an underlying io.Writer.
+type Writer struct {
+	w      io.Writer
+	buf    []byte // Scratch buffer holding header and payload, so each record is a single Write.
+	offset int64  // Number of bytes written so far.
+}
+
+// NewWriter returns a Writer appending records to `w`.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// WriteRecord appends `payload` as a single record.
+func (g *Writer) WriteRecord(payload []byte) error {
+	if len(payload) > RECORD_MAX_SIZE {
+		return ErrTooLarge
+	}
+
+	g.buf = append(g.buf[:0], make([]byte, RECORD_HEADER_SIZE)...)
+	binary.LittleEndian.PutUint32(g.buf[4:], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(g.buf[0:], checksum(g.buf, payload))
+	g.buf = append(g.buf, payload...)
+
+	n, err := g.w.Write(g.buf)
+	g.offset += int64(n)
+	return err
+}
+
+// Offset returns the number of bytes written through the Writer.
+func (g *Writer) Offset() int64 {
+	return g.offset
+}
+
+// Reader reads records framed by Writer.
+type Reader struct {
+	r      io.Reader
+	header [RECORD_HEADER_SIZE]byte
+	buf    bytes.Buffer
+	offset int64 // Offset just past the last record that was read successfully.
+}
+
+// NewReader returns a Reader over `r`.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r}
+}
+
+// Next returns the payload of the next record. The returned slice is only valid until the next call.
+// It returns io.EOF at a clean end of input, io.ErrUnexpectedEOF if the input ends in the middle of
+// a record, and ErrCorrupt if a record fails its checksum. The last two usually mean a torn write.
+func (g *Reader) Next() ([]byte, error) {
+	if _, err := io.ReadFull(g.r, g.header[:]); err != nil {
+		return nil, err // io.EOF on a clean boundary, io.ErrUnexpectedEOF on a torn header.
+	}
+
+	length := int64(binary.LittleEndian.Uint32(g.header[4:]))
+	if length > RECORD_MAX_SIZE {
+		return nil, ErrCorrupt
+	}
+
+	// Grow the buffer as bytes arrive instead of trusting a possibly torn length up front.
+	g.buf.Reset()
+	n, err := io.CopyN(&g.buf, g.r, length)
+	if n < length {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	payload := g.buf.Bytes()
+	if checksum(g.header[:], payload) != binary.LittleEndian.Uint32(g.header[0:]) {
+		return nil, ErrCorrupt
+	}
+
+	g.offset += RECORD_HEADER_SIZE + length
+	return payload, nil
+}
+
+// Offset returns the input offset just past the last valid record.
+// After a torn write, truncating the input to Offset discards the damaged tail.
+func (g *Reader) Offset() int64 {
+	return g.offset
+}
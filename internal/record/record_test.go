@@ -0,0 +1,87 @@
+package record_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"gosuda.org/sseuda/internal/record"
+)
+
+func writeRecords(t *testing.T, payloads ...string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := record.NewWriter(&buf)
+	for _, p := range payloads {
+		if err := w.WriteRecord([]byte(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if w.Offset() != int64(buf.Len()) {
+		t.Fatalf("Offset = %d, want %d", w.Offset(), buf.Len())
+	}
+	return buf.Bytes()
+}
+
+// TestRecordRoundTrip verifies that records, including empty ones, are read back in order.
+func TestRecordRoundTrip(t *testing.T) {
+	payloads := []string{"first", "", "third", string(make([]byte, 100000))}
+	data := writeRecords(t, payloads...)
+
+	r := record.NewReader(bytes.NewReader(data))
+	for i, want := range payloads {
+		got, err := r.Next()
+		if err != nil {
+			t.Fatalf("record %d: %v", i, err)
+		}
+		if string(got) != want {
+			t.Fatalf("record %d: payload mismatch", i)
+		}
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Fatalf("expected io.EOF after last record, got %v", err)
+	}
+	if r.Offset() != int64(len(data)) {
+		t.Fatalf("Offset = %d, want %d", r.Offset(), len(data))
+	}
+}
+
+// TestRecordTornWrite verifies that every possible truncation of the last record is
+// detected, and that Offset points at the end of the last intact record.
+func TestRecordTornWrite(t *testing.T) {
+	data := writeRecords(t, "intact", "torn-record")
+	intact := int64(record.RECORD_HEADER_SIZE + len("intact"))
+
+	for cut := intact + 1; cut < int64(len(data)); cut++ {
+		t.Run(fmt.Sprint(cut), func(t *testing.T) {
+			r := record.NewReader(bytes.NewReader(data[:cut]))
+			if _, err := r.Next(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := r.Next(); err != io.ErrUnexpectedEOF {
+				t.Fatalf("expected io.ErrUnexpectedEOF, got %v", err)
+			}
+			if r.Offset() != intact {
+				t.Fatalf("Offset = %d, want %d", r.Offset(), intact)
+			}
+		})
+	}
+}
+
+// TestRecordCorruption verifies that flipping any byte of a record fails its checksum.
+func TestRecordCorruption(t *testing.T) {
+	data := writeRecords(t, "payload")
+
+	for i := range data {
+		corrupted := append([]byte{}, data...)
+		corrupted[i] ^= 0x40
+
+		r := record.NewReader(bytes.NewReader(corrupted))
+		_, err := r.Next()
+		if !errors.Is(err, record.ErrCorrupt) && err != io.ErrUnexpectedEOF {
+			t.Fatalf("byte %d: expected corruption to be detected, got %v", i, err)
+		}
+	}
+}
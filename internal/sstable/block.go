@@ -0,0 +1,257 @@
+package sstable
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+// Blocks use the prefix-compressed layout popularized by LevelDB. Each entry is:
+//
+//	shared (uvarint) | unshared (uvarint) | value length (uvarint) | key[shared:] | value
+//
+// where `shared` is the length of the prefix shared with the previous key. Every
+// `restartInterval` entries a restart point stores its key in full; the block ends with the
+// offsets of all restart points (uint32 each) followed by their count (uint32).
+
+// blockWriter accumulates the entries of one block.
+type blockWriter struct {
+	restartInterval int
+	buf             []byte
+	restarts        []uint32
+	lastKey         []byte
+	counter         int // Entries since the last restart point.
+	entries         int
+}
+
+func (g *blockWriter) add(key, value []byte) {
+	shared := 0
+	if g.counter < g.restartInterval {
+		limit := min(len(key), len(g.lastKey))
+		for shared < limit && key[shared] == g.lastKey[shared] {
+			shared++
+		}
+	} else {
+		g.counter = 0
+	}
+	if g.counter == 0 {
+		g.restarts = append(g.restarts, uint32(len(g.buf)))
+	}
+
+	g.buf = binary.AppendUvarint(g.buf, uint64(shared))
+	g.buf = binary.AppendUvarint(g.buf, uint64(len(key)-shared))
+	g.buf = binary.AppendUvarint(g.buf, uint64(len(value)))
+	g.buf = append(g.buf, key[shared:]...)
+	g.buf = append(g.buf, value...)
+
+	g.lastKey = append(g.lastKey[:0], key...)
+	g.counter++
+	g.entries++
+}
+
+// estimatedSize returns the size of the block if it were finished now.
+func (g *blockWriter) estimatedSize() int {
+	return len(g.buf) + 4*max(len(g.restarts), 1) + 4
+}
+
+func (g *blockWriter) empty() bool {
+	return g.entries == 0
+}
+
+// finish appends the restart array and returns the block contents.
+// The returned slice is only valid until the next call to reset.
+func (g *blockWriter) finish() []byte {
+	if len(g.restarts) == 0 {
+		g.restarts = append(g.restarts, 0)
+	}
+	for _, restart := range g.restarts {
+		g.buf = binary.LittleEndian.AppendUint32(g.buf, restart)
+	}
+	return binary.LittleEndian.AppendUint32(g.buf, uint32(len(g.restarts)))
+}
+
+func (g *blockWriter) reset() {
+	g.buf = g.buf[:0]
+	g.restarts = g.restarts[:0]
+	g.lastKey = g.lastKey[:0]
+	g.counter = 0
+	g.entries = 0
+}
+
+// blockIter iterates over the entries of a finished block.
+type blockIter struct {
+	compare     func(key1, key2 []byte) int
+	data        []byte // Entries, without the restart array.
+	restarts    []byte // Restart array, without the count.
+	numRestarts int
+	offset      int    // Offset of the current entry.
+	nextOffset  int    // Offset of the entry after the current one.
+	key         []byte // Current key, reconstructed from its shared prefix.
+	value       []byte // Current value, aliasing `data`.
+	valid       bool
+	err         error
+}
+
+// init positions a blockIter over `block`, leaving it invalid.
+func (g *blockIter) init(compare func(key1, key2 []byte) int, block []byte) error {
+	if len(block) < 4 {
+		return ErrCorrupt
+	}
+	numRestarts := int(binary.LittleEndian.Uint32(block[len(block)-4:]))
+	if numRestarts == 0 || numRestarts > (len(block)-4)/4 {
+		return ErrCorrupt
+	}
+	restartsOffset := len(block) - 4 - 4*numRestarts
+
+	*g = blockIter{
+		compare:     compare,
+		data:        block[:restartsOffset],
+		restarts:    block[restartsOffset : len(block)-4],
+		numRestarts: numRestarts,
+		key:         g.key[:0],
+	}
+	return nil
+}
+
+func (g *blockIter) restart(i int) int {
+	return int(binary.LittleEndian.Uint32(g.restarts[4*i:]))
+}
+
+// decodeAt decodes the entry at `offset`, whose predecessor's key is in g.key.
+func (g *blockIter) decodeAt(offset int) bool {
+	if offset >= len(g.data) {
+		g.valid = false
+		return false
+	}
+
+	src := g.data[offset:]
+	shared, n1 := binary.Uvarint(src)
+	unshared, n2 := binary.Uvarint(src[max(n1, 0):])
+	valueLen, n3 := binary.Uvarint(src[max(n1+n2, 0):])
+	header := n1 + n2 + n3
+	if n1 <= 0 || n2 <= 0 || n3 <= 0 || shared > uint64(len(g.key)) ||
+		unshared+valueLen > uint64(len(src)-header) {
+		g.err = ErrCorrupt
+		g.valid = false
+		return false
+	}
+
+	keyEnd := header + int(unshared)
+	g.key = append(g.key[:shared], src[header:keyEnd]...)
+	g.value = src[keyEnd : keyEnd+int(valueLen)]
+	g.offset = offset
+	g.nextOffset = offset + keyEnd + int(valueLen)
+	g.valid = true
+	return true
+}
+
+func (g *blockIter) First() bool {
+	g.key = g.key[:0]
+	return g.decodeAt(0)
+}
+
+// Seek positions the iterator at the first entry whose key is >= `key`.
+func (g *blockIter) Seek(key []byte) bool {
+	// Binary search for the last restart point whose key is < `key`.
+	lo, hi := 0, g.numRestarts-1
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		g.key = g.key[:0]
+		if !g.decodeAt(g.restart(mid)) {
+			return false
+		}
+		if g.compare(g.key, key) < 0 {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+
+	// Scan forward from that restart point.
+	g.key = g.key[:0]
+	for valid := g.decodeAt(g.restart(lo)); valid; valid = g.Next() {
+		if g.compare(g.key, key) >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *blockIter) Next() bool {
+	if !g.valid {
+		return false
+	}
+	return g.decodeAt(g.nextOffset)
+}
+
+// Last positions the iterator at the last entry, scanning forward from the last restart point.
+func (g *blockIter) Last() bool {
+	g.key = g.key[:0]
+	if !g.decodeAt(g.restart(g.numRestarts - 1)) {
+		return false
+	}
+	for g.nextOffset < len(g.data) {
+		if !g.decodeAt(g.nextOffset) {
+			return false
+		}
+	}
+	return true
+}
+
+// SeekLT positions the iterator at the last entry whose key is < `key`.
+func (g *blockIter) SeekLT(key []byte) bool {
+	if g.Seek(key) {
+		return g.Prev()
+	}
+	if g.err != nil {
+		return false
+	}
+	return g.Last()
+}
+
+// SeekLE positions the iterator at the last entry whose key is <= `key`.
+func (g *blockIter) SeekLE(key []byte) bool {
+	if g.Seek(key) {
+		if g.compare(g.key, key) == 0 {
+			return true
+		}
+		return g.Prev()
+	}
+	if g.err != nil {
+		return false
+	}
+	return g.Last()
+}
+
+// Prev moves to the previous entry. Entries are only linked forward, so it rescans from the
+// last restart point before the current entry, which costs at most one restart interval.
+func (g *blockIter) Prev() bool {
+	if !g.valid {
+		return false
+	}
+	target := g.offset
+	if target == 0 {
+		g.valid = false
+		return false
+	}
+
+	i := sort.Search(g.numRestarts, func(i int) bool { return g.restart(i) >= target }) - 1
+	g.key = g.key[:0]
+	if !g.decodeAt(g.restart(max(i, 0))) {
+		return false
+	}
+	for g.nextOffset < target {
+		if !g.decodeAt(g.nextOffset) {
+			return false
+		}
+	}
+	if g.nextOffset != target {
+		g.err = ErrCorrupt
+		g.valid = false
+		return false
+	}
+	return true
+}
+
+func (g *blockIter) Valid() bool {
+	return g.valid
+}
@@ -0,0 +1,123 @@
+// Package sstable implements sorted string tables: immutable files holding key-value pairs
+// in comparator order.
+//
+// A table is laid out as:
+//
+//	[data block 0] ... [data block N-1]
+//	[range deletion block] (optional)
+//	[filter block] (optional)
+//	[prefix filter block] (optional)
+//	[properties block]
+//	[metaindex block]
+//	[index block]
+//	[footer]
+//
+// Every block is followed by a 4-byte little-endian CRC32C of its contents. Data blocks hold
+// the entries; the index block maps the last key of each data block to its handle; the
+// metaindex block maps the names of auxiliary blocks, such as the properties block, to their
+// handles. The range deletion block holds range tombstones apart from the entries, keyed by
+// their start under the table's ordering with their end as the value. The filter block is a
+// Bloom filter (see package bloom) of the filter keys of the entries; unlike the other blocks it
+// is stored as is rather than as sorted entries. The prefix filter block is another, of the
+// prefixes of the filter keys under a sseuda.PrefixExtractor, whose name completes the name of
+// the block in the metaindex. The fixed-size footer locates the metaindex
+// and index blocks and ends with a magic number.
+package sstable
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+)
+
+var (
+	ErrCorrupt    = errors.New("sstable: corrupt table")
+	ErrKeyOrder   = errors.New("sstable: keys must be added in strictly increasing order")
+	ErrWriterDone = errors.New("sstable: writer is already closed")
+)
+
+const (
+	// SSTABLE_MAGIC terminates every table.
+	SSTABLE_MAGIC = 0x61647565_73735f73
+
+	// SSTABLE_BLOCK_TRAILER_SIZE is the size of the checksum that follows every block.
+	SSTABLE_BLOCK_TRAILER_SIZE = 4
+
+	// SSTABLE_MAX_HANDLE_SIZE is the largest encoding of a blockHandle: two 64-bit uvarints.
+	SSTABLE_MAX_HANDLE_SIZE = 2 * binary.MaxVarintLen64
+
+	// SSTABLE_FOOTER_SIZE is the size of the footer: two padded handles and the magic number.
+	SSTABLE_FOOTER_SIZE = 2*SSTABLE_MAX_HANDLE_SIZE + 8
+
+	// SSTABLE_DEFAULT_BLOCK_SIZE is the target size of data blocks when WriterOptions.BlockSize is zero.
+	SSTABLE_DEFAULT_BLOCK_SIZE = 4 << 10
+
+	// SSTABLE_DEFAULT_RESTART_INTERVAL is the number of entries between restart points when
+	// WriterOptions.BlockRestartInterval is zero.
+	SSTABLE_DEFAULT_RESTART_INTERVAL = 16
+)
+
+// Names of the entries in the metaindex block.
+const (
+	metaPropertiesName = "sseuda.properties"
+	metaRangeDelName   = "sseuda.rangedel"
+	metaFilterName     = "sseuda.filter"
+
+	// metaPrefixFilterName is followed by the name of the extractor of the prefixes.
+	metaPrefixFilterName = "sseuda.prefixfilter."
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// blockHandle locates a block, excluding its trailer, within a table.
+type blockHandle struct {
+	offset uint64
+	length uint64
+}
+
+func (g blockHandle) encode(dst []byte) []byte {
+	dst = binary.AppendUvarint(dst, g.offset)
+	return binary.AppendUvarint(dst, g.length)
+}
+
+// decodeBlockHandle parses a handle at the start of `src` and returns it with the number of bytes read.
+func decodeBlockHandle(src []byte) (blockHandle, int, error) {
+	offset, n := binary.Uvarint(src)
+	if n <= 0 {
+		return blockHandle{}, 0, ErrCorrupt
+	}
+	length, m := binary.Uvarint(src[n:])
+	if m <= 0 {
+		return blockHandle{}, 0, ErrCorrupt
+	}
+	return blockHandle{offset: offset, length: length}, n + m, nil
+}
+
+// footer is the fixed-size tail of a table.
+type footer struct {
+	metaindex blockHandle
+	index     blockHandle
+}
+
+func (g footer) encode() []byte {
+	buf := make([]byte, SSTABLE_FOOTER_SIZE)
+	g.metaindex.encode(buf[:0])
+	g.index.encode(buf[SSTABLE_MAX_HANDLE_SIZE:SSTABLE_MAX_HANDLE_SIZE])
+	binary.LittleEndian.PutUint64(buf[2*SSTABLE_MAX_HANDLE_SIZE:], SSTABLE_MAGIC)
+	return buf
+}
+
+func decodeFooter(buf []byte) (footer, error) {
+	if len(buf) != SSTABLE_FOOTER_SIZE || binary.LittleEndian.Uint64(buf[2*SSTABLE_MAX_HANDLE_SIZE:]) != SSTABLE_MAGIC {
+		return footer{}, ErrCorrupt
+	}
+	metaindex, _, err := decodeBlockHandle(buf[:SSTABLE_MAX_HANDLE_SIZE])
+	if err != nil {
+		return footer{}, err
+	}
+	index, _, err := decodeBlockHandle(buf[SSTABLE_MAX_HANDLE_SIZE:])
+	if err != nil {
+		return footer{}, err
+	}
+	return footer{metaindex: metaindex, index: index}, nil
+}
@@ -0,0 +1,85 @@
+package sstable
+
+import (
+	"encoding/binary"
+)
+
+// Properties describes the contents of a table. They are stored in the properties block.
+type Properties struct {
+	NumEntries       uint64 // Number of key-value pairs.
+	NumDataBlocks    uint64 // Number of data blocks.
+	NumRangeDeletes  uint64 // Number of range tombstones in the range deletion block.
+	RawKeySize       uint64 // Total size of all keys, before prefix compression.
+	RawValueSize     uint64 // Total size of all values.
+	DataSize         uint64 // Total size of the data blocks, including their trailers.
+	FilterSize       uint64 // Size of the filter block, including its trailer, or 0 if the table has none.
+	PrefixFilterSize uint64 // Size of the prefix filter block, including its trailer, or 0 if the table has none.
+	IndexSize        uint64 // Size of the index block, including its trailer.
+}
+
+// Names of the properties in the properties block. The block is sorted, so names are too.
+const (
+	propDataSize         = "sseuda.data.size"
+	propFilterSize       = "sseuda.filter.size"
+	propIndexSize        = "sseuda.index.size"
+	propNumDataBlocks    = "sseuda.num.data.blocks"
+	propNumEntries       = "sseuda.num.entries"
+	propNumRangeDeletes  = "sseuda.num.range.deletes"
+	propPrefixFilterSize = "sseuda.prefix.filter.size"
+	propRawKeySize       = "sseuda.raw.key.size"
+	propRawValueSize     = "sseuda.raw.value.size"
+)
+
+// fields returns the named properties in sorted name order.
+func (g *Properties) fields() []struct {
+	name  string
+	value *uint64
+} {
+	return []struct {
+		name  string
+		value *uint64
+	}{
+		{propDataSize, &g.DataSize},
+		{propFilterSize, &g.FilterSize},
+		{propIndexSize, &g.IndexSize},
+		{propNumDataBlocks, &g.NumDataBlocks},
+		{propNumEntries, &g.NumEntries},
+		{propNumRangeDeletes, &g.NumRangeDeletes},
+		{propPrefixFilterSize, &g.PrefixFilterSize},
+		{propRawKeySize, &g.RawKeySize},
+		{propRawValueSize, &g.RawValueSize},
+	}
+}
+
+// encode writes the properties as uvarint values into `block`.
+func (g *Properties) encode(block *blockWriter) {
+	var buf []byte
+	for _, field := range g.fields() {
+		buf = binary.AppendUvarint(buf[:0], *field.value)
+		block.add([]byte(field.name), buf)
+	}
+}
+
+// decode reads properties from the contents of a properties block.
+// Unknown names are ignored, so that newer tables remain readable.
+func (g *Properties) decode(block []byte) error {
+	var iter blockIter
+	if err := iter.init(compareBytes, block); err != nil {
+		return err
+	}
+
+	fields := g.fields()
+	for valid := iter.First(); valid; valid = iter.Next() {
+		for _, field := range fields {
+			if string(iter.key) != field.name {
+				continue
+			}
+			v, n := binary.Uvarint(iter.value)
+			if n <= 0 {
+				return ErrCorrupt
+			}
+			*field.value = v
+		}
+	}
+	return iter.err
+}
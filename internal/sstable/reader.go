@@ -0,0 +1,463 @@
+package sstable
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"strings"
+
+	"gosuda.org/sseuda"
+	"gosuda.org/sseuda/internal/bloom"
+	"gosuda.org/sseuda/internal/bounds"
+	"gosuda.org/sseuda/internal/cache"
+)
+
+// ReaderOptions configures a Reader.
+type ReaderOptions struct {
+	// Compare orders keys. It must match the comparator the table was written with.
+	// Defaults to bytes.Compare.
+	Compare func(key1, key2 []byte) int
+
+	// Cache, if set, holds the data blocks read by the iterators of the Reader, keyed by
+	// CacheID, FileNum and the offset of each block. CacheID and FileNum must identify the
+	// table among the users of the cache.
+	Cache   *cache.Cache
+	CacheID uint64
+	FileNum uint64
+}
+
+// Reader reads a table. The index, range deletion and filter blocks are held in memory; data
+// blocks are read on demand, through the block cache if the Reader has one.
+// A Reader is safe for concurrent use by multiple iterators.
+type Reader struct {
+	r               io.ReaderAt
+	size            int64
+	compare         func(key1, key2 []byte) int
+	index           []byte       // Contents of the index block.
+	rangeDel        []byte       // Contents of the range deletion block, or nil if the table has none.
+	filter          bloom.Filter // Contents of the filter block, or nil if the table has none.
+	prefixFilter    bloom.Filter // Contents of the prefix filter block, or nil if the table has none.
+	prefixExtractor string       // Name of the extractor of the prefixes of `prefixFilter`.
+	props           Properties
+	cache           *cache.Cache
+	cacheID         uint64
+	fileNum         uint64
+}
+
+// NewReader opens the table of `size` bytes stored in `r`. A nil `opts` uses the defaults.
+// If `r` implements io.Closer, Reader.Close closes it.
+func NewReader(r io.ReaderAt, size int64, opts *ReaderOptions) (*Reader, error) {
+	g := &Reader{r: r, size: size, compare: bytes.Compare}
+	if opts != nil {
+		if opts.Compare != nil {
+			g.compare = opts.Compare
+		}
+		g.cache, g.cacheID, g.fileNum = opts.Cache, opts.CacheID, opts.FileNum
+	}
+
+	if size < SSTABLE_FOOTER_SIZE {
+		return nil, ErrCorrupt
+	}
+	buf := make([]byte, SSTABLE_FOOTER_SIZE)
+	if _, err := r.ReadAt(buf, size-SSTABLE_FOOTER_SIZE); err != nil {
+		return nil, err
+	}
+	f, err := decodeFooter(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	if g.index, err = g.readBlock(f.index, nil); err != nil {
+		return nil, err
+	}
+	if err := g.readMeta(f.metaindex); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// readMeta loads the auxiliary blocks referenced by the metaindex block.
+func (g *Reader) readMeta(handle blockHandle) error {
+	metaindex, err := g.readBlock(handle, nil)
+	if err != nil {
+		return err
+	}
+	var iter blockIter
+	if err := iter.init(compareBytes, metaindex); err != nil {
+		return err
+	}
+
+	for valid := iter.First(); valid; valid = iter.Next() {
+		h, _, err := decodeBlockHandle(iter.value)
+		if err != nil {
+			return err
+		}
+		switch name := string(iter.key); {
+		case name == metaPropertiesName:
+			block, err := g.readBlock(h, nil)
+			if err != nil {
+				return err
+			}
+			if err := g.props.decode(block); err != nil {
+				return err
+			}
+		case name == metaRangeDelName:
+			if g.rangeDel, err = g.readBlock(h, nil); err != nil {
+				return err
+			}
+		case name == metaFilterName:
+			if g.filter, err = g.readBlock(h, nil); err != nil {
+				return err
+			}
+		case strings.HasPrefix(name, metaPrefixFilterName):
+			if g.prefixFilter, err = g.readBlock(h, nil); err != nil {
+				return err
+			}
+			g.prefixExtractor = strings.TrimPrefix(name, metaPrefixFilterName)
+		}
+	}
+	return iter.err
+}
+
+// readBlock reads the block at `handle` into `buf`, reusing its capacity, and verifies its checksum.
+func (g *Reader) readBlock(handle blockHandle, buf []byte) ([]byte, error) {
+	n := handle.length + SSTABLE_BLOCK_TRAILER_SIZE
+	if handle.offset+n > uint64(g.size) || handle.offset+n < handle.offset {
+		return nil, ErrCorrupt
+	}
+	if uint64(cap(buf)) < n {
+		buf = make([]byte, n)
+	}
+	buf = buf[:n]
+
+	if _, err := g.r.ReadAt(buf, int64(handle.offset)); err != nil {
+		return nil, err
+	}
+	contents := buf[:handle.length]
+	if crc32.Checksum(contents, crcTable) != binary.LittleEndian.Uint32(buf[handle.length:]) {
+		return nil, ErrCorrupt
+	}
+	return contents, nil
+}
+
+// Properties returns the properties recorded when the table was written.
+func (g *Reader) Properties() Properties {
+	return g.props
+}
+
+// MayContain reports whether the table may hold an entry whose filter key, as given by
+// WriterOptions.FilterKey, is `filterKey`. Without a filter block, every key may be present.
+func (g *Reader) MayContain(filterKey []byte) bool {
+	return g.filter == nil || g.filter.MayContain(bloom.Hash(filterKey))
+}
+
+// MayContainPrefix reports whether the table may hold an entry whose filter key has the prefix
+// `prefix` under the sseuda.PrefixExtractor named `extractor`. Without a prefix filter built by
+// that extractor, every prefix may be present.
+func (g *Reader) MayContainPrefix(extractor string, prefix []byte) bool {
+	return g.prefixFilter == nil || g.prefixExtractor != extractor || g.prefixFilter.MayContain(bloom.Hash(prefix))
+}
+
+// NewIter returns an iterator over the table, confined to the bounds of `opts`.
+// A nil `opts` is unbounded. The iterator is initially invalid.
+func (g *Reader) NewIter(opts *sseuda.IterOptions) *Iterator {
+	iter := &Iterator{reader: g, bounds: bounds.New(g.compare, opts)}
+	if err := iter.index.init(g.compare, g.index); err != nil {
+		iter.err = err
+	}
+	return iter
+}
+
+// NewRangeDelIter returns an iterator over the range deletion block, or nil if the table holds
+// no range tombstone. The iterator is initially invalid.
+func (g *Reader) NewRangeDelIter() sseuda.Iterator {
+	if g.rangeDel == nil {
+		return nil
+	}
+	iter := &rangeDelIter{}
+	if err := iter.init(g.compare, g.rangeDel); err != nil {
+		iter.err = err
+	}
+	return iter
+}
+
+// Close closes the underlying reader if it implements io.Closer.
+func (g *Reader) Close() error {
+	if closer, ok := g.r.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// Iterator is a two-level iterator over a table: it walks the index block and loads
+// the data block each index entry points to.
+// Keys and values are only valid until the iterator moves to another data block. With a block
+// cache, the current data block stays pinned in the cache until then.
+// Entries with empty values are returned as-is: the table does not interpret values.
+//
+// Since every index entry holds the last key of its block, the iterator never loads a
+// block that lies entirely outside its bounds.
+type Iterator struct {
+	reader *Reader
+	index  blockIter
+	data   blockIter
+	buf    []byte        // Buffer holding the current data block, reused across blocks without a cache.
+	handle *cache.Handle // Pin of the current data block, with a cache.
+	bounds bounds.Bounds
+	err    error
+}
+
+var _ sseuda.Iterator = (*Iterator)(nil)
+
+// loadBlock loads the data block the index iterator points at.
+func (g *Iterator) loadBlock() bool {
+	g.data.valid = false
+	if g.err != nil || !g.index.Valid() {
+		return false
+	}
+
+	handle, _, err := decodeBlockHandle(g.index.value)
+	if err != nil {
+		g.err = err
+		return false
+	}
+	block, err := g.readBlock(handle)
+	if err != nil {
+		g.err = err
+		return false
+	}
+	if err := g.data.init(g.reader.compare, block); err != nil {
+		g.err = err
+		return false
+	}
+	return true
+}
+
+// readBlock returns the data block at `handle`, from the cache if the reader has one, and
+// releases the previous block.
+func (g *Iterator) readBlock(handle blockHandle) ([]byte, error) {
+	c := g.reader.cache
+	if c == nil {
+		block, err := g.reader.readBlock(handle, g.buf)
+		if err != nil {
+			return nil, err
+		}
+		g.buf = block[:cap(block)]
+		return block, nil
+	}
+
+	if g.handle != nil {
+		g.handle.Release()
+		g.handle = nil
+	}
+	key := cache.Key{ID: g.reader.cacheID, FileNum: g.reader.fileNum, Offset: handle.offset}
+	if g.handle = c.Get(key); g.handle != nil {
+		return g.handle.Value(), nil
+	}
+	block, err := g.reader.readBlock(handle, nil)
+	if err != nil {
+		return nil, err
+	}
+	g.handle = c.Set(key, block)
+	return block, nil
+}
+
+// skipForward moves to the first entry of the following blocks while the current block is
+// exhausted, and stops at the upper bound. A block whose last key reaches the upper bound is
+// the last one that can hold keys within bounds.
+func (g *Iterator) skipForward() bool {
+	for !g.data.valid && g.data.err == nil && g.err == nil {
+		if g.index.valid && g.bounds.Upper != nil && g.reader.compare(g.index.key, g.bounds.Upper) >= 0 {
+			break
+		}
+		if !g.index.Next() || !g.loadBlock() {
+			break
+		}
+		g.data.First()
+	}
+	if g.data.valid && !g.bounds.Forward(g.data.key) {
+		g.data.valid = false
+	}
+	return g.Valid()
+}
+
+// skipBackward moves to the last entry of the preceding blocks while the current block is
+// exhausted, and stops at the lower bound. A block whose last key is below the lower bound
+// is not loaded.
+func (g *Iterator) skipBackward() bool {
+	for !g.data.valid && g.data.err == nil && g.err == nil {
+		if !g.index.Prev() {
+			break
+		}
+		if g.bounds.Lower != nil && g.reader.compare(g.index.key, g.bounds.Lower) < 0 {
+			break
+		}
+		if !g.loadBlock() {
+			break
+		}
+		g.data.Last()
+	}
+	if g.data.valid && !g.bounds.Backward(g.data.key) {
+		g.data.valid = false
+	}
+	return g.Valid()
+}
+
+func (g *Iterator) First() bool {
+	if g.bounds.Lower != nil {
+		return g.Seek(g.bounds.Lower)
+	}
+	g.data.valid = false
+	if g.index.First() && g.loadBlock() {
+		g.data.First()
+	}
+	return g.skipForward()
+}
+
+// Seek positions the iterator at the first key >= `key`. The index maps each block to
+// its last key, so the first index entry >= `key` names the only block that can hold it.
+func (g *Iterator) Seek(key []byte) bool {
+	key = g.bounds.SeekGE(key)
+	g.data.valid = false
+	if g.index.Seek(key) && g.loadBlock() {
+		g.data.Seek(key)
+	}
+	return g.skipForward()
+}
+
+func (g *Iterator) Last() bool {
+	if g.bounds.Upper != nil {
+		return g.SeekLT(g.bounds.Upper)
+	}
+	return g.last()
+}
+
+// last positions the iterator at the last entry of the table, which the lower bound may exclude.
+func (g *Iterator) last() bool {
+	g.data.valid = false
+	if g.index.Last() && g.loadBlock() {
+		g.data.Last()
+	}
+	return g.skipBackward()
+}
+
+// SeekLT positions the iterator at the last key < `key`. The block that would hold the first
+// key >= `key` holds the answer unless every one of its keys is >= `key`, in which case the
+// answer ends the previous block. Past the last block, the answer is the table's last key.
+func (g *Iterator) SeekLT(key []byte) bool {
+	key = g.bounds.SeekLT(key)
+	g.data.valid = false
+	if !g.index.Seek(key) {
+		if g.index.err != nil {
+			return false
+		}
+		return g.last()
+	}
+	if g.loadBlock() {
+		g.data.SeekLT(key)
+	}
+	return g.skipBackward()
+}
+
+// SeekLE positions the iterator at the last key <= `key`, like SeekLT.
+func (g *Iterator) SeekLE(key []byte) bool {
+	key, lt := g.bounds.SeekLE(key)
+	if lt {
+		return g.SeekLT(key)
+	}
+	g.data.valid = false
+	if !g.index.Seek(key) {
+		if g.index.err != nil {
+			return false
+		}
+		return g.last()
+	}
+	if g.loadBlock() {
+		g.data.SeekLE(key)
+	}
+	return g.skipBackward()
+}
+
+func (g *Iterator) Valid() bool {
+	return g.data.valid && g.Error() == nil
+}
+
+func (g *Iterator) Next() bool {
+	if !g.Valid() {
+		return false
+	}
+	g.data.Next()
+	return g.skipForward()
+}
+
+func (g *Iterator) Prev() bool {
+	if !g.Valid() {
+		return false
+	}
+	g.data.Prev()
+	return g.skipBackward()
+}
+
+func (g *Iterator) Key() []byte {
+	if !g.Valid() {
+		return nil
+	}
+	return g.data.key
+}
+
+func (g *Iterator) Value() []byte {
+	if !g.Valid() {
+		return nil
+	}
+	return g.data.value
+}
+
+// Error returns the first error the iterator encountered, if any.
+func (g *Iterator) Error() error {
+	if g.err != nil {
+		return g.err
+	}
+	if g.index.err != nil {
+		return g.index.err
+	}
+	return g.data.err
+}
+
+// Close releases the iterator and returns the first error it encountered.
+func (g *Iterator) Close() error {
+	err := g.Error()
+	g.data = blockIter{}
+	g.buf = nil
+	if g.handle != nil {
+		g.handle.Release()
+		g.handle = nil
+	}
+	return err
+}
+
+// rangeDelIter iterates over the range deletion block, which the Reader holds in memory.
+type rangeDelIter struct {
+	blockIter
+}
+
+var _ sseuda.Iterator = (*rangeDelIter)(nil)
+
+func (g *rangeDelIter) Key() []byte {
+	if !g.Valid() {
+		return nil
+	}
+	return g.key
+}
+
+func (g *rangeDelIter) Value() []byte {
+	if !g.Valid() {
+		return nil
+	}
+	return g.value
+}
+
+// Close returns the first error the iterator encountered, if any.
+func (g *rangeDelIter) Close() error {
+	return g.err
+}
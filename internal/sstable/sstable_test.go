@@ -0,0 +1,455 @@
+package sstable
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+
+	"gosuda.org/sseuda"
+	"gosuda.org/sseuda/internal/cache"
+	"gosuda.org/sseuda/internal/oldsepia/marena"
+	"gosuda.org/sseuda/internal/oldsepia/mskip"
+)
+
+func testKey(i int) []byte   { return []byte(fmt.Sprintf("key%06d", i)) }
+func testValue(i int) []byte { return []byte(fmt.Sprintf("value%d", i)) }
+
+// buildTable writes keys 0, 2, 4, ... (2n-2) into a table with small blocks and opens it.
+func buildTable(t *testing.T, n int) (*Reader, []byte) {
+	t.Helper()
+	var buf bytes.Buffer
+	w := NewWriter(&buf, &WriterOptions{BlockSize: 256, BlockRestartInterval: 4})
+	for i := 0; i < n; i++ {
+		if err := w.Add(testKey(2*i), testValue(2*i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if w.Size() != uint64(buf.Len()) {
+		t.Fatalf("Size = %d, want %d", w.Size(), buf.Len())
+	}
+
+	r, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r, buf.Bytes()
+}
+
+// TestTableIterate verifies that a full scan returns every entry in order,
+// and that the properties describe the table.
+func TestTableIterate(t *testing.T) {
+	const n = 2000
+	r, _ := buildTable(t, n)
+
+	iter := r.NewIter(nil)
+	i := 0
+	for valid := iter.First(); valid; valid = iter.Next() {
+		if !bytes.Equal(iter.Key(), testKey(2*i)) || !bytes.Equal(iter.Value(), testValue(2*i)) {
+			t.Fatalf("entry %d: got %s=%s", i, iter.Key(), iter.Value())
+		}
+		i++
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if i != n {
+		t.Fatalf("scanned %d entries, want %d", i, n)
+	}
+
+	props := r.Properties()
+	if props.NumEntries != n {
+		t.Errorf("NumEntries = %d, want %d", props.NumEntries, n)
+	}
+	if props.NumDataBlocks < 2 {
+		t.Errorf("NumDataBlocks = %d, want several", props.NumDataBlocks)
+	}
+	if props.RawKeySize != n*uint64(len(testKey(0))) {
+		t.Errorf("RawKeySize = %d, want %d", props.RawKeySize, n*len(testKey(0)))
+	}
+}
+
+// TestTableSeek verifies seeks to present keys, to keys between entries, and past the end.
+func TestTableSeek(t *testing.T) {
+	const n = 2000
+	r, _ := buildTable(t, n)
+	iter := r.NewIter(nil)
+	defer iter.Close()
+
+	for i := 0; i < 2*n-1; i++ {
+		want := testKey(i + i%2) // Odd keys are absent and land on their successor.
+		if !iter.Seek(testKey(i)) {
+			t.Fatalf("Seek(%s): iterator invalid", testKey(i))
+		}
+		if !bytes.Equal(iter.Key(), want) {
+			t.Fatalf("Seek(%s) = %s, want %s", testKey(i), iter.Key(), want)
+		}
+	}
+	if !iter.Seek(nil) || !bytes.Equal(iter.Key(), testKey(0)) {
+		t.Fatalf("Seek(nil) = %s, want %s", iter.Key(), testKey(0))
+	}
+	if iter.Seek(testKey(2 * n)) {
+		t.Fatalf("Seek past the end landed on %s", iter.Key())
+	}
+}
+
+// TestTableReverse verifies backward scans and SeekLT/SeekLE across block boundaries.
+func TestTableReverse(t *testing.T) {
+	const n = 2000
+	r, _ := buildTable(t, n)
+	iter := r.NewIter(nil)
+	defer iter.Close()
+
+	i := n
+	for valid := iter.Last(); valid; valid = iter.Prev() {
+		i--
+		if !bytes.Equal(iter.Key(), testKey(2*i)) || !bytes.Equal(iter.Value(), testValue(2*i)) {
+			t.Fatalf("entry %d: got %s=%s", i, iter.Key(), iter.Value())
+		}
+	}
+	if i != 0 {
+		t.Fatalf("backward scan stopped at entry %d", i)
+	}
+
+	for i := 1; i <= 2*n; i++ {
+		want := testKey(i - 1 - (i-1)%2) // The largest even key < i.
+		if !iter.SeekLT(testKey(i)) || !bytes.Equal(iter.Key(), want) {
+			t.Fatalf("SeekLT(%s) = %s, want %s", testKey(i), iter.Key(), want)
+		}
+		want = testKey(min(i-i%2, 2*n-2)) // The largest even key <= i.
+		if !iter.SeekLE(testKey(i)) || !bytes.Equal(iter.Key(), want) {
+			t.Fatalf("SeekLE(%s) = %s, want %s", testKey(i), iter.Key(), want)
+		}
+	}
+	if iter.SeekLT(testKey(0)) {
+		t.Fatalf("SeekLT before the start landed on %s", iter.Key())
+	}
+	if !iter.SeekLE(testKey(0)) || !iter.Next() || !bytes.Equal(iter.Key(), testKey(2)) {
+		t.Fatalf("Next after SeekLE = %s, want %s", iter.Key(), testKey(2))
+	}
+}
+
+// countingReader counts the reads made through it.
+type countingReader struct {
+	r     *bytes.Reader
+	reads int
+}
+
+func (g *countingReader) ReadAt(p []byte, off int64) (int, error) {
+	g.reads++
+	return g.r.ReadAt(p, off)
+}
+
+// TestTableBounds verifies that a bounded iterator stays within its bounds in both directions
+// and loads only the data blocks that overlap them.
+func TestTableBounds(t *testing.T) {
+	const n = 2000
+	_, data := buildTable(t, n)
+	cr := &countingReader{r: bytes.NewReader(data)}
+	r, err := NewReader(cr, int64(len(data)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lo, hi := 500, 520 // Entries [lo, hi) are within bounds.
+	iter := r.NewIter(&sseuda.IterOptions{LowerBound: testKey(2 * lo), UpperBound: testKey(2*hi - 1)})
+	defer iter.Close()
+
+	cr.reads = 0
+	i := lo
+	for valid := iter.First(); valid; valid = iter.Next() {
+		if !bytes.Equal(iter.Key(), testKey(2*i)) {
+			t.Fatalf("entry %d: got %s", i, iter.Key())
+		}
+		i++
+	}
+	if i != hi {
+		t.Fatalf("forward scan stopped at entry %d, want %d", i, hi)
+	}
+	if blocks := r.Properties().NumDataBlocks; uint64(cr.reads) >= blocks/4 {
+		t.Fatalf("bounded scan read %d of %d blocks", cr.reads, blocks)
+	}
+
+	for valid := iter.Last(); valid; valid = iter.Prev() {
+		i--
+		if !bytes.Equal(iter.Key(), testKey(2*i)) {
+			t.Fatalf("entry %d: got %s", i, iter.Key())
+		}
+	}
+	if i != lo {
+		t.Fatalf("backward scan stopped at entry %d, want %d", i, lo)
+	}
+	if iter.Seek(testKey(2*hi)) || iter.SeekLT(testKey(2*lo)) {
+		t.Fatalf("seek outside the bounds landed on %s", iter.Key())
+	}
+	if !iter.SeekLE(testKey(2*n)) || !bytes.Equal(iter.Key(), testKey(2*hi-2)) {
+		t.Fatalf("SeekLE past the upper bound = %s, want %s", iter.Key(), testKey(2*hi-2))
+	}
+}
+
+// TestTableBlockCache verifies that a second scan through a block cache reads no block from the
+// table, and that closed iterators leave no block pinned.
+func TestTableBlockCache(t *testing.T) {
+	const n = 2000
+	_, data := buildTable(t, n)
+	c := cache.New(&cache.Options{Capacity: 1 << 20})
+	cr := &countingReader{r: bytes.NewReader(data)}
+	r, err := NewReader(cr, int64(len(data)), &ReaderOptions{Cache: c, CacheID: c.NewID(), FileNum: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for pass := 0; pass < 2; pass++ {
+		cr.reads = 0
+		iter := r.NewIter(nil)
+		i := 0
+		for valid := iter.First(); valid; valid = iter.Next() {
+			if !bytes.Equal(iter.Key(), testKey(2*i)) || !bytes.Equal(iter.Value(), testValue(2*i)) {
+				t.Fatalf("pass %d, entry %d: got %s=%s", pass, i, iter.Key(), iter.Value())
+			}
+			i++
+		}
+		if m := c.Metrics(); m.Pinned == 0 {
+			t.Fatalf("pass %d: the current block is not pinned", pass)
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if i != n {
+			t.Fatalf("pass %d: scanned %d entries, want %d", pass, i, n)
+		}
+		if blocks := r.Properties().NumDataBlocks; pass == 0 && uint64(cr.reads) != blocks || pass == 1 && cr.reads != 0 {
+			t.Fatalf("pass %d read %d of %d blocks", pass, cr.reads, blocks)
+		}
+	}
+	blocks := int64(r.Properties().NumDataBlocks)
+	if m := c.Metrics(); m.Hits != blocks || m.Misses != blocks || m.Count != blocks || m.Pinned != 0 {
+		t.Fatalf("Metrics() = %+v, want %d hits, misses and blocks, none pinned", m, blocks)
+	}
+}
+
+// TestTableFromSkipList verifies that a table can be written from a SkipListIterator.
+func TestTableFromSkipList(t *testing.T) {
+	arena, err := marena.NewArena(1 << 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	skl, err := mskip.NewSkipList(arena, bytes.Compare, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range []int{5, 3, 9, 1, 7} {
+		skl.Insert(testKey(i), testValue(i))
+	}
+	skl.Delete(testKey(3)) // Tombstones are skipped by the skip list iterator.
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf, nil)
+	src := skl.Iterator()
+	if err := w.AddAll(src); err != nil {
+		t.Fatal(err)
+	}
+	src.Close()
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iter := r.NewIter(nil)
+	defer iter.Close()
+	var got []string
+	for valid := iter.First(); valid; valid = iter.Next() {
+		got = append(got, string(iter.Key()))
+	}
+	if fmt.Sprint(got) != "[key000001 key000005 key000007 key000009]" {
+		t.Fatalf("unexpected keys %v", got)
+	}
+}
+
+// TestTableRangeDels verifies that range tombstones are stored apart from the entries, in
+// their own order, and that a table without any has no range deletion block.
+func TestTableRangeDels(t *testing.T) {
+	r, _ := buildTable(t, 10)
+	if r.NewRangeDelIter() != nil {
+		t.Fatalf("NewRangeDelIter of a table without tombstones is not nil")
+	}
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf, nil)
+	if err := w.AddRangeDel([]byte("b"), []byte("d")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Add([]byte("c"), []byte("3")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.AddRangeDel([]byte("a"), []byte("z")); !errors.Is(err, ErrKeyOrder) {
+		t.Fatalf("expected ErrKeyOrder, got %v", err)
+	}
+
+	buf.Reset()
+	w = NewWriter(&buf, nil)
+	if err := w.Add([]byte("c"), []byte("3")); err != nil {
+		t.Fatal(err)
+	}
+	for _, tombstone := range [][2]string{{"a", "z"}, {"b", "d"}, {"x", "y"}} {
+		if err := w.AddRangeDel([]byte(tombstone[0]), []byte(tombstone[1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if props := r.Properties(); props.NumEntries != 1 || props.NumRangeDeletes != 3 {
+		t.Fatalf("NumEntries = %d, NumRangeDeletes = %d; want 1, 3", props.NumEntries, props.NumRangeDeletes)
+	}
+
+	iter := r.NewRangeDelIter()
+	var got []string
+	for valid := iter.First(); valid; valid = iter.Next() {
+		got = append(got, fmt.Sprintf("%s-%s", iter.Key(), iter.Value()))
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(got) != "[a-z b-d x-y]" {
+		t.Fatalf("tombstones = %v", got)
+	}
+	if !iter.Seek([]byte("c")) || string(iter.Key()) != "x" {
+		t.Fatalf("Seek(c) = %s", iter.Key())
+	}
+}
+
+// TestTableFilter verifies that the filter of a table holds the filter key of every entry
+// once, that it rules out most absent keys, and that a table without one rules out none.
+func TestTableFilter(t *testing.T) {
+	r, _ := buildTable(t, 10)
+	if !r.MayContain([]byte("absent")) || r.Properties().FilterSize != 0 {
+		t.Fatalf("a table without a filter must match every key")
+	}
+
+	const n = 2000
+	var buf bytes.Buffer
+	prefix := func(key []byte) []byte { return key[:len(key)-1] } // Filters on all but the last byte.
+	w := NewWriter(&buf, &WriterOptions{BlockSize: 256, FilterBitsPerKey: 10, FilterKey: prefix})
+	for i := 0; i < n; i++ {
+		for _, suffix := range []string{"a", "b"} {
+			if err := w.Add(append(testKey(2*i), suffix...), testValue(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// One filter key per pair of entries: 10 bits each, rounded up to bytes, plus the probe count.
+	if size := r.Properties().FilterSize; size != n*10/8+1+SSTABLE_BLOCK_TRAILER_SIZE {
+		t.Errorf("FilterSize = %d, want %d", size, n*10/8+1+SSTABLE_BLOCK_TRAILER_SIZE)
+	}
+
+	falsePositives := 0
+	for i := 0; i < n; i++ {
+		if !r.MayContain(testKey(2 * i)) {
+			t.Fatalf("filter rules out key %d", 2*i)
+		}
+		if r.MayContain(testKey(2*i + 1)) {
+			falsePositives++
+		}
+	}
+	if falsePositives > n/20 {
+		t.Errorf("%d false positives among %d absent keys", falsePositives, n)
+	}
+}
+
+// TestTablePrefixFilter verifies that the prefix filter of a table holds the prefix of every
+// filter key in the extractor's domain, and only answers for the extractor that built it.
+func TestTablePrefixFilter(t *testing.T) {
+	var buf bytes.Buffer
+	extractor := sseuda.FixedPrefix(4)
+	w := NewWriter(&buf, &WriterOptions{FilterBitsPerKey: 10, PrefixExtractor: extractor})
+	for _, key := range []string{"ab", "abcd1", "abcd2", "abce", "bcde", "bcdf1"} {
+		if err := w.Add([]byte(key), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Properties().PrefixFilterSize == 0 {
+		t.Fatal("table has no prefix filter")
+	}
+	for _, prefix := range []string{"abcd", "abce", "bcde", "bcdf"} {
+		if !r.MayContainPrefix(extractor.Name(), []byte(prefix)) {
+			t.Errorf("prefix filter rules out %s", prefix)
+		}
+	}
+	falsePositives := 0
+	for i := 0; i < 1000; i++ {
+		if r.MayContainPrefix(extractor.Name(), []byte(fmt.Sprintf("x%03d", i))) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 50 {
+		t.Errorf("%d false positives among 1000 absent prefixes", falsePositives)
+	}
+	if !r.MayContainPrefix(sseuda.FixedPrefix(3).Name(), []byte("xyz")) {
+		t.Error("prefix filter answered for another extractor")
+	}
+}
+
+// TestTableKeyOrder verifies that out-of-order keys are rejected.
+func TestTableKeyOrder(t *testing.T) {
+	w := NewWriter(&bytes.Buffer{}, nil)
+	if err := w.Add([]byte("b"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Add([]byte("a"), nil); !errors.Is(err, ErrKeyOrder) {
+		t.Fatalf("expected ErrKeyOrder, got %v", err)
+	}
+	if err := w.Close(); !errors.Is(err, ErrKeyOrder) {
+		t.Fatalf("expected Close to report ErrKeyOrder, got %v", err)
+	}
+}
+
+// TestTableCorruption verifies that a damaged data block is reported by the iterator
+// and that a damaged footer is reported when opening the table.
+func TestTableCorruption(t *testing.T) {
+	_, data := buildTable(t, 200)
+
+	damaged := append([]byte{}, data...)
+	damaged[10] ^= 0xff
+	r, err := NewReader(bytes.NewReader(damaged), int64(len(damaged)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iter := r.NewIter(nil)
+	if iter.First() {
+		t.Fatal("expected the first block to fail its checksum")
+	}
+	if err := iter.Close(); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("expected ErrCorrupt, got %v", err)
+	}
+
+	damaged = append([]byte{}, data...)
+	damaged[len(damaged)-1] ^= 0xff
+	if _, err := NewReader(bytes.NewReader(damaged), int64(len(damaged)), nil); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("expected ErrCorrupt for a bad magic number, got %v", err)
+	}
+}
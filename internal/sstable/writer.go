@@ -0,0 +1,276 @@
+package sstable
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+
+	"gosuda.org/sseuda"
+	"gosuda.org/sseuda/internal/bloom"
+)
+
+// compareBytes orders the keys of the metaindex and properties blocks.
+var compareBytes = bytes.Compare
+
+// WriterOptions configures a Writer.
+type WriterOptions struct {
+	// Compare orders keys. Defaults to bytes.Compare.
+	Compare func(key1, key2 []byte) int
+
+	// BlockSize is the uncompressed size at which a data block is finished.
+	BlockSize int
+
+	// BlockRestartInterval is the number of entries between restart points within a block.
+	BlockRestartInterval int
+
+	// FilterBitsPerKey is the number of bits per key of the Bloom filter of the table. Zero
+	// writes no filter.
+	FilterBitsPerKey int
+
+	// FilterKey returns the part of a key the filter holds, such as the user key of an internal
+	// key. Consecutive keys with the same filter key add it once. Defaults to the whole key.
+	FilterKey func(key []byte) []byte
+
+	// PrefixExtractor, when set along with FilterBitsPerKey, gives the table a second filter,
+	// of the prefixes of the filter keys in the extractor's domain.
+	PrefixExtractor sseuda.PrefixExtractor
+}
+
+func (opts *WriterOptions) withDefaults() WriterOptions {
+	var o WriterOptions
+	if opts != nil {
+		o = *opts
+	}
+	if o.Compare == nil {
+		o.Compare = bytes.Compare
+	}
+	if o.BlockSize <= 0 {
+		o.BlockSize = SSTABLE_DEFAULT_BLOCK_SIZE
+	}
+	if o.BlockRestartInterval <= 0 {
+		o.BlockRestartInterval = SSTABLE_DEFAULT_RESTART_INTERVAL
+	}
+	if o.FilterKey == nil {
+		o.FilterKey = func(key []byte) []byte { return key }
+	}
+	return o
+}
+
+// Writer builds a table from keys added in strictly increasing order.
+// The table is complete only once Close returns successfully.
+type Writer struct {
+	w             io.Writer
+	opts          WriterOptions
+	offset        uint64 // Bytes written to `w` so far.
+	data          blockWriter
+	index         blockWriter
+	rangeDel      blockWriter
+	props         Properties
+	filter        bloom.Builder
+	prefixFilter  bloom.Builder
+	firstKey      []byte
+	lastKey       []byte
+	scratch       []byte
+	lastFilterKey []byte // Filter key last added to the filter.
+	lastPrefix    []byte // Prefix last added to the prefix filter.
+	err           error  // Sticky error: once set, every later call returns it.
+}
+
+// NewWriter returns a Writer that writes a table to `w`. A nil `opts` uses the defaults.
+func NewWriter(w io.Writer, opts *WriterOptions) *Writer {
+	o := opts.withDefaults()
+	return &Writer{
+		w:        w,
+		opts:     o,
+		data:     blockWriter{restartInterval: o.BlockRestartInterval},
+		index:    blockWriter{restartInterval: 1},
+		rangeDel: blockWriter{restartInterval: 1},
+	}
+}
+
+// Add appends a key-value pair. `key` must be greater than every previously added key.
+func (g *Writer) Add(key, value []byte) error {
+	if g.err != nil {
+		return g.err
+	}
+	if g.props.NumEntries > 0 && g.opts.Compare(key, g.lastKey) <= 0 {
+		g.err = ErrKeyOrder
+		return g.err
+	}
+
+	if g.opts.FilterBitsPerKey > 0 {
+		if filterKey := g.opts.FilterKey(key); g.filter.Len() == 0 || !bytes.Equal(filterKey, g.lastFilterKey) {
+			g.filter.Add(filterKey)
+			g.lastFilterKey = append(g.lastFilterKey[:0], filterKey...)
+			g.addPrefix(filterKey)
+		}
+	}
+	g.data.add(key, value)
+	if g.props.NumEntries == 0 {
+		g.firstKey = append(g.firstKey[:0], key...)
+	}
+	g.lastKey = append(g.lastKey[:0], key...)
+	g.props.NumEntries++
+	g.props.RawKeySize += uint64(len(key))
+	g.props.RawValueSize += uint64(len(value))
+
+	if g.data.estimatedSize() >= g.opts.BlockSize {
+		g.flushDataBlock()
+	}
+	return g.err
+}
+
+// addPrefix adds the prefix of `filterKey` to the prefix filter, if the table has one.
+func (g *Writer) addPrefix(filterKey []byte) {
+	extractor := g.opts.PrefixExtractor
+	if extractor == nil || !extractor.InDomain(filterKey) {
+		return
+	}
+	if prefix := extractor.Transform(filterKey); g.prefixFilter.Len() == 0 || !bytes.Equal(prefix, g.lastPrefix) {
+		g.prefixFilter.Add(prefix)
+		g.lastPrefix = append(g.lastPrefix[:0], prefix...)
+	}
+}
+
+// AddRangeDel appends a range tombstone to the range deletion block. Tombstones are kept apart
+// from the entries, so they may be added at any time, but `key` must be greater than the key
+// of every previously added tombstone. The table does not interpret `value`.
+func (g *Writer) AddRangeDel(key, value []byte) error {
+	if g.err != nil {
+		return g.err
+	}
+	if !g.rangeDel.empty() && g.opts.Compare(key, g.rangeDel.lastKey) <= 0 {
+		g.err = ErrKeyOrder
+		return g.err
+	}
+	g.rangeDel.add(key, value)
+	g.props.NumRangeDeletes++
+	return nil
+}
+
+// AddAll appends every remaining entry of `iter`, starting from its first entry.
+// The iterator is not closed.
+func (g *Writer) AddAll(iter sseuda.Iterator) error {
+	for valid := iter.First(); valid; valid = iter.Next() {
+		if err := g.Add(iter.Key(), iter.Value()); err != nil {
+			return err
+		}
+	}
+	return g.err
+}
+
+// flushDataBlock writes the pending data block and records it in the index.
+// The index key is the last key of the block, which is >= every key in the block
+// and < every key in the blocks that follow.
+func (g *Writer) flushDataBlock() {
+	if g.data.empty() {
+		return
+	}
+	handle := g.writeBlock(&g.data)
+	g.props.NumDataBlocks++
+	g.props.DataSize += handle.length + SSTABLE_BLOCK_TRAILER_SIZE
+
+	g.scratch = handle.encode(g.scratch[:0])
+	g.index.add(g.lastKey, g.scratch)
+}
+
+// writeBlock finishes `block`, writes it followed by its checksum, and resets it.
+func (g *Writer) writeBlock(block *blockWriter) blockHandle {
+	handle := g.writeRawBlock(block.finish())
+	block.reset()
+	return handle
+}
+
+// writeRawBlock writes `contents` followed by its checksum.
+func (g *Writer) writeRawBlock(contents []byte) blockHandle {
+	handle := blockHandle{offset: g.offset, length: uint64(len(contents))}
+
+	var trailer [SSTABLE_BLOCK_TRAILER_SIZE]byte
+	binary.LittleEndian.PutUint32(trailer[:], crc32.Checksum(contents, crcTable))
+	g.write(contents)
+	g.write(trailer[:])
+	return handle
+}
+
+func (g *Writer) write(p []byte) {
+	if g.err != nil {
+		return
+	}
+	n, err := g.w.Write(p)
+	g.offset += uint64(n)
+	g.err = err
+}
+
+// Close finishes the table by writing the last data block, the range deletion block if any
+// tombstone was added, the filter blocks if the table has filters and entries, the properties,
+// metaindex and index blocks, and the footer. It does not close the underlying io.Writer.
+func (g *Writer) Close() error {
+	if g.err != nil {
+		return g.err
+	}
+	g.flushDataBlock()
+
+	// The properties precede the index block, so its size is recorded from the estimate,
+	// which is exact for a block that is about to be finished.
+	g.props.IndexSize = uint64(g.index.estimatedSize()) + SSTABLE_BLOCK_TRAILER_SIZE
+
+	var rangeDelHandle blockHandle
+	hasRangeDels := !g.rangeDel.empty()
+	if hasRangeDels {
+		rangeDelHandle = g.writeBlock(&g.rangeDel)
+	}
+	var filterHandle blockHandle
+	hasFilter := g.filter.Len() > 0
+	if hasFilter {
+		filterHandle = g.writeRawBlock(g.filter.Finish(nil, g.opts.FilterBitsPerKey))
+		g.props.FilterSize = filterHandle.length + SSTABLE_BLOCK_TRAILER_SIZE
+	}
+	var prefixFilterHandle blockHandle
+	hasPrefixFilter := g.prefixFilter.Len() > 0
+	if hasPrefixFilter {
+		prefixFilterHandle = g.writeRawBlock(g.prefixFilter.Finish(nil, g.opts.FilterBitsPerKey))
+		g.props.PrefixFilterSize = prefixFilterHandle.length + SSTABLE_BLOCK_TRAILER_SIZE
+	}
+
+	// The metaindex block is sorted by name.
+	meta := blockWriter{restartInterval: 1}
+	props := blockWriter{restartInterval: 1}
+	g.props.encode(&props)
+	propsHandle := g.writeBlock(&props)
+	if hasFilter {
+		meta.add([]byte(metaFilterName), filterHandle.encode(nil))
+	}
+	if hasPrefixFilter {
+		meta.add([]byte(metaPrefixFilterName+g.opts.PrefixExtractor.Name()), prefixFilterHandle.encode(nil))
+	}
+	meta.add([]byte(metaPropertiesName), propsHandle.encode(nil))
+	if hasRangeDels {
+		meta.add([]byte(metaRangeDelName), rangeDelHandle.encode(nil))
+	}
+
+	metaindexHandle := g.writeBlock(&meta)
+	indexHandle := g.writeBlock(&g.index)
+	g.write(footer{metaindex: metaindexHandle, index: indexHandle}.encode())
+
+	if g.err == nil {
+		g.err = ErrWriterDone
+		return nil
+	}
+	return g.err
+}
+
+// Properties returns the properties of the table written so far.
+func (g *Writer) Properties() Properties {
+	return g.props
+}
+
+// Bounds returns the smallest and largest keys added so far.
+func (g *Writer) Bounds() (smallest, largest []byte) {
+	return g.firstKey, g.lastKey
+}
+
+// Size returns the number of bytes written so far.
+func (g *Writer) Size() uint64 {
+	return g.offset
+}
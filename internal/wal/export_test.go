@@ -0,0 +1,12 @@
+package wal
+
+import (
+	"io"
+	"os"
+)
+
+// CreateWithWriter is Create with the records of every segment written through
+// `writer(file)` rather than to the file directly. Sync still syncs the file itself.
+func CreateWithWriter(dirname string, num uint64, opts Options, writer func(file *os.File) io.Writer) (*Log, error) {
+	return create(dirname, num, opts, writer)
+}
@@ -0,0 +1,235 @@
+// Package wal implements a segmented write-ahead log.
+//
+// The log is a sequence of segment files named after monotonically increasing file numbers
+// ("000042.log"). Each segment is a stream of record.Writer records. Only the tail of the most
+// recent segment can be torn by a crash: segments are synced before the log moves past them.
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gosuda.org/sseuda/internal/record"
+)
+
+var (
+	ErrCorrupt = errors.New("wal: corrupt segment")
+)
+
+const (
+	// WAL_SEGMENT_EXT is the file extension of log segments.
+	WAL_SEGMENT_EXT = ".log"
+
+	// WAL_DEFAULT_SEGMENT_SIZE is the segment size used when Options.SegmentSize is zero.
+	WAL_DEFAULT_SEGMENT_SIZE = 64 << 20
+)
+
+// Options configures a Log.
+type Options struct {
+	// SegmentSize is the size in bytes after which appends move on to a fresh segment.
+	SegmentSize int64
+
+	// NewFileNum allocates the file number of the next segment. File numbers must increase.
+	NewFileNum func() uint64
+}
+
+// SegmentFilename returns the path of segment `num` in `dirname`.
+func SegmentFilename(dirname string, num uint64) string {
+	return filepath.Join(dirname, fmt.Sprintf("%06d%s", num, WAL_SEGMENT_EXT))
+}
+
+// ListSegments returns the numbers of all segments in `dirname`, in ascending order.
+func ListSegments(dirname string) ([]uint64, error) {
+	entries, err := os.ReadDir(dirname)
+	if err != nil {
+		return nil, err
+	}
+
+	var nums []uint64
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), WAL_SEGMENT_EXT)
+		if !ok {
+			continue
+		}
+		num, err := strconv.ParseUint(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		nums = append(nums, num)
+	}
+	slices.Sort(nums)
+	return nums, nil
+}
+
+// Log appends records to the current segment and rotates segments as they fill up.
+// A Log is not safe for concurrent use.
+type Log struct {
+	dirname string
+	opts    Options
+	num     uint64         // File number of the current segment.
+	file    *os.File       // Current segment file.
+	w       *record.Writer // Record framing over `file`.
+
+	writer func(file *os.File) io.Writer // If set, wraps the file of every segment; tests inject failures with it.
+}
+
+// Create starts a new log in `dirname` whose first segment is `num`.
+func Create(dirname string, num uint64, opts Options) (*Log, error) {
+	return create(dirname, num, opts, nil)
+}
+
+func create(dirname string, num uint64, opts Options, writer func(file *os.File) io.Writer) (*Log, error) {
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = WAL_DEFAULT_SEGMENT_SIZE
+	}
+
+	g := &Log{dirname: dirname, opts: opts, writer: writer}
+	if err := g.open(num); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// open creates segment `num` and makes it the current one.
+func (g *Log) open(num uint64) error {
+	file, err := os.OpenFile(SegmentFilename(g.dirname, num), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if err := syncDir(g.dirname); err != nil {
+		file.Close()
+		return err
+	}
+
+	g.num = num
+	g.file = file
+	if g.writer != nil {
+		g.w = record.NewWriter(g.writer(file))
+	} else {
+		g.w = record.NewWriter(file)
+	}
+	return nil
+}
+
+// Num returns the file number of the segment currently being written.
+func (g *Log) Num() uint64 {
+	return g.num
+}
+
+// Append writes `rec` to the log. The record is durable only after a subsequent Sync.
+// When the current segment has reached Options.SegmentSize, the log first rotates.
+func (g *Log) Append(rec []byte) error {
+	if g.w.Offset() >= g.opts.SegmentSize {
+		if _, err := g.Rotate(); err != nil {
+			return err
+		}
+	}
+	return g.w.WriteRecord(rec)
+}
+
+// Sync flushes the current segment to stable storage.
+func (g *Log) Sync() error {
+	return g.file.Sync()
+}
+
+// Rotate syncs and closes the current segment and starts a new one.
+// It returns the file number of the new segment.
+func (g *Log) Rotate() (uint64, error) {
+	if err := g.closeSegment(); err != nil {
+		return 0, err
+	}
+	if err := g.open(g.opts.NewFileNum()); err != nil {
+		return 0, err
+	}
+	return g.num, nil
+}
+
+func (g *Log) closeSegment() error {
+	if err := g.file.Sync(); err != nil {
+		g.file.Close()
+		return err
+	}
+	return g.file.Close()
+}
+
+// Close syncs and closes the current segment.
+func (g *Log) Close() error {
+	return g.closeSegment()
+}
+
+// Replay calls `fn` with every record of `segments`, in order.
+// A torn tail in the last segment is treated as the end of the log and truncated away,
+// so that later appends and replays never see it. Damage anywhere else returns ErrCorrupt.
+func Replay(dirname string, segments []uint64, fn func(rec []byte) error) error {
+	for i, num := range segments {
+		if err := replaySegment(dirname, num, i == len(segments)-1, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func replaySegment(dirname string, num uint64, last bool, fn func(rec []byte) error) error {
+	filename := SegmentFilename(dirname, num)
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	r := record.NewReader(file)
+	for {
+		rec, err := r.Next()
+		switch {
+		case err == io.EOF:
+			return nil
+		case err == io.ErrUnexpectedEOF || errors.Is(err, record.ErrCorrupt):
+			if !last {
+				return fmt.Errorf("%w: %s at offset %d: %v", ErrCorrupt, filename, r.Offset(), err)
+			}
+			return truncate(filename, r.Offset())
+		case err != nil:
+			return err
+		}
+
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+}
+
+// truncate cuts a torn tail off `filename` and syncs the result.
+func truncate(filename string, size int64) error {
+	file, err := os.OpenFile(filename, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if err := file.Truncate(size); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// syncDir makes file creations and removals in `dirname` durable.
+func syncDir(dirname string) error {
+	dir, err := os.Open(dirname)
+	if err != nil {
+		return err
+	}
+	if err := dir.Sync(); err != nil {
+		dir.Close()
+		return err
+	}
+	return dir.Close()
+}
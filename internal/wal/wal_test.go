@@ -0,0 +1,172 @@
+package wal_test
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+
+	"gosuda.org/sseuda/internal/wal"
+)
+
+// writeLog appends `n` records to a fresh log in `dir`, using tiny segments so that
+// the log rotates several times.
+func writeLog(t *testing.T, dir string, n int) []uint64 {
+	t.Helper()
+	next := uint64(1)
+	log, err := wal.Create(dir, next, wal.Options{
+		SegmentSize: 256,
+		NewFileNum:  func() uint64 { next++; return next },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		if err := log.Append([]byte(fmt.Sprintf("record-%03d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := log.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	segments, err := wal.ListSegments(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return segments
+}
+
+func replay(dir string, segments []uint64) ([]string, error) {
+	var got []string
+	err := wal.Replay(dir, segments, func(rec []byte) error {
+		got = append(got, string(rec))
+		return nil
+	})
+	return got, err
+}
+
+// TestLogReplay verifies that records written across several segments replay in order.
+func TestLogReplay(t *testing.T) {
+	dir := t.TempDir()
+	segments := writeLog(t, dir, 100)
+	if len(segments) < 2 {
+		t.Fatalf("expected the log to rotate, got %d segment(s)", len(segments))
+	}
+
+	got, err := replay(dir, segments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 100 {
+		t.Fatalf("replayed %d records, want 100", len(got))
+	}
+	for i, rec := range got {
+		if want := fmt.Sprintf("record-%03d", i); rec != want {
+			t.Fatalf("record %d = %q, want %q", i, rec, want)
+		}
+	}
+}
+
+// TestLogTornTail verifies that a torn tail in the last segment ends replay cleanly
+// and is truncated, so a second replay sees the same records.
+func TestLogTornTail(t *testing.T) {
+	dir := t.TempDir()
+	segments := writeLog(t, dir, 100)
+
+	last := wal.SegmentFilename(dir, segments[len(segments)-1])
+	info, err := os.Stat(last)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(last, info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := replay(dir, segments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 99 {
+		t.Fatalf("replayed %d records, want 99", len(got))
+	}
+
+	again, err := replay(dir, segments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(again) != len(got) {
+		t.Fatalf("second replay returned %d records, want %d", len(again), len(got))
+	}
+}
+
+// TestLogCorruptSegment verifies that damage before the last segment is reported.
+func TestLogCorruptSegment(t *testing.T) {
+	dir := t.TempDir()
+	segments := writeLog(t, dir, 100)
+
+	first := wal.SegmentFilename(dir, segments[0])
+	data, err := os.ReadFile(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 0xff
+	if err := os.WriteFile(first, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := replay(dir, segments); !errors.Is(err, wal.ErrCorrupt) {
+		t.Fatalf("expected ErrCorrupt, got %v", err)
+	}
+}
+
+var errInjected = errors.New("injected failure")
+
+// tornWriter writes half of every write to `w` once `fail` is set, and fails it.
+type tornWriter struct {
+	w    io.Writer
+	fail bool
+}
+
+func (g *tornWriter) Write(p []byte) (int, error) {
+	if !g.fail {
+		return g.w.Write(p)
+	}
+	n, _ := g.w.Write(p[:len(p)/2])
+	return n, errInjected
+}
+
+// TestLogFailedAppend verifies that an append that fails midway leaves a torn record, which
+// replay takes for the end of the log.
+func TestLogFailedAppend(t *testing.T) {
+	dir := t.TempDir()
+	tw := &tornWriter{}
+	log, err := wal.CreateWithWriter(dir, 1, wal.Options{}, func(file *os.File) io.Writer {
+		tw.w = file
+		return tw
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range []string{"record-000", "record-001"} {
+		if err := log.Append([]byte(rec)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tw.fail = true
+	if err := log.Append([]byte("record-002")); !errors.Is(err, errInjected) {
+		t.Fatalf("Append through a failing writer: %v, want the injected error", err)
+	}
+	if err := log.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := replay(dir, []uint64{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(got) != "[record-000 record-001]" {
+		t.Fatalf("replayed %v, want the records before the torn one", got)
+	}
+}